@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// secretParams are query parameters whose values the audit log leaves out,
+// matched case-insensitively as substrings
+var secretParams = []string{"token", "key", "secret", "signature", "password", "auth", "credential"}
+
+// auditLog receives the lines of auditTransport; nil, without -audit-log,
+// writes none
+var auditLog io.Writer
+
+// audited returns transport, or http.DefaultTransport when it is nil, sending
+// through an auditTransport when there is an auditLog
+func audited(transport http.RoundTripper) http.RoundTripper {
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	if auditLog == nil {
+		return transport
+	}
+	return &auditTransport{next: transport, out: auditLog}
+}
+
+// auditTransport appends a line to the -audit-log for every request sent
+// through it: when it was sent, the method, the URL with its secrets
+// redacted, the status, how many body bytes were read, how long it took,
+// the retry attempt and the worker that sent it. The line is written once
+// the body is closed, or right away when there is no response.
+type auditTransport struct {
+	next http.RoundTripper
+	out  io.Writer
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *auditTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		t.write(req, start, 0, 0, err)
+		return nil, err
+	}
+	resp.Body = &auditBody{ReadCloser: resp.Body, done: func(n int64, err error) { t.write(req, start, resp.StatusCode, n, err) }}
+	return resp, nil
+}
+
+// write appends the line of req
+func (t *auditTransport) write(req *http.Request, start time.Time, status int, n int64, err error) {
+	worker := workerID(req.Context())
+	if worker == "" {
+		worker = "-"
+	}
+	line := fmt.Sprintf("%s %s %s status=%d bytes=%d duration=%s attempt=%d worker=%s",
+		start.UTC().Format(time.RFC3339Nano), req.Method, redactURL(req.URL), status, n,
+		time.Since(start).Round(time.Millisecond), retryAttempt(req.Context()), worker)
+	if err != nil {
+		line += fmt.Sprintf(" error=%q", err.Error())
+	}
+	if _, err := io.WriteString(t.out, line+"\n"); err != nil {
+		slog.Warn("Failed to write audit log", "reason", err)
+	}
+}
+
+// auditBody counts the bytes read from a response body and reports them
+// once, when it is closed
+type auditBody struct {
+	io.ReadCloser
+	n    int64
+	err  error
+	once sync.Once
+	done func(n int64, err error)
+}
+
+func (b *auditBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
+func (b *auditBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() { b.done(b.n, b.err) })
+	return err
+}
+
+// redactURL returns u without user info and with the values of secret
+// query parameters replaced
+func redactURL(u *url.URL) string {
+	r := *u
+	r.User = nil
+	if r.RawQuery == "" {
+		return r.String()
+	}
+	query, redacted := r.Query(), false
+	for name := range query {
+		lower := strings.ToLower(name)
+		for _, secret := range secretParams {
+			if strings.Contains(lower, secret) {
+				query[name], redacted = []string{"REDACTED"}, true
+				break
+			}
+		}
+	}
+	if redacted {
+		r.RawQuery = query.Encode() // Otherwise the URL stays as it was sent
+	}
+	return r.String()
+}
+
+// workerKey carries the ID of the worker a request is made for
+type workerKey struct{}
+
+// withWorker returns ctx carrying the worker ID id
+func withWorker(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, workerKey{}, id)
+}
+
+// workerID returns the worker ID in ctx, "" outside the worker pools
+func workerID(ctx context.Context) string {
+	id, _ := ctx.Value(workerKey{}).(string)
+	return id
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// backoff pauses every request of the run while the server is refusing
+// them; nil when -backoff-pause is 0
+var backoff *backoffGate
+
+// backoffGate holds back all requests once one of them is answered with 429
+// Too Many Requests or 403 Forbidden, the answers of a rate limit or a
+// block, instead of letting each worker retry on its own. When the pause is
+// over a single probe request goes out; its answer either lifts the gate or
+// pauses again, for twice as long unless a Retry-After says otherwise.
+type backoffGate struct {
+	pause time.Duration // First pause when the server gives no Retry-After
+
+	mu      sync.Mutex
+	until   time.Time     // End of the pause, zero while open
+	since   time.Time     // Start of the pause
+	length  time.Duration // Length of the current pause
+	probing bool          // The probe request is out
+	changed chan struct{} // Closed and replaced whenever the state changes
+}
+
+func newBackoffGate(pause time.Duration) *backoffGate {
+	if pause <= 0 {
+		return nil
+	}
+	return &backoffGate{pause: pause, changed: make(chan struct{})}
+}
+
+// wait blocks while requests are paused and reports whether the request
+// let through is the probe, which must report its answer to observe. It is
+// a no-op on a nil *backoffGate.
+func (g *backoffGate) wait(ctx context.Context) (probe bool, err error) {
+	if g == nil {
+		return false, nil
+	}
+	for {
+		g.mu.Lock()
+		now := time.Now()
+		if g.until.IsZero() {
+			g.mu.Unlock()
+			return false, nil
+		}
+		changed := g.changed
+		if !now.Before(g.until) && !g.probing {
+			g.probing = true
+			g.mu.Unlock()
+			debugLog.Printf("backoff: sending a probe request")
+			return true, nil
+		}
+		// Past the end of the pause only the probe's answer changes anything
+		var timeout <-chan time.Time
+		timer := time.NewTimer(g.until.Sub(now))
+		if now.Before(g.until) {
+			timeout = timer.C
+		}
+		g.mu.Unlock()
+		select {
+		case <-changed:
+		case <-timeout:
+		case <-ctx.Done():
+		}
+		timer.Stop()
+		if ctx.Err() != nil {
+			return false, ctx.Err()
+		}
+	}
+}
+
+// observe looks at the answer to a request, nil when it failed without
+// one: a refusal starts or extends the pause, and the probe being answered
+// otherwise lifts it. It is a no-op on a nil *backoffGate.
+func (g *backoffGate) observe(probe bool, resp *http.Response) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	refused := resp != nil && (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusForbidden)
+	switch {
+	case refused:
+		// The server's Retry-After replaces the pause of the gate
+		suggested := parseRetryAfter(resp.Header.Get("Retry-After"), now)
+		switch {
+		case g.until.IsZero():
+			g.since, g.length = now, g.pause
+			stats.Backoffs.Add(1)
+		case probe:
+			g.length *= 2
+		}
+		if suggested > 0 {
+			g.length = suggested
+		}
+		if cfg.RetryAfterMax > 0 {
+			g.length = min(g.length, cfg.RetryAfterMax)
+		}
+		if until := now.Add(g.length); until.After(g.until) {
+			// Refusals during a pause extend it rather than add up
+			if g.until.IsZero() || probe {
+				slog.Warn("Server is refusing requests, pausing all of them", "status", resp.StatusCode, "for", g.length, "until", until.Format(time.TimeOnly))
+			} else {
+				debugLog.Printf("backoff: extending the pause to %s", until.Format(time.TimeOnly))
+			}
+			g.until = until
+		}
+	case probe && resp != nil:
+		paused := now.Sub(g.since)
+		stats.BackedOff.Add(int64(paused))
+		slog.Info("Server accepts requests again, resuming", "paused", paused.Round(time.Second))
+		g.until = time.Time{}
+	case !probe:
+		return // An answer to a request sent before the pause says nothing
+	}
+	if probe {
+		g.probing = false // Without an answer, the next request probes instead
+	}
+	close(g.changed)
+	g.changed = make(chan struct{})
+}
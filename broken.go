@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// brokenReasonInvalid is the reason of an image URL that answered with
+// content no image decoder can read
+const brokenReasonInvalid = "invalid content"
+
+// brokenLink is an image URL that is dead for good rather than failing for
+// the moment
+type brokenLink struct {
+	ProductID int    `json:"product_id"`
+	URL       string `json:"url"`
+	Status    int    `json:"status,omitempty"` // Zero for invalid content
+	Reason    string `json:"reason"`
+}
+
+// brokenImages collects the dead image URLs of the run when -report-broken
+// is set, and is nil otherwise
+var brokenImages *brokenLinks
+
+// brokenLinks is a concurrency-safe list of dead image URLs
+type brokenLinks struct {
+	mu    sync.Mutex
+	links []brokenLink
+}
+
+// add records a dead image URL; it is a no-op on a nil *brokenLinks
+func (b *brokenLinks) add(link brokenLink) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.links = append(b.links, link)
+	b.mu.Unlock()
+}
+
+// failed records the image URL of a product if err says it is gone: a 404
+// Not Found or 410 Gone. Transient failures, which retries may fix, are left
+// to the error log.
+func (b *brokenLinks) failed(productID int, url string, err error) {
+	var se *statusError
+	if !errors.As(err, &se) || (se.StatusCode != http.StatusNotFound && se.StatusCode != http.StatusGone) {
+		return
+	}
+	b.add(brokenLink{ProductID: productID, URL: url, Status: se.StatusCode, Reason: http.StatusText(se.StatusCode)})
+}
+
+// writeBrokenReport writes the dead image URLs to path as JSON, sorted by
+// product and URL
+func writeBrokenReport(path string, b *brokenLinks) (int, error) {
+	b.mu.Lock()
+	links := append([]brokenLink{}, b.links...)
+	b.mu.Unlock()
+	sort.Slice(links, func(i, j int) bool {
+		if links[i].ProductID != links[j].ProductID {
+			return links[i].ProductID < links[j].ProductID
+		}
+		return links[i].URL < links[j].URL
+	})
+	data, err := json.MarshalIndent(links, "", "  ")
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode broken URL report: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return 0, fmt.Errorf("failed to create report directory: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return 0, fmt.Errorf("failed to write broken URL report: %w", err)
+	}
+	return len(links), nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// freshnessFile is the name of the freshness index inside the image directory
+const freshnessFile = ".freshness.json"
+
+// freshnessEntry records until when a saved image may be reused
+type freshnessEntry struct {
+	URL     string    `json:"url"`
+	Expires time.Time `json:"expires"`
+}
+
+// freshnessIndex implements -http-cache-control-respect. It remembers, per
+// saved image, the freshness lifetime the CDN granted through Cache-Control
+// (or Expires). While an image is fresh and still on disk, downloading it
+// again is skipped without making a request. Responses marked no-store or
+// no-cache, or without any lifetime, are never reused. Listing and product
+// responses are not stored on disk, so only images are affected.
+//
+// A nil *freshnessIndex treats everything as stale. It is safe for concurrent use.
+type freshnessIndex struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]freshnessEntry // keyed by file path
+}
+
+// freshness is the index of the current run; nil unless -http-cache-control-respect is set
+var freshness *freshnessIndex
+
+func newFreshnessIndex(path string) *freshnessIndex {
+	return &freshnessIndex{path: path, entries: make(map[string]freshnessEntry)}
+}
+
+// loadFreshnessIndex reads the index at path; a missing file yields an empty index
+func loadFreshnessIndex(path string) (*freshnessIndex, error) {
+	f := newFreshnessIndex(path)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read freshness index: %w", err)
+	}
+	if err := json.Unmarshal(data, &f.entries); err != nil {
+		return nil, fmt.Errorf("failed to decode freshness index: %w", err)
+	}
+	return f, nil
+}
+
+// fresh reports whether filePath was downloaded from url, is still on disk and
+// has not outlived its freshness lifetime at now
+func (f *freshnessIndex) fresh(filePath, url string, now time.Time) bool {
+	if f == nil {
+		return false
+	}
+	f.mu.Lock()
+	entry, ok := f.entries[filePath]
+	f.mu.Unlock()
+	if !ok || entry.URL != url || !now.Before(entry.Expires) {
+		return false
+	}
+	_, err := os.Stat(filePath)
+	return err == nil
+}
+
+// record stores the freshness lifetime granted by header for filePath
+func (f *freshnessIndex) record(filePath, url string, header http.Header, now time.Time) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	lifetime, ok := cacheLifetime(header, now)
+	if !ok {
+		delete(f.entries, filePath)
+		return
+	}
+	f.entries[filePath] = freshnessEntry{URL: url, Expires: now.Add(lifetime)}
+}
+
+// save writes the index back to disk
+func (f *freshnessIndex) save() error {
+	if f == nil {
+		return nil
+	}
+	f.mu.Lock()
+	data, err := json.MarshalIndent(f.entries, "", "  ")
+	f.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to encode freshness index: %w", err)
+	}
+	if err := os.WriteFile(f.path, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write freshness index: %w", err)
+	}
+	return nil
+}
+
+// cacheLifetime returns how long a response with the given headers stays fresh
+// after now. max-age takes precedence over Expires, the Age header is
+// subtracted, and false is returned when the response must not be reused.
+func cacheLifetime(header http.Header, now time.Time) (time.Duration, bool) {
+	maxAge := -1
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(name) {
+		case "no-store", "no-cache":
+			return 0, false
+		case "max-age":
+			if n, err := strconv.Atoi(strings.Trim(value, `"`)); err == nil && n >= 0 {
+				maxAge = n
+			}
+		}
+	}
+
+	var lifetime time.Duration
+	switch {
+	case maxAge >= 0:
+		lifetime = time.Duration(maxAge) * time.Second
+	case header.Get("Expires") != "":
+		expires, err := http.ParseTime(header.Get("Expires"))
+		if err != nil {
+			return 0, false
+		}
+		date, err := http.ParseTime(header.Get("Date"))
+		if err != nil {
+			date = now
+		}
+		lifetime = expires.Sub(date)
+	default:
+		return 0, false
+	}
+
+	if age, err := strconv.Atoi(header.Get("Age")); err == nil && age > 0 {
+		lifetime -= time.Duration(age) * time.Second
+	}
+	if lifetime <= 0 {
+		return 0, false
+	}
+	return lifetime, true
+}
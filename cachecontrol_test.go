@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"image/color"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCacheLifetime(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	date := now.Format(http.TimeFormat)
+	tests := []struct {
+		name   string
+		header http.Header
+		want   time.Duration
+		ok     bool
+	}{
+		{"max-age", http.Header{"Cache-Control": {"public, max-age=3600"}}, time.Hour, true},
+		{"quoted max-age", http.Header{"Cache-Control": {`max-age="60"`}}, time.Minute, true},
+		{"max-age case", http.Header{"Cache-Control": {"Max-Age=60"}}, time.Minute, true},
+		{"max-age zero", http.Header{"Cache-Control": {"max-age=0"}}, 0, false},
+		{"max-age invalid", http.Header{"Cache-Control": {"max-age=soon"}}, 0, false},
+		{"max-age minus age", http.Header{"Cache-Control": {"max-age=3600"}, "Age": {"600"}}, 50 * time.Minute, true},
+		{"older than max-age", http.Header{"Cache-Control": {"max-age=60"}, "Age": {"60"}}, 0, false},
+		{"no-store", http.Header{"Cache-Control": {"no-store"}}, 0, false},
+		{"no-cache", http.Header{"Cache-Control": {"no-cache"}}, 0, false},
+		{"no-store after max-age", http.Header{"Cache-Control": {"max-age=3600, no-store"}}, 0, false},
+		{"no-cache with Expires", http.Header{"Cache-Control": {"no-cache"}, "Expires": {now.Add(time.Hour).Format(http.TimeFormat)}}, 0, false},
+		{"Expires from Date", http.Header{"Date": {now.Add(-time.Hour).Format(http.TimeFormat)}, "Expires": {now.Format(http.TimeFormat)}}, time.Hour, true},
+		{"Expires from now", http.Header{"Expires": {now.Add(2 * time.Hour).Format(http.TimeFormat)}}, 2 * time.Hour, true},
+		{"Expires past", http.Header{"Date": {date}, "Expires": {now.Add(-time.Hour).Format(http.TimeFormat)}}, 0, false},
+		{"Expires invalid", http.Header{"Expires": {"0"}}, 0, false},
+		{"max-age over Expires", http.Header{"Cache-Control": {"max-age=60"}, "Date": {date}, "Expires": {now.Add(time.Hour).Format(http.TimeFormat)}}, time.Minute, true},
+		{"none", http.Header{}, 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := cacheLifetime(tt.header, now)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("%s: cacheLifetime = %s, %v; want %s, %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestFreshnessIndex(t *testing.T) {
+	setupTest(t)
+	const url = "https://dkstatics-public.digikala.com/a.jpg"
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	if err := os.WriteFile("a.jpg", []byte("image"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f := newFreshnessIndex(freshnessFile)
+	f.record("a.jpg", url, http.Header{"Cache-Control": {"max-age=3600"}}, now)
+
+	tests := []struct {
+		name, path, url string
+		at              time.Time
+		want            bool
+	}{
+		{"within max-age", "a.jpg", url, now.Add(59 * time.Minute), true},
+		{"at expiry", "a.jpg", url, now.Add(time.Hour), false},
+		{"after expiry", "a.jpg", url, now.Add(2 * time.Hour), false},
+		{"other URL", "a.jpg", "https://dkstatics-public.digikala.com/b.jpg", now, false},
+		{"not recorded", "b.jpg", url, now, false},
+	}
+	for _, tt := range tests {
+		if got := f.fresh(tt.path, tt.url, tt.at); got != tt.want {
+			t.Errorf("%s: fresh = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// A later response that may not be reused forgets the lifetime
+	f.record("a.jpg", url, http.Header{"Cache-Control": {"no-store"}}, now)
+	if f.fresh("a.jpg", url, now) {
+		t.Error("fresh after a no-store response")
+	}
+
+	var none *freshnessIndex
+	none.record("a.jpg", url, http.Header{"Cache-Control": {"max-age=3600"}}, now)
+	if none.fresh("a.jpg", url, now) || none.save() != nil {
+		t.Error("a nil index is not a no-op")
+	}
+}
+
+func TestFreshnessIndexRoundTrip(t *testing.T) {
+	setupTest(t)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	f := newFreshnessIndex(freshnessFile)
+	f.record("a.jpg", "https://dkstatics-public.digikala.com/a.jpg", http.Header{"Cache-Control": {"max-age=60"}}, now)
+	f.record("b.jpg", "https://dkstatics-public.digikala.com/b.jpg", http.Header{"Cache-Control": {"max-age=3600"}}, now)
+	if err := f.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := loadFreshnessIndex(freshnessFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.entries) != 2 {
+		t.Fatalf("loaded %d entries, want 2", len(loaded.entries))
+	}
+	for path, want := range f.entries {
+		if got := loaded.entries[path]; got.URL != want.URL || !got.Expires.Equal(want.Expires) {
+			t.Errorf("%s: loaded %+v, want %+v", path, got, want)
+		}
+	}
+
+	if f, err := loadFreshnessIndex("missing.json"); err != nil || len(f.entries) != 0 {
+		t.Errorf("missing index: %d entries, %v; want an empty index", len(f.entries), err)
+	}
+	if err := os.WriteFile("broken.json", []byte("{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadFreshnessIndex("broken.json"); err == nil {
+		t.Error("loaded a broken index without an error")
+	}
+}
+
+// TestStaleImageFetchedAgain runs a scrape twice with
+// -http-cache-control-respect: the image served with a max-age is not
+// requested again, the no-store one is. Once the first has outlived its
+// lifetime, a third run requests it again.
+func TestStaleImageFetchedAgain(t *testing.T) {
+	setupTest(t)
+	scrapeIDs(1, 1)
+	cfg.RespectCacheControl = true
+	data := testPNG(t, 8, 8, color.White)
+	var mu sync.Mutex
+	var requested []string
+	serveAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/v2/product/") {
+			writeProduct(t, w, productID(r), 2)
+			return
+		}
+		mu.Lock()
+		requested = append(requested, r.URL.Path)
+		mu.Unlock()
+		if r.URL.Path == "/img/1-1.png" {
+			w.Header().Set("Cache-Control", "max-age=3600")
+		} else {
+			w.Header().Set("Cache-Control", "no-store")
+		}
+		w.Write(data)
+	}))
+	run := func() []string {
+		t.Helper()
+		requested = nil
+		resetStats()
+		if err := runScrape(context.Background(), nil); err != nil {
+			t.Fatal(err)
+		}
+		slices.Sort(requested)
+		return requested
+	}
+
+	if got := run(); !slices.Equal(got, []string{"/img/1-1.png", "/img/1-2.png"}) {
+		t.Fatalf("first run requested %v, want both images", got)
+	}
+	if got := run(); !slices.Equal(got, []string{"/img/1-2.png"}) {
+		t.Errorf("second run requested %v, want only the no-store image", got)
+	}
+	if got := stats.Fresh.Load(); got != 1 {
+		t.Errorf("%d images fresh, want 1", got)
+	}
+
+	path := filepath.Join(imageDir, freshnessFile)
+	index, err := loadFreshnessIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for file, entry := range index.entries {
+		entry.Expires = time.Now().Add(-time.Second)
+		index.entries[file] = entry
+	}
+	if err := index.save(); err != nil {
+		t.Fatal(err)
+	}
+	if got := run(); !slices.Equal(got, []string{"/img/1-1.png", "/img/1-2.png"}) {
+		t.Errorf("run after expiry requested %v, want both images", got)
+	}
+}
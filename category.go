@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Category is a category entry of a listing response
+type Category struct {
+	ID      int    `json:"id"`
+	Code    string `json:"code"`
+	TitleFa string `json:"title_fa"`
+	TitleEn string `json:"title_en"`
+}
+
+// pageBackoffBase is the wait after the first empty listing page with
+// -exponential-page-backoff, doubled for each empty page after it
+const pageBackoffBase = 2 * time.Second
+
+// pageBackoff returns the wait before the next listing page after empty
+// empty pages in a row, capped by -max-page-backoff
+func pageBackoff(empty int) time.Duration {
+	wait := pageBackoffBase
+	for i := 1; i < empty && wait < cfg.MaxPageBackoff; i++ {
+		wait *= 2
+	}
+	return min(wait, cfg.MaxPageBackoff)
+}
+
+// slugPattern matches category slugs that are safe to use in URLs and paths
+var slugPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// buildCategoryURL returns the listing URL of page of category below
+// baseURL, such as categoryRootURL, asking for what opts say. The category
+// is escaped as a path segment.
+func buildCategoryURL(baseURL, category string, page int, opts QueryOptions) string {
+	values := url.Values{}
+	for key, list := range opts.Params {
+		values[key] = append([]string(nil), list...)
+	}
+	values.Set("th_no_track", "1")
+	values.Set("page", strconv.Itoa(page))
+	if opts.Sort != "" {
+		values.Set("sort", opts.Sort)
+	}
+	if opts.MinDiscount > 0 {
+		values.Set(minDiscountParam, strconv.Itoa(opts.MinDiscount))
+	}
+	for param, list := range opts.Filters {
+		for i, value := range list {
+			values.Set(fmt.Sprintf("%s[%d]", param, i), value)
+		}
+	}
+	return strings.TrimSuffix(baseURL, "/") + "/" + url.PathEscape(category) + "/search/?" + values.Encode()
+}
+
+// fetchSubcategories returns the subcategories of the category slug, or the
+// top-level categories when slug is empty
+func (c *Client) fetchSubcategories(ctx context.Context, slug string) ([]Category, error) {
+	url := categoryRootURL
+	if slug != "" {
+		url = buildCategoryURL(categoryRootURL, slug, 1, QueryOptions{})
+	}
+	var res *CategoryRes
+	err := cfg.retryPolicy(stageSearch).do(ctx, func(ctx context.Context) (err error) {
+		res, err = c.fetchCategoryPage(ctx, url)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.Data.SubCategories, nil
+}
+
+// crawler walks a category, or a whole category tree, and queues its products
+type crawler struct {
+	client   *Client
+	jobs     chan<- productJob
+	query    QueryOptions // search parameters of every listing URL
+	prefetch int          // listing pages fetched ahead of the page being queued
+	tree     bool
+	maxDepth int
+	seen     map[int]bool    // product IDs already queued
+	queued   int             // products queued so far
+	visited  map[string]bool // category slugs already crawled, guards against cycles
+}
+
+func newCrawler(client *Client, jobs chan<- productJob, query QueryOptions, prefetch int, tree bool, maxDepth int) *crawler {
+	return &crawler{
+		client:   client,
+		jobs:     jobs,
+		query:    query,
+		prefetch: prefetch,
+		tree:     tree,
+		maxDepth: maxDepth,
+		seen:     make(map[int]bool),
+		visited:  make(map[string]bool),
+	}
+}
+
+// pageResult is a fetched listing page
+type pageResult struct {
+	page    int
+	url     string
+	res     *CategoryRes
+	err     error
+	release func() // Called once the page's products are queued
+}
+
+// fetchPages fetches the listing pages of slug in order on a separate
+// goroutine, staying up to c.prefetch pages ahead of the page whose products
+// are being queued, and stops after -empty-page-tolerance empty pages in a
+// row; pages that failed don't count. With -exponential-page-backoff it
+// slows down after each empty page short of that. The returned
+// function stops fetching early.
+func (c *crawler) fetchPages(ctx context.Context, slug string) (<-chan pageResult, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	ahead := make(chan struct{}, c.prefetch+1) // One token per page fetched but not yet released
+	results := make(chan pageResult, c.prefetch+1)
+	release := func() { <-ahead }
+
+	go func() {
+		defer close(results)
+		empty := 0 // Consecutive empty pages
+		for page := 1; page <= maxPages; page++ {
+			select {
+			case ahead <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			pause.wait()
+			if ctx.Err() != nil {
+				return
+			}
+			stats.setPosition(slug, page)
+			url := buildCategoryURL(categoryRootURL, slug, page, c.query)
+			slog.Info("Fetching page", "category", slug, "page", page)
+
+			var res *CategoryRes
+			policy := cfg.retryPolicy(stageSearch)
+			err := policy.do(ctx, func(ctx context.Context) (err error) {
+				res, err = c.client.fetchCategoryPage(ctx, url)
+				return err
+			})
+			results <- pageResult{page: page, url: url, res: res, err: err, release: release}
+			// Failed pages say nothing about where the category ends
+			if err == nil && len(res.Data.Products) == 0 {
+				if empty++; empty >= max(cfg.EmptyPages, 1) {
+					return // past the last page of this category
+				}
+				if cfg.PageBackoff {
+					wait := pageBackoff(empty)
+					debugLog.Printf("category %s: %d empty pages, waiting %s before page %d", slug, empty, wait, page+1)
+					if policy.clock().Sleep(ctx, wait) != nil {
+						return
+					}
+				}
+			} else if err == nil {
+				empty = 0
+			}
+		}
+	}()
+	return results, cancel
+}
+
+// crawl queues every product of the category slug with dir as its image folder.
+// In tree mode it then descends into the subcategories listed on the first
+// page, each getting its own folder below dir, until maxDepth is reached.
+// It stops queueing once ctx is done.
+func (c *crawler) crawl(ctx context.Context, slug, dir string, depth int) {
+	if c.visited[slug] {
+		debugLog.Printf("category %s already crawled, skipping", slug)
+		return
+	}
+	c.visited[slug] = true
+
+	pages, stopPages := c.fetchPages(ctx, slug)
+	defer stopPages()
+
+	var children []Category
+	for result := range pages {
+		page, res := result.page, result.res
+		if ctx.Err() != nil {
+			return
+		}
+		if result.err != nil {
+			stats.Errors.Add(1)
+			slog.Error("Failed to fetch page", "category", slug, "page", page, "reason", friendlyError(result.err))
+			debugLog.Printf("category %s page %d: %v", slug, page, result.err)
+			e := newErrorEvent("page", result.err)
+			e.Page, e.URL = page, result.url
+			reportError(e)
+			result.release()
+			continue
+		}
+		stats.Pages.Add(1)
+		events.emit(PageFetchedEvent{EventHeader: newEventHeader(eventPageFetched), Category: slug, Page: page, Products: len(res.Data.Products)})
+
+		if page == 1 {
+			children = res.Data.SubCategories
+			observeIDs(res.Data.Products)
+		}
+		if len(res.Data.Products) == 0 {
+			debugLog.Printf("category %s page %d is empty", slug, page)
+			result.release()
+			continue // fetchPages stops after -empty-page-tolerance of these
+		}
+
+		for _, product := range res.Data.Products {
+			if !c.queue(ctx, product.ID, slug, page, dir, &product) {
+				return
+			}
+		}
+		result.release()
+	}
+
+	if !c.tree || depth >= c.maxDepth {
+		return
+	}
+	for _, child := range children {
+		if !slugPattern.MatchString(child.Code) {
+			debugLog.Printf("category %s: ignoring subcategory with unusable code %q", slug, child.Code)
+			continue
+		}
+		c.crawl(ctx, child.Code, filepath.Join(dir, child.Code), depth+1)
+	}
+}
+
+// queue hands a discovered product to the detail workers unless it was
+// already queued or is skipped by -resume-from-id. source names where it was
+// found and listed is its listing entry, nil for sources without listings.
+// It returns false once ctx is done.
+func (c *crawler) queue(ctx context.Context, productID int, source string, page int, dir string, listed *Product) bool {
+	if c.seen[productID] {
+		return true
+	}
+	c.seen[productID] = true
+	if productID < cfg.ResumeFromID {
+		stats.ResumeSkipped.Add(1)
+		return true
+	}
+	if checkpointed[productID] {
+		stats.Checkpointed.Add(1)
+		debugLog.Printf("product %d is finished in the checkpoint, skipping", productID)
+		return true
+	}
+	if indexedProducts != nil && indexed(productID, time.Duration(cfg.MaxAge), time.Now()) {
+		stats.Indexed.Add(1)
+		debugLog.Printf("product %d is complete in the manifest, skipping", productID)
+		return true
+	}
+	if err := productLimiter.Wait(ctx); err != nil {
+		return false
+	}
+	if err := acquireQueueSlot(ctx); err != nil {
+		return false
+	}
+	stats.Discovered.Add(1)
+	events.emit(ProductDiscoveredEvent{EventHeader: newEventHeader(eventProductDiscovered), ProductID: productID, Category: source, Page: page, Listing: listed.listing(cfg.ListingFields)})
+	linkedCategories.expect()
+	seq := c.queued
+	c.queued++
+	select {
+	case c.jobs <- productJob{ID: productID, Seq: seq, Page: page, Dir: dir, Listed: listed}:
+		return true
+	case <-ctx.Done():
+		releaseQueueSlot()
+		productOrder.drop(seq)
+		return false
+	}
+}
+
+// crawlLinked crawls the categories in linkedCategories until no queued
+// product can add another. A linked category is crawled on its own, without
+// descending into its subcategories: following links is what discovers them.
+func (c *crawler) crawlLinked(ctx context.Context) {
+	for {
+		slug, ok := linkedCategories.next(ctx)
+		if !ok {
+			return
+		}
+		if c.visited[slug] {
+			continue
+		}
+		slog.Info("Following linked category", "category", slug)
+		dir := imageDir
+		if c.tree {
+			dir = filepath.Join(imageDir, slug)
+		}
+		c.crawl(ctx, slug, dir, c.maxDepth)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+)
+
+// TestPageBackoffUsesRetryClock checks that -exponential-page-backoff waits
+// on the clock of the search retry policy
+func TestPageBackoffUsesRetryClock(t *testing.T) {
+	setupTest(t)
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	cfg.Clock = clock
+	cfg.PageBackoff, cfg.EmptyPages, cfg.MaxPageBackoff = true, 3, time.Minute
+	serveAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":200,"data":{"products":[]}}`))
+	}))
+
+	c := newCrawler(httpClient, make(chan productJob), QueryOptions{}, 0, false, 0)
+	results, stop := c.fetchPages(context.Background(), "mobile-phone")
+	defer stop()
+	pages := 0
+	for res := range results {
+		if res.err != nil {
+			t.Fatal(res.err)
+		}
+		pages++
+		res.release()
+	}
+	if pages != 3 {
+		t.Errorf("fetched %d pages, want 3", pages)
+	}
+	want := []time.Duration{pageBackoff(1), pageBackoff(2)}
+	if len(clock.sleeps) != len(want) || clock.sleeps[0] != want[0] || clock.sleeps[1] != want[1] {
+		t.Errorf("waited %v, want %v", clock.sleeps, want)
+	}
+}
+
+func TestBuildCategoryURL(t *testing.T) {
+	const base = "https://api.digikala.com/v1/categories/"
+	tests := []struct {
+		name     string
+		category string
+		page     int
+		opts     QueryOptions
+		want     string
+	}{
+		{"first page", "mobile-phone", 1, QueryOptions{}, base + "mobile-phone/search/?page=1&th_no_track=1"},
+		{"later page", "mobile-phone", 12, QueryOptions{}, base + "mobile-phone/search/?page=12&th_no_track=1"},
+		{"sort", "mobile-phone", 1, QueryOptions{Sort: "7"}, base + "mobile-phone/search/?page=1&sort=7&th_no_track=1"},
+		{"min discount", "mobile-phone", 2, QueryOptions{MinDiscount: 30}, base + "mobile-phone/search/?discount%5Bmin%5D=30&page=2&th_no_track=1"},
+		{"no discount", "mobile-phone", 1, QueryOptions{MinDiscount: 0}, base + "mobile-phone/search/?page=1&th_no_track=1"},
+		{"filters", "kids-apparel", 1, QueryOptions{Filters: searchFilters{"colors": {"red", "blue"}}}, base + "kids-apparel/search/?colors%5B0%5D=red&colors%5B1%5D=blue&page=1&th_no_track=1"},
+		{"custom params", "kids-apparel", 3, QueryOptions{Params: url.Values{"q": {"shoes & socks"}, "has_selling_stock": {"1"}}}, base + "kids-apparel/search/?has_selling_stock=1&page=3&q=shoes+%26+socks&th_no_track=1"},
+		{"custom page ignored", "kids-apparel", 3, QueryOptions{Params: url.Values{"page": {"9"}}}, base + "kids-apparel/search/?page=3&th_no_track=1"},
+		{"special characters", "men's shoes/boots?", 1, QueryOptions{}, base + "men%27s%20shoes%2Fboots%3F/search/?page=1&th_no_track=1"},
+		{"base without slash", "mobile-phone", 1, QueryOptions{}, base + "mobile-phone/search/?page=1&th_no_track=1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := base
+			if tt.name == "base without slash" {
+				b = base[:len(base)-1]
+			}
+			got := buildCategoryURL(b, tt.category, tt.page, tt.opts)
+			if got != tt.want {
+				t.Errorf("got  %s\nwant %s", got, tt.want)
+			}
+			u, err := url.Parse(got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := "/v1/categories/" + tt.category + "/search/"; u.Path != want {
+				t.Errorf("path = %q, want %q", u.Path, want)
+			}
+		})
+	}
+}
+
+// TestEmptyPageBetweenFullOnes crawls a category whose page 2 comes back
+// empty although pages 3 and 4 have products, as the API sometimes does:
+// with -empty-page-tolerance 2 the crawl goes past it, with 1 it stops there
+func TestEmptyPageBetweenFullOnes(t *testing.T) {
+	// Products of each page; pages past the map fail
+	listing := map[string]string{
+		"1": `[{"id":1},{"id":2}]`,
+		"2": `[]`,
+		"3": `[{"id":3}]`,
+		"4": `[{"id":4}]`,
+		"5": `[]`,
+		"6": `[]`,
+	}
+	tests := []struct {
+		tolerance int
+		want      []int
+		pages     int
+	}{
+		{1, []int{1, 2}, 2},
+		{2, []int{1, 2, 3, 4}, 6},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("tolerance %d", tt.tolerance), func(t *testing.T) {
+			setupTest(t)
+			cfg.EmptyPages = tt.tolerance
+			var requested []string
+			serveAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				page := r.URL.Query().Get("page")
+				requested = append(requested, page)
+				products, ok := listing[page]
+				if !ok {
+					http.Error(w, "past the last page", http.StatusInternalServerError)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprintf(w, `{"status":200,"data":{"products":%s}}`, products)
+			}))
+
+			jobs := make(chan productJob, 10)
+			newCrawler(httpClient, jobs, QueryOptions{}, 0, false, 0).crawl(context.Background(), "mobile-phone", "mobile-phone", 0)
+			close(jobs)
+			var ids []int
+			for job := range jobs {
+				ids = append(ids, job.ID)
+			}
+			if !slices.Equal(ids, tt.want) {
+				t.Errorf("queued %v, want %v", ids, tt.want)
+			}
+			if len(requested) != tt.pages {
+				t.Errorf("requested pages %v, want 1 to %d", requested, tt.pages)
+			}
+		})
+	}
+}
+
+// TestFailedPageIsNotEmpty fails page 2 for good: it neither ends the
+// category nor resets the count of empty pages
+func TestFailedPageIsNotEmpty(t *testing.T) {
+	setupTest(t)
+	cfg.EmptyPages = 2
+	serveAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("page") {
+		case "1":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"status":200,"data":{"products":[{"id":1}]}}`))
+		case "2", "4":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"status":200,"data":{"products":[]}}`))
+		default:
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		}
+	}))
+
+	c := newCrawler(httpClient, make(chan productJob, 10), QueryOptions{}, 0, false, 0)
+	results, stop := c.fetchPages(context.Background(), "mobile-phone")
+	defer stop()
+	var pages []int
+	for res := range results {
+		pages = append(pages, res.page)
+		res.release()
+	}
+	// 2 is empty, 3 fails, 4 is the second empty page in a row
+	if !slices.Equal(pages, []int{1, 2, 3, 4}) {
+		t.Errorf("fetched pages %v, want 1 to 4", pages)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SearchOptions are the listing parameters carried over from a category URL
+type SearchOptions struct {
+	Sort    string        // Listing order, e.g. 7 for newest; "" for the default
+	Filters searchFilters // Attribute filters, by search API parameter
+	Ignored []string      // Query parameters of the URL that were not recognized
+}
+
+// QueryOptions are the search parameters of a listing URL besides its page
+type QueryOptions struct {
+	Sort        string        // Listing order, e.g. 7 for newest; "" for the default
+	MinDiscount int           // Least discount in percent, 0 for any
+	Filters     searchFilters // Attribute filters, by search API parameter
+	Params      url.Values    // Any other parameters, sent as they are
+}
+
+// listingOptions are the search parameters of every listing URL of the run:
+// the filters, -min-discount and the sort order of a category URL. The
+// filters of a category URL are merged into loadSearchFilters.
+func listingOptions(filters searchFilters) QueryOptions {
+	return QueryOptions{Sort: cfg.CategoryOptions.Sort, MinDiscount: cfg.MinDiscount, Filters: filters}
+}
+
+// indexedParam matches a filter parameter of a site URL, e.g. brands[0]
+var indexedParam = regexp.MustCompile(`^([a-z_]+)\[(\d*)\]$`)
+
+// ParseCategoryInput reads what was given as -category: a slug, returned as
+// it is, or a category URL copied from the site, such as
+// https://www.digikala.com/search/category-kids-apparel/?sort=7. The slug
+// of a URL is its category- path segment, wherever it is; its sort order and
+// its brand, color, material and size filters are carried over.
+func ParseCategoryInput(input string) (slug string, opts SearchOptions, err error) {
+	input = strings.TrimSpace(input)
+	if !strings.Contains(input, "://") && !strings.HasPrefix(input, "www.") && !strings.HasPrefix(input, "digikala.com") {
+		return input, SearchOptions{}, nil
+	}
+	if !strings.Contains(input, "://") {
+		input = "https://" + input
+	}
+	u, err := url.Parse(input)
+	if err != nil {
+		return "", SearchOptions{}, fmt.Errorf("invalid category URL %q: %w", input, err)
+	}
+	if host := u.Hostname(); host != "digikala.com" && !strings.HasSuffix(host, ".digikala.com") {
+		return "", SearchOptions{}, fmt.Errorf("invalid category URL %q: not a digikala.com address", input)
+	}
+	for _, segment := range strings.Split(u.Path, "/") {
+		if s, ok := strings.CutPrefix(segment, "category-"); ok && s != "" {
+			slug = s
+		}
+	}
+	if slug == "" {
+		return "", SearchOptions{}, fmt.Errorf("invalid category URL %q: no category in it; open the category page and copy its address", input)
+	}
+
+	// Filters keep the order of their indexes, e.g. brands[0] before brands[1]
+	query := u.Query()
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		mi, mj := indexedParam.FindStringSubmatch(keys[i]), indexedParam.FindStringSubmatch(keys[j])
+		if mi != nil && mj != nil && mi[1] == mj[1] {
+			ni, _ := strconv.Atoi(mi[2])
+			nj, _ := strconv.Atoi(mj[2])
+			return ni < nj
+		}
+		return keys[i] < keys[j]
+	})
+	for _, key := range keys {
+		value := query.Get(key)
+		if key == "sort" {
+			opts.Sort = value
+			continue
+		}
+		if m := indexedParam.FindStringSubmatch(key); m != nil && isFilterParam(m[1]) && value != "" {
+			if opts.Filters == nil {
+				opts.Filters = searchFilters{}
+			}
+			opts.Filters[m[1]] = append(opts.Filters[m[1]], value)
+			continue
+		}
+		opts.Ignored = append(opts.Ignored, key)
+	}
+	return slug, opts, nil
+}
+
+// isFilterParam reports whether param is a search API filter parameter
+func isFilterParam(param string) bool {
+	for _, p := range filterParams {
+		if p == param {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveCategory replaces a category URL in c.Category by its slug and
+// keeps its options in c.CategoryOptions
+func (c *Config) resolveCategory() error {
+	slug, opts, err := ParseCategoryInput(c.Category)
+	if err != nil {
+		return err
+	}
+	c.Category, c.CategoryOptions = slug, opts
+	return nil
+}
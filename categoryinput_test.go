@@ -0,0 +1,69 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseCategoryInput(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		slug  string
+		opts  SearchOptions
+	}{
+		{"slug", "mobile-phone", "mobile-phone", SearchOptions{}},
+		{"slug with spaces", "  mobile-phone\n", "mobile-phone", SearchOptions{}},
+		{"url", "https://www.digikala.com/search/category-kids-apparel/", "kids-apparel", SearchOptions{}},
+		{"no scheme", "www.digikala.com/search/category-kids-apparel/", "kids-apparel", SearchOptions{}},
+		{"bare host", "digikala.com/search/category-kids-apparel", "kids-apparel", SearchOptions{}},
+		{"mobile host", "https://m.digikala.com/search/category-kids-apparel/", "kids-apparel", SearchOptions{}},
+		{"sort", "https://www.digikala.com/search/category-mobile-phone/?sort=7", "mobile-phone", SearchOptions{Sort: "7"}},
+		{
+			"filters in index order",
+			"https://www.digikala.com/search/category-mobile-phone/?brands[10]=18&brands[2]=10&colors[0]=1&sort=4",
+			"mobile-phone",
+			SearchOptions{Sort: "4", Filters: searchFilters{"brands": {"10", "18"}, "colors": {"1"}}},
+		},
+		{
+			"unrecognized parameters",
+			"https://www.digikala.com/search/category-mobile-phone/?utm_source=x&brands[0]=&page=3",
+			"mobile-phone",
+			SearchOptions{Ignored: []string{"brands[0]", "page", "utm_source"}},
+		},
+		{"persian path", "https://www.digikala.com/search/category-mobile-phone/%DA%AF%D9%88%D8%B4%DB%8C/", "mobile-phone", SearchOptions{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			slug, opts, err := ParseCategoryInput(tt.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if slug != tt.slug {
+				t.Errorf("slug = %q, want %q", slug, tt.slug)
+			}
+			if !reflect.DeepEqual(opts, tt.opts) {
+				t.Errorf("options = %+v, want %+v", opts, tt.opts)
+			}
+		})
+	}
+}
+
+func TestParseCategoryInputErrors(t *testing.T) {
+	tests := []struct {
+		input, want string
+	}{
+		{"https://example.com/search/category-mobile-phone/", "not a digikala.com address"},
+		{"https://digikala.com.evil.example/search/category-mobile-phone/", "not a digikala.com address"},
+		{"https://www.digikala.com/product/dkp-123/", "no category in it"},
+		{"https://www.digikala.com/search/category-/", "no category in it"},
+		{"https://www.digikala.com/%zz", "invalid category URL"},
+	}
+	for _, tt := range tests {
+		_, _, err := ParseCategoryInput(tt.input)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("ParseCategoryInput(%q) = %v, want an error saying %q", tt.input, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// checkpointVersion is the version of the -checkpoint file this build writes
+const checkpointVersion = 1
+
+// checkpointFile is what a -checkpoint file holds
+type checkpointFile struct {
+	Version  int       `json:"version"`
+	Products []int     `json:"products"` // Products finished with every image, sorted
+	Updated  time.Time `json:"updated"`
+}
+
+// checkpointed holds the products the -checkpoint file listed as finished
+// when the run started; nil without -checkpoint
+var checkpointed map[int]bool
+
+// checkpoint records the products this run finishes; nil without -checkpoint
+var checkpoint *checkpointWriter
+
+// loadCheckpoint returns the finished products of the checkpoint at path; a
+// missing file has none. A bare JSON list of product IDs, such as a script
+// would write, is read as version 0. A version newer than this build's is
+// refused rather than overwritten.
+func loadCheckpoint(path string) (map[int]bool, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return make(map[int]bool), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checkpoint: %w", err)
+	}
+	var file checkpointFile
+	if data = bytes.TrimSpace(data); len(data) > 0 && data[0] == '[' {
+		err = json.Unmarshal(data, &file.Products)
+	} else {
+		err = json.Unmarshal(data, &file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode checkpoint %s: %w", path, err)
+	}
+	if file.Version > checkpointVersion {
+		return nil, fmt.Errorf("checkpoint %s is version %d, newer than the version %d this build reads; upgrade, or delete the file to start over", path, file.Version, checkpointVersion)
+	}
+	done := make(map[int]bool, len(file.Products))
+	for _, id := range file.Products {
+		done[id] = true
+	}
+	return done, nil
+}
+
+// writeCheckpoint replaces the checkpoint at path with the products in done.
+// The file is synced before it takes the name, so a crash leaves either the
+// old checkpoint or the new one.
+func writeCheckpoint(path string, done map[int]bool) error {
+	file := checkpointFile{Version: checkpointVersion, Products: make([]int, 0, len(done)), Updated: time.Now()}
+	for id := range done {
+		file.Products = append(file.Products, id)
+	}
+	slices.Sort(file.Products)
+	data, err := json.Marshal(file)
+	if err != nil {
+		return fmt.Errorf("failed to encode checkpoint: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create checkpoint directory: %w", err)
+	}
+	tmpPath := path + ".part"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	return nil
+}
+
+// checkpointWriter collects finished products from the workers on a channel
+// and rewrites the checkpoint from a goroutine of its own, coalescing
+// completions so the file is written at most once per every of them or per
+// interval
+type checkpointWriter struct {
+	path        string
+	done        map[int]bool // Owned by the goroutine
+	completions chan int
+	closed      chan error
+}
+
+// startCheckpoint starts writing the products in done, and those completed
+// from now on, to path
+func startCheckpoint(path string, done map[int]bool, every int, interval time.Duration) *checkpointWriter {
+	c := &checkpointWriter{path: path, done: done, completions: make(chan int, every), closed: make(chan error, 1)}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		pending := 0
+		flush := func() error {
+			if pending == 0 {
+				return nil
+			}
+			pending = 0
+			err := writeCheckpoint(c.path, c.done)
+			if err != nil {
+				slog.Error("Failed to save checkpoint", "reason", friendlyError(err))
+			}
+			return err
+		}
+		for {
+			select {
+			case id, ok := <-c.completions:
+				if !ok {
+					c.closed <- flush()
+					return
+				}
+				if !c.done[id] {
+					c.done[id] = true
+					pending++
+				}
+				if pending >= every {
+					flush()
+				}
+			case <-ticker.C:
+				flush()
+			}
+		}
+	}()
+	return c
+}
+
+// complete records that the product with id has every image; it is a no-op
+// on a nil *checkpointWriter
+func (c *checkpointWriter) complete(id int) {
+	if c == nil {
+		return
+	}
+	c.completions <- id
+}
+
+// close writes what is not written yet and stops the goroutine. No product
+// may be completed after it. It is a no-op on a nil *checkpointWriter.
+func (c *checkpointWriter) close() error {
+	if c == nil {
+		return nil
+	}
+	close(c.completions)
+	return <-c.closed
+}
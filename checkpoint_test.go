@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"image/color"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLoadCheckpoint(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string // Empty for no file
+		want    []int
+		wantErr string
+	}{
+		{"missing", "", nil, ""},
+		{"current", `{"version":1,"products":[3,1,2],"updated":"2026-10-01T00:00:00Z"}`, []int{1, 2, 3}, ""},
+		{"version 0", "[5, 7]\n", []int{5, 7}, ""},
+		{"newer", `{"version":2,"products":[1]}`, nil, "newer than the version 1"},
+		{"garbage", `{"version":`, nil, "failed to decode checkpoint"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "checkpoint.json")
+			if tt.content != "" {
+				if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			done, err := loadCheckpoint(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want one saying %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(done) != len(tt.want) {
+				t.Errorf("got %v, want %v", done, tt.want)
+			}
+			for _, id := range tt.want {
+				if !done[id] {
+					t.Errorf("product %d missing from %v", id, done)
+				}
+			}
+		})
+	}
+}
+
+// TestCheckpointCoalescesWrites checks that completions wait for
+// -checkpoint-every of them, and that closing writes the rest
+func TestCheckpointCoalescesWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	c := startCheckpoint(path, map[int]bool{1: true}, 5, time.Hour)
+	for id := 2; id <= 5; id++ {
+		c.complete(id)
+	}
+	c.complete(2) // Already recorded, not a new completion
+	time.Sleep(20 * time.Millisecond)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("checkpoint written after 4 completions of 5: %v", err)
+	}
+	c.complete(6)
+	waitFor(t, func() bool {
+		_, err := os.Stat(path)
+		return err == nil
+	})
+	c.complete(7)
+	if err := c.close(); err != nil {
+		t.Fatal(err)
+	}
+	done, err := loadCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(done) != 7 {
+		t.Errorf("checkpoint holds %v, want products 1 to 7", done)
+	}
+}
+
+// TestCheckpointConcurrentCompletions is meant for the race detector:
+// workers complete thousands of products at once while the checkpoint is
+// read back, which must always find a whole file
+func TestCheckpointConcurrentCompletions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	c := startCheckpoint(path, make(map[int]bool), 64, time.Millisecond)
+	const workers, perWorker = 50, 100
+
+	stop := make(chan struct{})
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(readErr)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if _, err := loadCheckpoint(path); err != nil {
+				readErr <- err
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				c.complete(w*perWorker + i)
+				c.complete(i) // Overlaps every other worker
+			}
+		}(w)
+	}
+	wg.Wait()
+	if err := c.close(); err != nil {
+		t.Fatal(err)
+	}
+	close(stop)
+	if err := <-readErr; err != nil {
+		t.Fatalf("read a torn checkpoint: %v", err)
+	}
+
+	done, err := loadCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(done) != workers*perWorker {
+		t.Errorf("checkpoint holds %d products, want %d", len(done), workers*perWorker)
+	}
+	if _, err := os.Stat(path + ".part"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+}
+
+// TestCheckpointSkipsFinishedProducts runs twice: the second run only
+// fetches the product whose image failed in the first
+func TestCheckpointSkipsFinishedProducts(t *testing.T) {
+	setupTest(t)
+	scrapeIDs(1, 3)
+	cfg.Checkpoint = "checkpoint.json"
+	cfg.MaxRetries = 0
+	data := testPNG(t, 4, 4, color.White)
+	var details atomic.Int64
+	imageMissing := true
+	serveAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := productID(r)
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/v2/product/"):
+			details.Add(1)
+			writeProduct(t, w, id, 1)
+		case id == 2 && imageMissing:
+			http.NotFound(w, r)
+		default:
+			w.Write(data)
+		}
+	}))
+
+	if err := runScrape(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	done, err := loadCheckpoint(cfg.Checkpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(done) != 2 || !done[1] || !done[3] {
+		t.Fatalf("checkpoint holds %v, want products 1 and 3", done)
+	}
+
+	imageMissing = false
+	details.Store(0)
+	resetStats()
+	if err := runScrape(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := details.Load(); got != 1 {
+		t.Errorf("second run fetched %d product details, want only product 2's", got)
+	}
+	if got := stats.Checkpointed.Load(); got != 2 {
+		t.Errorf("%d products skipped, want 2", got)
+	}
+	if done, _ := loadCheckpoint(cfg.Checkpoint); len(done) != 3 {
+		t.Errorf("checkpoint holds %v after the second run, want all 3", done)
+	}
+}
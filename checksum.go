@@ -0,0 +1,21 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// checksumExt is appended to an image's path to name its checksum file
+const checksumExt = ".sha256"
+
+// writeChecksum saves sum next to the image at path in the format of
+// sha256sum, so the folder can be checked with sha256sum -c
+func writeChecksum(path string, sum []byte) error {
+	line := fmt.Sprintf("%s  %s\n", hex.EncodeToString(sum), filepath.Base(path))
+	if err := os.WriteFile(path+checksumExt, []byte(line), 0o644); err != nil {
+		return fmt.Errorf("failed to write checksum: %w", err)
+	}
+	return nil
+}
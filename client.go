@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// errPinMismatch is returned when a server's key matches none of the -tls-pin pins
+var errPinMismatch = errors.New("certificate public key does not match any -tls-pin")
+
+// maxRedirects is how many redirects a request may follow, as in net/http
+const maxRedirects = 10
+
+// redirectLoopError is returned for a request whose redirects came back to
+// a URL already visited or went on past maxRedirects
+type redirectLoopError struct {
+	Chain []string // Every URL visited, the request's own first
+}
+
+func (e *redirectLoopError) Error() string {
+	return fmt.Sprintf("redirect loop after %d hops: %s", len(e.Chain)-1, strings.Join(e.Chain, " -> "))
+}
+
+// checkRedirect stops a redirect chain as soon as it loops, instead of
+// following the loop up to maxRedirects
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	chain := make([]string, 0, len(via)+1)
+	looped := len(via) >= maxRedirects
+	for _, r := range via {
+		chain = append(chain, r.URL.String())
+		looped = looped || r.URL.String() == req.URL.String()
+	}
+	if looped {
+		return &redirectLoopError{Chain: append(chain, req.URL.String())}
+	}
+	return nil
+}
+
+// Client sends the requests of a run, and downloads single products outside
+// of one with DownloadProduct, through the backoff gate and the rate limits
+// the flags configure. Its zero value is ready to use.
+type Client struct {
+	client *http.Client
+}
+
+// NewClient returns a Client sending its requests through transport, or
+// through http.DefaultTransport when transport is nil
+func NewClient(transport http.RoundTripper) *Client {
+	return &Client{client: newClient(transport)}
+}
+
+// httpClient makes every request of the run. Tests replace it, built with
+// NewClient around another transport, to send the requests elsewhere, e.g.
+// to an httptest.Server.
+var httpClient = NewClient(nil)
+
+// defaultClient is the http.Client of a zero Client
+var defaultClient = newClient(nil)
+
+// newClient returns an http.Client sending its requests through transport,
+// or through http.DefaultTransport when transport is nil
+func newClient(transport http.RoundTripper) *http.Client {
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	return &http.Client{Transport: transport, CheckRedirect: checkRedirect}
+}
+
+// plain returns the http.Client under c, for requests that skip the rate
+// limits, such as alerts
+func (c *Client) plain() *http.Client {
+	if c == nil || c.client == nil {
+		return defaultClient
+	}
+	return c.client
+}
+
+// get sends a GET request for url, waiting for its host's rate limit first (see Do), that is
+// abandoned once ctx is done
+func (c *Client) get(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.Do(req)
+}
+
+// getAuth is get for member endpoints, sending token as a bearer token
+func (c *Client) getAuth(ctx context.Context, url, token string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return c.Do(req)
+}
+
+// Do sends req once the backoff gate and the rate limits let it through,
+// and shows the answer to the gate
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	probe, err := backoff.wait(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := requestLimiter.Wait(ctx, req.URL.String()); err != nil {
+		if probe {
+			backoff.observe(true, nil)
+		}
+		return nil, err
+	}
+	resp, err := c.plain().Do(req)
+	backoff.observe(probe, resp)
+	if resp != nil {
+		// Count a redirected request once, under the host that answered last
+		host := req.URL.Host
+		if resp.Request != nil {
+			host = resp.Request.URL.Host
+		}
+		stats.host(host).observe(resp.StatusCode)
+	}
+	return resp, err
+}
+
+// newHTTPClient returns the client for the run. With pins, TLS connections
+// are only accepted when the SHA-256 of the leaf certificate's public key
+// (SubjectPublicKeyInfo) equals one of them, on top of the normal chain
+// verification. The requests go to the -audit-log once it is open.
+func newHTTPClient(pins []string) (*Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if len(pins) > 0 {
+		hashes, err := parsePins(pins)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = &tls.Config{VerifyConnection: func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errPinMismatch
+			}
+			sum := sha256.Sum256(cs.PeerCertificates[0].RawSubjectPublicKeyInfo)
+			if hashes[sum] {
+				return nil
+			}
+			return fmt.Errorf("%w: %s presented sha256/%s", errPinMismatch, cs.ServerName, base64.StdEncoding.EncodeToString(sum[:]))
+		}}
+	}
+	rt, err := vcrTransport(transport)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(audited(rt)), nil
+}
+
+// parsePins decodes base64 SPKI SHA-256 pins, with or without a sha256/ prefix
+func parsePins(pins []string) (map[[sha256.Size]byte]bool, error) {
+	hashes := make(map[[sha256.Size]byte]bool, len(pins))
+	for _, pin := range pins {
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(strings.TrimSpace(pin), "sha256/"))
+		if err != nil || len(raw) != sha256.Size {
+			return nil, fmt.Errorf("invalid -tls-pin %q: want the base64 SHA-256 of a public key", pin)
+		}
+		hashes[[sha256.Size]byte(raw)] = true
+	}
+	return hashes, nil
+}
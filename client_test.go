@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestNewClient(t *testing.T) {
+	c := newClient(nil)
+	if c.Transport != http.DefaultTransport {
+		t.Errorf("transport = %T, want http.DefaultTransport", c.Transport)
+	}
+	if c.CheckRedirect == nil {
+		t.Error("client follows redirect loops to the end")
+	}
+	transport := &countingTransport{replies: []func(*http.Request) (*http.Response, error){status(http.StatusTeapot)}}
+	resp, err := newClient(transport).Get("https://api.digikala.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if transport.calls != 1 || resp.StatusCode != http.StatusTeapot {
+		t.Errorf("%d calls answered %d, want 1 answered by the given transport", transport.calls, resp.StatusCode)
+	}
+	if (&Client{}).plain().Transport != http.DefaultTransport {
+		t.Error("a zero Client doesn't send through http.DefaultTransport")
+	}
+}
+
+// TestFetchThroughTestServer sends a listing page, product details and an
+// image request to a TLS test server through a client built by NewClient
+// around the server's own transport
+func TestFetchThroughTestServer(t *testing.T) {
+	setupTest(t)
+	data := testPNG(t, 4, 4, color.White)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/v1/categories/mobile-phone/search/"):
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"status":200,"data":{"products":[{"id":7},{"id":8}],"pager":{"total_pages":1}}}`))
+		case strings.HasPrefix(r.URL.Path, "/v2/product/"):
+			writeProduct(t, w, productID(r), 2)
+		case strings.HasPrefix(r.URL.Path, "/img/"):
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(data)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	target, _ := url.Parse(server.URL)
+	previous := httpClient
+	httpClient = NewClient(redirectTransport{target: target, next: server.Client().Transport})
+	defer func() { httpClient = previous }()
+	ctx := context.Background()
+
+	page, err := httpClient.fetchCategoryPage(ctx, buildCategoryURL(categoryRootURL, "mobile-phone", 1, QueryOptions{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Data.Products) != 2 || page.Data.Products[1].ID != 8 {
+		t.Errorf("listing = %+v, want products 7 and 8", page.Data.Products)
+	}
+
+	info, err := httpClient.fetchProductDetails(ctx, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Title != "product 7" || len(info.ImageURLs) != 2 {
+		t.Errorf("details = %q with %d images, want product 7 with 2", info.Title, len(info.ImageURLs))
+	}
+
+	image, contentType, err := httpClient.FetchImage(ctx, info.ImageURLs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(image, data) || contentType != "image/png" {
+		t.Errorf("image = %d bytes of %s, want the %d byte PNG", len(image), contentType, len(data))
+	}
+
+	var se *statusError
+	if _, err := httpClient.fetchCategoryPage(ctx, buildCategoryURL(categoryRootURL, "missing", 1, QueryOptions{})); !errors.As(err, &se) || se.StatusCode != http.StatusNotFound {
+		t.Errorf("missing category: err = %v, want a 404 status error", err)
+	}
+
+	var responses int64
+	for _, h := range stats.hostSummaries() {
+		responses += h.Responses
+	}
+	if responses != 4 {
+		t.Errorf("%d responses counted, want 4", responses)
+	}
+}
+
+// TestRedirectLoop follows redirects that come back to where they started:
+// the loop is stopped the first time it repeats a URL, and not retried
+func TestRedirectLoop(t *testing.T) {
+	setupTest(t)
+	cfg.MaxRetries = 3
+	hits := make(map[string]int)
+	serveAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits[r.URL.Path]++
+		switch r.URL.Path {
+		case "/v2/product/1/":
+			http.Redirect(w, r, "/v2/product/1/", http.StatusFound) // To itself
+		case "/v2/product/2/":
+			http.Redirect(w, r, "/moved/2/", http.StatusMovedPermanently)
+		case "/moved/2/":
+			http.Redirect(w, r, "/v2/product/2/", http.StatusFound)
+		}
+	}))
+
+	tests := []struct {
+		id    int
+		hops  int
+		paths []string
+	}{
+		{1, 1, []string{"/v2/product/1/"}},
+		{2, 2, []string{"/v2/product/2/", "/moved/2/"}},
+	}
+	for _, tt := range tests {
+		_, err := httpClient.fetchProductInfoWithRetry(context.Background(), tt.id)
+		var loop *redirectLoopError
+		if !errors.As(err, &loop) {
+			t.Fatalf("product %d: err = %v, want a redirectLoopError", tt.id, err)
+		}
+		if len(loop.Chain) != tt.hops+1 || loop.Chain[0] != loop.Chain[tt.hops] {
+			t.Errorf("product %d: chain %v, want %d hops back to the start", tt.id, loop.Chain, tt.hops)
+		}
+		for _, path := range tt.paths {
+			if hits[path] != 1 {
+				t.Errorf("product %d: %s requested %d times, want once", tt.id, path, hits[path])
+			}
+		}
+	}
+}
+
+func TestCheckRedirectLimit(t *testing.T) {
+	var via []*http.Request
+	for i := 0; i < maxRedirects; i++ {
+		req, _ := http.NewRequest(http.MethodGet, "https://api.digikala.com/hop/"+strings.Repeat("a", i+1), nil)
+		if err := checkRedirect(req, via); err != nil {
+			t.Fatalf("hop %d: %v", i+1, err)
+		}
+		via = append(via, req)
+	}
+	req, _ := http.NewRequest(http.MethodGet, "https://api.digikala.com/last", nil)
+	var loop *redirectLoopError
+	if err := checkRedirect(req, via); !errors.As(err, &loop) || len(loop.Chain) != maxRedirects+1 {
+		t.Errorf("redirect %d: err = %v, want a redirectLoopError of the whole chain", maxRedirects+1, err)
+	}
+	if retryable(loop) {
+		t.Error("a redirect loop is retryable")
+	}
+}
+
+// TestTLSPins connects to a TLS test server with its own key pinned, with
+// another key pinned and with both, as while rotating keys
+func TestTLSPins(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	sum := sha256.Sum256(server.Certificate().RawSubjectPublicKeyInfo)
+	pin := "sha256/" + base64.StdEncoding.EncodeToString(sum[:])
+	other := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+	tests := []struct {
+		name string
+		pins []string
+		want error
+	}{
+		{"matching", []string{pin}, nil},
+		{"other key", []string{other}, errPinMismatch},
+		{"rotating", []string{other, pin}, nil},
+	}
+	for _, tt := range tests {
+		client, err := newHTTPClient(tt.pins)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		// Trust the test server's self-signed certificate, so that only the pin
+		// decides
+		client.plain().Transport.(*http.Transport).TLSClientConfig.RootCAs = server.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+		resp, err := client.plain().Get(server.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestParsePins(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+	tests := []struct {
+		name string
+		pin  string
+		ok   bool
+	}{
+		{"bare", key, true},
+		{"prefixed", "sha256/" + key, true},
+		{"spaced", " sha256/" + key + " ", true},
+		{"empty", "", false},
+		{"not base64", "sha256/not*base64", false},
+		{"too short", base64.StdEncoding.EncodeToString(make([]byte, 20)), false},
+		{"too long", base64.StdEncoding.EncodeToString(make([]byte, 48)), false},
+		{"url encoding", base64.URLEncoding.EncodeToString(bytes.Repeat([]byte{0xfb}, sha256.Size)), false},
+		{"other hash", "sha1/" + key, false},
+	}
+	for _, tt := range tests {
+		hashes, err := parsePins([]string{tt.pin})
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: parsePins(%q) err = %v, want ok %v", tt.name, tt.pin, err, tt.ok)
+			continue
+		}
+		if tt.ok && len(hashes) != 1 {
+			t.Errorf("%s: %d hashes, want 1", tt.name, len(hashes))
+		}
+	}
+}
@@ -0,0 +1,602 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Config holds the settings of a run, filled in from the command line
+type Config struct {
+	PrintConfig     bool
+	Validate        bool
+	Explain         bool
+	ExplainJSON     bool
+	ExplainValidate bool
+	DryRunEstimate  bool
+	EstimateSample  int
+	Debug           bool
+	NoColor         bool
+	LogFile         string
+	AuditLog        string
+	WorkspacePerRun bool
+	Workspace       string
+	KeepRuns        int
+	KeepDays        days
+	RetentionDryRun bool
+	LogRotateSize   byteSize
+	AuditRotateSize byteSize
+	Source          string
+	Category        string
+	CategoryOptions SearchOptions // From a -category URL
+	AuthToken       string
+	AuthTokenFile   string
+	CategoryTree    bool
+	MaxDepth        int
+	FollowLinks     bool
+	SchemaBaseline  string
+	ModifiedSince   date
+	IDRange         idRange
+	IDStep          int
+	Events          bool
+	MaxRetries      int
+	RetryBase       time.Duration
+	RetryCap        time.Duration
+	RetryAfterMax   time.Duration
+	BackoffPause    time.Duration
+	StageRetries    map[string]*retryPolicy // Per-stage overrides; -1 and 0 mean unset
+	Clock           Clock                   // What retries and backoffs wait on, nil for the wall clock
+	QueueSize       int
+	QueueLimit      int
+	DownloadOrder   string
+	DetailWorkers   int
+	DownloadWorkers int
+	CPUWorkers      int
+	RampUp          time.Duration
+	RPS             float64
+	HostRPS         hostRates
+	RetryPriority   string
+	ProductRate     float64
+	PrefetchPages   int
+	EmptyPages      int
+	PageBackoff     bool
+	MaxPageBackoff  time.Duration
+	RetryOnEmpty    bool
+	ResumeFromID    int
+	FailOnEmpty     bool
+
+	FilterAttributes     string
+	FilterAttributesFile string
+
+	MaxFileSize           byteSize
+	MaxFilenameLength     int
+	Checksums             bool
+	StoreSourceURL        bool
+	MaxMemory             byteSize
+	OrderedExports        bool
+	DedupSizes            string
+	SortedOutput          bool
+	IDPadWidth            int
+	IntegritySample       float64
+	IntegrityWarn         float64
+	ReorderWindow         int
+	MaxPerProduct         int
+	URLRewrite            string
+	ImageMirrors          stringList
+	DedupeStrategy        string
+	ImageDedup            string
+	OutputSymlinks        bool
+	DetectDuplicates      bool
+	DuplicateReport       string
+	ReportBroken          bool
+	BrokenReport          string
+	Manifest              string
+	ParallelManifest      bool
+	StagingDir            string
+	ManifestBatchSize     int
+	ManifestFlushInterval time.Duration
+	Durability            string
+	Tags                  tags
+	TrustManifest         bool
+	SkipIndexed           bool
+	Checkpoint            string
+	CheckpointEvery       int
+	CheckpointInterval    time.Duration
+	MaxAge                days
+	MaxProductAge         days
+	MinDiscount           int
+	MinDimensions         dimensions
+	AllowFormats          stringList
+	ListingFields         stringList
+	NoDetailFetch         bool
+	NoPreflight           bool
+	ExtraFields           stringList
+	MinQuality            float64
+	VerifyImageFormat     bool
+	NSFWAPI               string
+	NSFWThreshold         float64
+
+	ContactSheets       bool
+	ContactSheetColumns int
+	ContactSheetSingle  bool
+
+	TLSPins stringList
+
+	ShutdownTimeout time.Duration
+	DiskFullPoll    time.Duration
+	DiskFullWait    time.Duration
+
+	Watchlist        string
+	WatchInterval    time.Duration
+	ServerAddr       string
+	PriceDropPercent float64
+	PriceHistory     string
+	Feed             string
+	FeedSize         int
+	AlertWebhook     string
+	TelegramToken    string
+	TelegramChatID   string
+
+	Sinks             stringList
+	MinIOEndpoint     string
+	MinIOAccessKey    string
+	MinIOSecretKey    string
+	MinIOBucket       string
+	MinIOUseSSL       bool
+	MinIOCreateBucket bool
+
+	RespectCacheControl bool
+	TUI                 bool
+}
+
+// clone returns a copy of c that shares no slice or map with it, so that
+// setting a repeatable flag on one doesn't append to the other. StageRetries
+// is left shared; see scrapeServer.configure.
+func (c Config) clone() Config {
+	c.ImageMirrors = slices.Clone(c.ImageMirrors)
+	c.AllowFormats = slices.Clone(c.AllowFormats)
+	c.ListingFields = slices.Clone(c.ListingFields)
+	c.ExtraFields = slices.Clone(c.ExtraFields)
+	c.TLSPins = slices.Clone(c.TLSPins)
+	c.Sinks = slices.Clone(c.Sinks)
+	c.HostRPS = maps.Clone(c.HostRPS)
+	c.Tags = maps.Clone(c.Tags)
+	c.CategoryOptions.Ignored = slices.Clone(c.CategoryOptions.Ignored)
+	if c.CategoryOptions.Filters != nil {
+		filters := make(searchFilters, len(c.CategoryOptions.Filters))
+		for key, values := range c.CategoryOptions.Filters {
+			filters[key] = slices.Clone(values)
+		}
+		c.CategoryOptions.Filters = filters
+	}
+	return c
+}
+
+// cfg is the configuration of the current run
+var cfg Config
+
+// parseFlags fills cfg from the command line arguments args
+func parseFlags(args []string) {
+	flag.BoolVar(&cfg.PrintConfig, "print-config", false, "print the effective settings and exit")
+	flag.BoolVar(&cfg.Validate, "validate", false, "check the settings and that the output paths are writable, print any problems and exit 1 if there are some; makes no network calls (validate-config also checks the API)")
+	flag.BoolVar(&cfg.Explain, "explain", false, "print the effective settings with where each comes from, the first URLs, filters, limits and outputs of the run, and exit without any request")
+	flag.BoolVar(&cfg.ExplainJSON, "explain-json", false, "explain, as JSON")
+	flag.BoolVar(&cfg.ExplainValidate, "explain-validate", false, "explain, and request the first listing page to check it works")
+	flag.BoolVar(&cfg.DryRunEstimate, "dry-run-estimate", false, "list the products, look at the images of a sample of them and print how many images, bytes and how long a run would take, without downloading")
+	flag.IntVar(&cfg.EstimateSample, "estimate-sample", 50, "dry-run-estimate: how many products to fetch the details and image sizes of")
+	flag.BoolVar(&cfg.Debug, "debug", false, "also print per-image progress and raw error details")
+	flag.BoolVar(&cfg.NoColor, "no-color", false, "never colorize output (NO_COLOR is honored as well)")
+	flag.StringVar(&cfg.LogFile, "log-file", "", "also append the log to this file, e.g. digigo.log (turns off colors)")
+	flag.BoolVar(&cfg.WorkspacePerRun, "workspace-per-run", false, "give each run a folder of its own, img/runs/<start time> with img/runs/latest linking to the newest, holding its manifest, duplicate report and log unless those flags are given; images stay shared in img (not in watch or server mode)")
+	flag.StringVar(&cfg.Workspace, "workspace", "", "reopen this run folder of -workspace-per-run instead of creating one, e.g. img/runs/latest to resume the last run")
+	flag.IntVar(&cfg.KeepRuns, "keep-runs", 0, "workspace-per-run: after a run that was not interrupted, remove the workspaces beyond the newest N, never the current or latest one (0 keeps all)")
+	flag.Var(&cfg.KeepDays, "keep-days", "workspace-per-run: like -keep-runs, remove the workspaces started longer ago than this, e.g. 30d (0 keeps all)")
+	flag.BoolVar(&cfg.RetentionDryRun, "retention-dry-run", false, "only log which workspaces -keep-runs and -keep-days would remove")
+	flag.StringVar(&cfg.AuditLog, "audit-log", "", "append a line for every HTTP request to this file, e.g. requests.log: time, method, URL with secrets redacted, status, bytes, duration, retry attempt and worker")
+	cfg.LogRotateSize = 100 << 20
+	flag.Var(&cfg.LogRotateSize, "log-rotate-size", "move -log-file to FILE.1 and start a new one once it reaches this size (0 never rotates)")
+	cfg.AuditRotateSize = 100 << 20
+	flag.Var(&cfg.AuditRotateSize, "audit-log-rotate-size", "like -log-rotate-size, for -audit-log")
+	flag.StringVar(&cfg.Source, "source", sourceCategory, "where products come from: category, wishlist (needs -auth-token), sitemap or id-range")
+	flag.Var(&cfg.IDRange, "id-range", "probe the product IDs FROM-TO, e.g. 14000000-14001000; implies -source id-range")
+	flag.IntVar(&cfg.IDStep, "id-step", 1, "id-range: only probe every Nth ID of the range")
+	flag.Var(&cfg.ModifiedSince, "modified-since", "sitemap: only products changed on or after this date, e.g. 2024-01-01")
+	flag.StringVar(&cfg.AuthToken, "auth-token", os.Getenv("DIGIKALA_TOKEN"), "access token of a logged-in Digikala session, for member endpoints (default $DIGIKALA_TOKEN)")
+	flag.StringVar(&cfg.AuthTokenFile, "auth-token-file", "", "read -auth-token from this file; when the API rejects it, the wishlist crawl pauses the run until another token is saved there, then goes on")
+	flag.StringVar(&cfg.Category, "category", "", "slug of the category to scrape, e.g. kids-apparel, or the address of its page copied from the browser (asked interactively on a terminal)")
+	flag.BoolVar(&cfg.CategoryTree, "category-tree", false, "also scrape subcategories recursively, each into its own folder")
+	flag.IntVar(&cfg.MaxDepth, "max-depth", 2, "how many subcategory levels -category-tree descends")
+	flag.StringVar(&cfg.SchemaBaseline, "schema-baseline", filepath.Join(imageDir, ".schema-baseline.json"), "file the API response shapes are compared against to spot API changes; delete it to accept the current shape, empty to skip")
+	flag.BoolVar(&cfg.FollowLinks, "follow-subcategory-links", false, "also crawl the categories that scraped products belong to, as they are discovered")
+	flag.BoolVar(&cfg.Events, "events", false, "write one JSON event per line to stdout and human output to stderr")
+	flag.StringVar(&cfg.FilterAttributes, "filter-attributes", "", "only list products matching these attributes, e.g. color:red,size:XL")
+	flag.StringVar(&cfg.FilterAttributesFile, "filter-attributes-file", "", "file of attribute:value filters, one or more per line")
+	flag.BoolVar(&cfg.FailOnEmpty, "fail-on-empty", false, "exit with status 5 when no product was discovered, which usually means a wrong category or a blocked client")
+	flag.IntVar(&cfg.ResumeFromID, "resume-from-id", 0, "skip products whose ID is below this, for restarting an interrupted run by hand")
+	flag.Var(&cfg.MaxProductAge, "max-product-age", "skip products first listed on Digikala longer ago than this, e.g. 365d (0 keeps all; products without a date are kept)")
+	flag.IntVar(&cfg.MinDiscount, "min-discount", 0, "only scrape products discounted by at least this percentage, 0 to 100; asked of the search API and checked again on each product's details")
+	flag.IntVar(&cfg.MaxPerProduct, "max-concurrent-per-product", 0, "most images of one product queued or downloading at once, so a large gallery doesn't take every download worker from the products next to it (0 means no cap)")
+	flag.IntVar(&cfg.QueueSize, "queue-size", 50, "how many discovered products, and separately how many images, may wait for a free worker")
+	flag.IntVar(&cfg.QueueLimit, "queue-limit", 1000, "most products between being discovered and finished, queued or in progress, so a fast crawl stops listing pages instead of filling memory (0 means no limit)")
+	flag.StringVar(&cfg.DownloadOrder, "download-order", orderFIFO, "order waiting products are processed in: fifo, lifo, id-desc (newest first) or id-asc")
+	flag.IntVar(&cfg.DetailWorkers, "detail-workers", concurrentLimit, "how many product details are fetched at once")
+	flag.IntVar(&cfg.DownloadWorkers, "download-workers", concurrentLimit, "how many images are downloaded at once")
+	flag.IntVar(&cfg.CPUWorkers, "cpu-workers", runtime.NumCPU(), "how many downloaded images are processed at once (-min-quality-score decoding), apart from -download-workers")
+	flag.DurationVar(&cfg.RampUp, "ramp-up", 0, "start the -detail-workers and -download-workers one by one, spread evenly over this long, e.g. 10s, so the request rate climbs to its limit instead of opening with a burst (0 starts them all at once)")
+	flag.IntVar(&cfg.PrefetchPages, "prefetch-pages", 1, "how many listing pages to fetch ahead while earlier products download")
+	flag.IntVar(&cfg.EmptyPages, "empty-page-tolerance", 1, "how many empty listing pages in a row end a category, so a page that briefly comes back empty doesn't end it early; failed pages don't count")
+	flag.BoolVar(&cfg.PageBackoff, "exponential-page-backoff", false, "after an empty listing page that doesn't end the category yet (see -empty-page-tolerance), wait 2s before the next page, doubling the wait for every further empty page; a page with products resets it")
+	flag.DurationVar(&cfg.MaxPageBackoff, "max-page-backoff", time.Minute, "longest wait of -exponential-page-backoff")
+	flag.Float64Var(&cfg.RPS, "rps", 0, "most HTTP requests per second across all workers (0 means unlimited)")
+	flag.Var(&cfg.HostRPS, "rps-host", "most requests per second to one host, as host=rate, e.g. dkstatics-public.digikala.com=20; repeatable, other hosts share -rps")
+	flag.StringVar(&cfg.RetryPriority, "retry-priority", priorityFIFO, "how retried requests queue for -rps: fifo, low (behind fresh requests, easing load during outages) or high (ahead of them)")
+	flag.Float64Var(&cfg.ProductRate, "products-per-second", 0, "most products queued per second, counting each product once however many requests it needs (0 means unlimited)")
+	flag.IntVar(&cfg.MaxRetries, "max-retries", 3, "how many times a failed request is retried, unless its stage sets its own count")
+	flag.DurationVar(&cfg.RetryBase, "retry-base", time.Second, "wait before the first retry, doubled on every further retry")
+	flag.DurationVar(&cfg.RetryCap, "retry-cap", 30*time.Second, "longest wait between retries")
+	flag.DurationVar(&cfg.BackoffPause, "backoff-pause", 30*time.Second, "when the server answers 429 or 403, pause every request this long, or as long as its Retry-After says, then probe with one request before resuming; each refused probe doubles the pause up to -retry-after-max (0 lets each worker retry on its own)")
+	flag.DurationVar(&cfg.RetryAfterMax, "retry-after-max", 5*time.Minute, "longest Retry-After the server may ask for; a longer one fails the request instead of stalling the run")
+	cfg.StageRetries = make(map[string]*retryPolicy)
+	for _, stage := range []string{stageSearch, stageDetails, stageDownload} {
+		p := &retryPolicy{Stage: stage}
+		cfg.StageRetries[stage] = p
+		flag.IntVar(&p.MaxRetries, "retry-"+stage, -1, "retries for "+stage+" requests (default -max-retries)")
+		flag.DurationVar(&p.BaseDelay, "retry-"+stage+"-base", 0, "first retry wait for "+stage+" requests (default -retry-base)")
+		flag.DurationVar(&p.MaxDelay, "retry-"+stage+"-cap", 0, "longest retry wait for "+stage+" requests (default -retry-cap)")
+	}
+	flag.BoolVar(&cfg.RetryOnEmpty, "retry-on-empty", false, "retry product details that come back without images before treating the product as imageless")
+	flag.Var(&cfg.MaxFileSize, "max-file-size", "skip images larger than this, e.g. 5MB (0 means no limit)")
+	flag.IntVar(&cfg.MaxFilenameLength, "max-filename-length", 255, "longest image filename in bytes; longer names are shortened and given a hash suffix")
+	flag.Var(&cfg.ImageMirrors, "image-mirrors", "comma-separated image hosts serving the same paths, e.g. dkstatics-public.digikala.com,dkstatics-public-2.digikala.com; an image on one of them that keeps failing is tried on the others")
+	flag.StringVar(&cfg.URLRewrite, "image-url-rewriter-pattern", "", "sed-style substitution applied to image URLs before downloading, e.g. s/800x600/1200x900/g")
+	flag.Float64Var(&cfg.IntegritySample, "integrity-sample", 0, "share of downloaded images, e.g. 0.01, fetched a second time (from another -image-mirrors host when there is one) to check the CDN serves the same bytes; both hashes go to the manifest")
+	flag.Float64Var(&cfg.IntegrityWarn, "integrity-warn-rate", 0.01, "share of -integrity-sample images coming back different above which the run warns that deduplication by content may be unreliable")
+	flag.BoolVar(&cfg.SortedOutput, "sorted-output", false, "zero-pad the product ID and image number in image names, e.g. product_00012345_img_01.jpg, so they sort in numeric order")
+	flag.IntVar(&cfg.IDPadWidth, "id-pad-width", 0, "digits product IDs are padded to with -sorted-output; 0 takes the length of the largest ID on the first listing page, or 8")
+	flag.StringVar(&cfg.DedupSizes, "dedup-across-sizes", "", "download one size of each photo a product lists more than once, telling variants apart by their URL without its resize parameters: largest, smallest, or the size closest to a number of pixels")
+	flag.BoolVar(&cfg.OrderedExports, "ordered-exports", false, "emit product_done events in the order products were discovered (page, then position on the page) rather than as they finish, and without their time, so identical runs give identical product_done streams")
+	flag.IntVar(&cfg.ReorderWindow, "reorder-window", 100, "with -ordered-exports, how many finished products may wait for an earlier one before it is passed over and emitted late, marked \"late\"")
+	flag.Var(&cfg.MaxMemory, "max-memory", "keep the heap under this size, e.g. 2GB: over it garbage is collected and, if that is not enough, the duplicate index is dropped (0 means no limit)")
+	flag.BoolVar(&cfg.StoreSourceURL, "store-source-url", false, "record the URL of every downloaded image in its user.xdg.origin.url extended attribute, or in a .url file next to it where the filesystem has no extended attributes")
+	flag.BoolVar(&cfg.Checksums, "checksums", false, "write a sha256sum-style .sha256 file next to every downloaded image")
+	flag.StringVar(&cfg.Manifest, "manifest", filepath.Join(imageDir, "manifest.jsonl"), "JSON lines file describing every saved image (empty to disable)")
+	flag.StringVar(&cfg.StagingDir, "staging-dir", "", "folder images are written to while they download, e.g. on a fast local disk (default next to each image); on another filesystem finished images are copied over")
+	flag.BoolVar(&cfg.ParallelManifest, "parallel-manifest-writes", false, "write manifest entries from a separate goroutine in batches, so download workers never wait on the file")
+	flag.IntVar(&cfg.ManifestBatchSize, "manifest-batch-size", 50, "parallel-manifest-writes: entries written at once; durability batch: entries written between syncs")
+	flag.DurationVar(&cfg.ManifestFlushInterval, "manifest-flush-interval", 5*time.Second, "parallel-manifest-writes: longest an entry waits before it is written; durability batch: longest it waits to be synced")
+	flag.StringVar(&cfg.Durability, "durability", durabilityNone, "when manifest entries are synced to disk, so a power loss cannot lose them: none (left to the system), batch or always (after every write, every batch with -parallel-manifest-writes)")
+	flag.Var(&cfg.Tags, "tag", "key=value label recorded with every manifest entry and in the summary, e.g. run=daily (repeatable)")
+	flag.BoolVar(&cfg.SkipIndexed, "skip-indexed", false, "skip products the manifest has every image of, before fetching their details; checked after -resume-from-id and before any per-image reuse")
+	flag.StringVar(&cfg.Checkpoint, "checkpoint", "", "JSON file listing the products finished with every image, which later runs skip before fetching their details (empty to disable)")
+	flag.IntVar(&cfg.CheckpointEvery, "checkpoint-every", 100, "checkpoint: finished products written at once")
+	flag.DurationVar(&cfg.CheckpointInterval, "checkpoint-interval", 5*time.Second, "checkpoint: longest a finished product waits before it is written")
+	flag.Var(&cfg.MaxAge, "max-age", "skip-indexed: crawl products again once their manifest record is this old, e.g. 30d or 12h (0 never)")
+	flag.BoolVar(&cfg.TrustManifest, "trust-manifest", false, "skip images the manifest lists whose file is still there with the recorded hash, without any request")
+	flag.BoolVar(&cfg.NoPreflight, "no-preflight", false, "start without first requesting page 1 of the category (or the wishlist, or the first -id-range product) to check that it exists")
+	flag.BoolVar(&cfg.NoDetailFetch, "no-detail-fetch", false, "download only the main image a listing page gives each product, usually a thumbnail, without fetching product details (category and wishlist sources)")
+	flag.Var(&cfg.ExtraFields, "product-extra-fields", "also record these fields of the product details in the manifest, as dot paths into the product JSON with * for every element, e.g. seller.id,specifications.*.value")
+	flag.Var(&cfg.ListingFields, "listing-fields", "keep these product fields from listing pages, e.g. title,price,rating, in the product_discovered events, without waiting for the details (category and wishlist sources)")
+	flag.Var(&cfg.AllowFormats, "allow-format", "only keep images of these formats, e.g. jpeg,png (of jpeg, png, gif and webp; default all)")
+	flag.Float64Var(&cfg.MinQuality, "min-quality-score", 0, "skip images whose sharpness scores below this, from 0 to 1, e.g. 0.1 drops blurry and blank images (0 scores nothing)")
+	flag.Var(&cfg.MinDimensions, "min-dimensions", "skip images smaller than WIDTHxHEIGHT, e.g. 400x400")
+	flag.StringVar(&cfg.NSFWAPI, "nsfw-api", "", "classification service each image is POSTed to, e.g. http://localhost:5001/classify; images it flags as NSFW are skipped")
+	flag.Float64Var(&cfg.NSFWThreshold, "nsfw-threshold", 0.9, "lowest -nsfw-api confidence at which an NSFW image is skipped")
+	flag.BoolVar(&cfg.VerifyImageFormat, "verify-image-format", false, "decode every downloaded image in full and discard the ones that fail, such as truncated files")
+	flag.BoolVar(&cfg.ContactSheets, "contact-sheets", false, "save a grid of each product's images with a caption to img/sheets/<product>.jpg")
+	flag.IntVar(&cfg.ContactSheetColumns, "contact-sheet-columns", 4, "images per row of a contact sheet")
+	flag.BoolVar(&cfg.ContactSheetSingle, "contact-sheet-single", false, "also make contact sheets for products with a single image")
+	flag.BoolVar(&cfg.DetectDuplicates, "detect-duplicate-products-by-metadata", false, "after the run, report products with the same normalized brand and title, likely re-listings, to -duplicate-report")
+	flag.StringVar(&cfg.DuplicateReport, "duplicate-report", filepath.Join(imageDir, "duplicate-products.json"), "JSON file the duplicate product groups are written to")
+	flag.BoolVar(&cfg.ReportBroken, "report-broken", false, "after the run, list the image URLs that are gone for good (404, 410 or content no decoder can read) with their products in -broken-report")
+	flag.StringVar(&cfg.BrokenReport, "broken-report", filepath.Join(imageDir, "broken-urls.json"), "JSON file the broken image URLs are written to")
+	flag.BoolVar(&cfg.OutputSymlinks, "output-symlinks", false, "store each image once under img/blobs, named by its SHA-256, and link the product's image path to it (hard links on Windows)")
+	flag.StringVar(&cfg.DedupeStrategy, "dedupe-strategy", "", "store images identical to one saved earlier as a hardlink, symlink or manifest reference, falling back in that order (empty keeps every copy)")
+	flag.StringVar(&cfg.ImageDedup, "image-dedup-strategy", dedupNone, "what makes an image a duplicate, each checking the ones before it first: none, url (saved from the same URL, not fetched again), sha256 (identical content) or phash (looks the same); duplicates are stored as -dedupe-strategy says, a manifest reference by default")
+	flag.Var(&cfg.TLSPins, "tls-pin", "only trust servers whose public key has this base64 SHA-256 pin; repeat or comma-separate for rotation")
+	flag.DurationVar(&cfg.DiskFullPoll, "disk-full-poll", 30*time.Second, "while paused for a full disk, how often to check whether space was freed")
+	flag.DurationVar(&cfg.DiskFullWait, "disk-full-wait", 30*time.Minute, "how long to stay paused for a full disk before exiting with status 3")
+	flag.DurationVar(&cfg.ShutdownTimeout, "graceful-shutdown-timeout", 30*time.Second, "after Ctrl-C or SIGTERM, how long to wait for running workers before exiting anyway")
+	flag.StringVar(&cfg.Watchlist, "watchlist", "", "watch: file of product IDs, each optionally followed by a target price, e.g. 12345 1500000 toman")
+	flag.StringVar(&cfg.ServerAddr, "server-addr", ":8081", "server: address the scrape API listens on; it runs one job at a time and answers POST /scrape with 409 Conflict while one runs")
+	flag.DurationVar(&cfg.WatchInterval, "watch-interval", time.Hour, "watch: time between price checks (0 checks once and exits)")
+	flag.Float64Var(&cfg.PriceDropPercent, "price-drop-percent", 0, "watch: also alert when a price falls by at least this percent since the last check (0 disables)")
+	flag.StringVar(&cfg.PriceHistory, "price-history", filepath.Join(imageDir, ".price-history.json"), "watch: file the last observed prices are kept in")
+	flag.StringVar(&cfg.Feed, "feed", filepath.Join(imageDir, "feed.xml"), "watch: Atom feed of products seen for the first time (empty for none)")
+	flag.IntVar(&cfg.FeedSize, "feed-size", 50, "watch: how many of the newest products the feed keeps")
+	flag.StringVar(&cfg.AlertWebhook, "alert-webhook", "", "URL alerts are POSTed to as JSON: price drops in watch mode, a full disk otherwise")
+	flag.StringVar(&cfg.TelegramToken, "telegram-token", "", "Telegram bot token alerts are sent with: price drops in watch mode, a full disk otherwise")
+	flag.StringVar(&cfg.TelegramChatID, "telegram-chat-id", "", "watch: Telegram chat price alerts are sent to")
+	flag.Var(&cfg.Sinks, "sinks", "where images end up: local, minio or both, comma-separated (default local)")
+	flag.StringVar(&cfg.MinIOEndpoint, "minio-endpoint", "", "host:port of the MinIO server for the minio sink")
+	flag.StringVar(&cfg.MinIOAccessKey, "minio-access-key", os.Getenv("MINIO_ACCESS_KEY"), "MinIO access key (default $MINIO_ACCESS_KEY)")
+	flag.StringVar(&cfg.MinIOSecretKey, "minio-secret-key", os.Getenv("MINIO_SECRET_KEY"), "MinIO secret key (default $MINIO_SECRET_KEY)")
+	flag.StringVar(&cfg.MinIOBucket, "minio-bucket", "", "bucket the minio sink uploads to")
+	flag.BoolVar(&cfg.MinIOUseSSL, "minio-use-ssl", true, "connect to MinIO over HTTPS")
+	flag.BoolVar(&cfg.MinIOCreateBucket, "minio-create-bucket", false, "create -minio-bucket if it does not exist")
+	flag.BoolVar(&cfg.RespectCacheControl, "http-cache-control-respect", false, "skip downloading saved images whose Cache-Control max-age has not expired yet")
+	flag.BoolVar(&cfg.TUI, "tui", false, "show a full-screen dashboard (p pause/resume, +/- workers, q quit)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+		flag.PrintDefaults()
+		printExitCodes(flag.CommandLine.Output())
+	}
+	flag.CommandLine.Parse(args)
+
+	if err := cfg.resolveCategory(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitUsage)
+	}
+
+	// -id-range is enough to pick its source
+	if cfg.IDRange.To > 0 && !isFlagSet("source") {
+		cfg.Source = sourceIDRange
+	}
+}
+
+// isFlagSet reports whether the flag name was given on the command line
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// printConfig writes every setting and the resolved retry policies to w
+func printConfig(w io.Writer) {
+	flag.VisitAll(func(f *flag.Flag) {
+		fmt.Fprintf(w, "%s=%s\n", f.Name, f.Value)
+	})
+	fmt.Fprintln(w, "retry policies:")
+	for _, stage := range []string{stageSearch, stageDetails, stageDownload} {
+		fmt.Fprintf(w, "  %s\n", cfg.retryPolicy(stage))
+	}
+}
+
+// commandLineWith returns the command line of this run with -name value
+// added, quoted so it can be pasted into a POSIX shell
+func commandLineWith(name, value string) string {
+	args := append([]string{os.Args[0]}, os.Args[1:]...)
+	args = append(args, "-"+name, value)
+	for i, arg := range args {
+		if arg == "" || strings.ContainsFunc(arg, func(r rune) bool {
+			return !(r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("-_./=:,@%+", r)))
+		}) {
+			args[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+		}
+	}
+	return strings.Join(args, " ")
+}
+
+// byteSize is a size in bytes that can be given with a unit, e.g. 512KB or
+// 5MB. Units are powers of 1024.
+type byteSize int64
+
+// byteUnits lists the accepted units, longest suffix first
+var byteUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"G", 1 << 30},
+	{"M", 1 << 20},
+	{"K", 1 << 10},
+	{"B", 1},
+}
+
+// String implements flag.Value
+func (b byteSize) String() string {
+	for _, unit := range byteUnits[:3] {
+		if b >= byteSize(unit.size) && int64(b)%unit.size == 0 {
+			return strconv.FormatInt(int64(b)/unit.size, 10) + unit.suffix
+		}
+	}
+	return strconv.FormatInt(int64(b), 10) + "B"
+}
+
+// Set implements flag.Value
+func (b *byteSize) Set(s string) error {
+	text := strings.ToUpper(strings.TrimSpace(s))
+	multiplier := int64(1)
+	for _, unit := range byteUnits {
+		if strings.HasSuffix(text, unit.suffix) {
+			text, multiplier = strings.TrimSpace(strings.TrimSuffix(text, unit.suffix)), unit.size
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(text, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q: want a number with an optional unit, e.g. 5MB", s)
+	}
+	*b = byteSize(n * float64(multiplier))
+	return nil
+}
+
+// stringList is a flag that can be repeated; each use may also hold a
+// comma-separated list
+type stringList []string
+
+// String implements flag.Value
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+// Set implements flag.Value
+func (l *stringList) Set(s string) error {
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// hostRates are per-host request rates, given as host=rate with a
+// repeatable flag
+type hostRates map[string]float64
+
+// String implements flag.Value
+func (h *hostRates) String() string {
+	hosts := make([]string, 0, len(*h))
+	for host := range *h {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for i, host := range hosts {
+		hosts[i] = host + "=" + strconv.FormatFloat((*h)[host], 'g', -1, 64)
+	}
+	return strings.Join(hosts, ",")
+}
+
+// Set implements flag.Value. A host given again replaces its earlier rate.
+func (h *hostRates) Set(s string) error {
+	host, value, ok := strings.Cut(s, "=")
+	host = strings.ToLower(strings.TrimSpace(host))
+	rate, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if !ok || host == "" || err != nil || rate < 0 {
+		return fmt.Errorf("invalid host rate %q: want host=requests per second, e.g. api.digikala.com=2", s)
+	}
+	// Copied rather than updated in place, so a copy of the Config keeps its rates
+	m := make(hostRates, len(*h)+1)
+	for k, v := range *h {
+		m[k] = v
+	}
+	m[host] = rate
+	*h = m
+	return nil
+}
+
+// tags are key=value labels of a run, given with a repeatable flag
+type tags map[string]string
+
+// String implements flag.Value
+func (t *tags) String() string {
+	keys := make([]string, 0, len(*t))
+	for key := range *t {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for i, key := range keys {
+		keys[i] = key + "=" + (*t)[key]
+	}
+	return strings.Join(keys, ",")
+}
+
+// Set implements flag.Value. A key given again replaces its earlier value.
+func (t *tags) Set(s string) error {
+	key, value, ok := strings.Cut(s, "=")
+	key = strings.TrimSpace(key)
+	if !ok || key == "" {
+		return fmt.Errorf("invalid tag %q: want key=value, e.g. run=daily", s)
+	}
+	// Copied rather than updated in place, so a copy of the Config keeps its tags
+	m := make(tags, len(*t)+1)
+	for k, v := range *t {
+		m[k] = v
+	}
+	m[key] = strings.TrimSpace(value)
+	*t = m
+	return nil
+}
+
+// days is a duration that may also be given in days, e.g. 30d
+type days time.Duration
+
+// String implements flag.Value
+func (d *days) String() string {
+	if *d != 0 && time.Duration(*d)%(24*time.Hour) == 0 {
+		return fmt.Sprintf("%dd", time.Duration(*d)/(24*time.Hour))
+	}
+	return time.Duration(*d).String()
+}
+
+// Set implements flag.Value
+func (d *days) Set(s string) error {
+	s = strings.TrimSpace(s)
+	if n, ok := strings.CutSuffix(s, "d"); ok {
+		count, err := strconv.Atoi(n)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q: want e.g. 30d or 12h", s)
+		}
+		*d = days(time.Duration(count) * 24 * time.Hour)
+		return nil
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q: want e.g. 30d or 12h", s)
+	}
+	*d = days(v)
+	return nil
+}
+
+// date is a calendar day given as YYYY-MM-DD, zero when unset
+type date struct {
+	time.Time
+}
+
+// String implements flag.Value
+func (d *date) String() string {
+	if d.IsZero() {
+		return ""
+	}
+	return d.Format(time.DateOnly)
+}
+
+// Set implements flag.Value
+func (d *date) Set(s string) error {
+	t, err := time.Parse(time.DateOnly, strings.TrimSpace(s))
+	if err != nil {
+		return fmt.Errorf("invalid date %q: want YYYY-MM-DD, e.g. 2024-01-01", s)
+	}
+	d.Time = t
+	return nil
+}
+
+// dimensions is a minimum image size given as WIDTHxHEIGHT
+type dimensions struct {
+	Width, Height int
+}
+
+// String implements flag.Value
+func (d *dimensions) String() string {
+	if d.Width == 0 && d.Height == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%dx%d", d.Width, d.Height)
+}
+
+// Set implements flag.Value
+func (d *dimensions) Set(s string) error {
+	w, h, ok := strings.Cut(strings.ToLower(strings.TrimSpace(s)), "x")
+	width, errW := strconv.Atoi(w)
+	height, errH := strconv.Atoi(h)
+	if !ok || errW != nil || errH != nil || width < 0 || height < 0 {
+		return fmt.Errorf("invalid dimensions %q: want WIDTHxHEIGHT, e.g. 400x400", s)
+	}
+	d.Width, d.Height = width, height
+	return nil
+}
+
+// allows reports whether an image of the given size meets d. Images whose
+// size is unknown (zero) are allowed.
+func (d dimensions) allows(width, height int) bool {
+	if width == 0 && height == 0 {
+		return true
+	}
+	return width >= d.Width && height >= d.Height
+}
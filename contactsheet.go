@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"strings"
+
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// Contact sheet layout
+const (
+	sheetCell    = 200 // Width and height of every image cell in pixels
+	sheetGap     = 4   // Space around cells
+	sheetCaption = 24  // Height of the caption strip
+	sheetDir     = "sheets"
+)
+
+// writeContactSheet composes the images at paths into a grid with a caption
+// strip and saves it as sheets/<product>.jpg below imageDir. Images that
+// can't be decoded leave their cell empty.
+func writeContactSheet(productID int, title string, paths []string, columns int) (string, error) {
+	columns = max(1, min(columns, len(paths)))
+	rows := (len(paths) + columns - 1) / columns
+	width := columns*(sheetCell+sheetGap) + sheetGap
+	height := sheetCaption + rows*(sheetCell+sheetGap) + sheetGap
+
+	sheet := image.NewRGBA(image.Rect(0, 0, width, height))
+	xdraw.Draw(sheet, sheet.Bounds(), image.White, image.Point{}, xdraw.Src)
+	xdraw.Draw(sheet, image.Rect(0, 0, width, sheetCaption), image.NewUniform(color.Gray{Y: 40}), image.Point{}, xdraw.Src)
+	drawer := font.Drawer{
+		Dst:  sheet,
+		Src:  image.White,
+		Face: basicfont.Face7x13,
+		Dot:  fixed.P(sheetGap, sheetCaption-8),
+	}
+	drawer.DrawString(sheetCaptionText(productID, title, (width-2*sheetGap)/basicfont.Face7x13.Advance))
+
+	for i, path := range paths {
+		img, err := decodeImageFile(path)
+		if err != nil {
+			debugLog.Printf("contact sheet %d: %v", productID, err)
+			continue
+		}
+		x := sheetGap + (i%columns)*(sheetCell+sheetGap)
+		y := sheetCaption + sheetGap + (i/columns)*(sheetCell+sheetGap)
+		xdraw.ApproxBiLinear.Scale(sheet, fitRect(img.Bounds(), image.Rect(x, y, x+sheetCell, y+sheetCell)), img, img.Bounds(), xdraw.Over, nil)
+	}
+
+	dir := filepath.Join(imageDir, sheetDir)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return "", fmt.Errorf("failed to create directory: %w", err)
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%d.jpg", productID))
+	file, err := os.Create(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to create contact sheet: %w", err)
+	}
+	err = jpeg.Encode(file, sheet, &jpeg.Options{Quality: 85})
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to save contact sheet: %w", err)
+	}
+	return path, nil
+}
+
+// sheetCaptionText returns the caption of a sheet cut to maxChars. The
+// built-in font only covers Latin text, so other characters are left out.
+func sheetCaptionText(productID int, title string, maxChars int) string {
+	title = strings.Join(strings.Fields(strings.Map(func(r rune) rune {
+		if r < ' ' || r > '~' {
+			return ' '
+		}
+		return r
+	}, title)), " ")
+	caption := fmt.Sprintf("product %d", productID)
+	if title != "" {
+		caption += "  " + title
+	}
+	if len(caption) > maxChars {
+		caption = caption[:max(0, maxChars-3)] + "..."
+	}
+	return caption
+}
+
+// fitRect returns the largest rectangle with the aspect ratio of src that
+// fits centered in cell
+func fitRect(src, cell image.Rectangle) image.Rectangle {
+	w, h := cell.Dx(), cell.Dy()
+	if src.Dx()*h > src.Dy()*w {
+		h = max(1, src.Dy()*w/src.Dx())
+	} else {
+		w = max(1, src.Dx()*h/max(1, src.Dy()))
+	}
+	origin := cell.Min.Add(image.Pt((cell.Dx()-w)/2, (cell.Dy()-h)/2))
+	return image.Rectangle{Min: origin, Max: origin.Add(image.Pt(w, h))}
+}
+
+// decodeImageFile decodes the whole image file at path
+func decodeImageFile(path string) (image.Image, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", path, err)
+	}
+	return img, nil
+}
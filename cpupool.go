@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"runtime"
+)
+
+// cpuPool runs the CPU-heavy work on downloaded images, decoding every
+// pixel for -min-quality-score, so that -download-workers sizes the
+// network concurrency and -cpu-workers the processing concurrency
+var cpuPool = newCPUPool(runtime.NumCPU())
+
+// cpuSlots bounds how many image jobs run at once; the download worker that
+// hands one over waits for its result
+type cpuSlots struct {
+	slots chan struct{}
+}
+
+func newCPUPool(size int) *cpuSlots {
+	return &cpuSlots{slots: make(chan struct{}, max(1, size))}
+}
+
+// run calls fn once a slot is free, or returns ctx.Err() if ctx is done first
+func (p *cpuSlots) run(ctx context.Context, fn func()) error {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-p.slots }()
+	fn()
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCPUPoolBounds(t *testing.T) {
+	p := newCPUPool(2)
+	var mu sync.Mutex
+	running, most := 0, 0
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.run(context.Background(), func() {
+				mu.Lock()
+				running++
+				most = max(most, running)
+				mu.Unlock()
+				time.Sleep(5 * time.Millisecond)
+				mu.Lock()
+				running--
+				mu.Unlock()
+			})
+		}()
+	}
+	wg.Wait()
+	if most != 2 {
+		t.Errorf("%d jobs ran at once, want 2", most)
+	}
+
+	// A job waiting for a slot gives up with its context
+	hold := make(chan struct{})
+	go p.run(context.Background(), func() { <-hold })
+	go p.run(context.Background(), func() { <-hold })
+	defer close(hold)
+	waitFor(t, func() bool { return len(p.slots) == 2 })
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	ran := false
+	if err := p.run(ctx, func() { ran = true }); err != context.DeadlineExceeded || ran {
+		t.Errorf("run on a full pool = %v, ran %v; want DeadlineExceeded without running", err, ran)
+	}
+	if newCPUPool(0).run(context.Background(), func() {}) != nil {
+		t.Error("a pool of size 0 has no slot")
+	}
+}
+
+// imageWork stands for one image: a network wait, then hashing that keeps a
+// CPU busy, like -min-quality-score decoding every pixel
+func imageWork(pool *cpuSlots) {
+	time.Sleep(time.Millisecond)
+	work := func() {
+		sum := sha256.Sum256(nil)
+		for i := 0; i < 2000; i++ {
+			sum = sha256.Sum256(sum[:])
+		}
+	}
+	if pool == nil {
+		work()
+		return
+	}
+	pool.run(context.Background(), work)
+}
+
+// BenchmarkImageWorkers compares image throughput with the processing
+// coupled to the downloads, one worker count for both as before
+// -cpu-workers, with many download workers handing the processing to a pool
+// of one slot per CPU
+func BenchmarkImageWorkers(b *testing.B) {
+	cpus := runtime.NumCPU()
+	run := func(b *testing.B, workers int, pool *cpuSlots) {
+		images := make(chan struct{})
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for range images {
+					imageWork(pool)
+				}
+			}()
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			images <- struct{}{}
+		}
+		close(images)
+		wg.Wait()
+	}
+	b.Run("coupled", func(b *testing.B) { run(b, cpus, nil) })
+	b.Run("decoupled", func(b *testing.B) { run(b, 8*cpus, newCPUPool(cpus)) })
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// errNotJSON is returned for API responses whose body isn't JSON
+var errNotJSON = errors.New("response is not JSON")
+
+// warnedContentTypes holds the mismatching content types already warned about
+var warnedContentTypes sync.Map
+
+// decodeJSON decodes the JSON body of resp into v. Misconfigured proxies
+// sometimes label JSON as text/plain, so the body itself decides: anything
+// starting with { or [ is decoded, whatever the Content-Type says.
+func decodeJSON(resp *http.Response, v any) error {
+	body := bufio.NewReader(resp.Body)
+	first, err := firstNonSpace(body)
+	if err != nil {
+		return err
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if first != '{' && first != '[' {
+		return fmt.Errorf("%w (Content-Type %q, starts with %q)", errNotJSON, contentType, first)
+	}
+	if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType != "application/json" {
+		if _, warned := warnedContentTypes.LoadOrStore(contentType, true); !warned {
+			slog.Warn("API response is JSON despite its Content-Type", "content_type", contentType, "url", resp.Request.URL.String())
+		}
+	}
+	return json.NewDecoder(body).Decode(v)
+}
+
+// firstNonSpace returns the first byte of r that isn't JSON whitespace
+// without consuming it
+func firstNonSpace(r *bufio.Reader) (byte, error) {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if b != ' ' && b != '\t' && b != '\r' && b != '\n' {
+			return b, r.UnreadByte()
+		}
+	}
+}
+
+// decodedBody returns the body of resp with its Content-Encoding undone. The
+// transport only decompresses gzip it asked for itself, but some CDNs
+// compress images unasked, and deflate is never decompressed for us. HTTP
+// deflate is meant to be zlib-wrapped; raw deflate streams are accepted too.
+func decodedBody(resp *http.Response) (io.Reader, error) {
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	switch encoding {
+	case "", "identity":
+		return resp.Body, nil
+	case "gzip", "x-gzip":
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress gzip body: %w", err)
+		}
+		return gz, nil
+	case "deflate":
+		body := bufio.NewReader(resp.Body)
+		header, err := body.Peek(2)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress deflate body: %w", err)
+		}
+		// A zlib header is a multiple of 31 when read as a big-endian number
+		if header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+			zr, err := zlib.NewReader(body)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decompress deflate body: %w", err)
+			}
+			return zr, nil
+		}
+		return flate.NewReader(body), nil
+	}
+	return nil, fmt.Errorf("unsupported Content-Encoding %q", encoding)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"image/color"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// compress encodes data as encoding, one of gzip, zlib and flate
+func compress(t *testing.T, encoding string, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "zlib":
+		w = zlib.NewWriter(&buf)
+	case "flate":
+		w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+	}
+	w.Write(data)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// TestDownloadEncodedImage serves an image compressed with each encoding a
+// CDN may use unasked and checks the image, not its compressed form, is
+// saved
+func TestDownloadEncodedImage(t *testing.T) {
+	setupTest(t)
+	data := testPNG(t, 32, 32, color.RGBA{R: 200, A: 255})
+	bodies := map[string]struct {
+		encoding string
+		body     []byte
+	}{
+		"/plain.png":  {"", data},
+		"/gzip.png":   {"gzip", compress(t, "gzip", data)},
+		"/x-gzip.png": {"x-gzip", compress(t, "gzip", data)},
+		"/zlib.png":   {"deflate", compress(t, "zlib", data)},
+		"/raw.png":    {"deflate", compress(t, "flate", data)},
+		"/brotli.png": {"br", data},
+	}
+	serveAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b := bodies[r.URL.Path]
+		w.Header().Set("Content-Type", "image/png")
+		if b.encoding != "" {
+			w.Header().Set("Content-Encoding", b.encoding)
+		}
+		w.Write(b.body)
+	}))
+
+	for path, b := range bodies {
+		filename := filepath.Base(path)
+		_, err := httpClient.downloadFromMirrors(context.Background(), "https://dkstatics-public.digikala.com"+path, imageDir, filename)
+		if b.encoding == "br" {
+			if err == nil {
+				t.Errorf("%s: saved a body of unsupported encoding", path)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", path, err)
+			continue
+		}
+		saved, err := os.ReadFile(filepath.Join(imageDir, filename))
+		if err != nil {
+			t.Errorf("%s: %v", path, err)
+			continue
+		}
+		if !bytes.Equal(saved, data) {
+			t.Errorf("%s: saved %d bytes that are not the image", path, len(saved))
+		}
+	}
+}
+
+func TestDecodedBodyCorrupt(t *testing.T) {
+	for _, encoding := range []string{"gzip", "deflate"} {
+		resp := &http.Response{Header: http.Header{"Content-Encoding": {encoding}}, Body: io.NopCloser(bytes.NewReader(nil))}
+		if _, err := decodedBody(resp); err == nil {
+			t.Errorf("%s: empty body decoded without an error", encoding)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sync"
+)
+
+// How an image is stored on disk, as recorded in the manifest
+const (
+	storageFile      = "file"      // A regular file with its own content
+	storageHardlink  = "hardlink"  // A hard link to an identical image
+	storageSymlink   = "symlink"   // A relative symbolic link to an identical image
+	storageReference = "reference" // No file; the manifest names the identical image
+)
+
+// dedupeStrategies are the accepted -dedupe-strategy values, each falling
+// back to the ones after it when it can't be used
+var dedupeStrategies = []string{storageHardlink, storageSymlink, storageReference}
+
+// Values of -image-dedup-strategy, what makes an image a duplicate; each
+// also checks what the ones before it do, cheapest first
+const (
+	dedupNone   = "none"
+	dedupURL    = "url"    // Its URL was saved before
+	dedupSHA256 = "sha256" // Identical content was saved before
+	dedupPHash  = "phash"  // Content that looks the same was saved before
+)
+
+// imageDedupStrategies lists the accepted -image-dedup-strategy values,
+// cheapest first
+var imageDedupStrategies = []string{dedupNone, dedupURL, dedupSHA256, dedupPHash}
+
+// phashDistance is how many of the 64 bits of their perceptual hashes two
+// images may differ in and still be taken for the same picture
+const phashDistance = 6
+
+// dedupChecks reports whether duplicates by strategy are looked for.
+// -dedupe-strategy alone looks for identical content, as it always has.
+func dedupChecks(strategy string) bool {
+	level := slices.Index(imageDedupStrategies, cfg.ImageDedup)
+	if cfg.DedupeStrategy != "" {
+		level = max(level, slices.Index(imageDedupStrategies, dedupSHA256))
+	}
+	return level >= slices.Index(imageDedupStrategies, strategy)
+}
+
+// dedupStorage is how duplicates are stored: as -dedupe-strategy says, or
+// else only as a manifest reference
+func dedupStorage() string {
+	if cfg.DedupeStrategy == "" {
+		return storageReference
+	}
+	return cfg.DedupeStrategy
+}
+
+// dedupe knows where each image was saved first; nil unless -dedupe-strategy
+// or -image-dedup-strategy is set
+var dedupe *dedupeIndex
+
+type dedupeIndex struct {
+	mu      sync.Mutex
+	paths   map[string]string // SHA-256 to path
+	urls    map[string]string // Image URL to path
+	phashes []phashPath
+}
+
+// phashPath is the perceptual hash of a saved image
+type phashPath struct {
+	hash uint64
+	path string
+}
+
+func newDedupeIndex() *dedupeIndex {
+	return &dedupeIndex{paths: make(map[string]string), urls: make(map[string]string)}
+}
+
+// savedURL returns the path the image at url was already saved to, when it
+// was to another path than path, or ""; it always returns "" on a nil
+// *dedupeIndex
+func (d *dedupeIndex) savedURL(url, path string) string {
+	if d == nil {
+		return ""
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if original := d.urls[url]; original != path {
+		return original
+	}
+	return ""
+}
+
+// recordURL records that the image at url is saved at path, unless an
+// earlier path is known; it is a no-op on a nil *dedupeIndex
+func (d *dedupeIndex) recordURL(url, path string) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.urls[url]; !ok {
+		d.urls[url] = path
+	}
+}
+
+// shed forgets every image known so far to free memory and returns how many
+// entries it dropped; images seen again are then saved again rather than
+// linked. It is a no-op on a nil *dedupeIndex.
+func (d *dedupeIndex) shed() int {
+	if d == nil {
+		return 0
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := len(d.paths) + len(d.urls) + len(d.phashes)
+	d.paths, d.urls, d.phashes = make(map[string]string), make(map[string]string), nil
+	return n
+}
+
+// similar returns the path of an image saved earlier whose perceptual hash
+// is within phashDistance of hash, or ""; it always returns "" on a nil
+// *dedupeIndex. Hashes are compared one by one, which is fast enough for the
+// images of a run.
+func (d *dedupeIndex) similar(hash uint64, path string) string {
+	if d == nil {
+		return ""
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, p := range d.phashes {
+		if p.path != path && bits.OnesCount64(p.hash^hash) <= phashDistance {
+			return p.path
+		}
+	}
+	return ""
+}
+
+// original returns the path already holding the content with hash sum, or
+// ""; it always returns "" on a nil *dedupeIndex
+func (d *dedupeIndex) original(sum, path string) string {
+	if d == nil {
+		return ""
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if original, ok := d.paths[sum]; ok && original != path {
+		return original
+	}
+	return ""
+}
+
+// record makes path, which must already hold the image, the original of its
+// content with hash sum and, when hashed, of its perceptual hash. Images
+// recorded first stay the originals: two copies that were downloading at
+// once are both kept. It is a no-op on a nil *dedupeIndex.
+func (d *dedupeIndex) record(sum string, hash uint64, hashed bool, path string) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.paths[sum]; !ok {
+		d.paths[sum] = path
+	}
+	if hashed {
+		d.phashes = append(d.phashes, phashPath{hash: hash, path: path})
+	}
+}
+
+// hardLink creates hard links; tests replace it to fail like a link across
+// filesystems
+var hardLink = os.Link
+
+// linkDuplicate makes path stand for the identical image at original using
+// strategy, falling back to the later strategies when it fails (hard links
+// don't cross filesystems, symlinks may need privileges on Windows), and
+// returns the one used
+func linkDuplicate(original, path, strategy string) string {
+	for _, s := range dedupeStrategies[slices.Index(dedupeStrategies, strategy):] {
+		var err error
+		switch s {
+		case storageHardlink:
+			err = replaceWithLink(path, func(tmp string) error { return hardLink(original, tmp) })
+		case storageSymlink:
+			target, relErr := filepath.Rel(filepath.Dir(path), original)
+			if relErr != nil {
+				target = original
+			}
+			err = replaceWithLink(path, func(tmp string) error { return os.Symlink(target, tmp) })
+		case storageReference:
+			// Drop a copy left by an earlier run so the path doesn't go stale
+			if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				debugLog.Printf("dedupe %s: %v", path, err)
+			}
+			return storageReference
+		}
+		if err == nil {
+			return s
+		}
+		debugLog.Printf("dedupe %s: %s failed, falling back: %v", path, s, err)
+	}
+	return storageReference
+}
+
+// replaceWithLink creates a link next to path with create and moves it over
+// path, so an existing file is only replaced once the link exists
+func replaceWithLink(path string, create func(tmp string) error) error {
+	tmp := path + ".link"
+	os.Remove(tmp)
+	if err := create(tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// blobDir holds the images of -output-symlinks, each named by its SHA-256
+const blobDir = "blobs"
+
+// storeBlob moves the image at tmpPath, whose SHA-256 is sum, to its
+// content-addressed path under blobDir and returns that path. An image
+// already stored there is kept and tmpPath is dropped instead.
+func storeBlob(tmpPath, sum, ext string) (string, error) {
+	dir := filepath.Join(imageDir, blobDir)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return "", fmt.Errorf("failed to create directory: %w", err)
+	}
+	blob := filepath.Join(dir, sum+ext)
+	if _, err := os.Stat(blob); err == nil {
+		stats.Duplicates.Add(1)
+		os.Remove(tmpPath)
+		return blob, nil
+	}
+	if err := moveFile(tmpPath, blob); err != nil {
+		return "", fmt.Errorf("failed to save image: %w", err)
+	}
+	return blob, nil
+}
+
+// blobLinkStrategy is how -output-symlinks links an image to its blob:
+// symlinks need privileges on Windows, so hard links are used there
+func blobLinkStrategy() string {
+	if runtime.GOOS == "windows" {
+		return storageHardlink
+	}
+	return storageSymlink
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image/color"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+// TestDedupeFailedSaveIsNotOriginal checks that an image that never reached
+// its path isn't linked to by a later identical one
+func TestDedupeFailedSaveIsNotOriginal(t *testing.T) {
+	setupTest(t)
+	cfg.DedupeStrategy = storageSymlink
+	dedupe = newDedupeIndex()
+	data := testPNG(t, 8, 8, color.White)
+	serveAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write(data) }))
+
+	// A non-empty directory in the way makes the rename fail
+	if err := os.MkdirAll(filepath.Join(imageDir, "a.png", "x"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := httpClient.downloadImage(context.Background(), "https://dkstatics-public.digikala.com/a.png", imageDir, "a.png"); err == nil {
+		t.Fatal("saving over a directory succeeded")
+	}
+	entry, err := httpClient.downloadImage(context.Background(), "https://dkstatics-public.digikala.com/b.png", imageDir, "b.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Storage != "" && entry.Storage != storageFile {
+		t.Errorf("second image stored as %s, want a file of its own", entry.Storage)
+	}
+	got, err := os.ReadFile(filepath.Join(imageDir, "b.png"))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("second image unreadable: %v", err)
+	}
+}
+
+// TestDedupeConcurrentIdenticalImages downloads the same content to many
+// paths at once; every path must end up readable
+func TestDedupeConcurrentIdenticalImages(t *testing.T) {
+	setupTest(t)
+	cfg.DedupeStrategy = storageSymlink
+	dedupe = newDedupeIndex()
+	data := testPNG(t, 8, 8, color.Black)
+	serveAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write(data) }))
+
+	const n = 16
+	var wg sync.WaitGroup
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("%d.png", i)
+			_, errs[i] = httpClient.downloadImage(context.Background(), "https://dkstatics-public.digikala.com/"+name, imageDir, name)
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("image %d: %v", i, err)
+		}
+		got, err := os.ReadFile(filepath.Join(imageDir, fmt.Sprintf("%d.png", i)))
+		if err != nil {
+			t.Fatalf("image %d: %v", i, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("image %d has other content", i)
+		}
+	}
+}
+
+func TestLinkDuplicateCrossDevice(t *testing.T) {
+	dir := setupTest(t)
+	defer func(link func(string, string) error) { hardLink = link }(hardLink)
+	hardLink = func(oldname, newname string) error {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: syscall.EXDEV}
+	}
+	original, path := filepath.Join(dir, "original.png"), filepath.Join(dir, "copy.png")
+	if err := os.WriteFile(original, []byte("image"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("image"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := linkDuplicate(original, path, storageHardlink); got != storageSymlink {
+		t.Fatalf("storage = %s, want the symlink fallback", got)
+	}
+	if target, err := os.Readlink(path); err != nil || target != "original.png" {
+		t.Errorf("link target = %q, %v; want original.png", target, err)
+	}
+	if _, err := os.Stat(path + ".link"); !os.IsNotExist(err) {
+		t.Errorf("temporary link left behind: %v", err)
+	}
+}
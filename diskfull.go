@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// diskProbeSize is how much must be writable again before a paused run resumes
+const diskProbeSize = 1 << 20
+
+// errDiskFull ends a run whose disk stayed full for -disk-full-wait
+var errDiskFull = errors.New("the disk stayed full")
+
+// isDiskFull reports whether err comes from a full disk
+func isDiskFull(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
+
+// diskGuard pauses the run while the image folder's disk is full; nil when
+// no run is going on
+var diskGuard *diskWatch
+
+// diskWatch pauses the run when the disk fills up, polls until space is
+// freed and then resumes it, or ends the run after a while
+type diskWatch struct {
+	dir    string
+	poll   time.Duration
+	limit  time.Duration
+	cancel context.CancelCauseFunc // Ends the run when the disk stays full
+
+	mu      sync.Mutex
+	resumed chan struct{} // Non-nil while full, closed once space is back
+}
+
+func newDiskWatch(dir string, poll, limit time.Duration, cancel context.CancelCauseFunc) *diskWatch {
+	return &diskWatch{dir: dir, poll: poll, limit: limit, cancel: cancel}
+}
+
+// wait blocks while the disk is full and reports whether there is space
+// again. The first caller pauses the run, alerts the user and polls; the
+// others just wait for its outcome.
+func (w *diskWatch) wait(ctx context.Context) bool {
+	w.mu.Lock()
+	resumed := w.resumed
+	if resumed == nil {
+		resumed = make(chan struct{})
+		w.resumed = resumed
+		go w.watch(ctx, resumed)
+	}
+	w.mu.Unlock()
+	select {
+	case <-resumed:
+		return ctx.Err() == nil
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// watch pauses the run until space is freed, the wait runs out or ctx is done
+func (w *diskWatch) watch(ctx context.Context, resumed chan struct{}) {
+	defer func() {
+		w.mu.Lock()
+		w.resumed = nil
+		w.mu.Unlock()
+		close(resumed)
+	}()
+	if !pause.paused() {
+		pause.toggle()
+	}
+	message := fmt.Sprintf("The disk holding %s is full; downloads are paused until space is freed (giving up after %s).", w.dir, w.limit)
+	slog.Error("DISK FULL: " + message)
+	reportError(newErrorEvent("disk", errors.New(message)))
+	for _, n := range configuredNotifiers() {
+		if err := n.notifyMessage(ctx, "digigo: "+message); err != nil {
+			slog.Warn("Failed to send disk full alert", "reason", err)
+		}
+	}
+
+	start := time.Now()
+	ticker := time.NewTicker(w.poll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if hasSpace(w.dir) {
+			slog.Info("Disk space is available again, resuming", "paused", time.Since(start).Round(time.Second))
+			pause.release()
+			return
+		}
+		if time.Since(start) >= w.limit {
+			slog.Error("Giving up, the disk is still full", "waited", w.limit)
+			w.cancel(fmt.Errorf("%w for %s", errDiskFull, w.limit))
+			pause.release() // Lets the workers see the cancelled context
+			return
+		}
+		debugLog.Printf("disk still full, checking again in %s", w.poll)
+	}
+}
+
+// hasSpace reports whether diskProbeSize bytes can be written to dir
+func hasSpace(dir string) bool {
+	probe := filepath.Join(dir, ".disk-probe")
+	defer os.Remove(probe)
+	file, err := os.Create(probe)
+	if err != nil {
+		return false
+	}
+	_, err = file.Write(make([]byte, diskProbeSize))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err == nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// OverwritePolicy says what DownloadProduct does with an image already at
+// its path
+type OverwritePolicy int
+
+const (
+	OverwriteNever  OverwritePolicy = iota // Keep it and don't download the image
+	OverwriteAlways                        // Download the image again
+)
+
+// DownloadOption changes what Client.DownloadProduct downloads
+type DownloadOption func(*downloadOptions)
+
+type downloadOptions struct {
+	maxImages int
+	mainOnly  bool
+	rendition string
+	overwrite OverwritePolicy
+}
+
+// WithMaxImages downloads at most n images, the main image first; 0 means
+// all of them
+func WithMaxImages(n int) DownloadOption {
+	return func(o *downloadOptions) { o.maxImages = n }
+}
+
+// WithMainOnly downloads only the main image, leaving out the gallery
+func WithMainOnly() DownloadOption {
+	return func(o *downloadOptions) { o.mainOnly = true }
+}
+
+// WithRendition downloads one size of each photo listed in several: largest,
+// smallest, or the size closest to a number of pixels, as -dedup-across-sizes
+func WithRendition(size string) DownloadOption {
+	return func(o *downloadOptions) { o.rendition = size }
+}
+
+// WithOverwrite sets what happens to images already on disk; the default is
+// OverwriteNever
+func WithOverwrite(policy OverwritePolicy) DownloadOption {
+	return func(o *downloadOptions) { o.overwrite = policy }
+}
+
+// ProductResult is what Client.DownloadProduct did with a product
+type ProductResult struct {
+	ID     int           `json:"id"`
+	Title  string        `json:"title"`
+	Images []ImageResult `json:"images"`
+}
+
+// ImageResult is the outcome of one image of a ProductResult
+type ImageResult struct {
+	URL     string `json:"url"`
+	Path    string `json:"path,omitempty"`    // Where the image is on disk, "" if it is not
+	Skipped bool   `json:"skipped,omitempty"` // Already on disk and kept
+	Err     error  `json:"-"`
+}
+
+// MarshalJSON implements json.Marshaler, adding the error as a string
+func (r ImageResult) MarshalJSON() ([]byte, error) {
+	type plain ImageResult
+	v := struct {
+		plain
+		Error string `json:"error,omitempty"`
+	}{plain: plain(r)}
+	if r.Err != nil {
+		v.Error = r.Err.Error()
+	}
+	return json.Marshal(v)
+}
+
+// Failed returns how many images of r could not be downloaded
+func (r ProductResult) Failed() int {
+	n := 0
+	for _, image := range r.Images {
+		if image.Err != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// DownloadProduct fetches the details of product id and downloads its images
+// to dest, named as a run names them. The error is for the product as a
+// whole; images that fail have their error in the result instead.
+func (c *Client) DownloadProduct(ctx context.Context, id int, dest string, opts ...DownloadOption) (ProductResult, error) {
+	var o downloadOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	result := ProductResult{ID: id}
+	if err := validateSizePreference(o.rendition); err != nil {
+		return result, err
+	}
+	info, err := c.fetchProductInfo(ctx, id)
+	if err != nil && !errors.Is(err, errNoImages) {
+		return result, err
+	}
+	result.Title = info.Title
+
+	urls := info.ImageURLs
+	if o.mainOnly {
+		urls = urls[:info.Main]
+	}
+	if o.rendition != "" {
+		urls, _ = dedupSizes(urls, o.rendition)
+	}
+	if o.maxImages > 0 && len(urls) > o.maxImages {
+		urls = urls[:o.maxImages]
+	}
+	for i, url := range urls {
+		filename := sanitizeFilename(imageFilename(id, i+1, len(urls)), cfg.MaxFilenameLength)
+		image := ImageResult{URL: url, Path: filepath.Join(dest, filename)}
+		if _, err := os.Stat(image.Path); err == nil && o.overwrite == OverwriteNever {
+			image.Skipped = true
+		} else if _, err := c.downloadFromMirrors(ctx, url, dest, filename); err != nil {
+			image.Path, image.Err = "", err
+		}
+		result.Images = append(result.Images, image)
+	}
+	return result, nil
+}
+
+// productCommand is the product subcommand, which downloads one product with
+// Client.DownloadProduct and prints its ProductResult as JSON
+type productCommand struct {
+	id        int
+	dest      string
+	maxImages int
+	mainOnly  bool
+	rendition string
+	overwrite bool
+}
+
+// parse reads the subcommand's own flags and product ID from args and
+// returns the arguments after them, the flags of a run
+func (c *productCommand) parse(args []string) ([]string, error) {
+	fs := flag.NewFlagSet("product", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: digi product [flags] ID [run flags]")
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&c.dest, "dest", imageDir, "folder the images are saved to")
+	fs.IntVar(&c.maxImages, "max-images", 0, "download at most this many images, the main image first (0 means all)")
+	fs.BoolVar(&c.mainOnly, "main-only", false, "download only the main image")
+	fs.StringVar(&c.rendition, "rendition", "", "download one size of each photo listed in several: largest, smallest or the size closest to a number of pixels")
+	fs.BoolVar(&c.overwrite, "overwrite", false, "download images already in -dest again instead of keeping them")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return nil, errors.New("missing product ID")
+	}
+	id, err := strconv.Atoi(fs.Arg(0))
+	if err != nil || id <= 0 {
+		return nil, fmt.Errorf("invalid product ID %q", fs.Arg(0))
+	}
+	c.id = id
+	return fs.Args()[1:], nil
+}
+
+// run downloads the product and writes the result to out, returning the
+// exit code
+func (c *productCommand) run(ctx context.Context, out io.Writer) int {
+	opts := []DownloadOption{WithMaxImages(c.maxImages), WithRendition(c.rendition)}
+	if c.mainOnly {
+		opts = append(opts, WithMainOnly())
+	}
+	if c.overwrite {
+		opts = append(opts, WithOverwrite(OverwriteAlways))
+	}
+	result, err := httpClient.DownloadProduct(ctx, c.id, c.dest, opts...)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(result); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	if result.Failed() > 0 {
+		return exitPartial
+	}
+	return exitOK
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// galleryProduct is the details response of a product whose main image is
+// listed in two sizes, followed by a gallery of two images, the second of
+// them gone
+const galleryProduct = `{"status":200,"data":{"product":{"title_fa":"Gallery","images":{
+	"main":{"url":["https://dkstatics-public.digikala.com/main.jpg?x-oss-process=image/resize,w_200","https://dkstatics-public.digikala.com/main.jpg?x-oss-process=image/resize,w_800"]},
+	"list":[{"url":["https://dkstatics-public.digikala.com/a.jpg"]},{"url":["https://dkstatics-public.digikala.com/gone.jpg"]}]}}}}`
+
+// galleryAPI serves galleryProduct and its images, counting the image requests
+func galleryAPI(data []byte, images *atomic.Int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/v2/product/"):
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(galleryProduct))
+		case r.URL.Path == "/gone.jpg":
+			images.Add(1)
+			http.NotFound(w, r)
+		default:
+			images.Add(1)
+			w.Write(data)
+		}
+	})
+}
+
+func TestDownloadProduct(t *testing.T) {
+	tests := []struct {
+		name       string
+		opts       []DownloadOption
+		wantURLs   []string // Base names with the query
+		wantFailed int
+	}{
+		{"all", nil, []string{"main.jpg?x-oss-process=image/resize,w_200", "main.jpg?x-oss-process=image/resize,w_800", "a.jpg", "gone.jpg"}, 1},
+		{"main only", []DownloadOption{WithMainOnly()}, []string{"main.jpg?x-oss-process=image/resize,w_200", "main.jpg?x-oss-process=image/resize,w_800"}, 0},
+		{"largest rendition", []DownloadOption{WithMainOnly(), WithRendition(sizeLargest)}, []string{"main.jpg?x-oss-process=image/resize,w_800"}, 0},
+		{"max images", []DownloadOption{WithRendition(sizeSmallest), WithMaxImages(2)}, []string{"main.jpg?x-oss-process=image/resize,w_200", "a.jpg"}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTest(t)
+			var requests atomic.Int64
+			serveAPI(t, galleryAPI(testPNG(t, 4, 4, color.White), &requests))
+
+			result, err := httpClient.DownloadProduct(context.Background(), 1, "out", tt.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Title != "Gallery" {
+				t.Errorf("title = %q", result.Title)
+			}
+			var urls []string
+			for _, image := range result.Images {
+				urls = append(urls, strings.TrimPrefix(image.URL, "https://dkstatics-public.digikala.com/"))
+				if image.Err == nil {
+					if _, err := os.Stat(image.Path); err != nil {
+						t.Errorf("image %s: %v", image.URL, err)
+					}
+				}
+			}
+			if strings.Join(urls, " ") != strings.Join(tt.wantURLs, " ") {
+				t.Errorf("downloaded %v, want %v", urls, tt.wantURLs)
+			}
+			if got := result.Failed(); got != tt.wantFailed {
+				t.Errorf("%d images failed, want %d", got, tt.wantFailed)
+			}
+		})
+	}
+}
+
+func TestDownloadProductOverwrite(t *testing.T) {
+	setupTest(t)
+	var requests atomic.Int64
+	serveAPI(t, galleryAPI(testPNG(t, 4, 4, color.White), &requests))
+	opts := []DownloadOption{WithMainOnly(), WithRendition(sizeLargest)}
+
+	if _, err := httpClient.DownloadProduct(context.Background(), 1, "out", opts...); err != nil {
+		t.Fatal(err)
+	}
+	result, err := httpClient.DownloadProduct(context.Background(), 1, "out", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests.Load() != 1 || !result.Images[0].Skipped {
+		t.Errorf("second download made %d image requests in all, skipped %v; want the saved image kept", requests.Load(), result.Images[0].Skipped)
+	}
+	result, err = httpClient.DownloadProduct(context.Background(), 1, "out", append(opts, WithOverwrite(OverwriteAlways))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests.Load() != 2 || result.Images[0].Skipped {
+		t.Errorf("overwriting made %d image requests in all, skipped %v; want the image downloaded again", requests.Load(), result.Images[0].Skipped)
+	}
+}
+
+func ExampleClient_DownloadProduct() {
+	useDefaults()
+	// A stand-in for the API, reached by every request
+	var requests atomic.Int64
+	server := httptest.NewServer(galleryAPI([]byte("image"), &requests))
+	defer server.Close()
+	target, _ := url.Parse(server.URL)
+	client := NewClient(redirectTransport{target: target, next: http.DefaultTransport})
+	dest, _ := os.MkdirTemp("", "digi-example")
+	defer os.RemoveAll(dest)
+
+	result, err := client.DownloadProduct(context.Background(), 1, dest, WithMaxImages(3), WithRendition("largest"))
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	for _, image := range result.Images {
+		if image.Err != nil {
+			fmt.Println("failed:", image.URL)
+		} else {
+			fmt.Println("saved:", filepath.Base(image.Path))
+		}
+	}
+	out, _ := json.Marshal(result.Images[2])
+	fmt.Println(strings.Contains(string(out), `"error":`))
+	// Output:
+	// saved: product_1_img_1.jpg
+	// saved: product_1_img_2.jpg
+	// failed: https://dkstatics-public.digikala.com/gone.jpg
+	// true
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// productRecord is the metadata of a product kept for the duplicate report
+type productRecord struct {
+	ID    int    `json:"id"`
+	Title string `json:"title"`
+	Brand string `json:"brand,omitempty"`
+}
+
+// duplicateGroup is a set of products that look like the same item
+type duplicateGroup struct {
+	Key      string          `json:"key"`
+	Products []productRecord `json:"products"`
+}
+
+// productCatalog collects the products of the run when
+// -detect-duplicate-products-by-metadata is set, and is nil otherwise
+var productCatalog *catalog
+
+// catalog is a concurrency-safe list of product records
+type catalog struct {
+	mu       sync.Mutex
+	products []productRecord
+}
+
+// add records a product; it is a no-op on a nil *catalog
+func (c *catalog) add(p productRecord) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.products = append(c.products, p)
+}
+
+// duplicateKey returns the brand and title of a product normalized so that
+// re-listings of one item compare equal: case, punctuation, Arabic letter
+// variants, digit scripts and spacing are ignored
+func duplicateKey(p productRecord) string {
+	normalize := func(s string) string {
+		s = strings.Map(func(r rune) rune {
+			switch {
+			case r == 'ي' || r == 'ى':
+				return 'ی'
+			case r == 'ك':
+				return 'ک'
+			case r >= '۰' && r <= '۹':
+				return '0' + r - '۰'
+			case r >= '٠' && r <= '٩':
+				return '0' + r - '٠'
+			case unicode.IsLetter(r) || unicode.IsDigit(r):
+				return unicode.ToLower(r)
+			}
+			return ' '
+		}, s)
+		return strings.Join(strings.Fields(s), " ")
+	}
+	return normalize(p.Brand) + "|" + normalize(p.Title)
+}
+
+// groupDuplicates returns the groups of products sharing a duplicate key,
+// largest first; products without a title are never grouped
+func groupDuplicates(products []productRecord) []duplicateGroup {
+	byKey := make(map[string][]productRecord)
+	for _, p := range products {
+		key := duplicateKey(p)
+		if strings.HasSuffix(key, "|") {
+			continue
+		}
+		byKey[key] = append(byKey[key], p)
+	}
+	var groups []duplicateGroup
+	for key, members := range byKey {
+		if len(members) < 2 {
+			continue
+		}
+		sort.Slice(members, func(i, j int) bool { return members[i].ID < members[j].ID })
+		groups = append(groups, duplicateGroup{Key: key, Products: members})
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if len(groups[i].Products) != len(groups[j].Products) {
+			return len(groups[i].Products) > len(groups[j].Products)
+		}
+		return groups[i].Key < groups[j].Key
+	})
+	return groups
+}
+
+// writeDuplicateReport groups the catalogued products and writes the groups
+// to path as JSON. It only reports; nothing is deleted.
+func writeDuplicateReport(path string, c *catalog) (int, error) {
+	c.mu.Lock()
+	groups := groupDuplicates(c.products)
+	c.mu.Unlock()
+	if groups == nil {
+		groups = []duplicateGroup{}
+	}
+	data, err := json.MarshalIndent(groups, "", "  ")
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode duplicate report: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return 0, fmt.Errorf("failed to create report directory: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return 0, fmt.Errorf("failed to write duplicate report: %w", err)
+	}
+	return len(groups), nil
+}
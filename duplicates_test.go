@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+func TestGroupDuplicates(t *testing.T) {
+	products := []productRecord{
+		{ID: 9, Title: "گوشی موبایل سامسونگ A54", Brand: "Samsung"},
+		{ID: 3, Title: "گوشي موبايل  سامسونگ a54", Brand: "samsung"}, // Arabic ya, case, spacing
+		{ID: 5, Title: "گوشی موبایل سامسونگ A۵۴", Brand: "SAMSUNG"},  // Persian digits
+		{ID: 4, Title: "کتاب کودک", Brand: "نشر"},
+		{ID: 7, Title: "كتاب كودك!", Brand: "نشر"}, // Arabic kaf, punctuation
+		{ID: 8, Title: "کتاب کودک", Brand: "دیگر"}, // Same title, other brand
+		{ID: 1, Title: "", Brand: "Samsung"},
+		{ID: 2, Title: "  ", Brand: "Samsung"},
+		{ID: 6, Title: "Unique item"},
+	}
+	groups := groupDuplicates(products)
+	if len(groups) != 2 {
+		t.Fatalf("got %d groups %+v, want 2", len(groups), groups)
+	}
+	want := [][]int{{3, 5, 9}, {4, 7}}
+	for i, group := range groups {
+		var ids []int
+		for _, p := range group.Products {
+			ids = append(ids, p.ID)
+		}
+		if len(ids) != len(want[i]) {
+			t.Errorf("group %d (%s) = %v, want %v", i, group.Key, ids, want[i])
+			continue
+		}
+		for j := range ids {
+			if ids[j] != want[i][j] {
+				t.Errorf("group %d (%s) = %v, want %v", i, group.Key, ids, want[i])
+				break
+			}
+		}
+	}
+	if groups[0].Key != "samsung|گوشی موبایل سامسونگ a54" {
+		t.Errorf("key = %q", groups[0].Key)
+	}
+}
+
+func TestWriteDuplicateReport(t *testing.T) {
+	setupTest(t)
+	c := &catalog{}
+	c.add(productRecord{ID: 1, Title: "A"})
+	c.add(productRecord{ID: 2, Title: "B"})
+	n, err := writeDuplicateReport("reports/duplicates.json", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile("reports/duplicates.json")
+	if n != 0 || string(data) != "[]" {
+		t.Errorf("%d groups written as %s, want an empty list", n, data)
+	}
+
+	c.add(productRecord{ID: 3, Title: "a"})
+	if n, err = writeDuplicateReport("reports/duplicates.json", c); err != nil {
+		t.Fatal(err)
+	}
+	var groups []duplicateGroup
+	data, _ = os.ReadFile("reports/duplicates.json")
+	if err := json.Unmarshal(data, &groups); err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || len(groups) != 1 || len(groups[0].Products) != 2 {
+		t.Errorf("%d groups written as %s, want products 1 and 3", n, data)
+	}
+
+	var none *catalog
+	none.add(productRecord{ID: 1}) // No-op without -detect-duplicate-products-by-metadata
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// errTooLarge is returned for images skipped because of -max-file-size
+var errTooLarge = errors.New("image exceeds -max-file-size")
+
+// errTooSmall is returned for images skipped because of -min-dimensions
+var errTooSmall = errors.New("image is below -min-dimensions")
+
+// errFormatNotAllowed is returned for images skipped because of -allow-format
+var errFormatNotAllowed = errors.New("image format is not in -allow-format")
+
+// errLowQuality is returned for images skipped because of -min-quality-score
+var errLowQuality = errors.New("image is below -min-quality-score")
+
+// errCorruptImage is returned for images -verify-image-format can't decode
+var errCorruptImage = errors.New("image does not decode")
+
+// statusError reports a response whose HTTP status was not 200 OK
+type statusError struct {
+	URL        string
+	StatusCode int
+	RetryAfter time.Duration // From the Retry-After header, zero when absent
+}
+
+// newStatusError describes the unexpected status of resp, a response for url
+func newStatusError(url string, resp *http.Response) *statusError {
+	return &statusError{URL: url, StatusCode: resp.StatusCode, RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())}
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds or as an HTTP
+// date; anything else, or a time in the past, gives zero
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return max(0, time.Duration(seconds)*time.Second)
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(0, at.Sub(now))
+	}
+	return 0
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("unexpected status %d from %s", e.StatusCode, e.URL)
+}
+
+// hasStatus reports whether err carries one of the given HTTP status codes
+func hasStatus(err error, codes ...int) bool {
+	var se *statusError
+	if !errors.As(err, &se) {
+		return false
+	}
+	for _, code := range codes {
+		if se.StatusCode == code {
+			return true
+		}
+	}
+	return false
+}
+
+// friendlyErrors maps internal errors to messages a non-developer can act on.
+// Rules are checked in order and the first match wins, so keep the more
+// specific ones near the top.
+var friendlyErrors = []struct {
+	match   func(err error) bool
+	message string
+}{
+	{
+		match:   func(err error) bool { return hasStatus(err, http.StatusTooManyRequests, http.StatusForbidden) },
+		message: "The server may be rate-limiting you; wait a few minutes and try again with fewer concurrent requests.",
+	},
+	{
+		match: func(err error) bool {
+			var me *mirrorsError
+			return errors.As(err, &me)
+		},
+		message: "The image failed on every host of -image-mirrors; Digikala's image servers may be down, try again later.",
+	},
+	{
+		match:   func(err error) bool { return errors.Is(err, errAuthExpired) },
+		message: "Digikala no longer accepts your -auth-token; it has probably expired. Log in again in the browser, copy the new token and rerun with it, or run with -auth-token-file to wait for a new token instead.",
+	},
+	{
+		match:   func(err error) bool { return errors.Is(err, errPinMismatch) },
+		message: "The server's certificate does not match -tls-pin; the connection may be intercepted, or the pins need updating after a certificate rotation.",
+	},
+	{
+		match:   func(err error) bool { return errors.Is(err, errNotRecorded) },
+		message: "This request is missing from the replayed cassette; record it again with DIGIGO_RECORD=1.",
+	},
+	{
+		match: func(err error) bool {
+			var le *redirectLoopError
+			return errors.As(err, &le)
+		},
+		message: "The image address redirects in a circle on Digikala's side; it cannot be downloaded and was skipped.",
+	},
+	{
+		match:   func(err error) bool { return hasStatus(err, http.StatusNotFound, http.StatusGone) },
+		message: "This item no longer exists on Digikala; it was skipped.",
+	},
+	{
+		match: func(err error) bool {
+			var se *statusError
+			return errors.As(err, &se) && se.StatusCode >= 500
+		},
+		message: "Digikala's servers are having trouble right now; try again later.",
+	},
+	{
+		match: func(err error) bool {
+			var ne net.Error
+			return errors.As(err, &ne) && ne.Timeout()
+		},
+		message: "The connection timed out; check your internet connection or try again later.",
+	},
+	{
+		match: func(err error) bool {
+			var de *net.DNSError
+			return errors.As(err, &de)
+		},
+		message: "Could not reach Digikala; check your internet connection and DNS settings.",
+	},
+	{
+		match: func(err error) bool {
+			var se *json.SyntaxError
+			var te *json.UnmarshalTypeError
+			return errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) || errors.Is(err, errNotJSON) ||
+				errors.As(err, &se) || errors.As(err, &te)
+		},
+		message: "The server sent an incomplete or unexpected response; this is usually temporary, try again later.",
+	},
+	{
+		match:   func(err error) bool { return errors.Is(err, errDiskFull) || isDiskFull(err) },
+		message: "The disk is full; free some space, or point the run at a bigger disk, and run again.",
+	},
+	{
+		match:   func(err error) bool { return errors.Is(err, fs.ErrPermission) },
+		message: "Cannot write to the image folder; check that you have permission to write there.",
+	},
+}
+
+// friendlyError returns a user-facing description of err with a suggested action
+func friendlyError(err error) string {
+	for _, rule := range friendlyErrors {
+		if rule.match(err) {
+			return rule.message
+		}
+	}
+	return "Something unexpected went wrong; run again with -debug for details."
+}
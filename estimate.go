@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+// meteredTransport counts the response bytes read through it and the time
+// spent on each request, to measure the throughput of one connection
+type meteredTransport struct {
+	next    http.RoundTripper
+	bytes   atomic.Int64
+	elapsed atomic.Int64 // Nanoseconds from sending each request to closing its body
+}
+
+func (t *meteredTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = &meteredBody{ReadCloser: resp.Body, transport: t, start: start}
+	return resp, nil
+}
+
+// bytesPerSecond is the measured throughput, zero before any body was read
+func (t *meteredTransport) bytesPerSecond() float64 {
+	elapsed := time.Duration(t.elapsed.Load()).Seconds()
+	if elapsed == 0 {
+		return 0
+	}
+	return float64(t.bytes.Load()) / elapsed
+}
+
+// meteredBody is a response body that reports to its meteredTransport
+type meteredBody struct {
+	io.ReadCloser
+	transport *meteredTransport
+	start     time.Time
+	closed    bool
+}
+
+func (b *meteredBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.transport.bytes.Add(int64(n))
+	return n, err
+}
+
+func (b *meteredBody) Close() error {
+	if !b.closed {
+		b.closed = true
+		b.transport.elapsed.Add(int64(time.Since(b.start)))
+	}
+	return b.ReadCloser.Close()
+}
+
+// estimate is what -dry-run-estimate measured and extrapolated
+type estimate struct {
+	Pages        int64
+	Products     int
+	Sampled      int           // Products whose details were fetched
+	SampleErrors int           // Sampled products whose details could not be fetched
+	Images       int           // Images of the sampled products
+	Sized        int           // Of those, images whose size the server gave
+	Bytes        int64         // Total size of the sized images
+	Crawl        time.Duration // Time taken to list the products
+	Detail       time.Duration // Average time to fetch a product's details
+	Head         time.Duration // Average time to a HEAD response
+	Throughput   float64       // Bytes per second on one connection
+}
+
+// imagesPerProduct is the average number of images of a sampled product
+func (e estimate) imagesPerProduct() float64 {
+	if e.Sampled == 0 {
+		return 0
+	}
+	return float64(e.Images) / float64(e.Sampled)
+}
+
+// imageSize is the average size of a sized image
+func (e estimate) imageSize() int64 {
+	if e.Sized == 0 {
+		return 0
+	}
+	return e.Bytes / int64(e.Sized)
+}
+
+// totalImages extrapolates the number of images of every listed product
+func (e estimate) totalImages() int {
+	return int(e.imagesPerProduct()*float64(e.Products) + 0.5)
+}
+
+// duration extrapolates the time of a full run. The stages overlap, so the
+// slowest of them, or the -rps limit, sets the pace.
+func (e estimate) duration() time.Duration {
+	images := e.totalImages()
+	details := time.Duration(e.Products) * e.Detail / time.Duration(cfg.DetailWorkers)
+	perImage := e.Head
+	if e.Throughput > 0 {
+		perImage += time.Duration(float64(e.imageSize()) / e.Throughput * float64(time.Second))
+	}
+	downloads := time.Duration(images) * perImage / time.Duration(cfg.DownloadWorkers)
+	d := max(e.Crawl, details, downloads)
+	if cfg.RPS > 0 {
+		requests := float64(e.Pages) + float64(e.Products) + float64(images)
+		d = max(d, time.Duration(requests/cfg.RPS*float64(time.Second)))
+	}
+	return d
+}
+
+// runEstimate is -dry-run-estimate: it lists every product of the run, looks
+// at the images of a sample of them without downloading any and prints what
+// a real run would take. It returns the exit status.
+func runEstimate(ctx context.Context) int {
+	requestLimiter, productLimiter = newHostLimiters(cfg.RPS, cfg.HostRPS, cfg.RetryPriority), newLimiter(0)
+	imageURLRewriter, queueSlots = nil, nil // Listed products are never finished
+	if cfg.URLRewrite != "" {
+		imageURLRewriter, _ = newRegexRewriter(cfg.URLRewrite) // Checked by validateConfig
+	}
+	transport := &meteredTransport{next: httpClient.plain().Transport}
+	client := NewClient(transport)
+
+	// List the products the way a run would, without fetching their details
+	slog.Info("Listing products for the estimate")
+	started := time.Now()
+	var ids []int
+	jobs := make(chan productJob)
+	listed := make(chan struct{})
+	go func() {
+		for job := range jobs {
+			ids = append(ids, job.ID)
+		}
+		close(listed)
+	}()
+	filters, _ := loadSearchFilters() // Checked by validateConfig
+	newCrawler(client, jobs, listingOptions(filters), cfg.PrefetchPages, cfg.CategoryTree, cfg.MaxDepth).crawlSource(ctx)
+	close(jobs)
+	<-listed
+	if ctx.Err() != nil {
+		return exitInterrupted
+	}
+	e := estimate{Pages: stats.Pages.Load(), Products: len(ids), Crawl: time.Since(started)}
+
+	sample := sampleIDs(ids, cfg.EstimateSample)
+	slog.Info("Sampling product images", "products", len(sample), "of", len(ids))
+	var mu sync.Mutex
+	var detailTime, headTime time.Duration
+	var heads int
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, cfg.DetailWorkers)
+	for _, id := range sample {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			start := time.Now()
+			info, err := client.fetchProductInfo(ctx, id)
+			took := time.Since(start)
+			if err != nil && !errors.Is(err, errNoImages) {
+				debugLog.Printf("estimate: product %d: %v", id, err)
+				mu.Lock()
+				e.SampleErrors++
+				mu.Unlock()
+				return
+			}
+			urls := info.ImageURLs
+			if imageURLRewriter != nil {
+				urls = rewriteURLs(id, urls)
+			}
+			sizes, headsTook := client.headImages(ctx, urls)
+			mu.Lock()
+			defer mu.Unlock()
+			e.Sampled++
+			detailTime += took
+			e.Images += len(urls)
+			for _, size := range sizes {
+				if size >= 0 {
+					e.Sized++
+					e.Bytes += size
+				}
+			}
+			headTime += headsTook
+			heads += len(sizes)
+		}()
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return exitInterrupted
+	}
+	if e.Sampled > 0 {
+		e.Detail = detailTime / time.Duration(e.Sampled)
+	}
+	if heads > 0 {
+		e.Head = headTime / time.Duration(heads)
+	}
+	e.Throughput = transport.bytesPerSecond()
+
+	writeEstimate(os.Stdout, e)
+	return exitOK
+}
+
+// sampleIDs returns n of ids spread evenly over the list, or all of them
+// when there are no more than n
+func sampleIDs(ids []int, n int) []int {
+	if len(ids) <= n {
+		return ids
+	}
+	sample := make([]int, n)
+	for i := range sample {
+		sample[i] = ids[i*len(ids)/n]
+	}
+	return sample
+}
+
+// headImages asks the server for the size of each image in urls, one at a
+// time; a size is -1 when the server did not give it. It also returns the
+// time all the requests took.
+func (c *Client) headImages(ctx context.Context, urls []string) ([]int64, time.Duration) {
+	sizes := make([]int64, 0, len(urls))
+	var took time.Duration
+	for _, url := range urls {
+		start := time.Now()
+		size, err := c.headSize(ctx, url)
+		took += time.Since(start)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			debugLog.Printf("estimate: image %s: %v", url, err)
+		}
+		sizes = append(sizes, size)
+	}
+	return sizes, took
+}
+
+// headSize returns the Content-Length of url from a HEAD request, -1 when
+// it is not given
+func (c *Client) headSize(ctx context.Context, url string) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return -1, err
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return -1, fmt.Errorf("failed to fetch image size: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return -1, newStatusError(url, resp)
+	}
+	return resp.ContentLength, nil
+}
+
+// writeEstimate prints e as a table
+func writeEstimate(out io.Writer, e estimate) {
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "listing pages\t%d\n", e.Pages)
+	fmt.Fprintf(tw, "products\t%d\n", e.Products)
+	fmt.Fprintf(tw, "products sampled\t%d", e.Sampled)
+	if e.SampleErrors > 0 {
+		fmt.Fprintf(tw, " (%d failed)", e.SampleErrors)
+	}
+	fmt.Fprintln(tw)
+	fmt.Fprintf(tw, "images per product\t%.1f\n", e.imagesPerProduct())
+	fmt.Fprintf(tw, "average image size\t%s", approxSize(e.imageSize()))
+	if unsized := e.Images - e.Sized; unsized > 0 {
+		fmt.Fprintf(tw, " (%d of %d sampled images without a size)", unsized, e.Images)
+	}
+	fmt.Fprintln(tw)
+	fmt.Fprintf(tw, "estimated images\t%d\n", e.totalImages())
+	fmt.Fprintf(tw, "estimated download size\t%s\n", approxSize(int64(e.totalImages())*e.imageSize()))
+	if e.Throughput > 0 {
+		fmt.Fprintf(tw, "measured throughput\t%s/s per connection\n", approxSize(int64(e.Throughput)))
+	}
+	fmt.Fprintf(tw, "estimated time\t%s (%d detail, %d download workers)\n", e.duration().Round(time.Second), cfg.DetailWorkers, cfg.DownloadWorkers)
+	tw.Flush()
+}
+
+// approxSize formats n bytes in the largest unit that keeps it at least 1,
+// to one decimal
+func approxSize(n int64) string {
+	for _, unit := range byteUnits[:3] {
+		if n >= unit.size {
+			return strconv.FormatFloat(float64(n)/float64(unit.size), 'f', 1, 64) + unit.suffix
+		}
+	}
+	return strconv.FormatInt(n, 10) + "B"
+}
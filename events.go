@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+)
+
+// eventSchemaVersion is bumped whenever an event struct changes incompatibly
+const eventSchemaVersion = 1
+
+// Event types written by -events, one JSON object per line
+const (
+	eventPageFetched       = "page_fetched"
+	eventProductDiscovered = "product_discovered"
+	eventProductDone       = "product_done"
+	eventImageDone         = "image_done"
+	eventError             = "error"
+	eventSummary           = "summary"
+)
+
+// EventHeader is embedded in every event
+type EventHeader struct {
+	Version int       `json:"version"`
+	Type    string    `json:"type"`
+	Time    time.Time `json:"time"`
+}
+
+func newEventHeader(eventType string) EventHeader {
+	return EventHeader{Version: eventSchemaVersion, Type: eventType, Time: time.Now().UTC()}
+}
+
+// PageFetchedEvent is emitted after a listing page has been decoded
+type PageFetchedEvent struct {
+	EventHeader
+	Category string `json:"category"`
+	Page     int    `json:"page"`
+	Products int    `json:"products"`
+}
+
+// ProductDiscoveredEvent is emitted when a product ID is queued for download
+type ProductDiscoveredEvent struct {
+	EventHeader
+	ProductID int          `json:"product_id"`
+	Category  string       `json:"category"`
+	Page      int          `json:"page"`
+	Listing   *ListingInfo `json:"listing,omitempty"` // With -listing-fields
+}
+
+// ImageDoneEvent is emitted after an image has been saved
+type ImageDoneEvent struct {
+	EventHeader
+	ProductID int    `json:"product_id"`
+	URL       string `json:"url"`
+	Path      string `json:"path"`
+}
+
+// ProductDoneEvent is emitted once all images of a product have been attempted
+type ProductDoneEvent struct {
+	EventHeader
+	ProductID int    `json:"product_id"`
+	Title     string `json:"title"`
+	Images    int    `json:"images"`
+	Failed    int    `json:"failed"`
+	Late      bool   `json:"late,omitempty"` // Released after later products, see -reorder-window
+}
+
+// MarshalJSON leaves out a zero Time, as -ordered-exports sends it
+func (e ProductDoneEvent) MarshalJSON() ([]byte, error) {
+	type plain ProductDoneEvent // Without this method
+	if !e.Time.IsZero() {
+		return json.Marshal(plain(e))
+	}
+	return json.Marshal(struct {
+		plain
+		Time *time.Time `json:"time,omitempty"` // Hides the header's
+	}{plain: plain(e)})
+}
+
+// ErrorEvent is emitted for every failed page, product or image
+type ErrorEvent struct {
+	EventHeader
+	Stage     string `json:"stage"`
+	Page      int    `json:"page,omitempty"`
+	ProductID int    `json:"product_id,omitempty"`
+	URL       string `json:"url,omitempty"`
+	Message   string `json:"message"`
+
+	// RetryPolicy names the policy that ran out when retries did not help
+	RetryPolicy string `json:"retry_policy,omitempty"`
+	// Mirrors lists the hosts an image failed on when every mirror failed
+	Mirrors []string `json:"mirrors,omitempty"`
+	// Stack is where a worker panicked, innermost call first
+	Stack []string `json:"stack,omitempty"`
+}
+
+// newErrorEvent returns the error event for err in stage
+func newErrorEvent(stage string, err error) ErrorEvent {
+	e := ErrorEvent{EventHeader: newEventHeader(eventError), Stage: stage, Message: err.Error()}
+	var exhausted *retryExhaustedError
+	if errors.As(err, &exhausted) {
+		e.RetryPolicy = exhausted.Policy.String()
+	}
+	var me *mirrorsError
+	if errors.As(err, &me) {
+		e.Mirrors = me.Hosts
+	}
+	return e
+}
+
+// SummaryEvent is the last event of a run
+type SummaryEvent struct {
+	EventHeader
+	Pages    int64 `json:"pages"`
+	Products int64 `json:"products"`
+	Images   int64 `json:"images"`
+	Errors   int64 `json:"errors"`
+
+	EmptyResolved int64 `json:"empty_resolved"`
+
+	// FirstError is the first error of the run, nil when there was none
+	FirstError *ErrorEvent `json:"first_error,omitempty"`
+
+	// Old run workspaces removed by -keep-runs and -keep-days, and their bytes
+	RunsRemoved int   `json:"runs_removed,omitempty"`
+	Reclaimed   int64 `json:"reclaimed_bytes,omitempty"`
+
+	Tags map[string]string `json:"tags,omitempty"` // From -tag
+
+	// Fingerprint hash of the response shapes seen, by response kind
+	Schema map[string]string `json:"schema,omitempty"`
+
+	Workers []WorkerSummary `json:"workers,omitempty"`
+	Hosts   []HostSummary   `json:"hosts,omitempty"`
+}
+
+// eventStream serializes events from all goroutines through a single writer,
+// so events sent by one goroutine are written in the order they were sent.
+// A nil *eventStream discards everything.
+type eventStream struct {
+	ch   chan any
+	done chan struct{}
+}
+
+// events is the stream for the current run; nil unless -events is set
+var events *eventStream
+
+func newEventStream(w io.Writer) *eventStream {
+	s := &eventStream{ch: make(chan any, 64), done: make(chan struct{})}
+	go func() {
+		defer close(s.done)
+		enc := json.NewEncoder(w)
+		for e := range s.ch {
+			if err := enc.Encode(e); err != nil {
+				debugLog.Printf("failed to write event: %v", err)
+			}
+		}
+	}()
+	return s
+}
+
+// emit queues e for writing
+func (s *eventStream) emit(e any) {
+	if s == nil {
+		return
+	}
+	s.ch <- e
+}
+
+// close flushes pending events and stops the writer
+func (s *eventStream) close() {
+	if s == nil {
+		return
+	}
+	close(s.ch)
+	<-s.done
+}
@@ -0,0 +1,66 @@
+// Command downloadproduct downloads the images of one product with
+// `digi product`, which calls Client.DownloadProduct, and lists what
+// became of each:
+//
+//	go run ./examples/downloadproduct 12345 ./photos
+//
+// The digi binary is looked up as $DIGI, or else in $PATH.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// productResult holds the fields of digi's ProductResult used here
+type productResult struct {
+	ID     int    `json:"id"`
+	Title  string `json:"title"`
+	Images []struct {
+		URL     string `json:"url"`
+		Path    string `json:"path"`
+		Skipped bool   `json:"skipped"`
+		Error   string `json:"error"`
+	} `json:"images"`
+}
+
+func main() {
+	if len(os.Args) != 3 {
+		fmt.Fprintln(os.Stderr, "usage: downloadproduct ID DEST")
+		os.Exit(2)
+	}
+	digi := os.Getenv("DIGI")
+	if digi == "" {
+		digi = "digi"
+	}
+	var out bytes.Buffer
+	cmd := exec.Command(digi, "product", "-dest", os.Args[2], "-main-only", "-rendition", "largest", os.Args[1])
+	cmd.Stdout, cmd.Stderr = &out, os.Stderr
+	// Exit code 4 means some images failed, which the result lists
+	var exitErr *exec.ExitError
+	if err := cmd.Run(); err != nil && !(errors.As(err, &exitErr) && exitErr.ExitCode() == 4) {
+		fmt.Fprintf(os.Stderr, "digi product failed: %v\n", err)
+		os.Exit(1)
+	}
+
+	var result productResult
+	if err := json.Unmarshal(out.Bytes(), &result); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to read the result: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("%d %s\n", result.ID, result.Title)
+	for _, image := range result.Images {
+		switch {
+		case image.Error != "":
+			fmt.Printf("  failed  %s: %s\n", image.URL, image.Error)
+		case image.Skipped:
+			fmt.Printf("  kept    %s\n", image.Path)
+		default:
+			fmt.Printf("  saved   %s\n", image.Path)
+		}
+	}
+}
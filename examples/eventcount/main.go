@@ -0,0 +1,46 @@
+// Command eventcount renders a live count of the events written by
+// `digi -events`:
+//
+//	digi -events | go run ./examples/eventcount
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// event holds the fields every digi event shares
+type event struct {
+	Version int    `json:"version"`
+	Type    string `json:"type"`
+}
+
+func main() {
+	counts := map[string]int{}
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		var e event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			fmt.Fprintf(os.Stderr, "skipping malformed event: %v\n", err)
+			continue
+		}
+		if e.Version != 1 {
+			fmt.Fprintf(os.Stderr, "skipping event with unsupported version %d\n", e.Version)
+			continue
+		}
+		counts[e.Type]++
+
+		fmt.Printf("\rpages %d  products %d/%d  images %d  errors %d",
+			counts["page_fetched"], counts["product_done"], counts["product_discovered"],
+			counts["image_done"], counts["error"])
+		if e.Type == "summary" {
+			fmt.Println()
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to read events: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Exit statuses of the program, listed by -help
+const (
+	exitOK          = 0   // Everything asked for was done
+	exitFailure     = 1   // A fatal error stopped the run, or -validate found problems
+	exitUsage       = 2   // Invalid command line or settings
+	exitDiskFull    = 3   // The disk stayed full for -disk-full-wait
+	exitPartial     = 4   // The run finished, but some products or images failed
+	exitEmpty       = 5   // No product was discovered and -fail-on-empty is set
+	exitInterrupted = 130 // Stopped early by Ctrl-C, SIGTERM or q in the -tui
+)
+
+// exitCodes describes each exit status for -help
+var exitCodes = []struct {
+	code    int
+	meaning string
+}{
+	{exitOK, "success"},
+	{exitFailure, "fatal error, or problems found by -validate"},
+	{exitUsage, "invalid command line or settings"},
+	{exitDiskFull, "the disk stayed full for -disk-full-wait"},
+	{exitPartial, "finished, but some products or images failed"},
+	{exitEmpty, "no product was discovered (with -fail-on-empty)"},
+	{exitInterrupted, "stopped early by Ctrl-C, SIGTERM or q in the -tui"},
+}
+
+// printExitCodes writes the exit status table to w
+func printExitCodes(w io.Writer) {
+	fmt.Fprintln(w, "\nExit status:")
+	for _, c := range exitCodes {
+		fmt.Fprintf(w, "  %3d  %s\n", c.code, c.meaning)
+	}
+}
+
+// scrapeExitCode is the exit status of a scrape that returned err; ctx is
+// the run's context and quit whether the user stopped it from the -tui
+func scrapeExitCode(ctx context.Context, err error, quit bool) int {
+	switch {
+	case errors.Is(err, errDiskFull):
+		return exitDiskFull
+	case err != nil:
+		return exitFailure
+	case ctx.Err() != nil || quit:
+		return exitInterrupted
+	case cfg.FailOnEmpty && stats.Discovered.Load() == 0:
+		return exitEmpty
+	case stats.Errors.Load() > 0:
+		return exitPartial
+	}
+	return exitOK
+}
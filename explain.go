@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+)
+
+// explainPages is how many listing page URLs -explain shows
+const explainPages = 3
+
+// Where a setting's value comes from
+const (
+	originFlag    = "flag"    // Given on the command line
+	originEnv     = "env"     // From an environment variable
+	originDefault = "default" // Nobody set it
+)
+
+// envFlags names the environment variable each flag defaults to
+var envFlags = map[string]string{
+	"auth-token":       "DIGIKALA_TOKEN",
+	"minio-access-key": "MINIO_ACCESS_KEY",
+	"minio-secret-key": "MINIO_SECRET_KEY",
+}
+
+// secretFlags are the flags whose values -explain doesn't show
+var secretFlags = map[string]bool{"auth-token": true, "minio-access-key": true, "minio-secret-key": true}
+
+// explainFilters are the flags that leave products or images out; -explain
+// lists those that are set
+var explainFilters = []string{"resume-from-id", "skip-indexed", "max-age", "max-product-age", "min-discount", "trust-manifest", "max-file-size", "min-dimensions", "allow-format", "min-quality-score", "image-dedup-strategy", "dedup-across-sizes", "dedupe-strategy", "nsfw-api"}
+
+// explainLimits are the flags that pace the run, always listed
+var explainLimits = []string{"rps", "rps-host", "products-per-second", "detail-workers", "download-workers", "cpu-workers", "max-concurrent-per-product", "ramp-up", "queue-size", "queue-limit", "prefetch-pages", "max-retries", "backoff-pause"}
+
+// setting is one flag with its effective value and where it comes from
+type setting struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+// explanation is what -explain prints: the effective settings and what a
+// run with them would do
+type explanation struct {
+	Settings   []setting         `json:"settings"`
+	Source     string            `json:"source"`
+	Pages      []string          `json:"pages,omitempty"` // First listing URLs requested
+	Filters    []setting         `json:"filters,omitempty"`
+	Limits     []setting         `json:"limits"`
+	Outputs    map[string]string `json:"outputs"`
+	Requests   string            `json:"requests"`             // Request pattern of a run
+	Problems   []string          `json:"problems,omitempty"`   // What -validate would report, paths aside
+	Validation string            `json:"validation,omitempty"` // Result of the -explain-validate request
+}
+
+// settingOrigin returns where the value of flag name comes from
+func settingOrigin(name string) string {
+	if isFlagSet(name) {
+		return originFlag
+	}
+	if env := envFlags[name]; env != "" && os.Getenv(env) != "" {
+		return originEnv
+	}
+	return originDefault
+}
+
+// lookupSetting returns the flag name as a setting, hiding secret values
+func lookupSetting(name string) setting {
+	f := flag.Lookup(name)
+	if f == nil {
+		return setting{Name: name}
+	}
+	value := f.Value.String()
+	if secretFlags[name] && value != "" {
+		value = "(set)"
+	}
+	return setting{Name: name, Value: value, Source: settingOrigin(name)}
+}
+
+// explain resolves what a run with the current settings would do, without
+// any network call
+func explain() explanation {
+	var e explanation
+	flag.VisitAll(func(f *flag.Flag) {
+		e.Settings = append(e.Settings, lookupSetting(f.Name))
+	})
+
+	e.Source = cfg.Source
+	switch cfg.Source {
+	case sourceCategory:
+		e.Source += " " + cfg.Category
+		if cfg.CategoryTree {
+			e.Source += fmt.Sprintf(", and its subcategories %d levels down", cfg.MaxDepth)
+		}
+		filters, _ := loadSearchFilters()
+		for page := 1; page <= explainPages; page++ {
+			e.Pages = append(e.Pages, buildCategoryURL(categoryRootURL, cfg.Category, page, listingOptions(filters)))
+		}
+	case sourceWishlist:
+		e.Pages = []string{fmt.Sprintf(wishlistURL, 1)}
+	case sourceSitemap:
+		e.Pages = []string{sitemapIndexURL}
+	case sourceIDRange:
+		e.Source += fmt.Sprintf(" %s, every %d", &cfg.IDRange, cfg.IDStep)
+	}
+
+	for _, name := range explainFilters {
+		if s := lookupSetting(name); s.Source != originDefault {
+			e.Filters = append(e.Filters, s)
+		}
+	}
+	for _, name := range explainLimits {
+		e.Limits = append(e.Limits, lookupSetting(name))
+	}
+
+	images := imageDir
+	if cfg.Source == sourceCategory && cfg.Category != "" {
+		images = filepath.Join(imageDir, cfg.Category)
+	}
+	e.Outputs = map[string]string{"images": images, "manifest": cfg.Manifest, "log": cfg.LogFile, "audit log": cfg.AuditLog, "staging": cfg.StagingDir}
+	if cfg.WorkspacePerRun {
+		e.Outputs["workspace"] = filepath.Join(imageDir, runsDir, time.Now().Format(workspaceLayout)) + " (manifest and log move there)"
+	} else if cfg.Workspace != "" {
+		e.Outputs["workspace"] = cfg.Workspace
+	}
+	if cfg.MinIOBucket != "" {
+		e.Outputs["minio"] = cfg.MinIOEndpoint + "/" + cfg.MinIOBucket
+	}
+
+	rate := "unlimited"
+	if cfg.RPS > 0 {
+		rate = fmt.Sprintf("at most %g a second", cfg.RPS)
+	}
+	e.Requests = fmt.Sprintf("1 per listing page (up to %d a category, %d fetched ahead), 1 per product for its details and 1 per image; %s, %d detail and %d download workers, up to %d retries each",
+		maxPages, cfg.PrefetchPages, rate, cfg.DetailWorkers, cfg.DownloadWorkers, cfg.MaxRetries)
+
+	for _, err := range validateConfig() {
+		e.Problems = append(e.Problems, err.Error())
+	}
+	return e
+}
+
+// validateFirstPage requests the first page of the plan with client, the one request
+// -explain-validate allows, and describes the outcome
+func validateFirstPage(ctx context.Context, client *Client, e explanation) string {
+	if len(e.Pages) == 0 {
+		return "no page to request for this source"
+	}
+	resp, err := client.get(ctx, e.Pages[0])
+	if err != nil {
+		return friendlyError(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return newStatusError(e.Pages[0], resp).Error()
+	}
+	return "ok"
+}
+
+// writeExplanation prints e for people
+func writeExplanation(w io.Writer, e explanation) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "settings:")
+	for _, s := range e.Settings {
+		fmt.Fprintf(tw, "  -%s\t%s\t(%s)\n", s.Name, s.Value, s.Source)
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "\nproducts from: %s\n", e.Source)
+	if len(e.Pages) > 0 {
+		fmt.Fprintln(w, "first requests:")
+		for _, page := range e.Pages {
+			fmt.Fprintf(w, "  %s\n", page)
+		}
+	}
+	for _, section := range []struct {
+		title    string
+		settings []setting
+	}{{"filters:", e.Filters}, {"limits:", e.Limits}} {
+		if len(section.settings) == 0 {
+			continue
+		}
+		fmt.Fprintln(tw, section.title)
+		for _, s := range section.settings {
+			fmt.Fprintf(tw, "  -%s\t%s\n", s.Name, s.Value)
+		}
+	}
+	fmt.Fprintln(tw, "outputs:")
+	for _, name := range []string{"images", "manifest", "log", "audit log", "staging", "workspace", "minio"} {
+		if path := e.Outputs[name]; path != "" {
+			fmt.Fprintf(tw, "  %s\t%s\n", name, path)
+		}
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "requests: %s\n", e.Requests)
+	if e.Validation != "" {
+		fmt.Fprintf(w, "first page: %s\n", e.Validation)
+	}
+	if len(e.Problems) > 0 {
+		fmt.Fprintln(w, "problems:")
+		for _, p := range e.Problems {
+			fmt.Fprintf(w, "  %s\n", p)
+		}
+	}
+}
+
+// runExplain prints what the run would do and returns the exit code: 0, or
+// 2 when the settings have problems
+func runExplain(ctx context.Context, w io.Writer) int {
+	e := explain()
+	if cfg.ExplainValidate {
+		client, err := newHTTPClient(cfg.TLSPins)
+		if err != nil { // Reported with the other problems
+			client = httpClient
+		}
+		e.Validation = validateFirstPage(ctx, client, e)
+	}
+	if cfg.ExplainJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(e)
+	} else {
+		writeExplanation(w, e)
+	}
+	if len(e.Problems) > 0 {
+		return exitUsage
+	}
+	return exitOK
+}
+
+// explainRequested reports whether one of the -explain flags was given
+func explainRequested() bool {
+	return cfg.Explain || cfg.ExplainJSON || cfg.ExplainValidate
+}
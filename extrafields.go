@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// extraWildcard in a -product-extra-fields path stands for every element of
+// an array or every value of an object
+const extraWildcard = "*"
+
+// validateFieldPath checks a -product-extra-fields path such as seller.id
+// or specifications.*.value
+func validateFieldPath(path string) error {
+	for _, segment := range strings.Split(path, ".") {
+		if segment == "" {
+			return fmt.Errorf("invalid -product-extra-fields path %q: empty segment", path)
+		}
+	}
+	return nil
+}
+
+// extras are the values of -product-extra-fields by path, left as JSON
+type extras map[string]json.RawMessage
+
+// decodeProductRes decodes a product details response into response and,
+// with -product-extra-fields, returns the fields it asks for
+func decodeProductRes(resp *http.Response, response *ProductRes) (extras, error) {
+	if len(cfg.ExtraFields) == 0 {
+		return nil, decodeSampledJSON(resp, schemaProduct, response)
+	}
+	var raw json.RawMessage
+	if err := decodeSampledJSON(resp, schemaProduct, &raw); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, response); err != nil {
+		return nil, err
+	}
+	var product struct {
+		Data struct {
+			Product json.RawMessage `json:"product"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(raw, &product); err != nil {
+		return nil, err
+	}
+	return extractFields(product.Data.Product, cfg.ExtraFields), nil
+}
+
+// extractFields returns the values at paths in the product JSON. A path with
+// a wildcard gets the list of the values it matched; paths matching nothing
+// are left out.
+func extractFields(product json.RawMessage, paths []string) extras {
+	fields := make(extras)
+	for _, path := range paths {
+		segments := strings.Split(path, ".")
+		values := lookupField(product, segments)
+		switch {
+		case len(values) == 0:
+		case !slices.Contains(segments, extraWildcard):
+			fields[path] = values[0]
+		default:
+			if list, err := json.Marshal(values); err == nil {
+				fields[path] = list
+			}
+		}
+	}
+	return fields
+}
+
+// lookupField returns the values at segments below value: an object key, an
+// array index or extraWildcard each step. Object values matched by a
+// wildcard come in key order.
+func lookupField(value json.RawMessage, segments []string) []json.RawMessage {
+	if len(segments) == 0 {
+		if string(value) == "null" {
+			return nil
+		}
+		return []json.RawMessage{value}
+	}
+	segment, rest := segments[0], segments[1:]
+
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(value, &object); err == nil {
+		if segment != extraWildcard {
+			child, ok := object[segment]
+			if !ok {
+				return nil
+			}
+			return lookupField(child, rest)
+		}
+		keys := make([]string, 0, len(object))
+		for key := range object {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		var values []json.RawMessage
+		for _, key := range keys {
+			values = append(values, lookupField(object[key], rest)...)
+		}
+		return values
+	}
+
+	var array []json.RawMessage
+	if err := json.Unmarshal(value, &array); err != nil {
+		return nil // A scalar has nothing below it
+	}
+	if segment != extraWildcard {
+		i, err := strconv.Atoi(segment)
+		if err != nil || i < 0 || i >= len(array) {
+			return nil
+		}
+		return lookupField(array[i], rest)
+	}
+	var values []json.RawMessage
+	for _, element := range array {
+		values = append(values, lookupField(element, rest)...)
+	}
+	return values
+}
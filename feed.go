@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// atomNamespace is the XML namespace of Atom (RFC 4287)
+const atomNamespace = "http://www.w3.org/2005/Atom"
+
+// newProduct is a product the watch command saw for the first time
+type newProduct struct {
+	ID       int
+	Title    string
+	Price    int    // Rials, zero if unavailable
+	ImageURL string // Main image, "" if none
+	Seen     time.Time
+}
+
+// exporter publishes the products found new in a watch cycle
+type exporter interface {
+	export(products []newProduct) error
+}
+
+// atomFeed is the document written by atomExporter
+type atomFeed struct {
+	XMLName xml.Name    `xml:"feed"`
+	XMLNS   string      `xml:"xmlns,attr"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  atomPerson  `xml:"author"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+}
+
+type atomEntry struct {
+	ID      string     `xml:"id"`
+	Title   string     `xml:"title"`
+	Updated string     `xml:"updated"`
+	Summary string     `xml:"summary,omitempty"`
+	Links   []atomLink `xml:"link"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+// atomExporter keeps an Atom feed of the most recent new products at path.
+// Entries are identified by the product page URL, so readers recognize a
+// product they have already shown when the feed is regenerated.
+type atomExporter struct {
+	path string
+	size int // Entries kept
+}
+
+func (e atomExporter) export(products []newProduct) error {
+	feed, err := readAtomFeed(e.path)
+	if err != nil {
+		return err
+	}
+	fresh := make([]atomEntry, 0, len(products))
+	for i := len(products) - 1; i >= 0; i-- { // Newest first
+		fresh = append(fresh, productEntry(products[i]))
+	}
+	ids := make(map[string]bool, len(fresh))
+	for _, entry := range fresh {
+		ids[entry.ID] = true
+	}
+	for _, entry := range feed.Entries {
+		if !ids[entry.ID] {
+			fresh = append(fresh, entry)
+		}
+	}
+	feed.Entries = fresh[:min(len(fresh), e.size)]
+	feed.Updated = time.Now().UTC().Format(time.RFC3339)
+	return writeAtomFeed(e.path, feed)
+}
+
+// productEntry returns the feed entry of p
+func productEntry(p newProduct) atomEntry {
+	url := fmt.Sprintf(productPageURL, p.ID)
+	entry := atomEntry{
+		ID:      url,
+		Title:   p.Title,
+		Updated: p.Seen.UTC().Format(time.RFC3339),
+		Links:   []atomLink{{Rel: "alternate", Type: "text/html", Href: url}},
+	}
+	if entry.Title == "" {
+		entry.Title = fmt.Sprintf("Product %d", p.ID)
+	}
+	if p.Price > 0 {
+		entry.Summary = formatRials(p.Price)
+	}
+	if p.ImageURL != "" {
+		entry.Links = append(entry.Links, atomLink{Rel: "enclosure", Type: "image/jpeg", Href: p.ImageURL})
+	}
+	return entry
+}
+
+// readAtomFeed reads the feed at path, or returns an empty one if there is
+// none yet
+func readAtomFeed(path string) (*atomFeed, error) {
+	feed := &atomFeed{
+		XMLNS:  atomNamespace,
+		ID:     "urn:digigo:new-products",
+		Title:  "New Digikala products",
+		Author: atomPerson{Name: "digigo"},
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return feed, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read feed: %w", err)
+	}
+	if err := xml.Unmarshal(data, feed); err != nil {
+		return nil, fmt.Errorf("failed to decode feed %s: %w", path, err)
+	}
+	feed.XMLNS = atomNamespace
+	return feed, nil
+}
+
+// writeAtomFeed replaces the feed at path, so readers never see half of it
+func writeAtomFeed(path string, feed *atomFeed) error {
+	data, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode feed: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create feed directory: %w", err)
+	}
+	tmpPath := path + ".part"
+	if err := os.WriteFile(tmpPath, append([]byte(xml.Header), data...), 0o644); err != nil {
+		return fmt.Errorf("failed to write feed: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to write feed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// validateAtom checks the feed at path against what RFC 4287 requires of a
+// feed and its entries, and returns the entries
+func validateAtom(t *testing.T, path string) []atomEntry {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), xml.Header) {
+		t.Error("feed has no XML declaration")
+	}
+	// Decoded independently of atomFeed, so a wrong namespace or a missing
+	// element isn't papered over by the same struct tags that wrote it
+	var feed struct {
+		XMLName xml.Name
+		ID      string `xml:"http://www.w3.org/2005/Atom id"`
+		Title   string `xml:"http://www.w3.org/2005/Atom title"`
+		Updated string `xml:"http://www.w3.org/2005/Atom updated"`
+		Author  struct {
+			Name string `xml:"http://www.w3.org/2005/Atom name"`
+		} `xml:"http://www.w3.org/2005/Atom author"`
+		Entries []atomEntry `xml:"http://www.w3.org/2005/Atom entry"`
+	}
+	if err := xml.Unmarshal(data, &feed); err != nil {
+		t.Fatalf("feed is not well-formed: %v", err)
+	}
+	if feed.XMLName.Space != atomNamespace || feed.XMLName.Local != "feed" {
+		t.Errorf("root element is {%s}%s, want {%s}feed", feed.XMLName.Space, feed.XMLName.Local, atomNamespace)
+	}
+	if feed.ID == "" || feed.Title == "" || feed.Author.Name == "" {
+		t.Errorf("feed id %q, title %q, author %q; all are required", feed.ID, feed.Title, feed.Author.Name)
+	}
+	if _, err := time.Parse(time.RFC3339, feed.Updated); err != nil {
+		t.Errorf("feed updated %q is not an RFC 3339 date", feed.Updated)
+	}
+	ids := make(map[string]bool)
+	for _, entry := range feed.Entries {
+		if entry.ID == "" || entry.Title == "" {
+			t.Errorf("entry id %q, title %q; both are required", entry.ID, entry.Title)
+		}
+		if ids[entry.ID] {
+			t.Errorf("entry %s appears twice", entry.ID)
+		}
+		ids[entry.ID] = true
+		if _, err := time.Parse(time.RFC3339, entry.Updated); err != nil {
+			t.Errorf("entry %s updated %q is not an RFC 3339 date", entry.ID, entry.Updated)
+		}
+		alternate := false
+		for _, link := range entry.Links {
+			alternate = alternate || link.Rel == "alternate" && link.Href != ""
+		}
+		if !alternate {
+			t.Errorf("entry %s has no alternate link", entry.ID)
+		}
+	}
+	return feed.Entries
+}
+
+func TestAtomExporter(t *testing.T) {
+	setupTest(t)
+	e := atomExporter{path: "feeds/new.xml", size: 3}
+	seen := time.Date(2024, 5, 1, 12, 0, 0, 0, time.FixedZone("IRST", 12600))
+
+	err := e.export([]newProduct{
+		{ID: 1, Title: "Phone & <case>", Price: 125000, ImageURL: "https://dkstatics-public.digikala.com/1.jpg", Seen: seen},
+		{ID: 2, Seen: seen},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := validateAtom(t, e.path)
+	if len(entries) != 2 {
+		t.Fatalf("%d entries, want 2", len(entries))
+	}
+	if entries[0].ID != fmt.Sprintf(productPageURL, 2) {
+		t.Errorf("first entry %s, want the newest product 2", entries[0].ID)
+	}
+	if entries[0].Title != "Product 2" {
+		t.Errorf("untitled product got title %q", entries[0].Title)
+	}
+	if entries[1].Title != "Phone & <case>" || entries[1].Updated != "2024-05-01T08:30:00Z" {
+		t.Errorf("product 1: title %q, updated %s", entries[1].Title, entries[1].Updated)
+	}
+	if len(entries[1].Links) != 2 || entries[1].Links[1].Rel != "enclosure" {
+		t.Errorf("product 1 links = %+v, want an alternate and an enclosure", entries[1].Links)
+	}
+
+	// A later cycle adds to the top, replaces a product seen again and
+	// keeps at most size entries
+	err = e.export([]newProduct{{ID: 3, Seen: seen}, {ID: 1, Title: "Phone", Seen: seen}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries = validateAtom(t, e.path)
+	var ids []string
+	for _, entry := range entries {
+		ids = append(ids, strings.TrimPrefix(entry.ID, "https://www.digikala.com/product/"))
+	}
+	if strings.Join(ids, " ") != "dkp-1/ dkp-3/ dkp-2/" {
+		t.Errorf("entries %v, want dkp-1/ dkp-3/ dkp-2/", ids)
+	}
+	if _, err := os.Stat(e.path + ".part"); !os.IsNotExist(err) {
+		t.Error("temporary feed file left behind")
+	}
+}
+
+func TestAtomExporterRejectsCorruptFeed(t *testing.T) {
+	setupTest(t)
+	if err := os.WriteFile("new.xml", []byte("<feed><entry>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := (atomExporter{path: "new.xml", size: 10}).export([]newProduct{{ID: 1}}); err == nil {
+		t.Error("exported over a feed that does not decode")
+	}
+	if data, _ := os.ReadFile("new.xml"); string(data) != "<feed><entry>" {
+		t.Error("the corrupt feed was overwritten")
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// filterParams maps the attribute names accepted by -filter-attributes to the
+// search API's query parameters
+var filterParams = map[string]string{
+	"brand":    "brands",
+	"color":    "colors",
+	"material": "materials",
+	"size":     "sizes",
+}
+
+// minDiscountParam is the search API parameter asking for products discounted
+// by at least a percentage. The API doesn't document it, so fetchDetails
+// checks the discount of every product as well.
+const minDiscountParam = "discount[min]"
+
+// searchFilters collects attribute filters as search API parameter -> values
+type searchFilters map[string][]string
+
+// add validates one attribute:value pair and records it
+func (f searchFilters) add(pair string) error {
+	key, value, ok := strings.Cut(pair, ":")
+	key, value = strings.ToLower(strings.TrimSpace(key)), strings.TrimSpace(value)
+	if !ok || key == "" || value == "" {
+		return fmt.Errorf("invalid filter %q: want attribute:value, e.g. color:red", pair)
+	}
+	param, ok := filterParams[key]
+	if !ok {
+		known := make([]string, 0, len(filterParams))
+		for name := range filterParams {
+			known = append(known, name)
+		}
+		sort.Strings(known)
+		return fmt.Errorf("unknown filter attribute %q: use one of %s", key, strings.Join(known, ", "))
+	}
+	f[param] = append(f[param], value)
+	return nil
+}
+
+// addList records a comma-separated list of attribute:value pairs
+func (f searchFilters) addList(list string) error {
+	for _, pair := range strings.Split(list, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		if err := f.add(pair); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addFile records the attribute:value pairs in path, one or more
+// comma-separated pairs per line; blank lines and lines starting with # are
+// skipped
+func (f searchFilters) addFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open filter file: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		if err := f.addList(text); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read filter file: %w", err)
+	}
+	return nil
+}
+
+// loadSearchFilters builds the filters given by -filter-attributes and
+// -filter-attributes-file
+func loadSearchFilters() (searchFilters, error) {
+	filters := searchFilters{}
+	for param, values := range cfg.CategoryOptions.Filters {
+		filters[param] = append(filters[param], values...)
+	}
+	if err := filters.addList(cfg.FilterAttributes); err != nil {
+		return nil, err
+	}
+	if cfg.FilterAttributesFile != "" {
+		if err := filters.addFile(cfg.FilterAttributesFile); err != nil {
+			return nil, err
+		}
+	}
+	return filters, nil
+}
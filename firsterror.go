@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"runtime"
+	"sync/atomic"
+)
+
+// firstError holds the first error of the run, which usually explains the
+// ones after it; runScrape clears it
+var firstError atomic.Pointer[ErrorEvent]
+
+// reportError emits the error event e, keeping it as firstError when it is
+// the first of the run
+func reportError(e ErrorEvent) {
+	firstError.CompareAndSwap(nil, &e)
+	events.emit(e)
+}
+
+// logFirstError repeats the first error of the run, if any, at the end of it
+func logFirstError() {
+	e := firstError.Load()
+	if e == nil {
+		return
+	}
+	args := []any{"stage", e.Stage}
+	if e.ProductID != 0 {
+		args = append(args, "product", e.ProductID)
+	}
+	if e.Page != 0 {
+		args = append(args, "page", e.Page)
+	}
+	if e.URL != "" {
+		args = append(args, "url", e.URL)
+	}
+	slog.Error("First error of the run", append(args, "reason", e.Message)...)
+	for _, frame := range e.Stack {
+		debugLog.Printf("    %s", frame)
+	}
+}
+
+// printFirstError writes the first error of the run, if any, to w
+func printFirstError(w io.Writer) {
+	if e := firstError.Load(); e != nil {
+		fmt.Fprintf(w, "first error (%s): %s\n", e.Stage, e.Message)
+	}
+}
+
+// recoverPanic, deferred by a worker, makes a panic of worker id the first
+// error of the run, with the stack it happened on, before letting it go on
+func recoverPanic(id string) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	e := newErrorEvent("panic", fmt.Errorf("worker %s panicked: %v", id, r))
+	pcs := make([]uintptr, 32)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(2, pcs)])
+	for {
+		frame, more := frames.Next()
+		e.Stack = append(e.Stack, fmt.Sprintf("%s %s:%d", frame.Function, frame.File, frame.Line))
+		if !more {
+			break
+		}
+	}
+	reportError(e)
+	logFirstError()
+	panic(r)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// FlexInt is an integer the API encodes either as a JSON number (12500) or
+// as a string ("12500"). A null or empty value decodes to zero.
+type FlexInt int
+
+// UnmarshalJSON implements json.Unmarshaler
+func (f *FlexInt) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if string(data) == "null" {
+		*f = 0
+		return nil
+	}
+
+	text := string(data)
+	if len(data) > 0 && data[0] == '"' {
+		if err := json.Unmarshal(data, &text); err != nil {
+			return fmt.Errorf("failed to decode FlexInt %s: %w", data, err)
+		}
+		text = strings.TrimSpace(text)
+		if text == "" {
+			*f = 0
+			return nil
+		}
+	}
+
+	n, err := strconv.Atoi(text)
+	if err != nil {
+		return fmt.Errorf("failed to decode FlexInt %s: %w", data, err)
+	}
+	*f = FlexInt(n)
+	return nil
+}
+
+// Value returns the decoded integer
+func (f FlexInt) Value() int {
+	return int(f)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestFlexIntUnmarshal(t *testing.T) {
+	tests := []struct {
+		name    string
+		json    string
+		want    int
+		wantErr bool
+	}{
+		{"integer", `{"price":12500}`, 12500, false},
+		{"negative", `{"price":-3}`, -3, false},
+		{"string", `{"price":"12500"}`, 12500, false},
+		{"padded string", `{"price":" 42 "}`, 42, false},
+		{"empty string", `{"price":""}`, 0, false},
+		{"null", `{"price":null}`, 0, false},
+		{"missing field", `{}`, 0, false},
+		{"float", `{"price":1.5}`, 0, true},
+		{"not a number", `{"price":"free"}`, 0, true},
+		{"boolean", `{"price":true}`, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var v struct {
+				Price FlexInt `json:"price"`
+			}
+			err := json.Unmarshal([]byte(tt.json), &v)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error: %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got := v.Price.Value(); got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestProductResNormalizesPrices decodes details whose prices come in every
+// encoding the API uses
+func TestProductResNormalizesPrices(t *testing.T) {
+	data := `{"status":200,"data":{"product":{"default_variant":{"price":{"selling_price":"125000","rrp_price":150000,"discount_percent":null}}}}}`
+	var res ProductRes
+	if err := json.Unmarshal([]byte(data), &res); err != nil {
+		t.Fatal(err)
+	}
+	price := res.Data.Product.DefaultVariant.Price
+	if price.SellingPrice.Value() != 125000 || price.RRPPrice.Value() != 150000 || price.DiscountPercent.Value() != 0 {
+		t.Errorf("got %d, %d, %d; want 125000, 150000, 0", price.SellingPrice, price.RRPPrice, price.DiscountPercent)
+	}
+}
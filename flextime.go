@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// flexTimeLayouts are the text forms FlexTime accepts, besides Unix seconds
+var flexTimeLayouts = []string{time.RFC3339, time.DateTime, time.DateOnly}
+
+// FlexTime is a point in time the API encodes as Unix seconds, as a number
+// or a string, or as an RFC 3339, "2006-01-02 15:04:05" or "2006-01-02"
+// string. Null, empty and unrecognized values decode to the zero time
+// rather than failing the whole response.
+type FlexTime struct {
+	time.Time
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (f *FlexTime) UnmarshalJSON(data []byte) error {
+	f.Time = time.Time{}
+	data = bytes.TrimSpace(data)
+	text := string(data)
+	if len(data) > 0 && data[0] == '"' {
+		if err := json.Unmarshal(data, &text); err != nil {
+			return nil
+		}
+		text = strings.TrimSpace(text)
+	}
+	if seconds, err := strconv.ParseInt(text, 10, 64); err == nil && seconds > 0 {
+		f.Time = time.Unix(seconds, 0)
+		return nil
+	}
+	for _, layout := range flexTimeLayouts {
+		if t, err := time.Parse(layout, text); err == nil {
+			f.Time = t
+			return nil
+		}
+	}
+	return nil
+}
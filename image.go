@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"os"
+	"strings"
+
+	// Decoders used by image.DecodeConfig and image.Decode
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+
+	_ "golang.org/x/image/webp"
+)
+
+// imageFormats are the formats probeImage recognizes, as -allow-format takes them
+var imageFormats = []string{"jpeg", "png", "gif", "webp"}
+
+// formatAllowed reports whether -allow-format lets images of format through;
+// an undecodable image, of format "", is never allowed by a non-empty list
+func formatAllowed(format string) bool {
+	if len(cfg.AllowFormats) == 0 {
+		return true
+	}
+	for _, allowed := range cfg.AllowFormats {
+		if strings.EqualFold(allowed, format) || strings.EqualFold(allowed, "jpg") && format == "jpeg" {
+			return true
+		}
+	}
+	return false
+}
+
+// imageMeta is what the header of an image file tells about it
+type imageMeta struct {
+	Width, Height int
+	Format        string
+}
+
+// probeImage decodes only the header of the image file at path
+func probeImage(path string) (imageMeta, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return imageMeta{}, err
+	}
+	defer file.Close()
+	config, format, err := image.DecodeConfig(file)
+	if err != nil {
+		return imageMeta{}, fmt.Errorf("failed to decode image header: %w", err)
+	}
+	return imageMeta{Width: config.Width, Height: config.Height, Format: format}, nil
+}
+
+// verifyImage decodes the whole image file at path, which catches files cut
+// short that still have a sound header
+func verifyImage(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, _, err := image.Decode(file); err != nil {
+		return fmt.Errorf("%w: %v", errCorruptImage, err)
+	}
+	return nil
+}
+
+// qualitySamples bounds how many pixels a side is sampled with when scoring
+const qualitySamples = 256
+
+// laplacianScale is the Laplacian variance scoring 0.5: sharp product
+// photos are well above it, blurry or blank ones well below
+const laplacianScale = 100
+
+// qualityScore rates the sharpness of the image file at path from 0 to 1 by
+// the variance of the Laplacian of its luminance, sampled on a grid of at
+// most qualitySamples points a side. Blurry images score low, and so do
+// near-white or near-black ones, which have no edges at all.
+func qualityScore(path string) (float64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return 0, fmt.Errorf("failed to decode image: %w", err)
+	}
+	b := img.Bounds()
+	step := max(1, max(b.Dx(), b.Dy())/qualitySamples)
+	w, h := (b.Dx()+step-1)/step, (b.Dy()+step-1)/step
+	if w < 3 || h < 3 {
+		return 0, nil
+	}
+	luma := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			r, g, bl, _ := img.At(b.Min.X+x*step, b.Min.Y+y*step).RGBA()
+			luma[y*w+x] = (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(bl)) / 257
+		}
+	}
+	var sum, sumSq float64
+	n := 0
+	for y := 1; y < h-1; y++ {
+		for x := 1; x < w-1; x++ {
+			i := y*w + x
+			l := luma[i-w] + luma[i+w] + luma[i-1] + luma[i+1] - 4*luma[i]
+			sum += l
+			sumSq += l * l
+			n++
+		}
+	}
+	mean := sum / float64(n)
+	variance := sumSq/float64(n) - mean*mean
+	return variance / (variance + laplacianScale), nil
+}
+
+// perceptualHash returns the difference hash of the image file at path: the
+// image is shrunk to a 9x8 grayscale grid, each cell the mean of up to 8x8
+// samples, and each of the 64 bits says whether a cell is brighter than its
+// right neighbour. Visually similar images differ in few bits.
+func perceptualHash(path string) (uint64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return 0, fmt.Errorf("failed to decode image: %w", err)
+	}
+	b := img.Bounds()
+	if b.Empty() {
+		return 0, errors.New("image is empty")
+	}
+	var cells [8][9]float64
+	for cy := 0; cy < 8; cy++ {
+		y0, y1 := b.Min.Y+cy*b.Dy()/8, b.Min.Y+max((cy+1)*b.Dy()/8, cy*b.Dy()/8+1)
+		for cx := 0; cx < 9; cx++ {
+			x0, x1 := b.Min.X+cx*b.Dx()/9, b.Min.X+max((cx+1)*b.Dx()/9, cx*b.Dx()/9+1)
+			xStep, yStep := max(1, (x1-x0)/8), max(1, (y1-y0)/8)
+			var sum float64
+			n := 0
+			for y := y0; y < y1; y += yStep {
+				for x := x0; x < x1; x += xStep {
+					r, g, bl, _ := img.At(x, y).RGBA()
+					sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(bl)
+					n++
+				}
+			}
+			cells[cy][cx] = sum / float64(n)
+		}
+	}
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if cells[y][x] > cells[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash, nil
+}
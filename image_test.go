@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestAllowFormatMixed downloads a product whose gallery mixes formats with
+// -allow-format jpg,png: only the JPEG and the PNG are saved, and the others
+// are skipped without being retried
+func TestAllowFormatMixed(t *testing.T) {
+	setupTest(t)
+	scrapeIDs(1, 1)
+	cfg.AllowFormats = stringList{"jpg", "PNG"}
+	cfg.MaxRetries = 3
+	img := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	var jpg, gifData bytes.Buffer
+	if err := jpeg.Encode(&jpg, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := gif.Encode(&gifData, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	// By image number, as writeProduct lists them
+	bodies := map[string][]byte{
+		"1": jpg.Bytes(),
+		"2": testPNG(t, 8, 8, color.White),
+		"3": gifData.Bytes(),
+		"4": []byte("not an image"),
+	}
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	serveAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/v2/product/") {
+			writeProduct(t, w, 1, len(bodies))
+			return
+		}
+		n := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/img/1-"), ".png")
+		mu.Lock()
+		requests[n]++
+		mu.Unlock()
+		w.Write(bodies[n])
+	}))
+
+	if err := runScrape(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(savedImages(t)); got != 2 {
+		t.Errorf("%d images saved, want the JPEG and the PNG", got)
+	}
+	if got := stats.WrongFormat.Load(); got != 2 {
+		t.Errorf("%d images skipped for their format, want 2", got)
+	}
+	for n, count := range requests {
+		if count != 1 {
+			t.Errorf("image %s requested %d times, want once", n, count)
+		}
+	}
+	if got := stats.Products.Load(); got != 1 {
+		t.Errorf("%d products done, want 1", got)
+	}
+}
+
+func TestFormatAllowed(t *testing.T) {
+	useDefaults()
+	for _, format := range append(imageFormats, "") {
+		if !formatAllowed(format) {
+			t.Errorf("%q refused without -allow-format", format)
+		}
+	}
+	cfg.AllowFormats = stringList{"jpg", "webp"}
+	want := map[string]bool{"jpeg": true, "webp": true, "png": false, "gif": false, "": false}
+	for format, allowed := range want {
+		if got := formatAllowed(format); got != allowed {
+			t.Errorf("formatAllowed(%q) = %v, want %v", format, got, allowed)
+		}
+	}
+
+	cfg.AllowFormats = stringList{"jpeg", "bmp"}
+	errs := validateConfig()
+	found := false
+	for _, err := range errs {
+		found = found || strings.Contains(err.Error(), `-allow-format "bmp"`)
+	}
+	if !found {
+		t.Errorf("validateConfig() = %v, want -allow-format bmp rejected", errs)
+	}
+	useDefaults()
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+)
+
+// sampleIntegrity reports whether a download is picked by -integrity-sample
+// to be fetched a second time
+func sampleIntegrity() bool {
+	return cfg.IntegritySample > 0 && rand.Float64() < cfg.IntegritySample
+}
+
+// recheckImage fetches the image served from servedURL once more, from
+// another -image-mirrors host when there is one, and returns the SHA-256 of
+// what came back. A CDN whose edges disagree returns other bytes than the
+// first fetch, whose hash is sum; that is logged and counted. The second
+// fetch goes through the rate limits like any other request.
+func (c *Client) recheckImage(ctx context.Context, servedURL, sum string) (string, error) {
+	url := servedURL
+	if urls := mirrorURLs(servedURL, cfg.ImageMirrors); len(urls) > 1 {
+		url = urls[1]
+	}
+	image, err := c.streamImage(ctx, url, io.Discard)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch image again: %w", err)
+	}
+	recheck := hex.EncodeToString(image.SHA256[:])
+	stats.Rechecked.Add(1)
+	if recheck != sum {
+		stats.RecheckMismatches.Add(1)
+		slog.Warn("Image differed when fetched again", "url", servedURL, "from", url, "sha256", sum, "again", recheck)
+	}
+	return recheck, nil
+}
+
+// reportIntegrity logs the outcome of -integrity-sample, prominently when
+// more than -integrity-warn-rate of the sampled images differed
+func reportIntegrity() {
+	checked, mismatched := stats.Rechecked.Load(), stats.RecheckMismatches.Load()
+	if checked == 0 {
+		return
+	}
+	slog.Info("Images fetched twice to check the CDN", "checked", checked, "differed", mismatched)
+	if rate := float64(mismatched) / float64(checked); rate > cfg.IntegrityWarn {
+		slog.Warn(fmt.Sprintf("CONTENT MISMATCH: %.1f%% of the images fetched twice came back different; deduplication by content may be unreliable for this run.", 100*rate))
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// linkedCategories collects the categories that product details point at, for
+// -follow-subcategory-links; nil when the flag is off
+var linkedCategories *categoryLinks
+
+// categoryLinks is the queue of linked categories still to crawl. Detail
+// workers add to it while the crawler takes from it, so it also counts the
+// queued products whose details haven't been looked at yet: until those are
+// in, an empty queue doesn't mean there is nothing left to follow.
+type categoryLinks struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	pending  []string
+	queued   map[string]bool // Slugs ever added, guards against cycles
+	inflight int
+}
+
+// newCategoryLinks returns an empty queue whose waits end once ctx is done
+func newCategoryLinks(ctx context.Context) *categoryLinks {
+	l := &categoryLinks{queued: make(map[string]bool)}
+	l.cond = sync.NewCond(&l.mu)
+	context.AfterFunc(ctx, func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.cond.Broadcast()
+	})
+	return l
+}
+
+// expect records that a product was queued and will report its category
+func (l *categoryLinks) expect() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inflight++
+}
+
+// report records the category slug of a product whose details were fetched,
+// "" when unknown. Every expect must be matched by one report.
+func (l *categoryLinks) report(slug string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inflight--
+	if slug != "" && slugPattern.MatchString(slug) && !l.queued[slug] {
+		l.queued[slug] = true
+		l.pending = append(l.pending, slug)
+	}
+	l.cond.Broadcast()
+}
+
+// next returns the next category to crawl, waiting while queued products may
+// still add one. It returns false once nothing is left or ctx is done.
+func (l *categoryLinks) next(ctx context.Context) (string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for len(l.pending) == 0 && l.inflight > 0 && ctx.Err() == nil {
+		l.cond.Wait()
+	}
+	if len(l.pending) == 0 || ctx.Err() != nil {
+		return "", false
+	}
+	slug := l.pending[0]
+	l.pending = l.pending[1:]
+	return slug, true
+}
@@ -0,0 +1,61 @@
+package main
+
+import "slices"
+
+// Values of -listing-fields, product fields kept from listing pages
+const (
+	listingTitle  = "title"  // Persian title, or the English one
+	listingPrice  = "price"  // Selling price of the default variant
+	listingRating = "rating" // Average rating and number of ratings
+)
+
+// listingFieldNames lists the accepted -listing-fields values
+var listingFieldNames = []string{listingTitle, listingPrice, listingRating}
+
+// ListingInfo is what -listing-fields keeps of a product as a listing page
+// shows it, before and without its details
+type ListingInfo struct {
+	Title   string  `json:"title,omitempty"`
+	Price   int     `json:"price,omitempty"`   // Rials
+	Rating  float64 `json:"rating,omitempty"`  // As the site gives it
+	Ratings int     `json:"ratings,omitempty"` // How many ratings it is the average of
+}
+
+// listing returns the fields of p that fields asks for, or nil when it asks
+// for none or p is nil
+func (p *Product) listing(fields []string) *ListingInfo {
+	if p == nil || len(fields) == 0 {
+		return nil
+	}
+	info := &ListingInfo{}
+	if slices.Contains(fields, listingTitle) {
+		info.Title = cleanText(p.TitleFa)
+		if info.Title == "" {
+			info.Title = cleanText(p.TitleEn)
+		}
+	}
+	if slices.Contains(fields, listingPrice) {
+		info.Price = p.DefaultVariant.Price.SellingPrice.Value()
+	}
+	if slices.Contains(fields, listingRating) {
+		info.Rating, info.Ratings = p.Rating.Rate, p.Rating.Count.Value()
+	}
+	return info
+}
+
+// info returns what the listing entry p tells of the product, standing in
+// for its details with -no-detail-fetch: only the main image, usually a
+// thumbnail, and no category, brand or date. A nil p tells nothing.
+func (p *Product) info() productInfo {
+	if p == nil {
+		return productInfo{}
+	}
+	price := p.DefaultVariant.Price
+	info := productInfo{Title: cleanText(p.TitleFa), Price: price.SellingPrice.Value(), Discount: price.DiscountPercent.Value()}
+	if info.Title == "" {
+		info.Title = cleanText(p.TitleEn)
+	}
+	info.ImageURLs = p.Images.Main.URLs
+	info.Main = len(info.ImageURLs)
+	return info
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"testing"
+)
+
+// TestListingFields decodes a listing page saved from the API, with prices
+// and rating counts given as numbers, strings and not at all, and keeps the
+// fields each -listing-fields asks for
+func TestListingFields(t *testing.T) {
+	data, err := os.ReadFile("testdata/listing_fields.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var page CategoryRes
+	if err := json.Unmarshal(data, &page); err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Data.Products) != 3 {
+		t.Fatalf("decoded %d products, want 3", len(page.Data.Products))
+	}
+	all := []string{listingTitle, listingPrice, listingRating}
+	tests := []struct {
+		name   string
+		index  int
+		fields []string
+		want   *ListingInfo
+	}{
+		{"all fields", 0, all, &ListingInfo{Title: "گوشی موبایل سامسونگ & قاب", Price: 125000000, Rating: 4.3, Ratings: 1520}},
+		{"English title, quoted numbers", 1, all, &ListingInfo{Title: "Phone case", Price: 890000, Ratings: 12}},
+		{"fields missing", 2, all, &ListingInfo{Title: "کتاب"}},
+		{"title only", 0, []string{listingTitle}, &ListingInfo{Title: "گوشی موبایل سامسونگ & قاب"}},
+		{"price only", 0, []string{listingPrice}, &ListingInfo{Price: 125000000}},
+		{"rating only", 0, []string{listingRating}, &ListingInfo{Rating: 4.3, Ratings: 1520}},
+		{"no fields", 0, nil, nil},
+	}
+	for _, tt := range tests {
+		got := page.Data.Products[tt.index].listing(tt.fields)
+		if (got == nil) != (tt.want == nil) || got != nil && *got != *tt.want {
+			t.Errorf("%s: listing = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+
+	var none *Product
+	if none.listing(all) != nil {
+		t.Error("a missing listing entry has fields")
+	}
+}
+
+// TestListingFieldsInEvents crawls the saved listing page with
+// -listing-fields title,price: its product_discovered events carry those
+// fields and no rating
+func TestListingFieldsInEvents(t *testing.T) {
+	data, err := os.ReadFile("testdata/listing_fields.json") // Before setupTest leaves the package directory
+	if err != nil {
+		t.Fatal(err)
+	}
+	setupTest(t)
+	if err := flag.CommandLine.Set("listing-fields", "title,price"); err != nil {
+		t.Fatal(err)
+	}
+	serveAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Query().Get("page") != "1" {
+			w.Write([]byte(`{"status":200,"data":{"products":[]}}`))
+			return
+		}
+		w.Write(data)
+	}))
+	var out bytes.Buffer
+	events = newEventStream(&out)
+	t.Cleanup(func() { events = nil })
+
+	jobs := make(chan productJob, 10)
+	newCrawler(httpClient, jobs, QueryOptions{}, 0, false, 0).crawl(context.Background(), "mobile-phone", "mobile-phone", 0)
+	close(jobs)
+	events.close()
+
+	listed := make(map[int]ListingInfo)
+	for dec := json.NewDecoder(&out); ; {
+		var e ProductDiscoveredEvent
+		if err := dec.Decode(&e); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if e.Type == eventProductDiscovered && e.Listing != nil {
+			listed[e.ProductID] = *e.Listing
+		}
+	}
+	want := map[int]ListingInfo{
+		101: {Title: "گوشی موبایل سامسونگ & قاب", Price: 125000000},
+		102: {Title: "Phone case", Price: 890000},
+		103: {Title: "کتاب"},
+	}
+	if !maps.Equal(listed, want) {
+		t.Errorf("listings in events = %+v, want %+v", listed, want)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// LevelSuccess marks a product that finished; it sorts between Info and Warn
+const LevelSuccess = slog.LevelInfo + 2
+
+// ANSI escape sequences used by consoleHandler
+const (
+	ansiReset  = "\x1b[0m"
+	ansiRed    = "\x1b[31m"
+	ansiGreen  = "\x1b[32m"
+	ansiYellow = "\x1b[33m"
+	ansiDim    = "\x1b[2m"
+)
+
+// debugLog receives raw error details; it logs at debug level, so it is
+// silent unless -debug is set
+var debugLog = log.New(io.Discard, "", 0)
+
+// setupLogging sends the human log output to w, in color when w is a terminal
+// and neither -no-color nor the NO_COLOR environment variable is set
+func setupLogging(w io.Writer) {
+	level := slog.LevelInfo
+	if cfg.Debug {
+		level = slog.LevelDebug
+	}
+	h := newConsoleHandler(w, level, useColor(w))
+	slog.SetDefault(slog.New(h))
+	debugLog = slog.NewLogLogger(h, slog.LevelDebug)
+}
+
+// useColor reports whether output written to w should be colorized
+func useColor(w io.Writer) bool {
+	if cfg.NoColor || os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// consoleHandler is a slog.Handler writing one "message key=value ..." line
+// per record, without timestamps. When color is set the line is colored by
+// level: errors red, warnings yellow, successes green and debug lines dim.
+type consoleHandler struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	level  slog.Leveler
+	color  bool
+	prefix string // group prefix for attribute keys
+	attrs  []byte // preformatted attributes from WithAttrs
+}
+
+func newConsoleHandler(w io.Writer, level slog.Leveler, color bool) *consoleHandler {
+	return &consoleHandler{mu: new(sync.Mutex), w: w, level: level, color: color}
+}
+
+// Enabled implements slog.Handler
+func (h *consoleHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+// Handle implements slog.Handler
+func (h *consoleHandler) Handle(_ context.Context, r slog.Record) error {
+	var buf bytes.Buffer
+	color := ""
+	if h.color {
+		color = levelColor(r.Level)
+	}
+	buf.WriteString(color)
+	buf.WriteString(r.Message)
+	buf.Write(h.attrs)
+	r.Attrs(func(a slog.Attr) bool {
+		appendAttr(&buf, h.prefix, a)
+		return true
+	})
+	if color != "" {
+		buf.WriteString(ansiReset)
+	}
+	buf.WriteByte('\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := h.w.Write(buf.Bytes())
+	return err
+}
+
+// WithAttrs implements slog.Handler
+func (h *consoleHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	var buf bytes.Buffer
+	buf.Write(h.attrs)
+	for _, a := range attrs {
+		appendAttr(&buf, h.prefix, a)
+	}
+	h2.attrs = buf.Bytes()
+	return &h2
+}
+
+// WithGroup implements slog.Handler
+func (h *consoleHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.prefix = h.prefix + name + "."
+	return &h2
+}
+
+// levelColor returns the escape sequence for records of the given level
+func levelColor(level slog.Level) string {
+	switch {
+	case level >= slog.LevelError:
+		return ansiRed
+	case level >= slog.LevelWarn:
+		return ansiYellow
+	case level >= LevelSuccess:
+		return ansiGreen
+	case level < slog.LevelInfo:
+		return ansiDim
+	}
+	return ""
+}
+
+// appendAttr writes a as " key=value", quoting values that contain spaces
+func appendAttr(buf *bytes.Buffer, prefix string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		for _, ga := range a.Value.Group() {
+			appendAttr(buf, prefix+a.Key+".", ga)
+		}
+		return
+	}
+	buf.WriteByte(' ')
+	buf.WriteString(prefix + a.Key)
+	buf.WriteByte('=')
+	s := a.Value.String()
+	if s == "" || strings.ContainsFunc(s, func(r rune) bool { return unicode.IsSpace(r) || r == '"' || r == '=' }) {
+		s = strconv.Quote(s)
+	}
+	buf.WriteString(s)
+}
+
+// rotatingFile is an append-only log file that is moved to path.1, replacing
+// any earlier one, once it would grow past maxSize
+type rotatingFile struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64 // Zero never rotates
+	file    *os.File
+	size    int64
+}
+
+func openRotatingFile(path string, maxSize int64) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// open opens path for appending and records its current size
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+// Write implements io.Writer, rotating first if p would not fit
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate moves the current file to path.1 and starts a new one
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return fmt.Errorf("failed to rotate log file: %w", err)
+	}
+	// When the rename fails the same file is reopened, and rotating is
+	// tried again on the next write
+	os.Rename(f.path, f.path+".1")
+	return f.open()
+}
+
+// Close closes the current file
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
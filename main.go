@@ -1,26 +1,69 @@
 package main
 
 import (
-	"encoding/json"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"maps"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strconv"
-	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/sync/singleflight"
 )
 
-// Product represents the structure of a product from the first API
+// productJob is a product queued for download and the folder its images go to
+type productJob struct {
+	ID     int
+	Seq    int // Discovery order of the run, from 0
+	Page   int
+	Dir    string
+	Listed *Product // The listing entry the product was found in, nil when the source has none
+}
+
+// Product represents the structure of a product from the first API. Only
+// the ID is used unless -listing-fields or -no-detail-fetch asks for more.
 type Product struct {
-	ID int `json:"id"`
+	ID             int    `json:"id"`
+	TitleFa        string `json:"title_fa"`
+	TitleEn        string `json:"title_en"`
+	DefaultVariant struct {
+		Price struct {
+			SellingPrice    FlexInt `json:"selling_price"`
+			DiscountPercent FlexInt `json:"discount_percent"`
+		} `json:"price"`
+	} `json:"default_variant"`
+	Images struct {
+		Main struct {
+			URLs []string `json:"url"`
+		} `json:"main"`
+	} `json:"images"`
+	Rating struct {
+		Rate  float64 `json:"rate"`
+		Count FlexInt `json:"count"`
+	} `json:"rating"`
 }
 
 // CategoryRes represents the structure of the first API response
 type CategoryRes struct {
 	Status int `json:"status"`
 	Data   struct {
-		Products []Product `json:"products"`
+		Products      []Product  `json:"products"`
+		SubCategories []Category `json:"sub_categories"`
+		Pager         struct {
+			TotalPages int `json:"total_pages"`
+			TotalItems int `json:"total_items"`
+		} `json:"pager"`
 	} `json:"data"`
 }
 
@@ -29,7 +72,14 @@ type ProductRes struct {
 	Status int `json:"status"`
 	Data   struct {
 		Product struct {
-			Images struct {
+			TitleFa string `json:"title_fa"`
+			TitleEn string `json:"title_en"`
+			Brand   struct {
+				TitleFa string `json:"title_fa"`
+				TitleEn string `json:"title_en"`
+			} `json:"brand"`
+			Category Category `json:"category"`
+			Images   struct {
 				Main struct {
 					URLs []string `json:"url"`
 				} `json:"main"`
@@ -37,141 +87,868 @@ type ProductRes struct {
 					URLs []string `json:"url"`
 				} `json:"list"`
 			} `json:"images"`
+			DefaultVariant struct {
+				Price struct {
+					SellingPrice    FlexInt `json:"selling_price"`
+					RRPPrice        FlexInt `json:"rrp_price"`
+					DiscountPercent FlexInt `json:"discount_percent"`
+				} `json:"price"`
+			} `json:"default_variant"`
+			CreatedAt        FlexTime `json:"created_at"`
+			FirstPublishDate FlexTime `json:"first_publish_date"`
 		} `json:"product"`
 	} `json:"data"`
 }
 
 const (
-	baseURL           = "https://api.digikala.com/v1/categories/kids-apparel/search/?th_no_track=1&page=" // Replace with the actual API URL
-	productDetailsURL = "https://api.digikala.com/v2/product/"                                            // Replace with the actual product API URL
-	concurrentLimit   = 1                                                                                 // Number of concurrent requests
+	categoryRootURL   = "https://api.digikala.com/v1/categories/" // Lists the top-level categories
+	productDetailsURL = "https://api.digikala.com/v2/product/"    // Replace with the actual product API URL
+	concurrentLimit   = 1                                         // Number of concurrent requests
+	maxPages          = 100                                       // Last listing page fetched per category
+	imageDir          = "./img"                                   // Directory images are saved to
 )
 
 func main() {
-	productChan := make(chan int, concurrentLimit) // Channel to handle product IDs
-	var wg sync.WaitGroup                          // WaitGroup to ensure all goroutines complete
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] == "validate-config" {
+		parseFlags(args[1:])
+		os.Exit(runValidateConfig())
+	}
+	watchMode := len(args) > 0 && args[0] == "watch"
+	serverMode := len(args) > 0 && args[0] == "server"
+	productMode := len(args) > 0 && args[0] == "product"
+	var product productCommand
+	if productMode {
+		rest, err := product.parse(args[1:])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(exitUsage)
+		}
+		args = rest
+	} else if watchMode || serverMode {
+		args = args[1:]
+	}
+	parseFlags(args)
+	if cfg.PrintConfig {
+		printConfig(os.Stdout)
+		return
+	}
+	if cfg.Validate {
+		os.Exit(runValidate())
+	}
+	if explainRequested() {
+		os.Exit(runExplain(context.Background(), os.Stdout))
+	}
+	var workspace string
+	if (cfg.WorkspacePerRun || cfg.Workspace != "") && !watchMode && !serverMode && !productMode {
+		dir, err := cfg.useWorkspace(time.Now())
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(exitFailure)
+		}
+		workspace = dir
+	}
+	var logOutput io.Writer = os.Stdout
+	if cfg.Events || productMode {
+		logOutput = os.Stderr
+		events = newEventStream(os.Stdout)
+	}
+	if cfg.LogFile != "" {
+		file, err := openRotatingFile(cfg.LogFile, int64(cfg.LogRotateSize))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(exitFailure)
+		}
+		defer file.Close()
+		logOutput = io.MultiWriter(logOutput, file)
+	}
+	setupLogging(logOutput)
+	if workspace != "" {
+		slog.Info("Writing this run's files to its workspace", "path", workspace)
+	}
 
-	// Launch workers to fetch product details and download images
-	for i := 0; i < concurrentLimit; i++ {
-		wg.Add(1)
-		go productWorker(productChan, &wg)
+	if cfg.AuditLog != "" {
+		file, err := openRotatingFile(cfg.AuditLog, int64(cfg.AuditRotateSize))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(exitFailure)
+		}
+		defer file.Close()
+		auditLog = file
 	}
+	client, err := newHTTPClient(cfg.TLSPins)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitUsage)
+	}
+	httpClient = client
 
-	// Fetch products for each page
-	for page := 1; page <= 100; page++ {
-		url := baseURL + strconv.Itoa(page)
-		fmt.Printf("Fetching page: %d\n", page)
+	if watchMode {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		code := runWatch(ctx)
+		stop()
+		os.Exit(code)
+	}
+	if serverMode {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		code := runServer(ctx)
+		stop()
+		os.Exit(code)
+	}
+	if productMode {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		code := product.run(ctx, os.Stdout)
+		stop()
+		os.Exit(code)
+	}
 
-		products, err := fetchProducts(url)
+	if cfg.Source == sourceCategory && cfg.Category == "" {
+		if !canPickCategory() {
+			fmt.Fprintln(os.Stderr, "missing -category: give the slug from the category URL, e.g. -category kids-apparel")
+			os.Exit(exitUsage)
+		}
+		slug, err := pickCategory()
 		if err != nil {
-			fmt.Printf("Failed to fetch page %d: %v\n", page, err)
-			continue
+			fmt.Fprintf(os.Stderr, "no category selected: %v\n", err)
+			os.Exit(exitUsage)
 		}
+		cfg.Category = slug
+		slog.Info("To skip the picker next time, run", "command", commandLineWith("category", slug))
+	}
+
+	if errs := validateConfig(); len(errs) > 0 {
+		for _, err := range errs {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		os.Exit(exitUsage)
+	}
+
+	// Ctrl-C or SIGTERM cancels ctx; lookups in flight are abandoned, images
+	// downloading are finished, and the workers return after their current step
+	ctx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+	if cfg.DryRunEstimate {
+		code := runEstimate(ctx)
+		stopSignals()
+		os.Exit(code)
+	}
+	var quit atomic.Bool
+	err = runScrape(ctx, func(run *scrapeRun) func() {
+		var ui *tui
+		if cfg.TUI {
+			var err error
+			stopCrawl := func() {
+				quit.Store(true)
+				run.stopCrawl()
+			}
+			if ui, err = startTUI(run.downloads, stopCrawl); err != nil {
+				slog.Warn("Falling back to plain output", "reason", err)
+			}
+		}
+
+		go func() {
+			select {
+			case <-ctx.Done():
+			case <-run.done:
+				return
+			}
+			stopSignals() // A second Ctrl-C kills the process right away
+			slog.Warn("Shutting down, waiting for running workers", "timeout", cfg.ShutdownTimeout)
+			pause.release()
+			select {
+			case <-run.done:
+				return
+			case <-time.After(cfg.ShutdownTimeout):
+			}
+			ui.close()
+			slog.Warn(fmt.Sprintf("forceful shutdown after %s, %d workers still running", cfg.ShutdownTimeout, run.details.running.Load()+run.downloads.running.Load()))
+			os.Exit(exitInterrupted)
+		}()
+		return ui.close
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	code := scrapeExitCode(ctx, err, quit.Load())
+	if code == exitEmpty {
+		fmt.Fprintln(os.Stderr, "no products were discovered; check the category, or whether requests are being blocked")
+	}
+	if code == exitPartial || code == exitFailure {
+		printFirstError(os.Stderr)
+	}
+	events.close()
+	stopSignals()
+	os.Exit(code)
+}
+
+// scrapeRun is a running scrape as seen by whoever started it
+type scrapeRun struct {
+	details, downloads *workerPool
+	stopCrawl          context.CancelFunc // Stops discovering products, letting queued ones finish
+	done               <-chan struct{}    // Closed once every worker has returned
+}
+
+// runScrape scrapes the configured source with the current cfg until every
+// discovered product is done or ctx is done. started, if not nil, is called
+// once the workers run; the function it returns is called when they are all
+// done, before the run is summarized.
+func runScrape(ctx context.Context, started func(*scrapeRun) func()) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	diskGuard = newDiskWatch(imageDir, cfg.DiskFullPoll, cfg.DiskFullWait, cancel)
+	requestLimiter, productLimiter = newHostLimiters(cfg.RPS, cfg.HostRPS, cfg.RetryPriority), newLimiter(cfg.ProductRate)
+
+	filters, _ := loadSearchFilters() // Checked by validateConfig
+	imageURLRewriter = nil
+	if cfg.URLRewrite != "" {
+		imageURLRewriter, _ = newRegexRewriter(cfg.URLRewrite) // Checked by validateConfig
+	}
+	contentFilter = nil
+	firstError.Store(nil)
+	queueSlots = newQueueSlots(cfg.QueueLimit)
+	backoff = newBackoffGate(cfg.BackoffPause)
+	productOrder = nil
+	observedIDWidth.Store(0)
+	if cfg.OrderedExports {
+		productOrder = newReorderBuffer(cfg.ReorderWindow)
+	}
+	cpuPool = newCPUPool(cfg.CPUWorkers)
+	if cfg.AuthTokenFile != "" {
+		token, err := readAuthToken(cfg.AuthTokenFile)
+		if err != nil {
+			return err
+		}
+		cfg.AuthToken = token
+	}
+	if cfg.NSFWAPI != "" {
+		contentFilter = newNSFWFilter(cfg.NSFWAPI, cfg.NSFWThreshold)
+	}
 
-		for _, product := range products {
-			productChan <- product.ID
+	if !cfg.NoPreflight {
+		if err := httpClient.preflight(ctx, listingOptions(filters)); err != nil {
+			return err
 		}
 	}
 
-	close(productChan) // Close the channel after feeding all product IDs
-	wg.Wait()          // Wait for all workers to finish
-	fmt.Println("All tasks completed.")
+	freshness, dedupe, manifest, linkedCategories, trustedImages, indexedProducts = nil, nil, nil, nil, nil, nil
+	productCatalog = nil
+	if cfg.DetectDuplicates {
+		productCatalog = &catalog{}
+	}
+	brokenImages = nil
+	if cfg.ReportBroken {
+		brokenImages = &brokenLinks{}
+	}
+	if cfg.RespectCacheControl {
+		path := filepath.Join(imageDir, freshnessFile)
+		index, err := loadFreshnessIndex(path)
+		if err != nil {
+			slog.Warn("Ignoring unreadable freshness index", "reason", err)
+			index = newFreshnessIndex(path)
+		}
+		freshness = index
+	}
+
+	if cfg.DedupeStrategy != "" || dedupChecks(dedupURL) {
+		dedupe = newDedupeIndex()
+	}
+
+	if cfg.StagingDir != "" {
+		if err := os.MkdirAll(cfg.StagingDir, os.ModePerm); err != nil {
+			return fmt.Errorf("failed to create staging directory: %w", err)
+		}
+		if err := cleanStagingDir(cfg.StagingDir, time.Now()); err != nil {
+			slog.Warn("Could not clean the staging folder", "reason", err)
+		}
+	}
+	if cfg.TrustManifest {
+		entries, err := loadManifest(cfg.Manifest)
+		if err != nil {
+			return err
+		}
+		trustedImages = entries
+	}
+	checkpointed, checkpoint = nil, nil
+	var checkpointDone map[int]bool
+	if cfg.Checkpoint != "" {
+		done, err := loadCheckpoint(cfg.Checkpoint)
+		if err != nil {
+			return err
+		}
+		checkpointed, checkpointDone = maps.Clone(done), done
+	}
+	if cfg.SkipIndexed {
+		index, err := loadProductIndex(cfg.Manifest)
+		if err != nil {
+			return err
+		}
+		indexedProducts = index
+	}
+	if cfg.Manifest != "" {
+		m, err := openManifest(cfg.Manifest)
+		if err != nil {
+			return err
+		}
+		m.sync(cfg.Durability, cfg.ManifestBatchSize, cfg.ManifestFlushInterval)
+		if cfg.ParallelManifest {
+			m.batch(cfg.ManifestBatchSize, cfg.ManifestFlushInterval)
+		}
+		manifest = m
+	}
+
+	crawlCtx, stopCrawl := context.WithCancel(ctx)
+	defer stopCrawl()
+	go watchMemory(ctx, cfg.MaxMemory)
+
+	var err error
+	if sinks, err = openSinks(ctx); err != nil {
+		manifest.close()
+		return err
+	}
+	if checkpointDone != nil {
+		checkpoint = startCheckpoint(cfg.Checkpoint, checkpointDone, cfg.CheckpointEvery, cfg.CheckpointInterval)
+	}
+
+	// Launch the detail and download stages of the pipeline
+	var productChan chan productJob
+	var products <-chan productJob // What the detail workers take from
+	if cfg.DownloadOrder == orderFIFO {
+		productChan = make(chan productJob, cfg.QueueSize)
+		products = productChan
+	} else {
+		productChan = make(chan productJob) // The reordering stage holds the waiting products
+		products = reorder(ctx, productChan, cfg.QueueSize, cfg.DownloadOrder)
+	}
+	imageChan := make(chan imageJob, cfg.QueueSize)
+	details := newWorkerPool(ctx, "details", cfg.DetailWorkers, cfg.RampUp, detailWorker(products, imageChan))
+	graceCtx, stopGrace := graceContext(ctx, cfg.ShutdownTimeout)
+	defer stopGrace()
+	downloads := newWorkerPool(ctx, "download", cfg.DownloadWorkers, cfg.RampUp, downloadWorker(graceCtx, imageChan))
+
+	workersDone := make(chan struct{})
+	stopUI := func() {}
+	if started != nil {
+		if stop := started(&scrapeRun{details: details, downloads: downloads, stopCrawl: stopCrawl, done: workersDone}); stop != nil {
+			stopUI = stop
+		}
+	}
+
+	if cfg.FollowLinks {
+		linkedCategories = newCategoryLinks(crawlCtx)
+	}
+	for _, param := range cfg.CategoryOptions.Ignored {
+		debugLog.Printf("ignoring unrecognized parameter %s of the -category URL", param)
+	}
+	crawler := newCrawler(httpClient, productChan, listingOptions(filters), cfg.PrefetchPages, cfg.CategoryTree, cfg.MaxDepth)
+	crawler.crawlSource(crawlCtx)
+	if linkedCategories != nil {
+		crawler.crawlLinked(crawlCtx)
+	}
+
+	// Drain the pipeline stage by stage
+	close(productChan)
+	pause.release() // A paused run would never drain the channels
+	details.drain()
+	details.wait()
+	close(imageChan)
+	downloads.drain()
+	downloads.wait()
+	productOrder.flush()
+	close(workersDone)
+	stopUI()
+	if err := manifest.close(); err != nil {
+		slog.Error("Failed to close manifest", "reason", err)
+	}
+	// Errors were logged as they happened
+	checkpoint.close()
+	if err := freshness.save(); err != nil {
+		slog.Error("Failed to save freshness index", "reason", err)
+	}
+	if productCatalog != nil {
+		if n, err := writeDuplicateReport(cfg.DuplicateReport, productCatalog); err != nil {
+			slog.Error("Failed to write duplicate product report", "reason", err)
+		} else if n > 0 {
+			slog.Warn("Products that look like re-listings of one item", "groups", n, "report", cfg.DuplicateReport)
+		}
+	}
+	if brokenImages != nil {
+		if n, err := writeBrokenReport(cfg.BrokenReport, brokenImages); err != nil {
+			slog.Error("Failed to write broken URL report", "reason", err)
+		} else if n > 0 {
+			slog.Warn("Image URLs that are gone for good", "count", n, "report", cfg.BrokenReport)
+		}
+	}
+	if cfg.SchemaBaseline != "" {
+		if err := checkSchemaDrift(cfg.SchemaBaseline); err != nil {
+			slog.Error("Failed to check for API changes", "reason", err)
+		}
+	}
+	if ctx.Err() != nil {
+		slog.Warn("Stopped early; run again to fetch the rest")
+	} else {
+		slog.Info("All tasks completed")
+	}
+	var runsRemoved int
+	var reclaimed int64
+	if cfg.Workspace != "" && (cfg.KeepRuns > 0 || cfg.KeepDays > 0) && ctx.Err() == nil {
+		runsRemoved, reclaimed, err = pruneWorkspaces(cfg.Workspace, cfg.KeepRuns, time.Duration(cfg.KeepDays), cfg.RetentionDryRun, time.Now())
+		if err != nil {
+			slog.Error("Failed to apply the workspace retention", "reason", err)
+		} else if runsRemoved > 0 && cfg.RetentionDryRun {
+			slog.Info("Old run workspaces that would be removed", "count", runsRemoved, "size", approxSize(reclaimed))
+		} else if runsRemoved > 0 {
+			slog.Info("Old run workspaces removed", "count", runsRemoved, "reclaimed", approxSize(reclaimed))
+		}
+	}
+	if n := stats.Nonexistent.Load(); n > 0 {
+		slog.Info("Product IDs that do not exist", "count", n)
+	}
+	if n := stats.ResumeSkipped.Load(); n > 0 {
+		slog.Info("Products skipped below -resume-from-id", "count", n)
+	}
+	if n := stats.Checkpointed.Load(); n > 0 {
+		slog.Info("Products skipped as finished in the checkpoint", "count", n)
+	}
+	if n := stats.Indexed.Load(); n > 0 {
+		slog.Info("Products skipped as already complete in the manifest", "count", n)
+	}
+	if n := stats.MemoryPressure.Load(); n > 0 {
+		slog.Info("Times memory use went over -max-memory", "count", n)
+	}
+	if n := stats.Backoffs.Load(); n > 0 {
+		slog.Info("Requests paused because the server refused them", "times", n, "paused", time.Duration(stats.BackedOff.Load()).Round(time.Second))
+	}
+	reportIntegrity()
+	if n := stats.SizeVariants.Load(); n > 0 {
+		slog.Info("Images skipped as other sizes of a photo", "count", n)
+	}
+	if n := stats.TooOld.Load(); n > 0 {
+		slog.Info("Products skipped as older than -max-product-age", "count", n)
+	}
+	if n := stats.DiscountFiltered.Load(); n > 0 {
+		slog.Info("Products skipped as discounted less than -min-discount", "count", n)
+	}
+	if n := stats.Trusted.Load(); n > 0 {
+		slog.Info("Images skipped as unchanged since recorded in the manifest", "count", n)
+	}
+	if n := stats.Fresh.Load(); n > 0 {
+		slog.Info("Images reused while still fresh", "count", n)
+	}
+	if n := stats.TooLarge.Load(); n > 0 {
+		slog.Info("Images skipped for exceeding -max-file-size", "count", n)
+	}
+	if n := stats.Duplicates.Load(); n > 0 {
+		slog.Info("Duplicate images linked instead of stored", "count", n, "strategy", dedupStorage())
+	}
+	if n := stats.TooSmall.Load(); n > 0 {
+		slog.Info("Images skipped for being below -min-dimensions", "count", n)
+	}
+	if n := stats.LowQuality.Load(); n > 0 {
+		slog.Info("Images skipped for scoring below -min-quality-score", "count", n)
+	}
+	if n := stats.WrongFormat.Load(); n > 0 {
+		slog.Info("Images skipped for a format not in -allow-format", "count", n)
+	}
+	if n := stats.CorruptImages.Load(); n > 0 {
+		slog.Warn("Images discarded for not decoding", "count", n)
+	}
+	if n := stats.Filtered.Load(); n > 0 {
+		slog.Info("Images rejected by the content filter", "count", n)
+	}
+	if n := stats.EmptyResolved.Load(); n > 0 {
+		slog.Info("Empty image lists resolved on retry", "count", n)
+	}
+	hosts := stats.hostSummaries()
+	for _, h := range hosts {
+		slog.Info("Responses by host", "host", h.Host, "responses", h.Responses, "statuses", h.shares())
+	}
+	logFirstError()
+	workers := stats.workerSummaries()
+	if cfg.Debug {
+		writeWorkerTable(os.Stderr, workers)
+	}
+
+	events.emit(SummaryEvent{
+		EventHeader:   newEventHeader(eventSummary),
+		Pages:         stats.Pages.Load(),
+		Products:      stats.Products.Load(),
+		Images:        stats.Images.Load(),
+		Errors:        stats.Errors.Load(),
+		EmptyResolved: stats.EmptyResolved.Load(),
+		FirstError:    firstError.Load(),
+		RunsRemoved:   runsRemoved,
+		Reclaimed:     reclaimed,
+		Tags:          cfg.Tags,
+		Schema:        schemas.hashes(),
+		Workers:       workers,
+		Hosts:         hosts,
+	})
+	if cause := context.Cause(ctx); errors.Is(cause, errDiskFull) {
+		return cause
+	}
+	return nil
 }
 
-// fetchProducts fetches products from a given page URL
-func fetchProducts(url string) ([]Product, error) {
-	resp, err := http.Get(url)
+// fetchCategoryPage fetches a listing page from the given page URL
+func (c *Client) fetchCategoryPage(ctx context.Context, url string) (*CategoryRes, error) {
+	resp, err := c.get(ctx, url)
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch page: %w", err)
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		return nil, newStatusError(url, resp)
+	}
+
 	var response CategoryRes
-	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+	decode := func(v any) error { return decodeSampledJSON(resp, schemaListing, v) }
+	if url == categoryRootURL {
+		decode = func(v any) error { return decodeJSON(resp, v) } // Shaped differently from listing pages
+	}
+	if err := decode(&response); err != nil {
 		return nil, fmt.Errorf("failed to decode response: %w", err)
 	}
 
-	return response.Data.Products, nil
+	return &response, nil
+}
+
+// productInfo is what the workers use from a product's details
+type productInfo struct {
+	Title     string    // Cleaned title, Persian when available
+	ImageURLs []string  // Main image first, then the gallery
+	Main      int       // How many of ImageURLs are of the main image
+	Price     int       // Selling price of the default variant in rials, zero if unavailable
+	Discount  int       // Discount of the default variant in percent, zero if none
+	Category  string    // Slug of the product's category, "" if not given
+	Brand     string    // Cleaned brand name, English when available
+	Added     time.Time // When the product was first listed on Digikala, zero if not given
+	Extra     extras    // Values of -product-extra-fields by path
 }
 
-// fetchProductDetails fetches product details including image URLs
 // fetchProductDetails fetches product details including all image URLs
-func fetchProductDetails(productID int) ([]string, error) {
+func (c *Client) fetchProductDetails(ctx context.Context, productID int) (productInfo, error) {
 	url := productDetailsURL + strconv.Itoa(productID) + "/"
-	resp, err := http.Get(url)
+	resp, err := c.get(ctx, url)
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch product %d details: %w", productID, err)
+		return productInfo{}, fmt.Errorf("failed to fetch product %d details: %w", productID, err)
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		return productInfo{}, fmt.Errorf("failed to fetch product %d details: %w", productID, newStatusError(url, resp))
+	}
+
 	var response ProductRes
-	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
-		return nil, fmt.Errorf("failed to decode product %d details: %w", productID, err)
+	extra, err := decodeProductRes(resp, &response)
+	if err != nil {
+		return productInfo{}, fmt.Errorf("failed to decode product %d details: %w", productID, err)
+	}
+
+	product := response.Data.Product
+	info := productInfo{Title: cleanText(product.TitleFa), Price: product.DefaultVariant.Price.SellingPrice.Value(), Category: product.Category.Code, Extra: extra}
+	if info.Title == "" {
+		info.Title = cleanText(product.TitleEn)
+	}
+	price := product.DefaultVariant.Price
+	info.Discount = price.DiscountPercent.Value()
+	if rrp := price.RRPPrice.Value(); info.Discount == 0 && rrp > info.Price && info.Price > 0 {
+		info.Discount = (rrp - info.Price) * 100 / rrp
+	}
+	info.Added = product.FirstPublishDate.Time
+	if info.Added.IsZero() {
+		info.Added = product.CreatedAt.Time
+	}
+	info.Brand = cleanText(product.Brand.TitleEn)
+	if info.Brand == "" {
+		info.Brand = cleanText(product.Brand.TitleFa)
 	}
 
 	// Collect all image URLs
-	var imageURLs []string
-	imageURLs = append(imageURLs, response.Data.Product.Images.Main.URLs...) // Add main URLs
+	info.ImageURLs = append(info.ImageURLs, product.Images.Main.URLs...) // Add main URLs
+	info.Main = len(info.ImageURLs)
 
-	for _, item := range response.Data.Product.Images.List {
-		imageURLs = append(imageURLs, item.URLs...) // Add list URLs
+	for _, item := range product.Images.List {
+		info.ImageURLs = append(info.ImageURLs, item.URLs...) // Add list URLs
 	}
 
-	return imageURLs, nil
+	return info, nil
 }
 
-// downloadImage downloads the image from the given URL and saves it locally
-func downloadImage(url, filename string) error {
-	// Create the ./img directory if it doesn't exist
-	imageDir := "./img"
-	if err := os.MkdirAll(imageDir, os.ModePerm); err != nil {
-		return fmt.Errorf("failed to create directory: %w", err)
+// detailRequests coalesces concurrent detail lookups of the same product
+var detailRequests singleflight.Group
+
+// fetchProductInfo fetches the details of a product. If the same product is
+// already being looked up, it waits for that lookup and shares its result
+// instead of making another request. The returned image slice must not be
+// modified.
+func (c *Client) fetchProductInfo(ctx context.Context, productID int) (productInfo, error) {
+	v, err, shared := detailRequests.Do(strconv.Itoa(productID), func() (any, error) {
+		return c.fetchProductInfoWithRetry(ctx, productID)
+	})
+	if shared {
+		debugLog.Printf("product %d: shared an in-flight detail request", productID)
 	}
+	info, _ := v.(productInfo)
+	return info, err
+}
 
-	// Construct the full file path
-	filePath := filepath.Join(imageDir, filename)
+// fetchProductInfoWithRetry fetches the details of a product, retrying failed
+// requests. With -retry-on-empty an empty image list is retried as well and
+// errNoImages is returned once the retries are used up.
+func (c *Client) fetchProductInfoWithRetry(ctx context.Context, productID int) (productInfo, error) {
+	var info productInfo
+	sawEmpty := false
+	err := cfg.retryPolicy(stageDetails).do(ctx, func(ctx context.Context) error {
+		details, err := c.fetchProductDetails(ctx, productID)
+		if err != nil {
+			return err
+		}
+		if len(details.ImageURLs) == 0 && cfg.RetryOnEmpty {
+			sawEmpty = true
+			return fmt.Errorf("product %d: %w", productID, errNoImages)
+		}
+		info = details
+		return nil
+	})
+	if err == nil && sawEmpty && len(info.ImageURLs) > 0 {
+		stats.EmptyResolved.Add(1)
+	}
+	return info, err
+}
 
-	// Fetch the image
-	resp, err := http.Get(url)
+// fetchedImage describes an image streamed by streamImage
+type fetchedImage struct {
+	Size   int64
+	SHA256 [sha256.Size]byte
+	Header http.Header
+}
+
+// FetchImage fetches the image at url into memory, decoded and within
+// -max-file-size, and returns it with its Content-Type. It writes nothing to
+// disk, so the bytes can go anywhere.
+func (c *Client) FetchImage(ctx context.Context, url string) ([]byte, string, error) {
+	var buf bytes.Buffer
+	image, err := c.streamImage(ctx, url, &buf)
 	if err != nil {
-		return fmt.Errorf("failed to fetch image: %w", err)
+		return nil, "", err
+	}
+	return buf.Bytes(), image.Header.Get("Content-Type"), nil
+}
+
+// streamImage copies the image at url, decoded and within -max-file-size, to
+// w and returns its size, SHA-256 and response header. The hash is computed
+// while copying, so the image is never held in memory. Part of an image
+// over the limit may have been written to w by the time errTooLarge is
+// returned.
+func (c *Client) streamImage(ctx context.Context, url string, w io.Writer) (fetchedImage, error) {
+	resp, err := c.get(ctx, url)
+	if err != nil {
+		var le *redirectLoopError
+		if errors.As(err, &le) {
+			slog.Warn("Image redirects in a loop, not retrying", "url", url, "chain", le.Chain)
+		}
+		return fetchedImage{}, fmt.Errorf("failed to fetch image: %w", err)
 	}
 	defer resp.Body.Close()
 
-	// Create the file in the specified directory
-	file, err := os.Create(filePath)
+	if resp.StatusCode != http.StatusOK {
+		return fetchedImage{}, fmt.Errorf("failed to fetch image: %w", newStatusError(url, resp))
+	}
+
+	// Skip images announced as too large before reading any of the body
+	if cfg.MaxFileSize > 0 && resp.ContentLength > int64(cfg.MaxFileSize) {
+		slog.Warn("Skipping image larger than -max-file-size", "url", url, "size", byteSize(resp.ContentLength))
+		return fetchedImage{}, errTooLarge
+	}
+
+	body, err := decodedBody(resp)
+	if err != nil {
+		return fetchedImage{}, fmt.Errorf("failed to fetch image: %w", err)
+	}
+	// Read at most one byte past the size limit when the server did not
+	// announce the length
+	if cfg.MaxFileSize > 0 {
+		body = io.LimitReader(body, int64(cfg.MaxFileSize)+1)
+	}
+	hash := sha256.New()
+	written, err := io.Copy(w, io.TeeReader(body, hash))
 	if err != nil {
-		return fmt.Errorf("failed to create file: %w", err)
+		return fetchedImage{}, fmt.Errorf("failed to fetch image: %w", err)
+	}
+	if cfg.MaxFileSize > 0 && written > int64(cfg.MaxFileSize) {
+		slog.Warn("Discarding image larger than -max-file-size", "url", url, "size", fmt.Sprintf("over %s", cfg.MaxFileSize))
+		return fetchedImage{}, errTooLarge
+	}
+	image := fetchedImage{Size: written, Header: resp.Header}
+	hash.Sum(image.SHA256[:0])
+	return image, nil
+}
+
+// downloadImage downloads the image from the given URL and saves it in dir.
+// The returned entry describes the saved file and has no Path when a still
+// fresh copy was kept instead.
+func (c *Client) downloadImage(ctx context.Context, url, dir, filename string) (manifestEntry, error) {
+	// Create the image directory if it doesn't exist
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return manifestEntry{}, fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	// Construct the full file path
+	filePath := filepath.Join(dir, filename)
+
+	// Skip images the manifest vouches for without asking the server at all
+	if trustedImages != nil && trusted(url, filePath) {
+		stats.Trusted.Add(1)
+		slog.Debug("Image matches the manifest", "path", filePath)
+		return manifestEntry{}, nil
+	}
+
+	// Reuse the saved image while its Cache-Control lifetime lasts
+	if freshness.fresh(filePath, url, time.Now()) {
+		stats.Fresh.Add(1)
+		slog.Debug("Image still fresh", "path", filePath)
+		return manifestEntry{}, nil
 	}
-	defer file.Close()
 
-	// Copy the response body to the file
-	_, err = io.Copy(file, resp.Body)
+	// Write to a temporary file first so a partial image never takes the
+	// final name
+	tmpPath := stagingPath(filePath)
+	defer os.Remove(tmpPath) // No-op once renamed
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return manifestEntry{}, fmt.Errorf("failed to create file: %w", err)
+	}
+	image, err := c.streamImage(ctx, url, file)
+	if closeErr := file.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("failed to save image: %w", closeErr)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to save image: %w", err)
+		return manifestEntry{}, err
 	}
+	sum, header := image.SHA256, image.Header
 
-	fmt.Printf("Image saved as %s\n", filePath)
-	return nil
-}
+	if cfg.VerifyImageFormat {
+		if runErr := cpuPool.run(ctx, func() { err = verifyImage(tmpPath) }); runErr != nil {
+			return manifestEntry{}, runErr
+		}
+		if err != nil {
+			slog.Error("Discarding image that does not decode", "url", url, "reason", err)
+			return manifestEntry{}, err
+		}
+	}
 
-// productWorker handles fetching product details and downloading images concurrently
-func productWorker(productChan <-chan int, wg *sync.WaitGroup) {
-	defer wg.Done()
+	entry := manifestEntry{URL: url, Path: filePath, Size: image.Size, SHA256: hex.EncodeToString(sum[:]), Time: time.Now()}
+	// Only the header is decoded; an undecodable one leaves the size unknown
+	if meta, err := probeImage(tmpPath); err != nil {
+		debugLog.Printf("image %s: %v", url, err)
+	} else {
+		entry.Width, entry.Height, entry.Format = meta.Width, meta.Height, meta.Format
+	}
+	if !formatAllowed(entry.Format) {
+		slog.Debug("Discarding image of a format not in -allow-format", "url", url, "format", entry.Format)
+		return manifestEntry{}, errFormatNotAllowed
+	}
+	if !cfg.MinDimensions.allows(entry.Width, entry.Height) {
+		slog.Debug("Discarding image smaller than -min-dimensions", "url", url, "width", entry.Width, "height", entry.Height)
+		return manifestEntry{}, errTooSmall
+	}
+	if cfg.MinQuality > 0 {
+		var score float64
+		if runErr := cpuPool.run(ctx, func() { score, err = qualityScore(tmpPath) }); runErr != nil {
+			return manifestEntry{}, runErr
+		}
+		if err != nil {
+			debugLog.Printf("image %s: %v", url, err)
+		} else if entry.Quality = score; score < cfg.MinQuality {
+			slog.Info("Discarding image below -min-quality-score", "url", url, "score", fmt.Sprintf("%.3f", score))
+			return manifestEntry{}, errLowQuality
+		}
+	}
+	if contentFilter != nil {
+		ok, reason, err := contentFilter.Allow(ctx, tmpPath)
+		if err != nil {
+			return manifestEntry{}, err
+		}
+		if !ok {
+			slog.Warn("Skipping image rejected by the content filter", "url", url, "reason", reason)
+			return manifestEntry{}, errFiltered
+		}
+	}
 
-	for productID := range productChan {
-		fmt.Printf("Fetching details for product ID: %d\n", productID)
-		imageURLs, err := fetchProductDetails(productID)
+	if cfg.OutputSymlinks {
+		blob, err := storeBlob(tmpPath, entry.SHA256, filepath.Ext(filename))
 		if err != nil {
-			fmt.Printf("Failed to fetch product %d details: %v\n", productID, err)
-			continue
+			return manifestEntry{}, err
+		}
+		entry.Storage, entry.Blob = linkDuplicate(blob, filePath, blobLinkStrategy()), blob
+		if cfg.Checksums {
+			if err := writeChecksum(filePath, sum[:]); err != nil {
+				return manifestEntry{}, err
+			}
 		}
+		if cfg.StoreSourceURL {
+			if err := storeSourceURL(filePath, url, true); err != nil {
+				return manifestEntry{}, err
+			}
+		}
+		freshness.record(filePath, url, header, time.Now())
+		slog.Debug("Image saved", "path", filePath, "blob", blob)
+		return entry, nil
+	}
 
-		for i, imgURL := range imageURLs {
-			filename := fmt.Sprintf("product_%d_img_%d.jpg", productID, i+1)
-			if err := downloadImage(imgURL, filename); err != nil {
-				fmt.Printf("Failed to download image for product %d: %v\n", productID, err)
+	// Link to an identical image saved earlier instead of storing it again
+	original := ""
+	if dedupChecks(dedupSHA256) {
+		original = dedupe.original(entry.SHA256, filePath)
+	}
+	// Then to one that looks the same, which takes decoding the image
+	var hash uint64
+	hashed := false
+	if original == "" && dedupChecks(dedupPHash) {
+		if runErr := cpuPool.run(ctx, func() { hash, err = perceptualHash(tmpPath) }); runErr != nil {
+			return manifestEntry{}, runErr
+		}
+		if err != nil {
+			debugLog.Printf("image %s: %v", url, err)
+		} else {
+			hashed = true
+			original = dedupe.similar(hash, filePath)
+		}
+	}
+	if original != "" {
+		entry.Storage = linkDuplicate(original, filePath, dedupStorage())
+		entry.DuplicateOf = original
+		if cfg.StoreSourceURL && entry.Storage != storageReference {
+			if err := storeSourceURL(filePath, url, true); err != nil {
+				return manifestEntry{}, err
 			}
 		}
+		stats.Duplicates.Add(1)
+		slog.Debug("Image is a duplicate", "path", filePath, "of", original, "storage", entry.Storage)
+		return entry, nil
+	}
+
+	entry.Storage = storageFile
+	if err := moveFile(tmpPath, filePath); err != nil {
+		return manifestEntry{}, fmt.Errorf("failed to save image: %w", err)
 	}
+	// Only an image on disk can be linked to
+	if dedupChecks(dedupSHA256) {
+		dedupe.record(entry.SHA256, hash, hashed, filePath)
+	}
+	if cfg.Checksums {
+		if err := writeChecksum(filePath, sum[:]); err != nil {
+			return manifestEntry{}, err
+		}
+	}
+	if cfg.StoreSourceURL {
+		if err := storeSourceURL(filePath, url, false); err != nil {
+			return manifestEntry{}, err
+		}
+	}
+
+	freshness.record(filePath, url, header, time.Now())
+	slog.Debug("Image saved", "path", filePath)
+	return entry, nil
 }
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flagDefaults is cfg as parseFlags leaves it without arguments, with the
+// values of its stage retry policies
+var flagDefaults struct {
+	once    sync.Once
+	cfg     Config
+	retries map[string]retryPolicy
+}
+
+// useDefaults sets cfg to the flag defaults, without the waits between
+// retries and the checks before a run that tests have no use for
+func useDefaults() {
+	flagDefaults.once.Do(func() {
+		parseFlags(nil)
+		flagDefaults.cfg = cfg
+		flagDefaults.retries = make(map[string]retryPolicy)
+		for stage, p := range cfg.StageRetries {
+			flagDefaults.retries[stage] = *p
+		}
+	})
+	policies := cfg.StageRetries
+	cfg = flagDefaults.cfg
+	cfg.StageRetries = policies
+	for stage, p := range flagDefaults.retries {
+		*policies[stage] = p
+	}
+	// Tests don't wait out real backoffs
+	cfg.RetryBase, cfg.RetryCap = 0, 0
+	cfg.NoPreflight = true
+	cfg.SchemaBaseline = ""
+}
+
+// setupTest gives the test the default configuration, fresh counters and
+// per-run state, and an empty working directory, so imageDir is its own.
+// It returns the directory.
+func setupTest(t *testing.T) string {
+	t.Helper()
+	useDefaults()
+	resetStats()
+	requestLimiter, productLimiter = newHostLimiters(0, nil, priorityFIFO), newLimiter(0)
+	backoff = nil
+	freshness, dedupe, manifest, linkedCategories, trustedImages, indexedProducts = nil, nil, nil, nil, nil, nil
+	productCatalog, brokenImages, queueSlots, productOrder = nil, nil, nil, nil
+	checkpointed, checkpoint = nil, nil
+	observedIDWidth.Store(0)
+
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	return dir
+}
+
+// redirectTransport sends every request to one test server whatever its
+// host, so the API's fixed URLs reach it
+type redirectTransport struct {
+	target *url.URL
+	next   http.RoundTripper
+}
+
+func (t redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme, req.URL.Host = t.target.Scheme, t.target.Host
+	return t.next.RoundTrip(req)
+}
+
+// serveAPI starts a test server with handler and points httpClient at it
+// for the rest of the test
+func serveAPI(t *testing.T, handler http.Handler) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	target, _ := url.Parse(server.URL)
+	previous := httpClient
+	httpClient = NewClient(redirectTransport{target: target, next: http.DefaultTransport})
+	t.Cleanup(func() { httpClient = previous })
+	return server
+}
+
+// writeProduct answers a details request for product id with images
+// images, served at /img/<id>-<n>.png from 1
+func writeProduct(t testing.TB, w http.ResponseWriter, id, images int) {
+	t.Helper()
+	var res ProductRes
+	res.Status = 200
+	res.Data.Product.TitleFa = fmt.Sprintf("product %d", id)
+	for n := 1; n <= images; n++ {
+		res.Data.Product.Images.Main.URLs = append(res.Data.Product.Images.Main.URLs, fmt.Sprintf("https://dkstatics-public.digikala.com/img/%d-%d.png", id, n))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		t.Error(err)
+	}
+}
+
+// productID returns the product a details or image request of the test
+// server is for, or 0
+func productID(r *http.Request) int {
+	path := r.URL.Path
+	if rest, ok := strings.CutPrefix(path, "/v2/product/"); ok {
+		id, _ := strconv.Atoi(strings.Trim(rest, "/"))
+		return id
+	}
+	if rest, ok := strings.CutPrefix(path, "/img/"); ok {
+		id, _, _ := strings.Cut(rest, "-")
+		n, _ := strconv.Atoi(id)
+		return n
+	}
+	return 0
+}
+
+// scrapeIDs sets cfg up to scrape the product IDs from-to
+func scrapeIDs(from, to int) {
+	cfg.Source = sourceIDRange
+	cfg.IDRange = idRange{From: from, To: to}
+}
+
+// savedImages returns the images under imageDir
+func savedImages(t testing.TB) []string {
+	t.Helper()
+	var paths []string
+	err := filepath.WalkDir(imageDir, func(path string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() && filepath.Ext(path) == ".jpg" {
+			paths = append(paths, path)
+		}
+		return err
+	})
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return paths
+}
+
+// testPNG encodes a width x height PNG filled with c
+func testPNG(t testing.TB, width, height int, c color.Color) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestFetchImage(t *testing.T) {
+	setupTest(t)
+	cfg.MaxFileSize = 100
+	small := bytes.Repeat([]byte("x"), 100)
+	large := bytes.Repeat([]byte("x"), 101)
+	serveAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/small.jpg":
+			w.Header().Set("Content-Type", "image/jpeg")
+			w.Write(small)
+		case "/announced.jpg":
+			w.Header().Set("Content-Length", strconv.Itoa(len(large)))
+			w.Write(large)
+		case "/chunked.jpg":
+			// Flushing first leaves the length unannounced
+			w.(http.Flusher).Flush()
+			w.Write(large)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	const host = "https://dkstatics-public.digikala.com"
+
+	data, contentType, err := httpClient.FetchImage(context.Background(), host+"/small.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, small) || contentType != "image/jpeg" {
+		t.Errorf("got %d bytes of %q, want %d bytes of image/jpeg", len(data), contentType, len(small))
+	}
+
+	for _, path := range []string{"/announced.jpg", "/chunked.jpg"} {
+		if _, _, err := httpClient.FetchImage(context.Background(), host+path); !errors.Is(err, errTooLarge) {
+			t.Errorf("%s: err = %v, want errTooLarge", path, err)
+		}
+	}
+
+	var se *statusError
+	if _, _, err := httpClient.FetchImage(context.Background(), host+"/missing.jpg"); !errors.As(err, &se) || se.StatusCode != http.StatusNotFound {
+		t.Errorf("missing image: err = %v, want a 404 status error", err)
+	}
+}
+
+func TestStreamImageHashesWhileCopying(t *testing.T) {
+	setupTest(t)
+	data := testPNG(t, 16, 16, color.Gray{Y: 128})
+	serveAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write(data) }))
+
+	var buf bytes.Buffer
+	image, err := httpClient.streamImage(context.Background(), "https://dkstatics-public.digikala.com/a.png", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Error("streamed bytes differ from the served image")
+	}
+	if image.Size != int64(len(data)) || image.SHA256 != sha256.Sum256(data) {
+		t.Errorf("size %d, hash %x; want %d, %x", image.Size, image.SHA256, len(data), sha256.Sum256(data))
+	}
+}
+
+// waitFor polls cond until it holds, failing the test after a few seconds
+func waitFor(t testing.TB, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
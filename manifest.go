@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// manifestEntry describes one saved image
+type manifestEntry struct {
+	ProductID   int               `json:"product_id"`
+	ImageCount  int               `json:"image_count,omitempty"` // Images of the product, this one included
+	URL         string            `json:"url"`
+	Host        string            `json:"host,omitempty"` // Mirror host that served the image, with -image-mirrors
+	Path        string            `json:"path"`
+	Size        int64             `json:"size"`
+	SHA256      string            `json:"sha256"`
+	Width       int               `json:"width,omitempty"` // Zero when the header could not be decoded
+	Height      int               `json:"height,omitempty"`
+	Format      string            `json:"format,omitempty"`       // jpeg, png, gif or webp
+	Quality     float64           `json:"quality,omitempty"`      // Sharpness from 0 to 1, with -min-quality-score
+	Storage     string            `json:"storage"`                // One of the storage constants
+	DuplicateOf string            `json:"duplicate_of,omitempty"` // Identical image this one links or refers to
+	Blob        string            `json:"blob,omitempty"`         // Content-addressed file the path links to, with -output-symlinks
+	Recheck     string            `json:"sha256_again,omitempty"` // SHA-256 of a second fetch, with -integrity-sample
+	Tags        map[string]string `json:"tags,omitempty"`         // From -tag
+	Extra       extras            `json:"extra,omitempty"`        // From -product-extra-fields
+	Time        time.Time         `json:"time"`
+}
+
+// Values of -durability, when manifest entries are synced to disk
+const (
+	durabilityNone   = "none"   // Left to the operating system
+	durabilityBatch  = "batch"  // Every -manifest-batch-size entries or -manifest-flush-interval
+	durabilityAlways = "always" // After every write
+)
+
+// durabilities lists the accepted -durability values
+var durabilities = []string{durabilityNone, durabilityBatch, durabilityAlways}
+
+// manifest records the images saved by this run; nil when -manifest is empty
+var manifest *manifestWriter
+
+// manifestWriter appends entries to a JSON lines file. Runs append to the
+// same file, so a path can appear more than once; the last entry is current.
+type manifestWriter struct {
+	mu   sync.Mutex
+	file *os.File
+
+	durability string        // One of the durability constants
+	syncEvery  int           // With durabilityBatch, entries written between syncs
+	unsynced   int           // Entries written since the last sync
+	stop       chan struct{} // Ends the durabilityBatch sync ticker; nil without it
+
+	// With -parallel-manifest-writes, entries go through this channel to a
+	// goroutine that writes them in batches; nil otherwise
+	entries chan manifestEntry
+	done    chan struct{} // Closed once the batching goroutine has flushed
+}
+
+func openManifest(path string) (*manifestWriter, error) {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, fmt.Errorf("failed to create manifest directory: %w", err)
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open manifest: %w", err)
+	}
+	if err := dropTornTail(file); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to repair manifest: %w", err)
+	}
+	return &manifestWriter{file: file, durability: durabilityNone}, nil
+}
+
+// dropTornTail cuts an entry left incomplete by a crash off the end of the
+// manifest, so that the entries appended next start on a line of their own.
+// A complete entry only missing its newline gets the newline instead.
+func dropTornTail(file *os.File) error {
+	info, err := file.Stat()
+	if err != nil || info.Size() == 0 {
+		return err
+	}
+	// Entries are far smaller than the 1MB readManifest accepts
+	start := max(0, info.Size()-1024*1024)
+	tail := make([]byte, info.Size()-start)
+	if _, err := file.ReadAt(tail, start); err != nil {
+		return err
+	}
+	if tail[len(tail)-1] == '\n' {
+		return nil
+	}
+	i := bytes.LastIndexByte(tail, '\n')
+	if last := tail[i+1:]; json.Valid(last) {
+		_, err := file.Write([]byte{'\n'})
+		return err
+	}
+	slog.Warn("Dropping the last manifest entry, cut short by an earlier crash", "bytes", len(tail)-i-1)
+	return file.Truncate(start + int64(i+1))
+}
+
+// sync sets when written entries are synced to disk, following policy: with
+// durabilityBatch, every size entries and, while any wait, every interval
+func (m *manifestWriter) sync(policy string, size int, interval time.Duration) {
+	m.durability, m.syncEvery = policy, size
+	if policy != durabilityBatch {
+		return
+	}
+	m.stop = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.stop:
+				return
+			case <-ticker.C:
+			}
+			m.mu.Lock()
+			if m.unsynced > 0 {
+				if err := m.syncFile(); err != nil {
+					slog.Warn("Failed to sync manifest", "reason", friendlyError(err))
+				}
+			}
+			m.mu.Unlock()
+		}
+	}()
+}
+
+// wrote counts n entries just written and syncs the file when the policy
+// asks for it; m.mu must be held
+func (m *manifestWriter) wrote(n int) error {
+	m.unsynced += n
+	if m.durability == durabilityAlways || m.durability == durabilityBatch && m.unsynced >= m.syncEvery {
+		return m.syncFile()
+	}
+	return nil
+}
+
+// syncFile flushes the manifest to disk; m.mu must be held
+func (m *manifestWriter) syncFile() error {
+	if err := m.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync manifest: %w", err)
+	}
+	m.unsynced = 0
+	return nil
+}
+
+// batch makes add hand entries to a goroutine that writes them size at a
+// time, or whatever has arrived every interval, so workers don't wait on
+// the file. Write errors are then logged rather than returned.
+func (m *manifestWriter) batch(size int, interval time.Duration) {
+	m.entries, m.done = make(chan manifestEntry, size), make(chan struct{})
+	go func() {
+		defer close(m.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		var buf []byte
+		pending := 0
+		flush := func() {
+			if pending == 0 {
+				return
+			}
+			m.mu.Lock()
+			_, err := m.file.Write(buf)
+			if err == nil {
+				err = m.wrote(pending)
+			}
+			m.mu.Unlock()
+			if err != nil {
+				slog.Error("Failed to write manifest entries", "count", pending, "reason", friendlyError(err))
+				debugLog.Printf("manifest: %v", err)
+			}
+			buf, pending = buf[:0], 0
+		}
+		for {
+			select {
+			case e, ok := <-m.entries:
+				if !ok {
+					flush()
+					return
+				}
+				line, err := json.Marshal(e)
+				if err != nil {
+					slog.Error("Failed to record image in manifest", "product", e.ProductID, "reason", err)
+					continue
+				}
+				buf, pending = append(append(buf, line...), '\n'), pending+1
+				if pending >= size {
+					flush()
+				}
+			case <-ticker.C:
+				flush()
+			}
+		}
+	}()
+}
+
+// add appends e; it is a no-op on a nil *manifestWriter
+func (m *manifestWriter) add(e manifestEntry) error {
+	if m == nil {
+		return nil
+	}
+	if m.entries != nil {
+		m.entries <- e
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// Marshal each entry on its own: a json.Encoder would keep failing after
+	// one failed write, e.g. on a full disk that was freed since
+	line, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	if _, err := m.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return m.wrote(1)
+}
+
+// close closes the manifest file; it is a no-op on a nil *manifestWriter
+func (m *manifestWriter) close() error {
+	if m == nil {
+		return nil
+	}
+	if m.entries != nil {
+		close(m.entries)
+		<-m.done
+	}
+	if m.stop != nil {
+		close(m.stop)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.durability != durabilityNone && m.unsynced > 0 {
+		if err := m.syncFile(); err != nil {
+			m.file.Close()
+			return err
+		}
+	}
+	return m.file.Close()
+}
+
+// trustedImages holds the latest manifest entry of each image URL when
+// -trust-manifest is set, and is nil otherwise
+var trustedImages map[string]manifestEntry
+
+// readManifest calls fn with every entry of the manifest at path, oldest
+// first; a missing manifest has no entries. A last entry that does not
+// decode was cut short by a crash and is dropped; anywhere else it is an
+// error.
+func readManifest(path string, fn func(manifestEntry)) error {
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open manifest: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	var torn error
+	for line := 1; scanner.Scan(); line++ {
+		if torn != nil {
+			return torn
+		}
+		var e manifestEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			torn = fmt.Errorf("%s:%d: failed to decode manifest entry: %w", path, line, err)
+			continue
+		}
+		fn(e)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read manifest: %w", err)
+	}
+	if torn != nil {
+		slog.Warn("Ignoring the last manifest entry, cut short by an earlier crash", "reason", torn)
+	}
+	return nil
+}
+
+// loadManifest reads the manifest at path and returns the latest entry of
+// each URL
+func loadManifest(path string) (map[string]manifestEntry, error) {
+	entries := make(map[string]manifestEntry)
+	err := readManifest(path, func(e manifestEntry) { entries[e.URL] = e })
+	return entries, err
+}
+
+// indexedProducts holds, when -skip-indexed is set, the products the manifest
+// has every image of, with the time the last of them was recorded
+var indexedProducts map[int]time.Time
+
+// loadProductIndex reads the manifest at path and returns the complete
+// products in it. A product is complete once it has an entry for as many
+// distinct images as its entries say it has; entries written before
+// image_count existed never make a product complete.
+func loadProductIndex(path string) (map[int]time.Time, error) {
+	type progress struct {
+		count  int
+		paths  map[string]bool
+		latest time.Time
+	}
+	products := make(map[int]*progress)
+	err := readManifest(path, func(e manifestEntry) {
+		if e.ProductID == 0 || e.ImageCount == 0 {
+			return
+		}
+		p := products[e.ProductID]
+		if p == nil {
+			p = &progress{paths: make(map[string]bool)}
+			products[e.ProductID] = p
+		}
+		p.count = e.ImageCount
+		p.paths[e.Path] = true
+		if e.Time.After(p.latest) {
+			p.latest = e.Time
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	index := make(map[int]time.Time)
+	for id, p := range products {
+		if len(p.paths) >= p.count {
+			index[id] = p.latest
+		}
+	}
+	return index, nil
+}
+
+// indexed reports whether the manifest has the product complete and recorded
+// within maxAge; zero means any age
+func indexed(productID int, maxAge time.Duration, now time.Time) bool {
+	recorded, ok := indexedProducts[productID]
+	return ok && (maxAge <= 0 || now.Sub(recorded) < maxAge)
+}
+
+// trusted reports whether the manifest vouches for the image url saved at
+// path: it was stored there as a file and the file still has the recorded
+// hash. Only the disk is read, never the network.
+func trusted(url, path string) bool {
+	e, ok := trustedImages[url]
+	if !ok || e.Path != path || e.Storage != storageFile || e.SHA256 == "" {
+		return false
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return false
+	}
+	return hex.EncodeToString(hash.Sum(nil)) == e.SHA256
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"image/color"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestTrustManifestMakesNoRequest runs a scrape, then runs it again with
+// -trust-manifest after one image was edited and another deleted: only those
+// two are requested again
+func TestTrustManifestMakesNoRequest(t *testing.T) {
+	setupTest(t)
+	scrapeIDs(1, 3)
+	data := testPNG(t, 8, 8, color.White)
+	var mu sync.Mutex
+	var requested []string
+	serveAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/v2/product/") {
+			writeProduct(t, w, productID(r), 2)
+			return
+		}
+		mu.Lock()
+		requested = append(requested, r.URL.Path)
+		mu.Unlock()
+		w.Write(data)
+	}))
+
+	if err := runScrape(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	saved := savedImages(t)
+	if len(saved) != 6 || len(requested) != 6 {
+		t.Fatalf("first run saved %d images with %d requests, want 6 and 6", len(saved), len(requested))
+	}
+
+	slices.Sort(saved)
+	edited, deleted := saved[0], saved[1]
+	if err := os.WriteFile(edited, []byte("edited"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(deleted); err != nil {
+		t.Fatal(err)
+	}
+
+	requested = nil
+	resetStats()
+	cfg.TrustManifest = true
+	if err := runScrape(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(requested) != 2 {
+		t.Errorf("second run requested %v, want only the edited and the deleted image", requested)
+	}
+	if got := stats.Trusted.Load(); got != 4 {
+		t.Errorf("%d images trusted, want 4", got)
+	}
+	if got, _ := os.ReadFile(edited); string(got) == "edited" {
+		t.Error("the edited image was not downloaded again")
+	}
+	if _, err := os.Stat(deleted); err != nil {
+		t.Errorf("the deleted image was not downloaded again: %v", err)
+	}
+}
+
+func TestTrusted(t *testing.T) {
+	setupTest(t)
+	const url = "https://dkstatics-public.digikala.com/a.jpg"
+	if err := os.WriteFile("a.jpg", []byte("image"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// sha256 of "image"
+	const sum = "6105d6cc76af400325e94d588ce511be5bfdbb73b437dc51eca43917d7a43e3d"
+	tests := []struct {
+		name  string
+		entry manifestEntry
+		want  bool
+	}{
+		{"intact", manifestEntry{URL: url, Path: "a.jpg", Storage: storageFile, SHA256: sum}, true},
+		{"other path", manifestEntry{URL: url, Path: "b.jpg", Storage: storageFile, SHA256: sum}, false},
+		{"other hash", manifestEntry{URL: url, Path: "a.jpg", Storage: storageFile, SHA256: strings.Repeat("0", 64)}, false},
+		{"no hash", manifestEntry{URL: url, Path: "a.jpg", Storage: storageFile}, false},
+		{"not a file", manifestEntry{URL: url, Path: "a.jpg", Storage: storageHardlink, SHA256: sum}, false},
+	}
+	for _, tt := range tests {
+		trustedImages = map[string]manifestEntry{url: tt.entry}
+		if got := trusted(url, "a.jpg"); got != tt.want {
+			t.Errorf("%s: trusted = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	trustedImages = map[string]manifestEntry{}
+	if trusted(url, "a.jpg") {
+		t.Error("trusted an image the manifest does not list")
+	}
+}
+
+// TestManifestTornAtEveryOffset cuts a manifest short at every byte, as a
+// crash may, and checks that reading it keeps every whole entry and that a
+// run appending to it leaves a manifest that reads back without error
+func TestManifestTornAtEveryOffset(t *testing.T) {
+	setupTest(t)
+	var full []byte
+	var ends []int // Offset just past each entry's closing brace
+	for i := 1; i <= 4; i++ {
+		line, _ := json.Marshal(manifestEntry{ProductID: i, URL: fmt.Sprintf("https://dkstatics-public.digikala.com/%d.jpg", i), Storage: storageFile})
+		full = append(full, line...)
+		ends = append(ends, len(full))
+		full = append(full, '\n')
+	}
+	// wholeBefore returns the products of the entries complete at offset n;
+	// one missing only its newline is complete
+	wholeBefore := func(n int) []int {
+		var ids []int
+		for i, end := range ends {
+			if end <= n {
+				ids = append(ids, i+1)
+			}
+		}
+		return ids
+	}
+	read := func(path string) ([]int, error) {
+		var ids []int
+		err := readManifest(path, func(e manifestEntry) { ids = append(ids, e.ProductID) })
+		return ids, err
+	}
+
+	for n := 0; n <= len(full); n++ {
+		path := fmt.Sprintf("manifest-%d.jsonl", n)
+		if err := os.WriteFile(path, full[:n], 0o644); err != nil {
+			t.Fatal(err)
+		}
+		want := wholeBefore(n)
+
+		ids, err := read(path)
+		if err != nil || !slices.Equal(ids, want) {
+			t.Errorf("cut at %d: read %v, %v; want %v", n, ids, err, want)
+			continue
+		}
+
+		m, err := openManifest(path)
+		if err != nil {
+			t.Errorf("cut at %d: %v", n, err)
+			continue
+		}
+		err = m.add(manifestEntry{ProductID: 99, URL: "https://dkstatics-public.digikala.com/99.jpg", Storage: storageFile})
+		if closeErr := m.close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			t.Errorf("cut at %d: %v", n, err)
+			continue
+		}
+		ids, err = read(path)
+		if err != nil || !slices.Equal(ids, append(want, 99)) {
+			t.Errorf("cut at %d, then appended to: read %v, %v; want %v", n, ids, err, append(want, 99))
+		}
+	}
+}
+
+func TestDropTornTail(t *testing.T) {
+	setupTest(t)
+	tests := []struct {
+		name, content, want string
+	}{
+		{"empty", "", ""},
+		{"whole", "{\"a\":1}\n", "{\"a\":1}\n"},
+		{"missing newline", "{\"a\":1}\n{\"b\":2}", "{\"a\":1}\n{\"b\":2}\n"},
+		{"torn", "{\"a\":1}\n{\"b\":", "{\"a\":1}\n"},
+		{"torn only entry", "{\"b\":", ""},
+	}
+	for _, tt := range tests {
+		if err := os.WriteFile("manifest.jsonl", []byte(tt.content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		file, err := os.OpenFile("manifest.jsonl", os.O_RDWR|os.O_APPEND, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = dropTornTail(file)
+		file.Close()
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got, _ := os.ReadFile("manifest.jsonl"); string(got) != tt.want {
+			t.Errorf("%s: repaired to %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestReadManifestTornInTheMiddle checks that only a torn last entry is
+// forgiven: a broken entry followed by others is an error
+func TestReadManifestTornInTheMiddle(t *testing.T) {
+	setupTest(t)
+	lines := []string{`{"product_id":1}`, `{"prod`, `{"product_id":3}`}
+	if err := os.WriteFile("manifest.jsonl", []byte(strings.Join(lines, "\n")+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := readManifest("manifest.jsonl", func(manifestEntry) {}); err == nil {
+		t.Error("read a manifest broken before its last entry without an error")
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+const (
+	memoryPoll     = time.Second     // How often memory use is checked
+	memoryLogEvery = time.Minute     // How often it is logged at debug level
+	memorySettle   = 5 * time.Second // How long a collection gets to bring it down
+	memoryLowWater = 0.8             // Share of -max-memory that ends memory pressure
+)
+
+// watchMemory logs the memory use of the run until ctx is done. With limit,
+// going over it collects garbage and, if that doesn't bring the heap under
+// memoryLowWater of the limit within memorySettle, drops the caches that
+// can be rebuilt, which only costs some duplicate detection.
+func watchMemory(ctx context.Context, limit byteSize) {
+	if limit > 0 {
+		debug.SetMemoryLimit(int64(limit)) // Makes the collector work harder close to the limit
+	}
+	ticker := time.NewTicker(memoryPoll)
+	defer ticker.Stop()
+	var logged, pressure time.Time // pressure is when the heap went over limit, zero while under
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			var m runtime.MemStats
+			runtime.ReadMemStats(&m)
+			if now.Sub(logged) >= memoryLogEvery {
+				slog.Debug("Memory use", "alloc", approxSize(int64(m.Alloc)), "sys", approxSize(int64(m.Sys)))
+				logged = now
+			}
+			if limit <= 0 {
+				continue
+			}
+			switch {
+			case pressure.IsZero() && m.Alloc > uint64(limit):
+				stats.MemoryPressure.Add(1)
+				slog.Warn("Memory use is over -max-memory, collecting garbage", "alloc", approxSize(int64(m.Alloc)), "limit", limit)
+				runtime.GC()
+				pressure = now
+			case pressure.IsZero():
+			case float64(m.Alloc) < memoryLowWater*float64(limit):
+				slog.Info("Memory use is back under -max-memory", "alloc", approxSize(int64(m.Alloc)))
+				pressure = time.Time{}
+			case now.Sub(pressure) >= memorySettle:
+				dropped := dedupe.shed()
+				slog.Warn("Memory use is still high, dropping the duplicate index", "alloc", approxSize(int64(m.Alloc)), "entries", dropped)
+				runtime.GC()
+				pressure = now
+			}
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// mirrorsError is returned when an image failed with a retryable error on
+// every mirror host it was tried on
+type mirrorsError struct {
+	Hosts []string // In the order they were tried
+	Err   error    // From the last host
+}
+
+func (e *mirrorsError) Error() string {
+	return fmt.Sprintf("failed on all %d mirrors (%s): %v", len(e.Hosts), strings.Join(e.Hosts, ", "), e.Err)
+}
+
+func (e *mirrorsError) Unwrap() error {
+	return e.Err
+}
+
+// mirrorURLs returns rawURL followed by the same URL on each other host of
+// mirrors. URLs whose host is not one of the mirrors, such as API URLs, are
+// returned alone.
+func mirrorURLs(rawURL string, mirrors []string) []string {
+	u, err := url.Parse(rawURL)
+	if err != nil || !slices.Contains(mirrors, u.Host) {
+		return []string{rawURL}
+	}
+	urls := []string{rawURL}
+	for _, host := range mirrors {
+		if host == u.Host {
+			continue
+		}
+		mirror := *u
+		mirror.Host = host
+		urls = append(urls, mirror.String())
+	}
+	return urls
+}
+
+// downloadFromMirrors downloads the image at rawURL with the download retry
+// policy, moving on to the next -image-mirrors host whenever the retries on
+// one host run out. The entry records the original URL and the host that
+// served the image.
+func (c *Client) downloadFromMirrors(ctx context.Context, rawURL, dir, filename string) (manifestEntry, error) {
+	urls := mirrorURLs(rawURL, cfg.ImageMirrors)
+	var hosts []string
+	var lastErr error
+	for _, mirrorURL := range urls {
+		var entry manifestEntry
+		err := cfg.retryPolicy(stageDownload).do(ctx, func(ctx context.Context) (err error) {
+			entry, err = c.downloadImage(ctx, mirrorURL, dir, filename)
+			return err
+		})
+		if err == nil {
+			if entry.SHA256 != "" && sampleIntegrity() {
+				// A failed second fetch says nothing about the first
+				if entry.Recheck, err = c.recheckImage(ctx, mirrorURL, entry.SHA256); err != nil {
+					debugLog.Printf("image %s: %v", rawURL, err)
+				}
+			}
+			if len(urls) > 1 && entry.Path != "" {
+				u, _ := url.Parse(mirrorURL) // Parsed by mirrorURLs
+				entry.URL, entry.Host = rawURL, u.Host
+			}
+			return entry, nil
+		}
+		if len(urls) == 1 || !retryable(err) || ctx.Err() != nil {
+			return manifestEntry{}, err
+		}
+		u, _ := url.Parse(mirrorURL)
+		hosts, lastErr = append(hosts, u.Host), err
+		if len(hosts) < len(urls) {
+			debugLog.Printf("image %s failed on %s, trying the next mirror: %v", rawURL, u.Host, err)
+		}
+	}
+	return manifestEntry{}, &mirrorsError{Hosts: hosts, Err: lastErr}
+}
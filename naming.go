@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync/atomic"
+)
+
+// defaultIDPadWidth pads product IDs with -sorted-output until a listing
+// page shows how long they are; Digikala's IDs have 8 digits
+const defaultIDPadWidth = 8
+
+// observedIDWidth is the number of digits of the largest product ID on the
+// first listing page of the run, zero until one is seen
+var observedIDWidth atomic.Int64
+
+// observeIDs fixes the -sorted-output padding from the first listing page
+// seen, so that every image of the run is named with the same width
+func observeIDs(products []Product) {
+	largest := 0
+	for _, p := range products {
+		largest = max(largest, p.ID)
+	}
+	if largest > 0 {
+		observedIDWidth.CompareAndSwap(0, int64(len(strconv.Itoa(largest))))
+	}
+}
+
+// idPadWidth is the width product IDs are padded to with -sorted-output:
+// -id-pad-width, the width seen on the first listing page, the width of the
+// end of -id-range, or defaultIDPadWidth
+func idPadWidth() int {
+	if cfg.IDPadWidth > 0 {
+		return cfg.IDPadWidth
+	}
+	if w := observedIDWidth.Load(); w > 0 {
+		return int(w)
+	}
+	if cfg.Source == sourceIDRange {
+		return len(strconv.Itoa(cfg.IDRange.To))
+	}
+	return defaultIDPadWidth
+}
+
+// imageFilename names image index, counted from 1, of the product with
+// count images. With -sorted-output the numbers are zero-padded, e.g.
+// product_00012345_img_01.jpg, so that names sort in numeric order.
+func imageFilename(productID, index, count int) string {
+	if !cfg.SortedOutput {
+		return fmt.Sprintf("product_%d_img_%d.jpg", productID, index)
+	}
+	indexWidth := max(2, len(strconv.Itoa(count)))
+	return fmt.Sprintf("product_%0*d_img_%0*d.jpg", idPadWidth(), productID, indexWidth, index)
+}
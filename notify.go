@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// telegramAPI is the Bot API endpoint, filled with the bot token
+const telegramAPI = "https://api.telegram.org/bot%s/sendMessage"
+
+// priceAlert is a price drop worth telling the user about
+type priceAlert struct {
+	ProductID int    `json:"product_id"`
+	Title     string `json:"title"`
+	OldPrice  int    `json:"old_price"` // Rials; zero when there was no earlier observation
+	NewPrice  int    `json:"new_price"` // Rials
+	Reason    string `json:"reason"`
+	URL       string `json:"url"`
+}
+
+// String returns the alert as a short message
+func (a priceAlert) String() string {
+	old := "unknown"
+	if a.OldPrice > 0 {
+		old = formatRials(a.OldPrice)
+	}
+	return fmt.Sprintf("Price drop: %s\n%s -> %s (%s)\n%s", a.Title, old, formatRials(a.NewPrice), a.Reason, a.URL)
+}
+
+// notifier delivers price alerts, and other messages for the user, somewhere
+type notifier interface {
+	notify(ctx context.Context, alert priceAlert) error
+	notifyMessage(ctx context.Context, message string) error
+}
+
+// webhookNotifier POSTs each alert as JSON to a URL
+type webhookNotifier struct {
+	url string
+}
+
+func (n webhookNotifier) notify(ctx context.Context, alert priceAlert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	return postAlert(ctx, n.url, "application/json", body)
+}
+
+func (n webhookNotifier) notifyMessage(ctx context.Context, message string) error {
+	body, err := json.Marshal(map[string]string{"message": message})
+	if err != nil {
+		return err
+	}
+	return postAlert(ctx, n.url, "application/json", body)
+}
+
+// telegramNotifier sends each alert as a Telegram message
+type telegramNotifier struct {
+	token  string
+	chatID string
+}
+
+func (n telegramNotifier) notify(ctx context.Context, alert priceAlert) error {
+	form := url.Values{"chat_id": {n.chatID}, "text": {alert.String()}}
+	return postAlert(ctx, fmt.Sprintf(telegramAPI, n.token), "application/x-www-form-urlencoded", []byte(form.Encode()))
+}
+
+func (n telegramNotifier) notifyMessage(ctx context.Context, message string) error {
+	form := url.Values{"chat_id": {n.chatID}, "text": {message}}
+	return postAlert(ctx, fmt.Sprintf(telegramAPI, n.token), "application/x-www-form-urlencoded", []byte(form.Encode()))
+}
+
+// postAlert sends body to target and fails on any non-2xx status
+func postAlert(ctx context.Context, target, contentType string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := httpClient.plain().Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send alert: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		// Don't put the Telegram token from the URL into logs
+		return fmt.Errorf("failed to send alert: %w", &statusError{URL: req.URL.Host, StatusCode: resp.StatusCode})
+	}
+	return nil
+}
+
+// formatRials formats a price with thousands separators
+func formatRials(price int) string {
+	digits := fmt.Sprint(price)
+	var b strings.Builder
+	for i, d := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			b.WriteByte(',')
+		}
+		b.WriteRune(d)
+	}
+	return b.String() + " rials"
+}
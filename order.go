@@ -0,0 +1,93 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+)
+
+// Values of -download-order, the order queued products are processed in
+const (
+	orderFIFO   = "fifo"    // As discovered
+	orderLIFO   = "lifo"    // Most recently discovered first
+	orderIDDesc = "id-desc" // Highest product ID, usually the newest product, first
+	orderIDAsc  = "id-asc"  // Lowest product ID first
+)
+
+// downloadOrders lists the accepted -download-order values
+var downloadOrders = []string{orderFIFO, orderLIFO, orderIDDesc, orderIDAsc}
+
+// queuedProduct is a product job waiting in a productHeap
+type queuedProduct struct {
+	job productJob
+	seq int // Position in discovery order
+}
+
+// productHeap is a container/heap of queued products ordered by less
+type productHeap struct {
+	items []queuedProduct
+	less  func(a, b queuedProduct) bool
+}
+
+func (h *productHeap) Len() int           { return len(h.items) }
+func (h *productHeap) Less(i, j int) bool { return h.less(h.items[i], h.items[j]) }
+func (h *productHeap) Swap(i, j int)      { h.items[i], h.items[j] = h.items[j], h.items[i] }
+func (h *productHeap) Push(x any)         { h.items = append(h.items, x.(queuedProduct)) }
+
+func (h *productHeap) Pop() any {
+	last := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	return last
+}
+
+// orderLess returns the comparison of the -download-order order
+func orderLess(order string) func(a, b queuedProduct) bool {
+	switch order {
+	case orderLIFO:
+		return func(a, b queuedProduct) bool { return a.seq > b.seq }
+	case orderIDDesc:
+		return func(a, b queuedProduct) bool { return a.job.ID > b.job.ID }
+	case orderIDAsc:
+		return func(a, b queuedProduct) bool { return a.job.ID < b.job.ID }
+	default:
+		return func(a, b queuedProduct) bool { return a.seq < b.seq }
+	}
+}
+
+// reorder passes the jobs from in on in the given order. It holds up to size
+// jobs, so the order applies to the products waiting at any moment rather
+// than the whole run, and the crawler still blocks once that many wait. The
+// returned channel is closed after in is closed and emptied, or once ctx is
+// done.
+func reorder(ctx context.Context, in <-chan productJob, size int, order string) <-chan productJob {
+	out := make(chan productJob)
+	go func() {
+		defer close(out)
+		queue := &productHeap{less: orderLess(order)}
+		seq := 0
+		for in != nil || queue.Len() > 0 {
+			// A nil channel blocks, switching a case off
+			recv, send := in, chan productJob(nil)
+			var next productJob
+			if queue.Len() > 0 {
+				send, next = out, queue.items[0].job
+			}
+			if queue.Len() >= max(size, 1) {
+				recv = nil
+			}
+			select {
+			case job, ok := <-recv:
+				if !ok {
+					in = nil
+					continue
+				}
+				heap.Push(queue, queuedProduct{job: job, seq: seq})
+				seq++
+			case send <- next:
+				heap.Pop(queue)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
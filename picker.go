@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/term"
+)
+
+// canPickCategory reports whether the interactive category picker can run
+func canPickCategory() bool {
+	if t := os.Getenv("TERM"); t == "" || t == "dumb" {
+		return false
+	}
+	return term.IsTerminal(int(os.Stdin.Fd())) && term.IsTerminal(int(os.Stdout.Fd()))
+}
+
+// pickerLevel is one level of the category tree shown by the picker
+type pickerLevel struct {
+	title string // title of the parent category, empty at the top
+	items []Category
+}
+
+// picker is the state of the interactive category picker
+type picker struct {
+	levels []pickerLevel
+	filter []rune
+	cursor int
+	status string
+}
+
+// pickCategory shows the category tree and lets the user filter it by typing,
+// move with the arrow keys, open subcategories with → and go back with ←.
+// Enter returns the highlighted category's slug; Esc or Ctrl-C cancels.
+func pickCategory() (string, error) {
+	roots, err := httpClient.fetchSubcategories(context.Background(), "")
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch categories: %w", err)
+	}
+	if len(roots) == 0 {
+		return "", errors.New("the category list is empty")
+	}
+
+	in := int(os.Stdin.Fd())
+	state, err := term.MakeRaw(in)
+	if err != nil {
+		return "", fmt.Errorf("failed to switch terminal to raw mode: %w", err)
+	}
+	defer term.Restore(in, state)
+	fmt.Fprint(os.Stdout, ansiAltScreen)
+	defer fmt.Fprint(os.Stdout, ansiMainScreen)
+
+	p := &picker{levels: []pickerLevel{{items: roots}}}
+	buf := make([]byte, 64)
+	for {
+		p.draw()
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			return "", fmt.Errorf("failed to read key: %w", err)
+		}
+		key := buf[:n]
+		switch {
+		case bytes.Equal(key, []byte{3}), bytes.Equal(key, []byte{27}):
+			return "", errors.New("cancelled")
+		case bytes.Equal(key, []byte{'\r'}), bytes.Equal(key, []byte{'\n'}):
+			if items := p.visible(); len(items) > 0 {
+				return items[p.cursor].Code, nil
+			}
+		case bytes.Equal(key, []byte("\x1b[A")):
+			p.cursor = max(p.cursor-1, 0)
+		case bytes.Equal(key, []byte("\x1b[B")):
+			p.cursor = min(p.cursor+1, max(len(p.visible())-1, 0))
+		case bytes.Equal(key, []byte("\x1b[C")):
+			p.open()
+		case bytes.Equal(key, []byte("\x1b[D")):
+			if len(p.levels) > 1 {
+				p.levels = p.levels[:len(p.levels)-1]
+				p.filter, p.cursor, p.status = nil, 0, ""
+			}
+		case bytes.Equal(key, []byte{127}), bytes.Equal(key, []byte{8}):
+			if len(p.filter) > 0 {
+				p.filter = p.filter[:len(p.filter)-1]
+				p.cursor = 0
+			}
+		case key[0] != 27:
+			for len(key) > 0 {
+				r, size := utf8.DecodeRune(key)
+				if unicode.IsPrint(r) {
+					p.filter = append(p.filter, r)
+				}
+				key = key[size:]
+			}
+			p.cursor = 0
+		}
+	}
+}
+
+// visible returns the items of the current level matching the filter, which
+// is compared against the Persian and English names and the slug
+func (p *picker) visible() []Category {
+	items := p.levels[len(p.levels)-1].items
+	filter := strings.ToLower(string(p.filter))
+	if filter == "" {
+		return items
+	}
+	var matches []Category
+	for _, c := range items {
+		if strings.Contains(strings.ToLower(c.TitleFa), filter) ||
+			strings.Contains(strings.ToLower(c.TitleEn), filter) ||
+			strings.Contains(strings.ToLower(c.Code), filter) {
+			matches = append(matches, c)
+		}
+	}
+	return matches
+}
+
+// open descends into the subcategories of the highlighted category
+func (p *picker) open() {
+	items := p.visible()
+	if len(items) == 0 {
+		return
+	}
+	c := items[p.cursor]
+	p.status = "Loading " + c.Code + "..."
+	p.draw()
+	children, err := httpClient.fetchSubcategories(context.Background(), c.Code)
+	switch {
+	case err != nil:
+		p.status = friendlyError(err)
+		debugLog.Printf("subcategories of %s: %v", c.Code, err)
+	case len(children) == 0:
+		p.status = c.Code + " has no subcategories; press Enter to select it"
+	default:
+		p.levels = append(p.levels, pickerLevel{title: categoryTitle(c), items: children})
+		p.filter, p.cursor, p.status = nil, 0, ""
+	}
+}
+
+// draw renders the picker to fit the terminal
+func (p *picker) draw() {
+	width, height, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil || width < 20 || height < 6 {
+		width, height = 80, 24
+	}
+
+	path := []string{"All categories"}
+	for _, level := range p.levels[1:] {
+		path = append(path, level.title)
+	}
+	lines := []string{
+		"Choose a category: type to filter, ↑/↓ move, → open, ← back, Enter select, Esc cancel",
+		strings.Join(path, " > "),
+		"Filter: " + string(p.filter),
+		p.status,
+	}
+
+	items := p.visible()
+	rows := height - len(lines)
+	first := max(p.cursor-rows+1, 0)
+	for i := first; i < len(items) && i < first+rows; i++ {
+		marker := "  "
+		if i == p.cursor {
+			marker = "> "
+		}
+		lines = append(lines, marker+categoryTitle(items[i])+"  ("+items[i].Code+")")
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(ansiHome)
+	for i, line := range lines {
+		buf.WriteString(truncate(line, width))
+		buf.WriteString(ansiClearLine)
+		if i < len(lines)-1 {
+			buf.WriteString("\r\n")
+		}
+	}
+	buf.WriteString(ansiClearBelow)
+	os.Stdout.Write(buf.Bytes())
+}
+
+// categoryTitle returns the name shown for c, both languages when available
+func categoryTitle(c Category) string {
+	switch {
+	case c.TitleFa != "" && c.TitleEn != "":
+		return c.TitleFa + " / " + c.TitleEn
+	case c.TitleFa != "":
+		return c.TitleFa
+	case c.TitleEn != "":
+		return c.TitleEn
+	}
+	return c.Code
+}
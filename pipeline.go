@@ -0,0 +1,424 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// The run is a pipeline of three stages joined by bounded channels:
+//
+//	crawler (listing pages) -> productJob -> detail workers -> imageJob -> download workers
+//
+// Every stage closes its output once its input is closed and its workers
+// have returned, so a normal run drains from front to back; a cancelled
+// context makes every stage return early instead. Images already
+// downloading are finished first, for up to -graceful-shutdown-timeout.
+
+// imageJob is one image of a product whose details are known
+type imageJob struct {
+	Product *productRun
+	Index   int // Position in the product's image list, from 0
+	URL     string
+}
+
+// productRun tracks a product while its images are being downloaded
+type productRun struct {
+	Job  productJob
+	Info productInfo
+
+	mu      sync.Mutex
+	next    int      // Index of the first image not queued yet
+	pending int      // Images not finished yet
+	failed  int      // Images that could not be downloaded
+	saved   []string // Path of each image on disk by index, "" when not saved
+	sent    []string // Paths uploaded to the remote sinks
+}
+
+// uploaded records that the image at path reached every remote sink
+func (r *productRun) uploaded(path string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sent = append(r.sent, path)
+}
+
+// take returns the product's next image that was held back by
+// -max-concurrent-per-product, if any
+func (r *productRun) take() (imageJob, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.next == len(r.Info.ImageURLs) {
+		return imageJob{}, false
+	}
+	job := imageJob{Product: r, Index: r.next, URL: r.Info.ImageURLs[r.next]}
+	r.next++
+	return job, true
+}
+
+// imageDone records the result of one image and reports whether it was the
+// product's last
+func (r *productRun) imageDone(index int, path string, failed bool) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.saved[index] = path
+	if failed {
+		r.failed++
+	}
+	r.pending--
+	return r.pending == 0
+}
+
+// detailWorker returns the loop of a stage 2 worker: it fetches the details
+// of queued products and hands their images to the download workers
+func detailWorker(products <-chan productJob, images chan<- imageJob) workerFunc {
+	return func(ctx context.Context, id string, stop <-chan struct{}) {
+		counters := stats.worker(id)
+		for {
+			activity.set(id, "idle")
+			waiting := time.Now()
+			var job productJob
+			select {
+			case <-stop:
+				return
+			case <-ctx.Done():
+				return
+			case j, ok := <-products:
+				if !ok {
+					return
+				}
+				job = j
+			}
+			pause.wait()
+			counters.waited(waiting)
+			if ctx.Err() != nil {
+				return
+			}
+			working := time.Now()
+			fetchDetails(ctx, id, job, images)
+			counters.worked(working)
+		}
+	}
+}
+
+// fetchDetails fetches the details of one product and queues its images
+func fetchDetails(ctx context.Context, workerID string, job productJob, images chan<- imageJob) {
+	productID := job.ID
+	var category string
+	defer func() { linkedCategories.report(category) }()
+	finishing := false // Once set, finishProduct frees the queue slot
+	defer func() {
+		if !finishing {
+			releaseQueueSlot()
+			productOrder.drop(job.Seq)
+		}
+	}()
+	var info productInfo
+	var err error
+	if cfg.NoDetailFetch {
+		info = job.Listed.info()
+		if len(info.ImageURLs) == 0 {
+			err = errNoImages
+		}
+	} else {
+		activity.set(workerID, fmt.Sprintf("product %d: fetching details", productID))
+		slog.Info("Fetching product details", "product", productID)
+		info, err = httpClient.fetchProductInfo(ctx, productID)
+	}
+	if errors.Is(err, errNoImages) {
+		slog.Warn("Product has no images", "product", productID)
+		err = nil
+	}
+	if ctx.Err() != nil {
+		return // shutting down
+	}
+	if err != nil && cfg.Source == sourceIDRange && hasStatus(err, http.StatusNotFound, http.StatusGone) {
+		stats.Nonexistent.Add(1)
+		debugLog.Printf("product %d does not exist", productID)
+		return
+	}
+	if err != nil {
+		stats.Errors.Add(1)
+		stats.worker(workerID).Errors.Add(1)
+		slog.Error("Failed to fetch product details", "product", productID, "reason", friendlyError(err))
+		debugLog.Printf("product %d: %v", productID, err)
+		e := newErrorEvent("product", err)
+		e.ProductID = productID
+		reportError(e)
+		return
+	}
+
+	if age := time.Since(info.Added); cfg.MaxProductAge > 0 && !info.Added.IsZero() && age > time.Duration(cfg.MaxProductAge) {
+		stats.TooOld.Add(1)
+		slog.Debug("Skipping product older than -max-product-age", "product", productID, "age", age.Round(time.Hour))
+		return
+	}
+
+	if cfg.MinDiscount > 0 && info.Discount < cfg.MinDiscount {
+		stats.DiscountFiltered.Add(1)
+		slog.Debug("Skipping product discounted less than -min-discount", "product", productID, "discount", info.Discount)
+		return
+	}
+
+	category = info.Category
+	productCatalog.add(productRecord{ID: productID, Title: info.Title, Brand: info.Brand})
+	stats.worker(workerID).Products.Add(1)
+	if imageURLRewriter != nil {
+		info.ImageURLs = rewriteURLs(productID, info.ImageURLs)
+	}
+	if cfg.DedupSizes != "" {
+		var variants int
+		info.ImageURLs, variants = dedupSizes(info.ImageURLs, cfg.DedupSizes)
+		stats.SizeVariants.Add(int64(variants))
+	}
+	run := &productRun{Job: job, Info: info, pending: len(info.ImageURLs), saved: make([]string, len(info.ImageURLs))}
+	// Past -max-concurrent-per-product, the download workers take the
+	// product's other images one by one as they finish these
+	run.next = len(info.ImageURLs)
+	if cfg.MaxPerProduct > 0 && run.next > cfg.MaxPerProduct {
+		run.next = cfg.MaxPerProduct
+	}
+	finishing = true
+	if run.pending == 0 {
+		finishProduct(workerID, run)
+		return
+	}
+	activity.set(workerID, fmt.Sprintf("product %d: queueing images", productID))
+	for i, imgURL := range info.ImageURLs[:run.next] {
+		select {
+		case images <- imageJob{Product: run, Index: i, URL: imgURL}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// rewriteURLs returns urls passed through imageURLRewriter. It copies the
+// slice, which may be shared with other workers; a URL that can't be
+// rewritten is kept as it is.
+func rewriteURLs(productID int, urls []string) []string {
+	rewritten := make([]string, len(urls))
+	for i, url := range urls {
+		r, err := imageURLRewriter.Rewrite(url)
+		if err != nil {
+			slog.Warn("Keeping image URL that could not be rewritten", "product", productID, "url", url, "reason", err)
+			r = url
+		}
+		rewritten[i] = r
+	}
+	return rewritten
+}
+
+// graceContext returns a context that is cancelled grace after ctx is, for
+// work that is better finished than abandoned on shutdown
+func graceContext(ctx context.Context, grace time.Duration) (context.Context, context.CancelFunc) {
+	graceCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(ctx, func() { time.AfterFunc(grace, cancel) })
+	return graceCtx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// downloadWorker returns the loop of a stage 3 worker: it downloads queued
+// images and finishes each product once its last image is done. Images are
+// downloaded with graceCtx, so one that is running when ctx is cancelled
+// still finishes, while no further image is started.
+func downloadWorker(graceCtx context.Context, images <-chan imageJob) workerFunc {
+	return func(ctx context.Context, id string, stop <-chan struct{}) {
+		counters := stats.worker(id)
+		for {
+			activity.set(id, "idle")
+			waiting := time.Now()
+			var job imageJob
+			select {
+			case <-stop:
+				return
+			case <-ctx.Done():
+				return
+			case j, ok := <-images:
+				if !ok {
+					return
+				}
+				job = j
+			}
+			pause.wait()
+			counters.waited(waiting)
+			if ctx.Err() != nil {
+				return
+			}
+			working := time.Now()
+			// An image held back by -max-concurrent-per-product goes to the
+			// worker that finished one of the product's images before it,
+			// so the product never has more downloading at once
+			for more := true; more; job, more = job.Product.take() {
+				path, failed := downloadProductImage(graceCtx, id, job)
+				if graceCtx.Err() != nil {
+					counters.worked(working)
+					return // out of time, the product stays unfinished
+				}
+				if job.Product.imageDone(job.Index, path, failed) {
+					finishProduct(id, job.Product)
+				}
+				if ctx.Err() != nil {
+					counters.worked(working)
+					return // shutting down, the rest of the product stays unfinished
+				}
+			}
+			counters.worked(working)
+		}
+	}
+}
+
+// downloadProductImage downloads one image of a product and returns its path
+// on disk, or whether it failed; skipped images have neither
+func downloadProductImage(ctx context.Context, workerID string, job imageJob) (path string, failed bool) {
+	run := job.Product
+	productID := run.Job.ID
+	activity.set(workerID, fmt.Sprintf("product %d: image %d/%d", productID, job.Index+1, len(run.Info.ImageURLs)))
+	filename := sanitizeFilename(imageFilename(productID, job.Index+1, len(run.Info.ImageURLs)), cfg.MaxFilenameLength)
+	var entry manifestEntry
+	var err error
+	if original := dedupe.savedURL(job.URL, filepath.Join(run.Job.Dir, filename)); original != "" && dedupChecks(dedupURL) {
+		// Stand for the image saved from the same URL without fetching it
+		entry = manifestEntry{URL: job.URL, Path: filepath.Join(run.Job.Dir, filename), DuplicateOf: original, Time: time.Now()}
+		entry.Storage = linkDuplicate(original, entry.Path, dedupStorage())
+		stats.Duplicates.Add(1)
+		slog.Debug("Image URL was saved before", "path", entry.Path, "of", original, "storage", entry.Storage)
+	} else {
+		entry, err = httpClient.downloadFromMirrors(ctx, job.URL, run.Job.Dir, filename)
+		// A full disk fails every image alike; wait for space and try again
+		// rather than counting it as this image's failure
+		for isDiskFull(err) && diskGuard.wait(ctx) {
+			entry, err = httpClient.downloadFromMirrors(ctx, job.URL, run.Job.Dir, filename)
+		}
+	}
+	if ctx.Err() != nil {
+		return "", false
+	}
+	if errors.Is(err, errTooLarge) {
+		stats.TooLarge.Add(1)
+		return "", false
+	}
+	if errors.Is(err, errTooSmall) {
+		stats.TooSmall.Add(1)
+		return "", false
+	}
+	if errors.Is(err, errLowQuality) {
+		stats.LowQuality.Add(1)
+		return "", false
+	}
+	if errors.Is(err, errFormatNotAllowed) {
+		stats.WrongFormat.Add(1)
+		return "", false
+	}
+	if errors.Is(err, errCorruptImage) {
+		stats.CorruptImages.Add(1)
+		brokenImages.add(brokenLink{ProductID: productID, URL: job.URL, Reason: brokenReasonInvalid})
+		return "", false
+	}
+	if errors.Is(err, errFiltered) {
+		stats.Filtered.Add(1)
+		return "", false
+	}
+	if err != nil {
+		stats.Errors.Add(1)
+		stats.worker(workerID).Errors.Add(1)
+		slog.Error("Failed to download image", "product", productID, "reason", friendlyError(err))
+		debugLog.Printf("product %d image %s: %v", productID, job.URL, err)
+		e := newErrorEvent("image", err)
+		e.ProductID, e.URL = productID, job.URL
+		reportError(e)
+		brokenImages.failed(productID, job.URL, err)
+		return "", true
+	}
+	if entry.SHA256 != "" && entry.Format == "" {
+		// Saved all the same, but no decoder could read what the URL serves
+		brokenImages.add(brokenLink{ProductID: productID, URL: job.URL, Reason: brokenReasonInvalid})
+	}
+
+	path = filepath.Join(run.Job.Dir, filename)
+	if len(sinks) > 0 && entry.Path != "" && entry.Storage != storageReference {
+		for _, sink := range sinks {
+			if err := sink.put(ctx, path); err != nil {
+				stats.Errors.Add(1)
+				stats.worker(workerID).Errors.Add(1)
+				slog.Error("Failed to upload image", "product", productID, "reason", friendlyError(err))
+				debugLog.Printf("product %d image %s: %v", productID, path, err)
+				e := newErrorEvent("upload", err)
+				e.ProductID, e.URL = productID, job.URL
+				reportError(e)
+				return "", true
+			}
+		}
+		run.uploaded(path)
+	}
+	stats.Images.Add(1)
+	counters := stats.worker(workerID)
+	counters.Images.Add(1)
+	counters.Bytes.Add(entry.Size)
+	if entry.Path != "" {
+		if entry.Storage == storageReference {
+			dedupe.recordURL(job.URL, entry.DuplicateOf)
+		} else {
+			dedupe.recordURL(job.URL, entry.Path)
+		}
+		entry.ProductID, entry.ImageCount, entry.Tags, entry.Extra = productID, len(run.Info.ImageURLs), cfg.Tags, run.Info.Extra
+		if err := manifest.add(entry); err != nil {
+			slog.Error("Failed to record image in manifest", "product", productID, "reason", friendlyError(err))
+			debugLog.Printf("product %d manifest: %v", productID, err)
+		}
+	}
+	events.emit(ImageDoneEvent{EventHeader: newEventHeader(eventImageDone), ProductID: productID, URL: job.URL, Path: path})
+	if onImageSaved != nil {
+		onImageSaved(path)
+	}
+	return path, false
+}
+
+// finishProduct does the per-product work that needs all its images and
+// reports the product as done
+func finishProduct(workerID string, run *productRun) {
+	defer releaseQueueSlot()
+	productID := run.Job.ID
+	images := len(run.Info.ImageURLs) - run.failed
+	var saved []string
+	for _, path := range run.saved {
+		if path != "" {
+			saved = append(saved, path)
+		}
+	}
+
+	// A failed sheet is only a warning; the product itself succeeded
+	if cfg.ContactSheets && (len(saved) > 1 || len(saved) == 1 && cfg.ContactSheetSingle) {
+		activity.set(workerID, fmt.Sprintf("product %d: contact sheet", productID))
+		if path, err := writeContactSheet(productID, run.Info.Title, saved, cfg.ContactSheetColumns); err != nil {
+			slog.Warn("Failed to make contact sheet", "product", productID, "reason", friendlyError(err))
+			debugLog.Printf("product %d contact sheet: %v", productID, err)
+		} else {
+			slog.Debug("Contact sheet saved", "path", path)
+		}
+	}
+
+	// Without the local sink, the disk only held the images until now
+	if !keepLocal() {
+		for _, path := range run.sent {
+			os.Remove(path)
+			os.Remove(path + checksumExt)
+			os.Remove(path + sourceURLExt)
+		}
+	}
+
+	stats.Products.Add(1)
+	// Products with failed images are tried again by the next run
+	if run.failed == 0 {
+		checkpoint.complete(productID)
+	}
+	slog.Log(context.Background(), LevelSuccess, "Product done", "product", productID, "title", run.Info.Title, "images", images, "failed", run.failed)
+	productOrder.done(run.Job.Seq, ProductDoneEvent{EventHeader: newEventHeader(eventProductDone), ProductID: productID, Title: run.Info.Title, Images: images, Failed: run.failed})
+}
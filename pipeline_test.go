@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image/color"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// runUntilReturned runs runScrape with ctx and fails the test if it has not
+// returned after a few seconds, which means a stage never shut down
+func runUntilReturned(t *testing.T, ctx context.Context) error {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() { done <- runScrape(ctx, nil) }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(10 * time.Second):
+		t.Fatal("runScrape did not return; a stage of the pipeline is stuck")
+		return nil
+	}
+}
+
+// TestPipelineDrains runs more products and images than the one-slot queues
+// between the stages hold: every product is finished and the run returns
+// once the stages have drained front to back
+func TestPipelineDrains(t *testing.T) {
+	setupTest(t)
+	scrapeIDs(1, 12)
+	cfg.DetailWorkers, cfg.DownloadWorkers, cfg.QueueSize = 2, 3, 1
+	const images = 3
+	data := testPNG(t, 4, 4, color.White)
+	serveAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/v2/product/") {
+			writeProduct(t, w, productID(r), images)
+			return
+		}
+		w.Write(data)
+	}))
+
+	if err := runUntilReturned(t, context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := stats.Products.Load(); got != 12 {
+		t.Errorf("%d products done, want 12", got)
+	}
+	if got := len(savedImages(t)); got != 12*images {
+		t.Errorf("%d images saved, want %d", got, 12*images)
+	}
+}
+
+// TestPipelineCancelWhileBlocked cancels a run whose detail lookups never
+// answer, so the detail workers are busy and the crawler is blocked on a
+// full queue: every stage returns and nothing is downloaded
+func TestPipelineCancelWhileBlocked(t *testing.T) {
+	setupTest(t)
+	scrapeIDs(1, 50)
+	cfg.DetailWorkers, cfg.DownloadWorkers, cfg.QueueSize = 2, 2, 1
+	cfg.ShutdownTimeout = 50 * time.Millisecond
+	var lookups atomic.Int64
+	serveAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/v2/product/") {
+			lookups.Add(1)
+		}
+		<-r.Context().Done()
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		for lookups.Load() < 2 {
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+	}()
+	if err := runUntilReturned(t, ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := stats.Products.Load(); got != 0 {
+		t.Errorf("%d products done, want none", got)
+	}
+	if got := len(savedImages(t)); got != 0 {
+		t.Errorf("%d images saved, want none", got)
+	}
+	// The two lookups in flight, and no more once cancelled
+	if got := lookups.Load(); got > int64(cfg.DetailWorkers) {
+		t.Errorf("%d detail lookups, want at most %d", got, cfg.DetailWorkers)
+	}
+}
+
+// TestMaxPerProductLeavesWorkersForSmallProducts downloads a large gallery
+// next to small products: the gallery never has more than
+// -max-concurrent-per-product images downloading, and the small products
+// are done long before it
+func TestMaxPerProductLeavesWorkersForSmallProducts(t *testing.T) {
+	setupTest(t)
+	scrapeIDs(1, 4)
+	cfg.DetailWorkers, cfg.DownloadWorkers, cfg.MaxPerProduct = 4, 4, 2
+	const gallery = 12
+	data := testPNG(t, 4, 4, color.White)
+
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	var smallDone, galleryDone time.Time
+	serveAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := productID(r)
+		if strings.HasPrefix(r.URL.Path, "/v2/product/") {
+			images := 1
+			if id == 1 {
+				images = gallery
+			}
+			writeProduct(t, w, id, images)
+			return
+		}
+		if id != 1 {
+			w.Write(data)
+			mu.Lock()
+			smallDone = time.Now()
+			mu.Unlock()
+			return
+		}
+		mu.Lock()
+		inFlight++
+		maxInFlight = max(maxInFlight, inFlight)
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		w.Write(data)
+		mu.Lock()
+		inFlight--
+		galleryDone = time.Now()
+		mu.Unlock()
+	}))
+
+	if err := runScrape(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(savedImages(t)); got != gallery+3 {
+		t.Errorf("%d images saved, want %d", got, gallery+3)
+	}
+	if got := stats.Products.Load(); got != 4 {
+		t.Errorf("%d products done, want 4", got)
+	}
+	if maxInFlight > cfg.MaxPerProduct {
+		t.Errorf("gallery had %d images downloading at once, want at most %d", maxInFlight, cfg.MaxPerProduct)
+	}
+	if !smallDone.Before(galleryDone.Add(-100 * time.Millisecond)) {
+		t.Errorf("small products done %v before the gallery, want them not to wait for it", galleryDone.Sub(smallDone))
+	}
+}
+
+// TestNoDetailFetch crawls a category with -no-detail-fetch: no details are
+// requested, and each product is finished from its listing entry, its title
+// and main image included
+func TestNoDetailFetch(t *testing.T) {
+	setupTest(t)
+	cfg.Category, cfg.NoDetailFetch, cfg.MaxDepth = "mobile-phone", true, 0
+	data := testPNG(t, 4, 4, color.White)
+	var mu sync.Mutex
+	var requested []string
+	serveAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requested = append(requested, r.URL.Path)
+		mu.Unlock()
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/v1/categories/"):
+			products := `[]`
+			if r.URL.Query().Get("page") == "1" {
+				products = `[
+					{"id":1,"title_fa":"گوشی &amp; قاب","images":{"main":{"url":["https://dkstatics-public.digikala.com/img/1.png"]}}},
+					{"id":2,"title_en":"Phone case","images":{"main":{"url":["https://dkstatics-public.digikala.com/img/2.png"]}}}
+				]`
+			}
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"status":200,"data":{"products":%s,"pager":{"total_pages":1}}}`, products)
+		case strings.HasPrefix(r.URL.Path, "/img/"):
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(data)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	var out bytes.Buffer
+	events = newEventStream(&out)
+	t.Cleanup(func() { events = nil })
+
+	err := runUntilReturned(t, context.Background())
+	events.close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range requested {
+		if strings.HasPrefix(path, "/v2/product/") {
+			t.Errorf("requested details %s", path)
+		}
+	}
+	if got := len(savedImages(t)); got != 2 {
+		t.Errorf("%d images saved, want the main image of both products", got)
+	}
+	titles := make(map[int]string)
+	for dec := json.NewDecoder(&out); ; {
+		var e ProductDoneEvent
+		if err := dec.Decode(&e); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if e.Type == eventProductDone {
+			titles[e.ProductID] = e.Title
+		}
+	}
+	if titles[1] != "گوشی & قاب" || titles[2] != "Phone case" {
+		t.Errorf("products done with titles %q, want those of the listing", titles)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxWorkers caps how far the worker pool can be grown at runtime
+const maxWorkers = 32
+
+// workerFunc is the loop of one worker. It returns when its input is
+// drained, stop is closed or ctx is done.
+type workerFunc func(ctx context.Context, id string, stop <-chan struct{})
+
+// workerPool runs the workers of one pipeline stage and lets their number
+// change while the run is in progress. Removed workers finish their current
+// job first.
+type workerPool struct {
+	ctx     context.Context // Workers return once it is done
+	name    string          // Stage name, prefixed to worker IDs
+	run     workerFunc
+	clock   Clock         // What the ramp-up waits on
+	drained chan struct{} // Closed by drain
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	stops   []chan struct{} // one per running worker, closed to retire it
+	next    int             // Number of the next worker spawned
+	running atomic.Int64    // Workers that have not returned yet, retired ones included
+}
+
+// newWorkerPool starts size workers, staggered evenly over rampUp so their
+// first requests don't all go out at once; the first starts right away. The
+// ramp-up waits on cfg.Clock.
+func newWorkerPool(ctx context.Context, name string, size int, rampUp time.Duration, run workerFunc) *workerPool {
+	clock := cfg.Clock
+	if clock == nil {
+		clock = realClock{}
+	}
+	p := &workerPool{ctx: ctx, name: name, run: run, clock: clock, drained: make(chan struct{})}
+	for i := 0; i < size; i++ {
+		p.growAfter(rampUp * time.Duration(i) / time.Duration(size))
+	}
+	return p
+}
+
+// grow starts one more worker unless maxWorkers are already running
+func (p *workerPool) grow() {
+	p.growAfter(0)
+}
+
+// growAfter adds a worker like grow that waits delay before taking its first
+// job. It counts as running, and can be retired, while it waits; once the
+// pool is drained it stops waiting.
+func (p *workerPool) growAfter(delay time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.stops) >= maxWorkers {
+		return
+	}
+	p.next++
+	stop := make(chan struct{})
+	p.stops = append(p.stops, stop)
+	p.wg.Add(1)
+	p.running.Add(1)
+	id := fmt.Sprintf("%s-%d", p.name, p.next)
+	go func() {
+		defer p.wg.Done()
+		defer p.running.Add(-1)
+		defer activity.remove(id)
+		defer recoverPanic(id)
+		if delay > 0 {
+			activity.set(id, "starting")
+			wait, cancel := context.WithCancel(p.ctx)
+			go func() {
+				defer cancel()
+				select {
+				case <-stop:
+				case <-p.drained:
+				case <-wait.Done():
+				}
+			}()
+			p.clock.Sleep(wait, delay)
+			cancel()
+			select {
+			case <-stop:
+				return
+			case <-p.ctx.Done():
+				return
+			default:
+			}
+		}
+		p.run(withWorker(p.ctx, id), id, stop)
+	}()
+}
+
+// shrink retires the most recently started worker, always keeping one
+func (p *workerPool) shrink() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.stops) <= 1 {
+		return
+	}
+	last := len(p.stops) - 1
+	close(p.stops[last])
+	p.stops = p.stops[:last]
+}
+
+// size returns the number of workers that have not been retired
+func (p *workerPool) size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.stops)
+}
+
+// drain tells the pool its input is closed: workers still waiting out the
+// ramp-up start right away, to take what is left or return
+func (p *workerPool) drain() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	select {
+	case <-p.drained:
+	default:
+		close(p.drained)
+	}
+}
+
+// wait blocks until every worker has returned
+func (p *workerPool) wait() {
+	p.wg.Wait()
+}
+
+// pauseGate holds back workers and the crawler while paused
+type pauseGate struct {
+	mu     sync.Mutex
+	resume chan struct{} // non-nil while paused, closed on resume
+}
+
+// pause is the gate of the current run
+var pause pauseGate
+
+// toggle pauses a running gate or resumes a paused one and reports whether
+// the gate is now paused
+func (g *pauseGate) toggle() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.resume != nil {
+		close(g.resume)
+		g.resume = nil
+		return false
+	}
+	g.resume = make(chan struct{})
+	return true
+}
+
+// paused reports whether the gate is currently paused
+func (g *pauseGate) paused() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.resume != nil
+}
+
+// release resumes the gate if it is paused
+func (g *pauseGate) release() {
+	if g.paused() {
+		g.toggle()
+	}
+}
+
+// wait blocks while the gate is paused
+func (g *pauseGate) wait() {
+	g.mu.Lock()
+	resume := g.resume
+	g.mu.Unlock()
+	if resume != nil {
+		<-resume
+	}
+}
+
+// activityBoard tracks what each worker is doing, for display
+type activityBoard struct {
+	mu    sync.Mutex
+	tasks map[string]string
+}
+
+// activity is the board of the current run
+var activity activityBoard
+
+// set records the current task of worker id
+func (b *activityBoard) set(id, task string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tasks == nil {
+		b.tasks = make(map[string]string)
+	}
+	b.tasks[id] = task
+}
+
+// remove forgets a worker that has returned
+func (b *activityBoard) remove(id string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.tasks, id)
+}
+
+// workerTask is a worker ID and its current task
+type workerTask struct {
+	ID   string
+	Task string
+}
+
+// snapshot returns the current tasks ordered by worker ID
+func (b *activityBoard) snapshot() []workerTask {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	tasks := make([]workerTask, 0, len(b.tasks))
+	for id, task := range b.tasks {
+		tasks = append(tasks, workerTask{ID: id, Task: task})
+	}
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].ID < tasks[j].ID })
+	return tasks
+}
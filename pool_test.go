@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"image/color"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestWorkerPoolGracefulShutdown cancels a run of 20 products once 5 are
+// done, while 3 images are half sent and 3 more products are being looked
+// up: the images are finished and no other lookup starts
+func TestWorkerPoolGracefulShutdown(t *testing.T) {
+	setupTest(t)
+	scrapeIDs(1, 20)
+	cfg.DetailWorkers, cfg.DownloadWorkers = 3, 3
+	cfg.Checkpoint = "checkpoint.json"
+	cfg.ShutdownTimeout = 5 * time.Second
+	data := testPNG(t, 64, 64, color.White)
+
+	var (
+		mu             sync.Mutex
+		detailsStarted = make(map[int]bool)
+		cancelled      atomic.Bool
+		lateDetails    atomic.Int64
+		imagesWaiting  atomic.Int64
+		release        = make(chan struct{})
+		quit           = make(chan struct{})
+	)
+	t.Cleanup(func() { close(quit) })
+	serveAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := productID(r)
+		if strings.HasPrefix(r.URL.Path, "/v2/product/") {
+			if cancelled.Load() {
+				lateDetails.Add(1)
+			}
+			mu.Lock()
+			detailsStarted[id] = true
+			mu.Unlock()
+			switch {
+			case id <= 5:
+			case id <= 8:
+				// Looked up once the first five are done
+				for stats.Products.Load() < 5 {
+					select {
+					case <-r.Context().Done():
+						return
+					case <-time.After(time.Millisecond):
+					}
+				}
+			default:
+				// Still being looked up when the run is cancelled
+				select {
+				case <-r.Context().Done():
+				case <-quit:
+				}
+				return
+			}
+			writeProduct(t, w, id, 1)
+			return
+		}
+		if id <= 5 {
+			w.Write(data)
+			return
+		}
+		// Half the image, then the rest once the run is cancelled
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data[:len(data)/2])
+		w.(http.Flusher).Flush()
+		imagesWaiting.Add(1)
+		select {
+		case <-release:
+		case <-quit:
+			return
+		}
+		w.Write(data[len(data)/2:])
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	result := make(chan error, 1)
+	go func() { result <- runScrape(ctx, nil) }()
+
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return imagesWaiting.Load() == 3 && detailsStarted[9] && detailsStarted[10] && detailsStarted[11]
+	})
+	cancelled.Store(true)
+	cancel()
+	cancelledAt := time.Now()
+	time.Sleep(50 * time.Millisecond) // Long enough for an abandoned image to be dropped
+	close(release)
+
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(cfg.ShutdownTimeout + time.Second):
+		t.Fatal("run did not return after the shutdown timeout")
+	}
+	if elapsed := time.Since(cancelledAt); elapsed > cfg.ShutdownTimeout {
+		t.Errorf("run returned %s after the cancel, more than the %s shutdown timeout", elapsed, cfg.ShutdownTimeout)
+	}
+
+	if n := lateDetails.Load(); n > 0 {
+		t.Errorf("%d product lookups started after the cancel", n)
+	}
+	images := savedImages(t)
+	if len(images) != 8 {
+		t.Errorf("%d images saved, want those of products 1 to 8", len(images))
+	}
+	for _, path := range images {
+		if got, err := os.ReadFile(path); err != nil || len(got) != len(data) {
+			t.Errorf("%s: %d bytes, %v; want the whole image of %d bytes", path, len(got), err, len(data))
+		}
+	}
+	if parts, _ := filepath.Glob(filepath.Join(imageDir, "*.part")); len(parts) > 0 {
+		t.Errorf("partial files left behind: %v", parts)
+	}
+
+	done, err := loadCheckpoint(cfg.Checkpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(done) != 8 {
+		t.Errorf("checkpoint holds %v, want products 1 to 8", done)
+	}
+	for id := 1; id <= 8; id++ {
+		if !done[id] {
+			t.Errorf("product %d missing from the checkpoint", id)
+		}
+	}
+}
+
+// TestRampUpStartTimes starts 4 workers over a ramp-up of 4s on a fake
+// clock: the first starts right away and the others 1s apart
+func TestRampUpStartTimes(t *testing.T) {
+	setupTest(t)
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	cfg.Clock = clock
+	var mu sync.Mutex
+	var started []string
+	p := newWorkerPool(context.Background(), "test", 4, 4*time.Second, func(ctx context.Context, id string, stop <-chan struct{}) {
+		mu.Lock()
+		started = append(started, id)
+		mu.Unlock()
+	})
+	p.wait()
+
+	if len(started) != 4 {
+		t.Errorf("workers %v started, want 4", started)
+	}
+	slices.Sort(clock.sleeps)
+	if want := []time.Duration{time.Second, 2 * time.Second, 3 * time.Second}; !slices.Equal(clock.sleeps, want) {
+		t.Errorf("workers waited %v, want %v", clock.sleeps, want)
+	}
+
+	clock.sleeps = nil
+	newWorkerPool(context.Background(), "test", 4, 0, func(context.Context, string, <-chan struct{}) {}).wait()
+	if len(clock.sleeps) != 0 {
+		t.Errorf("workers without a ramp-up waited %v", clock.sleeps)
+	}
+}
+
+// TestRampUpWorkerStopsWaiting starts workers with a ramp-up far longer than
+// the test: once their closed input is drained, or they are retired, or the
+// run is cancelled, the waiting ones stop waiting
+func TestRampUpWorkerStopsWaiting(t *testing.T) {
+	setupTest(t)
+	jobs := make(chan int)
+	close(jobs)
+	var ran atomic.Int64
+	run := func(ctx context.Context, id string, stop <-chan struct{}) {
+		ran.Add(1)
+		for range jobs {
+		}
+	}
+	returned := func(p *workerPool) bool {
+		done := make(chan struct{})
+		go func() {
+			p.wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+			return true
+		case <-time.After(5 * time.Second):
+			return false
+		}
+	}
+
+	p := newWorkerPool(context.Background(), "drained", 3, time.Hour, run)
+	p.drain()
+	p.drain() // Twice is fine
+	if !returned(p) {
+		t.Fatal("workers still waiting out the ramp-up after the pool was drained")
+	}
+	if got := ran.Load(); got != 3 {
+		t.Errorf("%d workers ran, want all 3 to look at the drained input", got)
+	}
+
+	ran.Store(0)
+	p = newWorkerPool(context.Background(), "retired", 2, time.Hour, run)
+	p.shrink()
+	if !returned(p) {
+		t.Fatal("a retired worker is still waiting out the ramp-up")
+	}
+	if got := ran.Load(); got != 1 {
+		t.Errorf("%d workers ran, want only the first", got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p = newWorkerPool(ctx, "cancelled", 3, time.Hour, run)
+	cancel()
+	if !returned(p) {
+		t.Fatal("workers still waiting out the ramp-up after the run was cancelled")
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// maxSuggestionDistance is how many edits a known category slug may be away
+// from a mistyped one to be suggested
+const maxSuggestionDistance = 3
+
+// preflight checks that the source of the run exists with one request
+// before any worker starts, so a mistyped -category fails at once instead
+// of after a hundred failed pages. It goes through the same rate limits as
+// the run. Listing totals it learns seed stats.Expected.
+func (c *Client) preflight(ctx context.Context, query QueryOptions) error {
+	switch cfg.Source {
+	case sourceCategory:
+		return c.preflightCategory(ctx, cfg.Category, query)
+	case sourceWishlist:
+		res, err := c.fetchWishlistPage(ctx, 1)
+		if hasStatus(err, http.StatusUnauthorized, http.StatusForbidden) {
+			return errors.New("the wishlist refused the -auth-token; check that it is current (skip this check with -no-preflight)")
+		}
+		if err != nil {
+			return fmt.Errorf("preflight: %w", err)
+		}
+		slog.Info("Wishlist found", "pages", res.Data.Pager.TotalPages)
+	case sourceIDRange:
+		// Most IDs are gaps, so only a failure other than a missing product counts
+		_, err := c.fetchProductDetails(ctx, cfg.IDRange.From)
+		if err != nil && !hasStatus(err, http.StatusNotFound, http.StatusGone) {
+			return fmt.Errorf("preflight: %w", err)
+		}
+	}
+	return nil
+}
+
+// preflightCategory fetches the first listing page of slug and, when the
+// category doesn't exist, names the closest top-level category
+func (c *Client) preflightCategory(ctx context.Context, slug string, query QueryOptions) error {
+	url := buildCategoryURL(categoryRootURL, slug, 1, query)
+	var res *CategoryRes
+	err := cfg.retryPolicy(stageSearch).do(ctx, func(ctx context.Context) (err error) {
+		res, err = c.fetchCategoryPage(ctx, url)
+		return err
+	})
+	var se *statusError
+	if errors.As(err, &se) && (se.StatusCode == http.StatusNotFound || se.StatusCode == http.StatusBadRequest) {
+		msg := fmt.Sprintf("category %q returned status %d", slug, se.StatusCode)
+		if suggestion := c.suggestCategory(ctx, slug); suggestion != "" {
+			msg += fmt.Sprintf("; did you mean %s?", suggestion)
+		}
+		return fmt.Errorf("%s (skip this check with -no-preflight)", msg)
+	}
+	if err != nil {
+		return fmt.Errorf("preflight of category %q: %w", slug, err)
+	}
+	pager := res.Data.Pager
+	if len(res.Data.Products) == 0 {
+		slog.Warn("The first page of the category lists no products; check the slug and the filters", "category", slug)
+		return nil
+	}
+	slog.Info("Category found", "category", slug, "pages", pager.TotalPages, "products", pager.TotalItems)
+	if !cfg.CategoryTree {
+		stats.Expected.Store(int64(pager.TotalItems))
+	}
+	return nil
+}
+
+// suggestCategory returns the top-level category slug closest to slug, or ""
+// when none is close or the categories can't be listed
+func (c *Client) suggestCategory(ctx context.Context, slug string) string {
+	categories, err := c.fetchSubcategories(ctx, "")
+	if err != nil {
+		debugLog.Printf("preflight: listing categories for a suggestion: %v", err)
+		return ""
+	}
+	best, bestDistance := "", maxSuggestionDistance+1
+	for _, c := range categories {
+		if d := editDistance(strings.ToLower(slug), strings.ToLower(c.Code)); d < bestDistance {
+			best, bestDistance = c.Code, d
+		}
+	}
+	return best
+}
+
+// editDistance is the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur := make([]int, len(rb)+1)
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(rb)]
+}
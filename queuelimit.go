@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// queueSlots caps how many products are between being discovered and being
+// finished (-queue-limit), across the product and image queues and the
+// workers, so a fast crawl can't pile up products in memory. nil means no
+// cap.
+var queueSlots *semaphore.Weighted
+
+// newQueueSlots returns the slots for limit products, nil for no limit
+func newQueueSlots(limit int) *semaphore.Weighted {
+	if limit <= 0 {
+		return nil
+	}
+	return semaphore.NewWeighted(int64(limit))
+}
+
+// acquireQueueSlot blocks until one more product may be queued, returning
+// ctx.Err() if ctx is done first
+func acquireQueueSlot(ctx context.Context) error {
+	if queueSlots == nil {
+		return nil
+	}
+	return queueSlots.Acquire(ctx, 1)
+}
+
+// releaseQueueSlot frees the slot of a product that is finished or dropped
+func releaseQueueSlot() {
+	if queueSlots != nil {
+		queueSlots.Release(1)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// Values of -retry-priority, how retried requests queue for -rps
+const (
+	priorityFIFO = "fifo" // In arrival order, retries or not
+	priorityLow  = "low"  // Behind every waiting fresh request
+	priorityHigh = "high" // Ahead of every waiting fresh request
+)
+
+// retryPriorities lists the accepted -retry-priority values
+var retryPriorities = []string{priorityFIFO, priorityLow, priorityHigh}
+
+// requestLimiter paces every HTTP request of the run (-rps and -rps-host)
+var requestLimiter = newHostLimiters(0, nil, priorityFIFO)
+
+// productLimiter paces how fast discovered products are queued
+// (-products-per-second). Each product costs a details request plus one
+// request per image, and whatever runs on its saved images afterwards, so
+// this is a coarser knob than -rps.
+var productLimiter = newLimiter(0)
+
+// newLimiter returns a limiter allowing perSecond events a second, or an
+// unlimited one when perSecond is zero
+func newLimiter(perSecond float64) *rate.Limiter {
+	if perSecond <= 0 {
+		return rate.NewLimiter(rate.Inf, 0)
+	}
+	return rate.NewLimiter(rate.Limit(perSecond), 1)
+}
+
+// hostLimiters pace requests by host: each host given to -rps-host has a
+// gate of its own, and all other hosts share the -rps one
+type hostLimiters struct {
+	shared *requestGate
+	hosts  map[string]*requestGate
+}
+
+func newHostLimiters(perSecond float64, perHost hostRates, policy string) *hostLimiters {
+	l := &hostLimiters{shared: newRequestGate(perSecond, policy), hosts: make(map[string]*requestGate, len(perHost))}
+	for host, rate := range perHost {
+		l.hosts[host] = newRequestGate(rate, policy)
+	}
+	return l
+}
+
+// Wait blocks until a request to rawURL may be sent or ctx is done. A host
+// is looked up with its port first, then without.
+func (l *hostLimiters) Wait(ctx context.Context, rawURL string) error {
+	if u, err := url.Parse(rawURL); err == nil && len(l.hosts) > 0 {
+		host := strings.ToLower(u.Host)
+		if g := l.hosts[host]; g != nil {
+			return g.Wait(ctx)
+		}
+		if g := l.hosts[strings.ToLower(u.Hostname())]; g != nil {
+			return g.Wait(ctx)
+		}
+	}
+	return l.shared.Wait(ctx)
+}
+
+// requestGate is a rate limiter whose waiters are served by priority: fresh
+// requests and retried ones (see isRetry) queue separately, and the policy
+// says which queue goes first. One waiter at a time waits on the limiter;
+// the others wait in their queue.
+type requestGate struct {
+	limiter *rate.Limiter
+	policy  string
+
+	mu      sync.Mutex
+	busy    bool            // A waiter is waiting on the limiter
+	fresh   []chan struct{} // Queued fresh requests, oldest first
+	retries []chan struct{} // Queued retries, oldest first
+}
+
+func newRequestGate(perSecond float64, policy string) *requestGate {
+	return &requestGate{limiter: newLimiter(perSecond), policy: policy}
+}
+
+// Wait blocks until the request of ctx may be sent or ctx is done
+func (g *requestGate) Wait(ctx context.Context) error {
+	if g.policy == priorityFIFO || g.limiter.Limit() == rate.Inf {
+		return g.limiter.Wait(ctx)
+	}
+	g.mu.Lock()
+	if g.busy {
+		turn := make(chan struct{})
+		queue := &g.fresh
+		if isRetry(ctx) {
+			queue = &g.retries
+		}
+		*queue = append(*queue, turn)
+		g.mu.Unlock()
+		select {
+		case <-turn:
+		case <-ctx.Done():
+			g.mu.Lock()
+			i := slices.Index(*queue, turn)
+			if i >= 0 {
+				*queue = slices.Delete(*queue, i, i+1)
+			}
+			g.mu.Unlock()
+			if i < 0 {
+				g.next() // The turn was handed over meanwhile; pass it on
+			}
+			return ctx.Err()
+		}
+	} else {
+		g.busy = true
+		g.mu.Unlock()
+	}
+	defer g.next()
+	return g.limiter.Wait(ctx)
+}
+
+// next hands the limiter to the first waiter of the queue the policy
+// prefers, or marks it free when nobody waits
+func (g *requestGate) next() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	first, second := &g.fresh, &g.retries
+	if g.policy == priorityHigh {
+		first, second = second, first
+	}
+	for _, queue := range []*[]chan struct{}{first, second} {
+		if len(*queue) > 0 {
+			close((*queue)[0])
+			*queue = (*queue)[1:]
+			return
+		}
+	}
+	g.busy = false
+}
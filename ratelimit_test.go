@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// elapsed returns how long l took to let a request to url through
+func elapsed(t *testing.T, l *hostLimiters, url string) time.Duration {
+	t.Helper()
+	start := time.Now()
+	if err := l.Wait(context.Background(), url); err != nil {
+		t.Fatal(err)
+	}
+	return time.Since(start)
+}
+
+// TestHostLimitersIndependent paces two hosts at 5 requests a second each:
+// using up one host's allowance doesn't hold back the other, nor hosts
+// without a rate of their own
+func TestHostLimitersIndependent(t *testing.T) {
+	const api, images = "https://api.digikala.com/v2/product/1/", "https://dkstatics-public.digikala.com:443/a.jpg"
+	l := newHostLimiters(0, hostRates{"api.digikala.com": 5, "dkstatics-public.digikala.com": 5}, priorityFIFO)
+
+	// The first request of each host goes at once
+	for _, url := range []string{api, images} {
+		if d := elapsed(t, l, url); d > 50*time.Millisecond {
+			t.Errorf("first request to %s waited %s", url, d)
+		}
+	}
+	// The second waits for its own host's next token only
+	if d := elapsed(t, l, api); d < 150*time.Millisecond {
+		t.Errorf("second api request waited %s, want about 200ms", d)
+	}
+	if d := elapsed(t, l, "https://www.digikala.com/sitemap.xml"); d > 50*time.Millisecond {
+		t.Errorf("unlimited host waited %s", d)
+	}
+	if d := elapsed(t, l, images); d > 50*time.Millisecond {
+		t.Errorf("image request waited %s after the api host's wait; the hosts share a limit", d)
+	}
+}
+
+func TestHostLimitersPortAndCase(t *testing.T) {
+	l := newHostLimiters(0, hostRates{"localhost:8080": 1, "api.digikala.com": 1}, priorityFIFO)
+	for _, url := range []string{"http://localhost:8080/a", "https://API.Digikala.com/b"} {
+		elapsed(t, l, url)
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		if err := l.Wait(ctx, url); err == nil {
+			t.Errorf("%s: second request within a second was let through", url)
+		}
+		cancel()
+	}
+	// Another port of the host is not the one limited
+	if d := elapsed(t, l, "http://localhost:9090/a"); d > 50*time.Millisecond {
+		t.Errorf("other port waited %s", d)
+	}
+}
+
+func TestHostRatesSet(t *testing.T) {
+	var h hostRates
+	for _, s := range []string{"API.digikala.com=2", "cdn=0.5", "api.digikala.com = 3"} {
+		if err := h.Set(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if h.String() != "api.digikala.com=3,cdn=0.5" {
+		t.Errorf("rates = %s, want api.digikala.com=3,cdn=0.5", h.String())
+	}
+	for _, s := range []string{"api.digikala.com", "=2", "api=-1", "api=fast"} {
+		if err := h.Set(s); err == nil {
+			t.Errorf("Set(%q) accepted", s)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// productOrder releases product_done events in discovery order with
+// -ordered-exports, so that runs over the same listing export the same
+// sequence; nil otherwise
+var productOrder *reorderBuffer
+
+// reorderBuffer holds finished products back until every product discovered
+// before them is finished or dropped. Products are numbered from 0 as they
+// are queued. Once more than window are held, the oldest missing product is
+// passed over; it is released with Late set whenever it finishes. The events
+// go out without their time, which would differ between identical runs.
+type reorderBuffer struct {
+	window int
+
+	mu    sync.Mutex
+	next  int                       // Number of the next product to release
+	ready map[int]*ProductDoneEvent // Held products by number, nil for dropped ones
+	held  int                       // Non-nil entries of ready, what the window bounds
+}
+
+func newReorderBuffer(window int) *reorderBuffer {
+	return &reorderBuffer{window: window, ready: make(map[int]*ProductDoneEvent)}
+}
+
+// done releases e, the event of the product numbered seq, once its turn
+// comes; on a nil *reorderBuffer it is emitted right away
+func (b *reorderBuffer) done(seq int, e ProductDoneEvent) {
+	if b == nil {
+		events.emit(e)
+		return
+	}
+	e.Time = time.Time{}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if seq < b.next {
+		e.Late = true
+		events.emit(e)
+		return
+	}
+	b.ready[seq] = &e
+	b.held++
+	b.release()
+}
+
+// drop records that the product numbered seq won't finish, so products after
+// it needn't wait; it takes no room in the window. It is a no-op on a nil
+// *reorderBuffer.
+func (b *reorderBuffer) drop(seq int) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if seq >= b.next {
+		b.ready[seq] = nil
+		b.release()
+	}
+}
+
+// release emits the held products whose turn has come, passing over missing
+// ones while more than the window are held; b.mu must be held
+func (b *reorderBuffer) release() {
+	for {
+		e, ok := b.ready[b.next]
+		if !ok && b.held <= b.window {
+			return
+		}
+		if ok {
+			delete(b.ready, b.next)
+			if e != nil {
+				b.held--
+				events.emit(*e)
+			}
+		}
+		b.next++
+	}
+}
+
+// flush emits every held product in order, for the end of a run whose
+// remaining products will never finish; it is a no-op on a nil
+// *reorderBuffer
+func (b *reorderBuffer) flush() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for len(b.ready) > 0 {
+		if e := b.ready[b.next]; e != nil {
+			events.emit(*e)
+		}
+		delete(b.ready, b.next)
+		b.next++
+	}
+	b.held = 0
+}
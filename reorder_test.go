@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image/color"
+	"math/rand"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// captureEvents sends the events of the rest of the test to the returned
+// function, which closes the stream and returns what was written
+func captureEvents(t *testing.T) func() []byte {
+	t.Helper()
+	var out bytes.Buffer
+	events = newEventStream(&out)
+	t.Cleanup(func() { events = nil })
+	return func() []byte {
+		events.close()
+		events = nil
+		return out.Bytes()
+	}
+}
+
+// doneIDs returns the products of the product_done events in out, with a
+// trailing * for late ones
+func doneIDs(t *testing.T, out []byte) string {
+	t.Helper()
+	var ids []string
+	for dec := json.NewDecoder(bytes.NewReader(out)); dec.More(); {
+		var e ProductDoneEvent
+		if err := dec.Decode(&e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Type != eventProductDone {
+			continue
+		}
+		id := fmt.Sprint(e.ProductID)
+		if e.Late {
+			id += "*"
+		}
+		ids = append(ids, id)
+	}
+	return strings.Join(ids, " ")
+}
+
+func TestReorderBuffer(t *testing.T) {
+	done := func(b *reorderBuffer, seq int) {
+		b.done(seq, ProductDoneEvent{EventHeader: newEventHeader(eventProductDone), ProductID: seq})
+	}
+	tests := []struct {
+		name   string
+		window int
+		steps  func(b *reorderBuffer)
+		want   string
+	}{
+		{"in order", 2, func(b *reorderBuffer) { done(b, 1); done(b, 0); done(b, 2) }, "0 1 2"},
+		{"dropped passed over", 2, func(b *reorderBuffer) { done(b, 2); b.drop(1); done(b, 0) }, "0 2"},
+		{"window full", 1, func(b *reorderBuffer) { done(b, 2); done(b, 3); done(b, 0) }, "2 3 0*"},
+		// Dropped products take no room: product 6 waits for 0 although
+		// five products after 0 were dropped
+		{"dropped take no room", 2, func(b *reorderBuffer) {
+			for seq := 1; seq <= 5; seq++ {
+				b.drop(seq)
+			}
+			done(b, 6)
+			done(b, 0)
+		}, "0 6"},
+		{"flush", 5, func(b *reorderBuffer) { done(b, 3); b.drop(2); done(b, 1); b.flush(); done(b, 0) }, "1 3 0*"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			written := captureEvents(t)
+			tt.steps(newReorderBuffer(tt.window))
+			if got := doneIDs(t, written()); got != tt.want {
+				t.Errorf("released %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReorderBufferLeavesOutTime(t *testing.T) {
+	written := captureEvents(t)
+	newReorderBuffer(1).done(0, ProductDoneEvent{EventHeader: newEventHeader(eventProductDone), ProductID: 1})
+	out := written()
+	if bytes.Contains(out, []byte(`"time"`)) {
+		t.Errorf("ordered event %s has a time", out)
+	}
+	var e ProductDoneEvent
+	if err := json.Unmarshal(out, &e); err != nil || e.ProductID != 1 || e.Type != eventProductDone {
+		t.Errorf("ordered event %s decoded as %+v, %v", out, e, err)
+	}
+
+	stamped, _ := json.Marshal(ProductDoneEvent{EventHeader: newEventHeader(eventProductDone)})
+	if !bytes.Contains(stamped, []byte(`"time"`)) {
+		t.Errorf("unordered event %s has no time", stamped)
+	}
+}
+
+// TestOrderedExportsRepeatable runs the same scrape twice with
+// -ordered-exports against a server answering in a random order: both runs
+// write the same product_done events, byte for byte, in discovery order
+func TestOrderedExportsRepeatable(t *testing.T) {
+	const products = 20
+	run := func() []byte {
+		setupTest(t)
+		scrapeIDs(1, products)
+		cfg.Events, cfg.OrderedExports = true, true
+		cfg.DetailWorkers, cfg.DownloadWorkers = 4, 4
+		data := testPNG(t, 4, 4, color.White)
+		serveAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(time.Duration(rand.Intn(3)) * time.Millisecond)
+			if strings.HasPrefix(r.URL.Path, "/v2/product/") {
+				writeProduct(t, w, productID(r), 2)
+				return
+			}
+			w.Write(data)
+		}))
+		written := captureEvents(t)
+		if err := runScrape(context.Background(), nil); err != nil {
+			t.Fatal(err)
+		}
+		var lines [][]byte
+		for _, line := range bytes.SplitAfter(written(), []byte("\n")) {
+			if bytes.Contains(line, []byte(`"type":"product_done"`)) {
+				lines = append(lines, line)
+			}
+		}
+		return bytes.Join(lines, nil)
+	}
+
+	first, second := run(), run()
+	if !bytes.Equal(first, second) {
+		t.Errorf("runs wrote different product_done events:\n%s\nand\n%s", first, second)
+	}
+	var want []string
+	for id := 1; id <= products; id++ {
+		want = append(want, fmt.Sprint(id))
+	}
+	if got := doneIDs(t, first); got != strings.Join(want, " ") {
+		t.Errorf("products done in the order %s, want %s", got, strings.Join(want, " "))
+	}
+}
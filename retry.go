@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Stages with their own retry policy
+const (
+	stageSearch   = "search"   // Listing pages
+	stageDetails  = "details"  // Product details
+	stageDownload = "download" // Images
+)
+
+// errNoImages is returned when product details list no image URLs
+var errNoImages = errors.New("product has no images")
+
+// retryable reports whether err may go away if the request is repeated
+func retryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if errors.Is(err, errTooLarge) || errors.Is(err, errTooSmall) || errors.Is(err, errFormatNotAllowed) || errors.Is(err, errLowQuality) || errors.Is(err, errCorruptImage) || errors.Is(err, errFiltered) || errors.Is(err, errPinMismatch) || errors.Is(err, errNotRecorded) || isDiskFull(err) {
+		return false
+	}
+	var le *redirectLoopError
+	if errors.As(err, &le) {
+		return false
+	}
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.StatusCode == http.StatusTooManyRequests || se.StatusCode >= 500
+	}
+	return true
+}
+
+// Clock is the time source retries wait on, so that tests can replace it
+type Clock interface {
+	Now() time.Time
+	// Sleep waits for d, returning ctx.Err() if ctx is done first
+	Sleep(ctx context.Context, d time.Duration) error
+}
+
+// realClock is the Clock of the wall clock
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) Sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// retryPolicy says how often and how patiently one stage retries
+type retryPolicy struct {
+	Stage      string
+	MaxRetries int
+	BaseDelay  time.Duration // Wait before the first retry, doubled on every further retry
+	MaxDelay   time.Duration // Upper bound of the wait between retries
+	// Longest Retry-After honored; asking for more fails the request
+	MaxRetryAfter time.Duration
+	Clock         Clock // Nil means the wall clock
+}
+
+func (p retryPolicy) String() string {
+	return fmt.Sprintf("%s: %d retries, backoff %s doubling up to %s", p.Stage, p.MaxRetries, p.BaseDelay, p.MaxDelay)
+}
+
+// clock returns p.Clock, or the wall clock if it is nil
+func (p retryPolicy) clock() Clock {
+	if p.Clock == nil {
+		return realClock{}
+	}
+	return p.Clock
+}
+
+// retryExhaustedError is returned when a retryable error outlasted a policy
+type retryExhaustedError struct {
+	Policy   retryPolicy
+	Attempts int
+	Elapsed  time.Duration // From the first attempt to giving up
+	Err      error
+}
+
+func (e *retryExhaustedError) Error() string {
+	return fmt.Sprintf("gave up after %d attempts in %s (%s): %v", e.Attempts, e.Elapsed.Round(time.Millisecond), e.Policy, e.Err)
+}
+
+func (e *retryExhaustedError) Unwrap() error {
+	return e.Err
+}
+
+// retryKey carries the number of a repeated attempt, see isRetry
+type retryKey struct{}
+
+// isRetry reports whether ctx belongs to an attempt retried by retryPolicy.do
+func isRetry(ctx context.Context) bool {
+	return retryAttempt(ctx) > 0
+}
+
+// retryAttempt returns how many times retryPolicy.do had tried before the
+// attempt of ctx, zero for a first attempt
+func retryAttempt(ctx context.Context) int {
+	attempt, _ := ctx.Value(retryKey{}).(int)
+	return attempt
+}
+
+// do calls fn until it succeeds, fails with an error that isn't retryable, or
+// has been retried p.MaxRetries times, in which case the last error is
+// returned wrapped in a retryExhaustedError. Waiting between attempts ends
+// early once ctx is done. Retried attempts get a context isRetry recognizes,
+// so -retry-priority can order their requests.
+func (p retryPolicy) do(ctx context.Context, fn func(ctx context.Context) error) error {
+	clock := p.clock()
+	start := clock.Now()
+	delay := p.BaseDelay
+	for attempt := 0; ; attempt++ {
+		attemptCtx := ctx
+		if attempt > 0 {
+			attemptCtx = context.WithValue(ctx, retryKey{}, attempt)
+		}
+		err := fn(attemptCtx)
+		if err == nil || !retryable(err) {
+			return err
+		}
+		if attempt >= p.MaxRetries {
+			if attempt == 0 {
+				return err
+			}
+			return &retryExhaustedError{Policy: p, Attempts: attempt + 1, Elapsed: clock.Now().Sub(start), Err: err}
+		}
+		// The server's Retry-After replaces the backoff, within reason
+		wait := delay
+		var se *statusError
+		if errors.As(err, &se) && se.RetryAfter > 0 {
+			if se.RetryAfter > p.MaxRetryAfter {
+				return fmt.Errorf("server asked to retry after %s, more than -retry-after-max %s: %w", se.RetryAfter, p.MaxRetryAfter, err)
+			}
+			wait = se.RetryAfter
+		}
+		debugLog.Printf("%s attempt %d failed, retrying in %s: %v", p.Stage, attempt+1, wait, err)
+		if clock.Sleep(ctx, wait) != nil {
+			return err
+		}
+		delay = min(delay*2, p.MaxDelay)
+	}
+}
+
+// retryPolicy returns the policy of stage, filling in the shared -max-retries,
+// -retry-base and -retry-cap for anything the stage flags leave unset
+func (c *Config) retryPolicy(stage string) retryPolicy {
+	p := retryPolicy{Stage: stage, MaxRetries: c.MaxRetries, BaseDelay: c.RetryBase, MaxDelay: c.RetryCap, MaxRetryAfter: c.RetryAfterMax, Clock: c.Clock}
+	override := c.StageRetries[stage]
+	if override.MaxRetries >= 0 {
+		p.MaxRetries = override.MaxRetries
+	}
+	if override.BaseDelay > 0 {
+		p.BaseDelay = override.BaseDelay
+	}
+	if override.MaxDelay > 0 {
+		p.MaxDelay = override.MaxDelay
+	}
+	return p
+}
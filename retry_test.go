@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image/color"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock that records the waits asked of it and passes them
+// at once
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	sleeps []time.Duration
+	events *[]string // Shared with a countingTransport to tell the order
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Sleep(ctx context.Context, d time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	c.sleeps = append(c.sleeps, d)
+	if c.events != nil {
+		*c.events = append(*c.events, "sleep")
+	}
+	return ctx.Err()
+}
+
+// countingTransport answers the nth request with replies[n], repeating the
+// last reply, and counts the requests
+type countingTransport struct {
+	mu      sync.Mutex
+	replies []func(*http.Request) (*http.Response, error)
+	calls   int
+	events  *[]string
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	reply := t.replies[min(t.calls, len(t.replies)-1)]
+	t.calls++
+	if t.events != nil {
+		*t.events = append(*t.events, "call")
+	}
+	t.mu.Unlock()
+	return reply(req)
+}
+
+// status replies with an empty response of code
+func status(code int) func(*http.Request) (*http.Response, error) {
+	return func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: code, Header: http.Header{}, Body: io.NopCloser(strings.NewReader("")), Request: req}, nil
+	}
+}
+
+// product replies with the details of a product with one image
+func product(req *http.Request) (*http.Response, error) {
+	body := `{"status":200,"data":{"product":{"title_fa":"x","images":{"main":{"url":["https://dkstatics-public.digikala.com/1.jpg"]}}}}}`
+	return &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Content-Type": {"application/json"}}, Body: io.NopCloser(strings.NewReader(body)), Request: req}, nil
+}
+
+// networkError fails like a connection reset by the server
+func networkError(*http.Request) (*http.Response, error) {
+	return nil, syscall.ECONNRESET
+}
+
+func TestRetryBackoff(t *testing.T) {
+	tests := []struct {
+		name       string
+		replies    []func(*http.Request) (*http.Response, error)
+		wantCalls  int
+		wantSleeps []time.Duration
+		wantErr    bool
+	}{
+		{"success", []func(*http.Request) (*http.Response, error){product}, 1, nil, false},
+		{"server errors", []func(*http.Request) (*http.Response, error){status(500), status(503), product}, 3, []time.Duration{time.Second, 2 * time.Second}, false},
+		{"network errors", []func(*http.Request) (*http.Response, error){networkError, networkError, product}, 3, []time.Duration{time.Second, 2 * time.Second}, false},
+		{"not found", []func(*http.Request) (*http.Response, error){status(404)}, 1, nil, true},
+		{"forbidden", []func(*http.Request) (*http.Response, error){status(403)}, 1, nil, true},
+		{"exhausted", []func(*http.Request) (*http.Response, error){status(502)}, 4, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTest(t)
+			var events []string
+			clock := &fakeClock{now: time.Unix(0, 0), events: &events}
+			transport := &countingTransport{replies: tt.replies, events: &events}
+			cfg.Clock = clock
+			cfg.MaxRetries, cfg.RetryBase, cfg.RetryCap = 3, time.Second, time.Minute
+			previous := httpClient
+			httpClient = NewClient(transport)
+			t.Cleanup(func() { httpClient = previous })
+
+			_, err := httpClient.fetchProductInfoWithRetry(context.Background(), 1)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error: %v", err, tt.wantErr)
+			}
+			if transport.calls != tt.wantCalls {
+				t.Errorf("%d calls, want %d", transport.calls, tt.wantCalls)
+			}
+			if len(events) > 0 && events[0] != "call" {
+				t.Errorf("waited before the first attempt: %v", events)
+			}
+			if len(clock.sleeps) != len(tt.wantSleeps) {
+				t.Fatalf("slept %v, want %v", clock.sleeps, tt.wantSleeps)
+			}
+			for i, want := range tt.wantSleeps {
+				if got := clock.sleeps[i]; got < want*9/10 || got > want*11/10 {
+					t.Errorf("wait %d = %s, want %s ±10%%", i+1, got, want)
+				}
+			}
+			var exhausted *retryExhaustedError
+			if tt.wantErr && len(tt.wantSleeps) > 0 && !errors.As(err, &exhausted) {
+				t.Errorf("err = %v, want a retryExhaustedError", err)
+			}
+		})
+	}
+}
+
+// TestStageRetries fails every stage's first requests with 503 and checks
+// that each stage retries as often as its own policy says
+func TestStageRetries(t *testing.T) {
+	setupTest(t)
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	cfg.Clock = clock
+	cfg.MaxRetries, cfg.RetryBase, cfg.RetryCap = 1, time.Second, time.Minute
+	cfg.StageRetries[stageSearch].MaxRetries = 3
+	cfg.StageRetries[stageDetails].MaxRetries = 0
+	cfg.StageRetries[stageDownload].BaseDelay = 5 * time.Second
+	// -retry-download is unset, so downloads retry -max-retries times
+
+	failures := map[string]int{stageSearch: 2, stageDetails: 1, stageDownload: 1}
+	var mu sync.Mutex
+	calls := map[string]int{}
+	serveAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stage := stageDownload
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/v1/categories/"):
+			stage = stageSearch
+		case strings.HasPrefix(r.URL.Path, "/v2/product/"):
+			stage = stageDetails
+		}
+		mu.Lock()
+		calls[stage]++
+		failing := calls[stage] <= failures[stage]
+		mu.Unlock()
+		switch {
+		case failing:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case stage == stageSearch:
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"status":200,"data":{"products":[]}}`))
+		default:
+			w.Write([]byte("image"))
+		}
+	}))
+
+	ctx := context.Background()
+	if _, err := httpClient.fetchSubcategories(ctx, "mobile-phone"); err != nil {
+		t.Errorf("search: %v", err)
+	}
+	if _, err := httpClient.fetchProductInfoWithRetry(ctx, 1); err == nil {
+		t.Error("details: succeeded, want the failure kept with -retry-details 0")
+	}
+	if _, err := httpClient.downloadFromMirrors(ctx, "https://dkstatics-public.digikala.com/a.jpg", imageDir, "a.jpg"); err != nil {
+		t.Errorf("download: %v", err)
+	}
+
+	want := map[string]int{stageSearch: 3, stageDetails: 1, stageDownload: 2}
+	for stage, n := range want {
+		if calls[stage] != n {
+			t.Errorf("%s: %d requests, want %d", stage, calls[stage], n)
+		}
+	}
+	wantSleeps := []time.Duration{time.Second, 2 * time.Second, 5 * time.Second}
+	if len(clock.sleeps) != len(wantSleeps) {
+		t.Fatalf("waited %v, want %v", clock.sleeps, wantSleeps)
+	}
+	for i := range wantSleeps {
+		if clock.sleeps[i] != wantSleeps[i] {
+			t.Errorf("waited %v, want %v", clock.sleeps, wantSleeps)
+			break
+		}
+	}
+}
+
+// tooManyRequests replies 429 asking to be retried after value
+func tooManyRequests(value string) func(*http.Request) (*http.Response, error) {
+	return func(req *http.Request) (*http.Response, error) {
+		resp, _ := status(http.StatusTooManyRequests)(req)
+		resp.Header.Set("Retry-After", value)
+		return resp, nil
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 0},
+		{"120", 2 * time.Minute},
+		{"-5", 0},
+		{"soon", 0},
+		{now.Add(90 * time.Second).Format(http.TimeFormat), 90 * time.Second},
+		{now.Add(-time.Hour).Format(http.TimeFormat), 0},
+	}
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.value, now); got != tt.want {
+			t.Errorf("parseRetryAfter(%q) = %s, want %s", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		name       string
+		value      string
+		wantCalls  int
+		wantSleeps []time.Duration
+		wantErr    bool
+	}{
+		{"honored", "30", 2, []time.Duration{30 * time.Second}, false},
+		{"at the limit", "300", 2, []time.Duration{5 * time.Minute}, false},
+		// A day is more than -retry-after-max; the run doesn't stall for it
+		{"oversized", "86400", 1, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTest(t)
+			clock := &fakeClock{now: time.Unix(0, 0)}
+			transport := &countingTransport{replies: []func(*http.Request) (*http.Response, error){tooManyRequests(tt.value), product}}
+			cfg.Clock = clock
+			cfg.MaxRetries, cfg.RetryBase, cfg.RetryCap = 3, time.Second, time.Minute
+			cfg.RetryAfterMax = 5 * time.Minute
+			previous := httpClient
+			httpClient = NewClient(transport)
+			t.Cleanup(func() { httpClient = previous })
+
+			_, err := httpClient.fetchProductInfoWithRetry(context.Background(), 1)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error: %v", err, tt.wantErr)
+			}
+			if tt.wantErr && !hasStatus(err, http.StatusTooManyRequests) {
+				t.Errorf("err = %v, want the 429 kept", err)
+			}
+			if transport.calls != tt.wantCalls {
+				t.Errorf("%d calls, want %d", transport.calls, tt.wantCalls)
+			}
+			if len(clock.sleeps) != len(tt.wantSleeps) {
+				t.Fatalf("slept %v, want %v", clock.sleeps, tt.wantSleeps)
+			}
+			for i, want := range tt.wantSleeps {
+				if clock.sleeps[i] != want {
+					t.Errorf("wait %d = %s, want %s", i+1, clock.sleeps[i], want)
+				}
+			}
+		})
+	}
+}
+
+// TestTruncatedBodyRetried serves product details and an image whose
+// connection is closed halfway through the body, as a proxy dropping it
+// does: a body cut once is fetched again in full, one cut every time is
+// given up on after the retries, leaving no partial image behind
+func TestTruncatedBodyRetried(t *testing.T) {
+	tests := []struct {
+		name    string
+		cuts    int // How many responses are cut short before a whole one
+		wantErr bool
+	}{
+		{"cut once", 1, false},
+		{"cut every time", 100, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTest(t)
+			cfg.Clock = &fakeClock{now: time.Unix(0, 0)}
+			cfg.MaxRetries = 2
+			data := testPNG(t, 64, 64, color.White)
+			var mu sync.Mutex
+			calls := make(map[string]int)
+			serveAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var body bytes.Buffer
+				if strings.HasPrefix(r.URL.Path, "/v2/product/") {
+					rec := httptest.NewRecorder()
+					writeProduct(t, rec, productID(r), 1)
+					body = *rec.Body
+					w.Header().Set("Content-Type", "application/json")
+				} else {
+					body.Write(data)
+					w.Header().Set("Content-Type", "image/png")
+				}
+				mu.Lock()
+				calls[r.URL.Path]++
+				cut := calls[r.URL.Path] <= tt.cuts
+				mu.Unlock()
+				if !cut {
+					w.Write(body.Bytes())
+					return
+				}
+				w.Header().Set("Content-Length", strconv.Itoa(body.Len()))
+				w.Write(body.Bytes()[:body.Len()/2])
+				w.(http.Flusher).Flush()
+				conn, _, err := w.(http.Hijacker).Hijack()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				conn.Close()
+			}))
+			ctx := context.Background()
+
+			info, err := httpClient.fetchProductInfoWithRetry(ctx, 1)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("details: decoded a body cut short")
+				}
+				info.ImageURLs = []string{"https://dkstatics-public.digikala.com/img/1-1.png"}
+			} else if err != nil || info.Title != "product 1" {
+				t.Errorf("details: %q, %v; want product 1", info.Title, err)
+			}
+			if got, want := calls["/v2/product/1/"], min(tt.cuts+1, cfg.MaxRetries+1); got != want {
+				t.Errorf("details: %d requests, want %d", got, want)
+			}
+
+			_, err = httpClient.downloadFromMirrors(ctx, info.ImageURLs[0], imageDir, "1.png")
+			saved, readErr := os.ReadFile(filepath.Join(imageDir, "1.png"))
+			if tt.wantErr {
+				if err == nil || readErr == nil {
+					t.Errorf("image: saved %d bytes of a body cut short, err = %v", len(saved), err)
+				}
+			} else if err != nil || !bytes.Equal(saved, data) {
+				t.Errorf("image: saved %d of %d bytes, err = %v", len(saved), len(data), err)
+			}
+			if got, want := calls["/img/1-1.png"], min(tt.cuts+1, cfg.MaxRetries+1); got != want {
+				t.Errorf("image: %d requests, want %d", got, want)
+			}
+			if parts, _ := filepath.Glob(filepath.Join(imageDir, "*.part")); len(parts) > 0 {
+				t.Errorf("partial files left behind: %v", parts)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// URLRewriter transforms an image URL before it is downloaded
+type URLRewriter interface {
+	Rewrite(url string) (string, error)
+}
+
+// imageURLRewriter is applied to every image URL; nil leaves them unchanged
+var imageURLRewriter URLRewriter
+
+// RegexRewriter is a sed-style substitution, e.g. s/800x600/1200x900/
+type RegexRewriter struct {
+	pattern     *regexp.Regexp
+	replacement string // In regexp.Expand syntax
+	global      bool   // Replace every match rather than the first
+}
+
+// newRegexRewriter parses a substitution of the form s/pattern/replacement/
+// with an optional trailing g. Any character after the s is the delimiter;
+// a backslash escapes it, and \1 to \9 in the replacement refer to groups.
+func newRegexRewriter(expr string) (*RegexRewriter, error) {
+	if len(expr) < 2 || expr[0] != 's' {
+		return nil, fmt.Errorf("invalid rewrite %q: want s/pattern/replacement/", expr)
+	}
+	parts := splitUnescaped(expr[2:], expr[1])
+	if len(parts) != 3 || (parts[2] != "" && parts[2] != "g") {
+		return nil, fmt.Errorf("invalid rewrite %q: want s/pattern/replacement/ with an optional g", expr)
+	}
+	pattern, err := regexp.Compile(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid rewrite pattern: %w", err)
+	}
+	return &RegexRewriter{pattern: pattern, replacement: sedReplacement(parts[1]), global: parts[2] == "g"}, nil
+}
+
+// Rewrite implements URLRewriter
+func (r *RegexRewriter) Rewrite(url string) (string, error) {
+	if r.global {
+		return r.pattern.ReplaceAllString(url, r.replacement), nil
+	}
+	loc := r.pattern.FindStringSubmatchIndex(url)
+	if loc == nil {
+		return url, nil
+	}
+	expanded := r.pattern.ExpandString(nil, r.replacement, url, loc)
+	return url[:loc[0]] + string(expanded) + url[loc[1]:], nil
+}
+
+// splitUnescaped splits s at every delim not preceded by a backslash and
+// drops the backslash of escaped delimiters
+func splitUnescaped(s string, delim byte) []string {
+	var parts []string
+	var part strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s) && s[i+1] == delim:
+			part.WriteByte(delim)
+			i++
+		case s[i] == delim:
+			parts = append(parts, part.String())
+			part.Reset()
+		default:
+			part.WriteByte(s[i])
+		}
+	}
+	return append(parts, part.String())
+}
+
+// sedReplacement turns a sed replacement into regexp.Expand syntax: \1
+// becomes ${1}, & the whole match, and a literal $ is escaped
+func sedReplacement(s string) string {
+	var out strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' && i+1 < len(s) && s[i+1] >= '0' && s[i+1] <= '9':
+			out.WriteString("${" + string(s[i+1]) + "}")
+			i++
+		case c == '\\' && i+1 < len(s):
+			out.WriteByte(s[i+1]) // \& and \\ are literal
+			i++
+		case c == '&':
+			out.WriteString("${0}")
+		case c == '$':
+			out.WriteString("$$")
+		default:
+			out.WriteByte(c)
+		}
+	}
+	return out.String()
+}
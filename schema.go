@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Response kinds whose shape is fingerprinted
+const (
+	schemaListing = "listing" // Category listing pages
+	schemaProduct = "product" // Product details
+)
+
+// schemaDepth is how many levels of nested objects a fingerprint looks into
+const schemaDepth = 3
+
+// schemaFingerprint describes the shape of a response: the paths of the
+// fields it has, "data.products[].id" style, and a short hash of them
+type schemaFingerprint struct {
+	Hash   string   `json:"hash"`
+	Fields []string `json:"fields"`
+}
+
+// fingerprintJSON computes the fingerprint of a JSON document. Only field
+// names count, not values; arrays are represented by their first element.
+func fingerprintJSON(data []byte) (schemaFingerprint, error) {
+	var doc any
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return schemaFingerprint{}, err
+	}
+	fields := make(map[string]bool)
+	collectFields(doc, "", 0, fields)
+	fp := schemaFingerprint{Fields: make([]string, 0, len(fields))}
+	for field := range fields {
+		fp.Fields = append(fp.Fields, field)
+	}
+	sort.Strings(fp.Fields)
+	sum := sha256.Sum256([]byte(strings.Join(fp.Fields, "\n")))
+	fp.Hash = hex.EncodeToString(sum[:6])
+	return fp, nil
+}
+
+// collectFields adds the field paths of v below prefix to fields
+func collectFields(v any, prefix string, depth int, fields map[string]bool) {
+	switch v := v.(type) {
+	case map[string]any:
+		if depth >= schemaDepth {
+			return
+		}
+		for name, child := range v {
+			path := name
+			if prefix != "" {
+				path = prefix + "." + name
+			}
+			fields[path] = true
+			collectFields(child, path, depth+1, fields)
+		}
+	case []any:
+		if len(v) > 0 {
+			collectFields(v[0], prefix+"[]", depth, fields)
+		}
+	}
+}
+
+// diff returns the fields of fp missing from base and those of base
+// missing from fp
+func (fp schemaFingerprint) diff(base schemaFingerprint) (added, removed []string) {
+	for _, field := range fp.Fields {
+		if !slices.Contains(base.Fields, field) {
+			added = append(added, field)
+		}
+	}
+	for _, field := range base.Fields {
+		if !slices.Contains(fp.Fields, field) {
+			removed = append(removed, field)
+		}
+	}
+	return added, removed
+}
+
+// schemaRecorder keeps the fingerprint of the first response of each kind
+type schemaRecorder struct {
+	mu      sync.Mutex
+	samples map[string]schemaFingerprint
+}
+
+// schemas holds the fingerprints observed in this run
+var schemas = &schemaRecorder{samples: make(map[string]schemaFingerprint)}
+
+// wants reports whether no response of kind has been fingerprinted yet
+func (r *schemaRecorder) wants(kind string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.samples[kind]
+	return !ok
+}
+
+// record fingerprints data as the sample of kind unless there already is one
+func (r *schemaRecorder) record(kind string, data []byte) {
+	fp, err := fingerprintJSON(data)
+	if err != nil {
+		return // decoding reports the error
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.samples[kind]; !ok {
+		r.samples[kind] = fp
+	}
+}
+
+// hashes returns the hash of every recorded fingerprint by kind
+func (r *schemaRecorder) hashes() map[string]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	hashes := make(map[string]string, len(r.samples))
+	for kind, fp := range r.samples {
+		hashes[kind] = fp.Hash
+	}
+	return hashes
+}
+
+// decodeSampledJSON is decodeJSON that also fingerprints the response when
+// it is the first of its kind
+func decodeSampledJSON(resp *http.Response, kind string, v any) error {
+	if !schemas.wants(kind) {
+		return decodeJSON(resp, v)
+	}
+	var raw json.RawMessage
+	if err := decodeJSON(resp, &raw); err != nil {
+		return err
+	}
+	schemas.record(kind, raw)
+	return json.Unmarshal(raw, v)
+}
+
+// checkSchemaDrift compares the fingerprints of this run with the baseline
+// at path and warns about fields that appeared or disappeared. Kinds missing
+// from the baseline are added to it; known ones are left alone, so a change
+// keeps being reported until the baseline file is deleted.
+func checkSchemaDrift(path string) error {
+	baseline := make(map[string]schemaFingerprint)
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to read schema baseline: %w", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &baseline); err != nil {
+			return fmt.Errorf("failed to decode schema baseline %s: %w", path, err)
+		}
+	}
+
+	schemas.mu.Lock()
+	defer schemas.mu.Unlock()
+	changed := false
+	for kind, fp := range schemas.samples {
+		base, ok := baseline[kind]
+		if !ok {
+			baseline[kind] = fp
+			changed = true
+			continue
+		}
+		if fp.Hash == base.Hash {
+			continue
+		}
+		added, removed := fp.diff(base)
+		slog.Warn("API response shape changed since the baseline", "response", kind, "added", added, "removed", removed, "baseline", path)
+	}
+	if !changed {
+		return nil
+	}
+
+	data, err = json.MarshalIndent(baseline, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode schema baseline: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create schema baseline directory: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write schema baseline: %w", err)
+	}
+	return nil
+}
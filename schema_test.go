@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"slices"
+	"testing"
+)
+
+func TestFingerprintJSON(t *testing.T) {
+	fp, err := fingerprintJSON([]byte(`{"status":200,"data":{"products":[{"id":1,"title_fa":"a"},{"id":2,"extra":true}],"pager":{"total_pages":3}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Arrays count by their first element
+	want := []string{"data", "data.pager", "data.pager.total_pages", "data.products", "data.products[].id", "data.products[].title_fa", "status"}
+	if !slices.Equal(fp.Fields, want) {
+		t.Errorf("fields = %v, want %v", fp.Fields, want)
+	}
+
+	// Values and field order don't change the fingerprint
+	same, _ := fingerprintJSON([]byte(`{"data":{"pager":{"total_pages":9},"products":[{"title_fa":"b","id":"7"}]},"status":500}`))
+	if same.Hash != fp.Hash {
+		t.Errorf("hash %s for the same shape, want %s", same.Hash, fp.Hash)
+	}
+
+	// Objects past schemaDepth are left out
+	deep, _ := fingerprintJSON([]byte(`{"a":{"b":{"c":{"d":1}}}}`))
+	if !slices.Equal(deep.Fields, []string{"a", "a.b", "a.b.c"}) {
+		t.Errorf("deep fields = %v, want three levels", deep.Fields)
+	}
+
+	if _, err := fingerprintJSON([]byte(`{"status":`)); err == nil {
+		t.Error("fingerprinted invalid JSON")
+	}
+}
+
+func TestFingerprintDiff(t *testing.T) {
+	base, _ := fingerprintJSON([]byte(`{"data":{"product":{"title_fa":"a","images":{"main":1}}}}`))
+	current, _ := fingerprintJSON([]byte(`{"data":{"product":{"title_fa":"a","gallery":{"main":1}}}}`))
+	if current.Hash == base.Hash {
+		t.Fatal("a renamed field kept the hash")
+	}
+	added, removed := current.diff(base)
+	if !slices.Equal(added, []string{"data.product.gallery"}) {
+		t.Errorf("added = %v, want data.product.gallery", added)
+	}
+	if !slices.Equal(removed, []string{"data.product.images"}) {
+		t.Errorf("removed = %v, want data.product.images", removed)
+	}
+	if added, removed := base.diff(base); added != nil || removed != nil {
+		t.Errorf("diff with itself = %v, %v; want none", added, removed)
+	}
+}
+
+func TestCheckSchemaDrift(t *testing.T) {
+	setupTest(t)
+	previous := schemas
+	schemas = &schemaRecorder{samples: make(map[string]schemaFingerprint)}
+	t.Cleanup(func() { schemas = previous })
+
+	schemas.record(schemaProduct, []byte(`{"data":{"product":{"title_fa":"a"}}}`))
+	if err := checkSchemaDrift("schema.json"); err != nil {
+		t.Fatal(err)
+	}
+	first, err := os.ReadFile("schema.json")
+	if err != nil {
+		t.Fatalf("no baseline written: %v", err)
+	}
+
+	// A changed shape is reported but doesn't replace the baseline; a new
+	// kind is added to it
+	schemas = &schemaRecorder{samples: make(map[string]schemaFingerprint)}
+	schemas.record(schemaProduct, []byte(`{"data":{"product":{"title_en":"a"}}}`))
+	schemas.record(schemaListing, []byte(`{"data":{"products":[]}}`))
+	if err := checkSchemaDrift("schema.json"); err != nil {
+		t.Fatal(err)
+	}
+	var before, after map[string]schemaFingerprint
+	data, _ := os.ReadFile("schema.json")
+	if err := json.Unmarshal(first, &before); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &after); err != nil {
+		t.Fatal(err)
+	}
+	if after[schemaProduct].Hash != before[schemaProduct].Hash {
+		t.Error("the product baseline was replaced by the changed shape")
+	}
+	if _, ok := after[schemaListing]; !ok {
+		t.Error("the listing fingerprint was not added to the baseline")
+	}
+}
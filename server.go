@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// States of a server job
+const (
+	jobRunning   = "running"
+	jobDone      = "done"
+	jobCancelled = "cancelled"
+	jobFailed    = "failed"
+)
+
+// onImageSaved, when set, is called with the path of every image saved
+var onImageSaved func(path string)
+
+// jobStats are the counters of a server job
+type jobStats struct {
+	Pages      int64 `json:"pages"`
+	Discovered int64 `json:"discovered"`
+	Products   int64 `json:"products"`
+	Images     int64 `json:"images"`
+	Errors     int64 `json:"errors"`
+}
+
+// currentStats takes a snapshot of the global counters
+func currentStats() jobStats {
+	s := runStats()
+	return jobStats{
+		Pages:      s.Pages.Load(),
+		Discovered: s.Discovered.Load(),
+		Products:   s.Products.Load(),
+		Images:     s.Images.Load(),
+		Errors:     s.Errors.Load(),
+	}
+}
+
+// scrapeJob is a scrape started through the server
+type scrapeJob struct {
+	ID       string            `json:"id"`
+	Category string            `json:"category"`
+	Options  map[string]string `json:"options,omitempty"`
+	Status   string            `json:"status"`
+	Error    string            `json:"error,omitempty"`
+	Started  time.Time         `json:"started"`
+	Finished *time.Time        `json:"finished,omitempty"`
+	Stats    jobStats          `json:"stats"`
+
+	mu     sync.Mutex
+	images []string
+	cancel context.CancelFunc
+}
+
+// snapshot returns a copy of the job's public fields, with live counters
+// while it runs
+func (j *scrapeJob) snapshot() *scrapeJob {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	view := &scrapeJob{ID: j.ID, Category: j.Category, Options: j.Options, Status: j.Status, Error: j.Error, Started: j.Started, Finished: j.Finished, Stats: j.Stats}
+	if j.Status == jobRunning {
+		view.Stats = currentStats()
+	}
+	return view
+}
+
+func (j *scrapeJob) addImage(path string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.images = append(j.images, path)
+}
+
+// scrapeServer runs scrapes requested over HTTP. A run reads the process-wide
+// cfg, counters and shared state such as the manifest and the rate limits
+// rather than a job of its own, so only one job runs at a time: POST /scrape
+// answers 409 Conflict while one is running.
+type scrapeServer struct {
+	ctx     context.Context
+	base    Config                 // Configuration from the command line, which jobs start from
+	retries map[string]retryPolicy // base's stage retry policies, kept apart since jobs change them in place
+
+	mu      sync.Mutex
+	jobs    map[string]*scrapeJob
+	nextID  int
+	running *scrapeJob
+	wg      sync.WaitGroup
+}
+
+// scrapeRequest is the body of POST /scrape; options are command-line flags
+// without the dash, e.g. {"max-depth": "1"}
+type scrapeRequest struct {
+	Category string            `json:"category"`
+	Options  map[string]string `json:"options"`
+}
+
+func (s *scrapeServer) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /scrape", s.handleScrape)
+	mux.HandleFunc("GET /jobs/{id}", s.handleJob)
+	mux.HandleFunc("GET /jobs/{id}/images", s.handleImages)
+	mux.HandleFunc("DELETE /jobs/{id}", s.handleCancel)
+	return mux
+}
+
+// handleScrape configures and starts a job, or answers 409 Conflict while
+// another is running
+func (s *scrapeServer) handleScrape(w http.ResponseWriter, r *http.Request) {
+	var req scrapeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running != nil {
+		writeError(w, http.StatusConflict, fmt.Sprintf("job %s is still running; only one job runs at a time", s.running.ID))
+		return
+	}
+	if err := s.configure(req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	s.nextID++
+	ctx, cancel := context.WithCancel(s.ctx)
+	job := &scrapeJob{ID: strconv.Itoa(s.nextID), Category: cfg.Category, Options: req.Options, Status: jobRunning, Started: time.Now().UTC(), cancel: cancel}
+	s.jobs[job.ID] = job
+	s.running = job
+	s.wg.Add(1)
+	go s.run(ctx, job)
+	slog.Info("Job started", "job", job.ID, "category", job.Category)
+	writeJSON(w, http.StatusAccepted, map[string]string{"id": job.ID})
+}
+
+// configure sets cfg up for req, starting from the command-line configuration
+func (s *scrapeServer) configure(req scrapeRequest) error {
+	// The -retry-<stage> flags write to the policies cfg.StageRetries points
+	// to, so those are reset rather than replaced
+	policies := cfg.StageRetries
+	cfg = s.base.clone()
+	cfg.StageRetries = policies
+	for stage, p := range s.retries {
+		*policies[stage] = p
+	}
+	if req.Category != "" {
+		cfg.Category = req.Category
+		if err := cfg.resolveCategory(); err != nil {
+			return err
+		}
+	}
+	for name, value := range req.Options {
+		if err := flag.CommandLine.Set(name, value); err != nil {
+			return fmt.Errorf("invalid option %s: %w", name, err)
+		}
+	}
+	if cfg.Source == sourceCategory && cfg.Category == "" {
+		return errors.New("missing category")
+	}
+	if errs := validateConfig(); len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	return nil
+}
+
+// run runs job and records how it ended
+func (s *scrapeServer) run(ctx context.Context, job *scrapeJob) {
+	defer s.wg.Done()
+	defer job.cancel()
+	resetStats()
+	onImageSaved = job.addImage
+	err := runScrape(ctx, nil)
+	onImageSaved = nil
+
+	finished := time.Now().UTC()
+	job.mu.Lock()
+	job.Stats, job.Finished = currentStats(), &finished
+	switch {
+	case err != nil:
+		job.Status, job.Error = jobFailed, err.Error()
+	case ctx.Err() != nil:
+		job.Status = jobCancelled
+	default:
+		job.Status = jobDone
+	}
+	status := job.Status
+	job.mu.Unlock()
+	slog.Info("Job finished", "job", job.ID, "status", status)
+
+	s.mu.Lock()
+	s.running = nil
+	s.mu.Unlock()
+}
+
+// job returns the job named in the request path, answering 404 if unknown
+func (s *scrapeServer) job(w http.ResponseWriter, r *http.Request) *scrapeJob {
+	s.mu.Lock()
+	job := s.jobs[r.PathValue("id")]
+	s.mu.Unlock()
+	if job == nil {
+		writeError(w, http.StatusNotFound, "no such job")
+	}
+	return job
+}
+
+func (s *scrapeServer) handleJob(w http.ResponseWriter, r *http.Request) {
+	if job := s.job(w, r); job != nil {
+		writeJSON(w, http.StatusOK, job.snapshot())
+	}
+}
+
+func (s *scrapeServer) handleImages(w http.ResponseWriter, r *http.Request) {
+	job := s.job(w, r)
+	if job == nil {
+		return
+	}
+	job.mu.Lock()
+	images := append([]string{}, job.images...)
+	job.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string][]string{"images": images})
+}
+
+// handleCancel cancels a running job; it stops once its workers return
+func (s *scrapeServer) handleCancel(w http.ResponseWriter, r *http.Request) {
+	job := s.job(w, r)
+	if job == nil {
+		return
+	}
+	if job.snapshot().Status != jobRunning {
+		writeError(w, http.StatusConflict, "job is not running")
+		return
+	}
+	job.cancel()
+	writeJSON(w, http.StatusAccepted, job.snapshot())
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+// newScrapeServer returns a server whose jobs start from the current cfg
+func newScrapeServer(ctx context.Context) *scrapeServer {
+	s := &scrapeServer{ctx: ctx, base: cfg.clone(), retries: make(map[string]retryPolicy), jobs: make(map[string]*scrapeJob)}
+	for stage, p := range cfg.StageRetries {
+		s.retries[stage] = *p
+	}
+	return s
+}
+
+// runServer serves the scrape API on -server-addr until ctx is done, then
+// cancels the running job and waits up to -graceful-shutdown-timeout for it
+func runServer(ctx context.Context) int {
+	s := newScrapeServer(ctx)
+	srv := &http.Server{Addr: cfg.ServerAddr, Handler: s.routes()}
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe() }()
+	slog.Info("Serving the scrape API", "addr", cfg.ServerAddr)
+
+	select {
+	case err := <-errc:
+		slog.Error("Server stopped", "reason", err)
+		return exitFailure
+	case <-ctx.Done():
+	}
+	slog.Warn("Shutting down, waiting for the running job", "timeout", s.base.ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.base.ShutdownTimeout)
+	defer cancel()
+	srv.Shutdown(shutdownCtx)
+	jobsDone := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(jobsDone)
+	}()
+	select {
+	case <-jobsDone:
+		return exitOK
+	case <-shutdownCtx.Done():
+		slog.Warn("forceful shutdown, the running job did not stop in time")
+		return exitInterrupted
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestServerJobOptionsDoNotCarryOver(t *testing.T) {
+	setupTest(t)
+	s := newScrapeServer(context.Background())
+	defaultRetries := cfg.retryPolicy(stageSearch).MaxRetries
+
+	if err := s.configure(scrapeRequest{Category: "kids-apparel", Options: map[string]string{"retry-search": "5", "max-depth": "1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg.retryPolicy(stageSearch).MaxRetries; got != 5 {
+		t.Fatalf("first job: search retries = %d, want 5", got)
+	}
+
+	if err := s.configure(scrapeRequest{Category: "kids-apparel"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg.retryPolicy(stageSearch).MaxRetries; got != defaultRetries {
+		t.Errorf("second job: search retries = %d, want the default %d", got, defaultRetries)
+	}
+	if cfg.MaxDepth != s.base.MaxDepth {
+		t.Errorf("second job: max depth = %d, want the default %d", cfg.MaxDepth, s.base.MaxDepth)
+	}
+	if got := s.retries[stageSearch].MaxRetries; got != -1 {
+		t.Errorf("base search retries = %d after the jobs, want unset (-1)", got)
+	}
+}
+
+// TestServerJobListsDoNotCarryOver sets a repeatable flag in two jobs: each
+// appends to the base's list, and must not do so into an array the base or
+// the other job still holds
+func TestServerJobListsDoNotCarryOver(t *testing.T) {
+	setupTest(t)
+	cfg.AllowFormats = append(make(stringList, 0, 4), "jpeg")
+	s := newScrapeServer(context.Background())
+
+	if err := s.configure(scrapeRequest{Category: "kids-apparel", Options: map[string]string{"allow-format": "png"}}); err != nil {
+		t.Fatal(err)
+	}
+	first := cfg.AllowFormats
+	if err := s.configure(scrapeRequest{Category: "kids-apparel", Options: map[string]string{"allow-format": "gif"}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(first, ","); got != "jpeg,png" {
+		t.Errorf("first job's formats became %s once the second was configured, want jpeg,png", got)
+	}
+	if got := strings.Join(cfg.AllowFormats, ","); got != "jpeg,gif" {
+		t.Errorf("second job's formats = %s, want jpeg,gif", got)
+	}
+
+	if err := s.configure(scrapeRequest{Category: "kids-apparel"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(cfg.AllowFormats, ","); got != "jpeg" {
+		t.Errorf("third job's formats = %s, want only the base's jpeg", got)
+	}
+}
+
+// TestStatsResetWhileRead is meant for the race detector: the server reads
+// the counters of a job while the next job replaces them
+func TestStatsResetWhileRead(t *testing.T) {
+	setupTest(t)
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				currentStats()
+			}
+		}
+	}()
+	for i := 0; i < 1000; i++ {
+		resetStats()
+		stats.Pages.Add(1)
+	}
+	close(done)
+	wg.Wait()
+	if got := currentStats().Pages; got != 1 {
+		t.Errorf("pages = %d after a reset and one page, want 1", got)
+	}
+}
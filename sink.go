@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"path/filepath"
+	"slices"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// Values of -sinks
+const (
+	sinkLocal = "local" // Keep images in the image folder
+	sinkMinIO = "minio" // Upload images to a MinIO or other S3-compatible server
+)
+
+// imageSink receives every image saved to disk
+type imageSink interface {
+	put(ctx context.Context, path string) error
+}
+
+// sinks are the remote destinations of this run; images are always written
+// to disk first, and removed again when -sinks leaves out local
+var sinks []imageSink
+
+// keepLocal reports whether images stay on disk after the remote sinks got them
+func keepLocal() bool {
+	return len(cfg.Sinks) == 0 || slices.Contains(cfg.Sinks, sinkLocal)
+}
+
+// openSinks connects the remote sinks named by -sinks
+func openSinks(ctx context.Context) ([]imageSink, error) {
+	if !slices.Contains(cfg.Sinks, sinkMinIO) {
+		return nil, nil
+	}
+	s, err := newMinIOSink(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return []imageSink{s}, nil
+}
+
+// minioSink uploads images to a bucket, keyed by their path below imageDir
+type minioSink struct {
+	client *minio.Client
+	bucket string
+}
+
+// newMinIOSink connects to -minio-endpoint and makes sure the bucket exists,
+// creating it with -minio-create-bucket
+func newMinIOSink(ctx context.Context) (*minioSink, error) {
+	if cfg.MinIOEndpoint == "" || cfg.MinIOBucket == "" {
+		return nil, errors.New("the minio sink needs -minio-endpoint and -minio-bucket")
+	}
+	client, err := minio.New(cfg.MinIOEndpoint, &minio.Options{
+		Creds:     credentials.NewStaticV4(cfg.MinIOAccessKey, cfg.MinIOSecretKey, ""),
+		Secure:    cfg.MinIOUseSSL,
+		Transport: httpClient.plain().Transport,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up MinIO client: %w", err)
+	}
+	exists, err := client.BucketExists(ctx, cfg.MinIOBucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check MinIO bucket: %w", err)
+	}
+	if !exists {
+		if !cfg.MinIOCreateBucket {
+			return nil, fmt.Errorf("MinIO bucket %q does not exist; create it or pass -minio-create-bucket", cfg.MinIOBucket)
+		}
+		if err := client.MakeBucket(ctx, cfg.MinIOBucket, minio.MakeBucketOptions{}); err != nil {
+			return nil, fmt.Errorf("failed to create MinIO bucket: %w", err)
+		}
+	}
+	return &minioSink{client: client, bucket: cfg.MinIOBucket}, nil
+}
+
+func (s *minioSink) put(ctx context.Context, path string) error {
+	key, err := filepath.Rel(imageDir, path)
+	if err != nil {
+		key = path
+	}
+	_, err = s.client.FPutObject(ctx, s.bucket, filepath.ToSlash(key), path, minio.PutObjectOptions{
+		ContentType: mime.TypeByExtension(filepath.Ext(path)),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload %s to MinIO: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const sitemapIndexURL = "https://www.digikala.com/sitemap.xml" // Sitemap index listing the shards
+
+// productURLPattern matches product page URLs, capturing the product ID
+var productURLPattern = regexp.MustCompile(`/product/dkp-(\d+)(?:[/?#]|$)`)
+
+// productIDFromURL returns the product ID in a product page URL
+func productIDFromURL(url string) (int, bool) {
+	m := productURLPattern.FindStringSubmatch(url)
+	if m == nil {
+		return 0, false
+	}
+	id, err := strconv.Atoi(m[1])
+	if err != nil || id <= 0 {
+		return 0, false
+	}
+	return id, true
+}
+
+// sitemapEntry is a <sitemap> of an index or a <url> of a shard
+type sitemapEntry struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod"`
+}
+
+// modified returns the lastmod time of e; ok is false when it is missing or
+// unreadable
+func (e sitemapEntry) modified() (t time.Time, ok bool) {
+	value := strings.TrimSpace(e.LastMod)
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04Z07:00", time.DateOnly} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// before reports whether e was last modified before since. Entries without a
+// usable lastmod are never filtered out.
+func (e sitemapEntry) before(since time.Time) bool {
+	if since.IsZero() {
+		return false
+	}
+	t, ok := e.modified()
+	return ok && t.Before(since)
+}
+
+// openSitemap requests the sitemap at url and returns its body, gunzipped
+// when it is compressed
+func (c *Client) openSitemap(ctx context.Context, url string) (io.ReadCloser, error) {
+	resp, err := c.get(ctx, url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch sitemap: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, newStatusError(url, resp)
+	}
+	// Shards are usually .xml.gz served as application/octet-stream, so the
+	// gzip magic number decides rather than the headers
+	body := bufio.NewReader(resp.Body)
+	magic, err := body.Peek(2)
+	if err != nil || magic[0] != 0x1f || magic[1] != 0x8b {
+		return struct {
+			io.Reader
+			io.Closer
+		}{body, resp.Body}, nil
+	}
+	gz, err := gzip.NewReader(body)
+	if err != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to decompress sitemap %s: %w", url, err)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{gz, resp.Body}, nil
+}
+
+// scanSitemap calls fn for every <element> entry of the sitemap read from r,
+// decoding one entry at a time so that shards of any size use little memory.
+// It stops early when fn returns false.
+func scanSitemap(r io.Reader, element string, fn func(sitemapEntry) bool) error {
+	decoder := xml.NewDecoder(r)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to parse sitemap: %w", err)
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != element {
+			continue
+		}
+		var entry sitemapEntry
+		if err := decoder.DecodeElement(&entry, &start); err != nil {
+			return fmt.Errorf("failed to parse sitemap: %w", err)
+		}
+		if !fn(entry) {
+			return nil
+		}
+	}
+}
+
+// sitemapShards returns the product shards listed in the sitemap index,
+// leaving out those untouched since since
+func (c *Client) sitemapShards(ctx context.Context, since time.Time) ([]sitemapEntry, error) {
+	var shards []sitemapEntry
+	err := cfg.retryPolicy(stageSearch).do(ctx, func(ctx context.Context) error {
+		shards = shards[:0]
+		index, err := c.openSitemap(ctx, sitemapIndexURL)
+		if err != nil {
+			return err
+		}
+		defer index.Close()
+		return scanSitemap(index, "sitemap", func(shard sitemapEntry) bool {
+			if strings.Contains(shard.Loc, "product") && !shard.before(since) {
+				shards = append(shards, shard)
+			}
+			return true
+		})
+	})
+	return shards, err
+}
+
+// crawlSitemap queues every product listed in the product sitemap shards with
+// dir as its image folder, skipping entries last modified before since
+func (c *crawler) crawlSitemap(ctx context.Context, dir string, since time.Time) {
+	slog.Info("Fetching sitemap index", "url", sitemapIndexURL)
+	shards, err := c.client.sitemapShards(ctx, since)
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		stats.Errors.Add(1)
+		slog.Error("Failed to read the sitemap index", "reason", friendlyError(err))
+		debugLog.Printf("sitemap index: %v", err)
+		reportError(newErrorEvent("page", err))
+		return
+	}
+
+	for i, shard := range shards {
+		pause.wait()
+		if ctx.Err() != nil {
+			return
+		}
+		stats.setPosition(sourceSitemap, i+1)
+		before := stats.Discovered.Load()
+		if err := c.crawlShard(ctx, shard.Loc, i+1, dir, since); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			stats.Errors.Add(1)
+			slog.Error("Failed to read sitemap shard", "shard", shard.Loc, "reason", friendlyError(err))
+			debugLog.Printf("sitemap shard %s: %v", shard.Loc, err)
+			e := newErrorEvent("page", err)
+			e.Page, e.URL = i+1, shard.Loc
+			reportError(e)
+		}
+		stats.Pages.Add(1)
+		slog.Info("Sitemap shard done", "shard", fmt.Sprintf("%d/%d", i+1, len(shards)), "new_products", stats.Discovered.Load()-before, "discovered", stats.Discovered.Load())
+	}
+}
+
+// crawlShard queues the products of one sitemap shard. Products queued
+// before a parse error stay queued.
+func (c *crawler) crawlShard(ctx context.Context, url string, shard int, dir string, since time.Time) error {
+	body, err := c.client.openSitemap(ctx, url)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	stopped := false
+	err = scanSitemap(body, "url", func(entry sitemapEntry) bool {
+		if entry.before(since) {
+			return true
+		}
+		id, ok := productIDFromURL(entry.Loc)
+		if !ok {
+			return true
+		}
+		stopped = !c.queue(ctx, id, sourceSitemap, shard, dir, nil)
+		return !stopped
+	})
+	if stopped {
+		return ctx.Err()
+	}
+	return err
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProductIDFromURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		id   int
+		want bool
+	}{
+		{"https://www.digikala.com/product/dkp-12345/", 12345, true},
+		{"https://www.digikala.com/product/dkp-12345/گوشی-موبایل", 12345, true},
+		{"https://www.digikala.com/product/dkp-12345?ref=a", 12345, true},
+		{"https://www.digikala.com/product/dkp-12345", 12345, true},
+		{"https://www.digikala.com/product/dkp-12345x/", 0, false},
+		{"https://www.digikala.com/product/dkp-0/", 0, false},
+		{"https://www.digikala.com/search/category-mobile-phone/", 0, false},
+	}
+	for _, tt := range tests {
+		id, ok := productIDFromURL(tt.url)
+		if id != tt.id || ok != tt.want {
+			t.Errorf("productIDFromURL(%q) = %d, %v; want %d, %v", tt.url, id, ok, tt.id, tt.want)
+		}
+	}
+}
+
+func TestSitemapEntryBefore(t *testing.T) {
+	since := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		lastMod string
+		want    bool
+	}{
+		{"2024-04-30T23:00:00+00:00", true},
+		{"2024-05-01T10:00+03:30", false},
+		{"2024-04-01", true},
+		{" 2024-06-01 ", false},
+		{"", false},          // Unknown, kept
+		{"yesterday", false}, // Unreadable, kept
+	}
+	for _, tt := range tests {
+		if got := (sitemapEntry{LastMod: tt.lastMod}).before(since); got != tt.want {
+			t.Errorf("lastmod %q before %s = %v, want %v", tt.lastMod, since.Format(time.DateOnly), got, tt.want)
+		}
+	}
+	if (sitemapEntry{LastMod: "2000-01-01"}).before(time.Time{}) {
+		t.Error("an entry was filtered out without a -since")
+	}
+}
+
+func TestScanSitemap(t *testing.T) {
+	shard := `<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <url><loc>https://www.digikala.com/product/dkp-1/</loc><lastmod>2024-05-01</lastmod></url>
+  <url><loc>https://www.digikala.com/product/dkp-2/</loc></url>
+  <url><loc>https://www.digikala.com/product/dkp-3/</loc></url>
+</urlset>`
+	var locs []string
+	err := scanSitemap(strings.NewReader(shard), "url", func(e sitemapEntry) bool {
+		locs = append(locs, e.Loc)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locs) != 3 || locs[0] != "https://www.digikala.com/product/dkp-1/" {
+		t.Errorf("entries = %v, want the three products", locs)
+	}
+
+	n := 0
+	scanSitemap(strings.NewReader(shard), "url", func(sitemapEntry) bool {
+		n++
+		return n < 2
+	})
+	if n != 2 {
+		t.Errorf("scanned %d entries after asking to stop at 2", n)
+	}
+
+	// Entries read before the document breaks are kept
+	locs = nil
+	err = scanSitemap(strings.NewReader(shard[:strings.Index(shard, "dkp-3")]), "url", func(e sitemapEntry) bool {
+		locs = append(locs, e.Loc)
+		return true
+	})
+	if err == nil {
+		t.Error("truncated sitemap parsed without an error")
+	}
+	if len(locs) != 2 {
+		t.Errorf("%d entries before the error, want 2", len(locs))
+	}
+}
+
+// TestCrawlSitemap reads an index listing a gzipped product shard, a shard
+// untouched since -since and a shard of categories, and queues the products
+// of the first only
+func TestCrawlSitemap(t *testing.T) {
+	setupTest(t)
+	index := `<sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <sitemap><loc>https://www.digikala.com/sitemap-products-1.xml.gz</loc><lastmod>2024-06-01</lastmod></sitemap>
+  <sitemap><loc>https://www.digikala.com/sitemap-products-2.xml.gz</loc><lastmod>2023-01-01</lastmod></sitemap>
+  <sitemap><loc>https://www.digikala.com/sitemap-categories.xml</loc></sitemap>
+</sitemapindex>`
+	var shard bytes.Buffer
+	gz := gzip.NewWriter(&shard)
+	gz.Write([]byte(`<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <url><loc>https://www.digikala.com/product/dkp-11/</loc><lastmod>2024-06-01</lastmod></url>
+  <url><loc>https://www.digikala.com/product/dkp-12/</loc><lastmod>2023-01-01</lastmod></url>
+  <url><loc>https://www.digikala.com/landing/sale/</loc></url>
+  <url><loc>https://www.digikala.com/product/dkp-13/</loc></url>
+</urlset>`))
+	gz.Close()
+	var requested []string
+	serveAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = append(requested, r.URL.Path)
+		switch r.URL.Path {
+		case "/sitemap.xml":
+			w.Write([]byte(index))
+		case "/sitemap-products-1.xml.gz":
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write(shard.Bytes())
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+
+	jobs := make(chan productJob, 10)
+	c := newCrawler(httpClient, jobs, QueryOptions{}, 0, false, 0)
+	c.crawlSitemap(context.Background(), "sitemap", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	close(jobs)
+
+	var ids []int
+	for job := range jobs {
+		ids = append(ids, job.ID)
+	}
+	if !slices.Equal(ids, []int{11, 13}) {
+		t.Errorf("queued %v, want [11 13]", ids)
+	}
+	if !slices.Equal(requested, []string{"/sitemap.xml", "/sitemap-products-1.xml.gz"}) {
+		t.Errorf("requested %v, want the index and the fresh product shard", requested)
+	}
+	if got := stats.Errors.Load(); got != 0 {
+		t.Errorf("%d errors, want none", got)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Named values of -dedup-across-sizes; a number of pixels keeps the variant
+// closest to it instead
+const (
+	sizeLargest  = "largest"
+	sizeSmallest = "smallest"
+)
+
+var (
+	// sizeSegment matches a path segment naming a size, e.g. 800x600
+	sizeSegment = regexp.MustCompile(`^\d+x\d+$`)
+	// sizeParam matches a width or height in an image processing parameter,
+	// e.g. the w_800 of x-oss-process=image/resize,m_lfit,w_800,h_800
+	sizeParam = regexp.MustCompile(`\b[wh]_(\d+)\b`)
+)
+
+// resizeParams are the query parameters that pick an image's size; the
+// others, such as a version, tell different images apart
+var resizeParams = map[string]bool{
+	"x-oss-process": true,
+	"w":             true,
+	"h":             true,
+	"width":         true,
+	"height":        true,
+	"size":          true,
+	"resize":        true,
+}
+
+// validateSizePreference checks a -dedup-across-sizes value
+func validateSizePreference(pref string) error {
+	if pref == "" || pref == sizeLargest || pref == sizeSmallest {
+		return nil
+	}
+	if n, err := strconv.Atoi(pref); err != nil || n <= 0 {
+		return fmt.Errorf("invalid -dedup-across-sizes %q: use largest, smallest or a size in pixels", pref)
+	}
+	return nil
+}
+
+// imageIdentity returns what is left of an image URL without the parts that
+// pick its size: the CDN's resize parameters of the query and any path
+// segment such as 800x600. Variants of one photo share it.
+func imageIdentity(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	segments := strings.Split(u.Path, "/")
+	kept := segments[:0]
+	for _, segment := range segments {
+		if !sizeSegment.MatchString(segment) {
+			kept = append(kept, segment)
+		}
+	}
+	query := u.Query()
+	for name := range query {
+		if resizeParams[strings.ToLower(name)] {
+			query.Del(name)
+		}
+	}
+	id := u.Host + strings.Join(kept, "/")
+	if len(query) > 0 {
+		id += "?" + query.Encode() // Sorted, so the order of the parameters doesn't matter
+	}
+	return id
+}
+
+// imageSize returns the largest dimension in pixels an image URL asks for,
+// or 0 when it asks for none, which is taken to be the original and larger
+// than any resized variant
+func imageSize(rawURL string) int {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return 0
+	}
+	size := 0
+	for _, segment := range strings.Split(u.Path, "/") {
+		if sizeSegment.MatchString(segment) {
+			w, h, _ := strings.Cut(segment, "x")
+			size = max(size, atoi(w), atoi(h))
+		}
+	}
+	for name, values := range u.Query() {
+		name = strings.ToLower(name)
+		for _, value := range values {
+			switch {
+			case name == "x-oss-process":
+				for _, m := range sizeParam.FindAllStringSubmatch(value, -1) {
+					size = max(size, atoi(m[1]))
+				}
+			case resizeParams[name]:
+				if n, err := strconv.Atoi(value); err == nil {
+					size = max(size, n)
+				}
+			}
+		}
+	}
+	return size
+}
+
+// atoi is strconv.Atoi for strings already known to be digits
+func atoi(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
+
+// preferSize reports whether an image of size a suits pref better than one
+// of size b
+func preferSize(a, b int, pref string) bool {
+	const original = int(^uint(0) >> 1) // 0 stands for the largest size of all
+	if a == 0 {
+		a = original
+	}
+	if b == 0 {
+		b = original
+	}
+	switch pref {
+	case sizeLargest:
+		return a > b
+	case sizeSmallest:
+		return a < b
+	}
+	target := atoi(pref)
+	return abs(a-target) < abs(b-target)
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// dedupSizes returns urls with the size variants of each photo reduced to
+// the one pref prefers, kept where the photo first appeared, and how many
+// variants were left out. It returns a new slice.
+func dedupSizes(urls []string, pref string) ([]string, int) {
+	kept := make([]string, 0, len(urls))
+	index := make(map[string]int, len(urls)) // Identity to position in kept
+	for _, u := range urls {
+		id := imageIdentity(u)
+		i, seen := index[id]
+		if !seen {
+			index[id] = len(kept)
+			kept = append(kept, u)
+			continue
+		}
+		if preferSize(imageSize(u), imageSize(kept[i]), pref) {
+			kept[i] = u
+		}
+	}
+	return kept, len(urls) - len(kept)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestImageIdentity(t *testing.T) {
+	const base = "https://dkstatics-public.digikala.com/digikala-products/1.jpg"
+	tests := []struct {
+		name      string
+		a, b      string
+		sameImage bool
+	}{
+		{"resize parameter", base + "?x-oss-process=image/resize,m_lfit,h_800,w_800/quality,q_90", base, true},
+		{"two resize parameters", base + "?x-oss-process=image/resize,w_200", base + "?x-oss-process=image/resize,w_800", true},
+		{"width parameter", base + "?w=300&h=300", base + "?width=1200", true},
+		{"size segment", "https://dkstatics-public.digikala.com/800x600/1.jpg", "https://dkstatics-public.digikala.com/1.jpg", true},
+		{"kept parameter", base + "?v=2&x-oss-process=image/resize,w_200", base + "?x-oss-process=image/resize,w_800&v=2", true},
+		{"other version", base + "?v=1", base + "?v=2", false},
+		{"version against none", base + "?v=1", base, false},
+		{"other photo", base, "https://dkstatics-public.digikala.com/digikala-products/2.jpg", false},
+		{"other host", base, "https://dkstatics-public-2.digikala.com/digikala-products/1.jpg", false},
+	}
+	for _, tt := range tests {
+		a, b := imageIdentity(tt.a), imageIdentity(tt.b)
+		if (a == b) != tt.sameImage {
+			t.Errorf("%s: identities %q and %q, want same %v", tt.name, a, b, tt.sameImage)
+		}
+	}
+}
+
+func TestImageSize(t *testing.T) {
+	tests := []struct {
+		url  string
+		want int
+	}{
+		{"https://dkstatics-public.digikala.com/1.jpg", 0},
+		{"https://dkstatics-public.digikala.com/1.jpg?x-oss-process=image/resize,m_lfit,h_600,w_800", 800},
+		{"https://dkstatics-public.digikala.com/1.jpg?x-oss-process=image/quality,q_90", 0},
+		{"https://dkstatics-public.digikala.com/300x400/1.jpg", 400},
+		{"https://dkstatics-public.digikala.com/1.jpg?w=300&h=500", 500},
+		{"https://dkstatics-public.digikala.com/1.jpg?v=1200", 0},
+	}
+	for _, tt := range tests {
+		if got := imageSize(tt.url); got != tt.want {
+			t.Errorf("imageSize(%q) = %d, want %d", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestDedupSizes(t *testing.T) {
+	const (
+		photo    = "https://dkstatics-public.digikala.com/1.jpg"
+		original = photo
+		small    = photo + "?x-oss-process=image/resize,w_200"
+		medium   = photo + "?x-oss-process=image/resize,w_600"
+		large    = photo + "?x-oss-process=image/resize,w_1600"
+		other    = "https://dkstatics-public.digikala.com/2.jpg?x-oss-process=image/resize,w_200"
+		version  = photo + "?v=2&x-oss-process=image/resize,w_200"
+	)
+	resized := []string{small, other, large, medium}
+	withOriginal := []string{medium, original, small, other}
+	tests := []struct {
+		name    string
+		urls    []string
+		pref    string
+		want    []string
+		dropped int
+	}{
+		{"largest", resized, sizeLargest, []string{large, other}, 2},
+		{"smallest", resized, sizeSmallest, []string{small, other}, 2},
+		{"closest to 500", resized, "500", []string{medium, other}, 2},
+		{"closest to 1200", resized, "1200", []string{large, other}, 2},
+		{"closest to 10", resized, "10", []string{small, other}, 2},
+		{"tie keeps the first", []string{small, large}, "900", []string{small}, 1},
+		{"original is largest", withOriginal, sizeLargest, []string{original, other}, 2},
+		{"original is not smallest", withOriginal, sizeSmallest, []string{small, other}, 2},
+		{"original is far from a target", withOriginal, "800", []string{medium, other}, 2},
+		{"another version is another photo", []string{small, version}, sizeLargest, []string{small, version}, 0},
+		{"nothing to drop", []string{small, other}, sizeLargest, []string{small, other}, 0},
+		{"empty", nil, sizeLargest, []string{}, 0},
+	}
+	for _, tt := range tests {
+		before := slices.Clone(tt.urls)
+		got, dropped := dedupSizes(tt.urls, tt.pref)
+		if !slices.Equal(got, tt.want) || dropped != tt.dropped {
+			t.Errorf("%s: dedupSizes = %v, %d; want %v, %d", tt.name, got, dropped, tt.want, tt.dropped)
+		}
+		if !slices.Equal(tt.urls, before) {
+			t.Errorf("%s: dedupSizes changed its argument to %v", tt.name, tt.urls)
+		}
+	}
+}
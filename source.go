@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Values of -source, where the products of a run come from
+const (
+	sourceCategory = "category" // The listing of -category
+	sourceWishlist = "wishlist" // The wishlist of the -auth-token account
+	sourceSitemap  = "sitemap"  // Every product in the site's sitemap
+	sourceIDRange  = "id-range" // Every product ID in -id-range
+)
+
+// sources lists the accepted -source values
+var sources = []string{sourceCategory, sourceWishlist, sourceSitemap, sourceIDRange}
+
+// idRange is an inclusive range of product IDs given as FROM-TO
+type idRange struct {
+	From, To int
+}
+
+// String implements flag.Value
+func (r *idRange) String() string {
+	if r.From == 0 && r.To == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d-%d", r.From, r.To)
+}
+
+// Set implements flag.Value
+func (r *idRange) Set(s string) error {
+	from, to, ok := strings.Cut(strings.TrimSpace(s), "-")
+	f, errF := strconv.Atoi(from)
+	t, errT := strconv.Atoi(to)
+	if !ok || errF != nil || errT != nil || f <= 0 || t < f {
+		return fmt.Errorf("invalid ID range %q: want FROM-TO, e.g. 14000000-14001000", s)
+	}
+	r.From, r.To = f, t
+	return nil
+}
+
+// crawlIDRange queues every step-th product ID of r with dir as its image
+// folder. Most IDs of a range may not exist; their details return 404, which
+// is counted as nonexistent rather than as an error.
+func (c *crawler) crawlIDRange(ctx context.Context, dir string, r idRange, step int) {
+	slog.Info("Probing product IDs", "from", r.From, "to", r.To, "step", step)
+	for id := r.From; id <= r.To; id += step {
+		pause.wait()
+		stats.setPosition(sourceIDRange, id)
+		if !c.queue(ctx, id, sourceIDRange, 0, dir, nil) {
+			return
+		}
+	}
+}
+
+// crawlSource queues the products of the -source the run was given
+func (c *crawler) crawlSource(ctx context.Context) {
+	switch cfg.Source {
+	case sourceWishlist:
+		c.crawlWishlist(ctx, imageDir)
+	case sourceSitemap:
+		c.crawlSitemap(ctx, imageDir, cfg.ModifiedSince.Time)
+	case sourceIDRange:
+		c.crawlIDRange(ctx, imageDir, cfg.IDRange, cfg.IDStep)
+	default:
+		// Fetch products for each page of the category (and its subcategories)
+		dir := imageDir
+		if cfg.CategoryTree {
+			dir = filepath.Join(imageDir, cfg.Category)
+		}
+		c.crawl(ctx, cfg.Category, dir, 0)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// sourceURLAttr is the extended attribute -store-source-url writes, the one
+// browsers and wget use for where a file was downloaded from
+const sourceURLAttr = "user.xdg.origin.url"
+
+// sourceURLExt is appended to an image's path to name its source URL file,
+// written where extended attributes can't be
+const sourceURLExt = ".url"
+
+// writeXattr sets an extended attribute; tests replace it
+var writeXattr = setXattr
+
+// warnNoXattr warns once that source URLs went to files instead
+var warnNoXattr sync.Once
+
+// storeSourceURL records url as where the image at path was downloaded from:
+// in an extended attribute when the filesystem supports them, or else in a
+// file next to it. A shared file, such as a hard link, always gets the file,
+// since an attribute would be overwritten by the next image sharing it.
+func storeSourceURL(path, url string, shared bool) error {
+	if !shared {
+		err := writeXattr(path, sourceURLAttr, url)
+		if err == nil {
+			return nil
+		}
+		warnNoXattr.Do(func() {
+			slog.Warn("Extended attributes are not available here, writing source URLs to .url files", "reason", err)
+		})
+	}
+	if err := os.WriteFile(path+sourceURLExt, []byte(url+"\n"), 0o644); err != nil {
+		return fmt.Errorf("failed to write source URL: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+// fakeXattrs replaces writeXattr for the rest of the test with one that
+// records the attributes set, or fails with err
+func fakeXattrs(t *testing.T, err error) map[string]string {
+	t.Helper()
+	attrs := make(map[string]string)
+	previous := writeXattr
+	writeXattr = func(path, name, value string) error {
+		if err != nil {
+			return err
+		}
+		attrs[path+" "+name] = value
+		return nil
+	}
+	t.Cleanup(func() { writeXattr = previous })
+	return attrs
+}
+
+func TestStoreSourceURL(t *testing.T) {
+	const url = "https://dkstatics-public.digikala.com/a.jpg"
+	tests := []struct {
+		name     string
+		shared   bool
+		xattrErr error
+		attr     bool // Whether the URL goes to the extended attribute
+	}{
+		{"own file", false, nil, true},
+		{"shared file", true, nil, false},
+		{"no extended attributes", false, errors.New("operation not supported"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTest(t)
+			attrs := fakeXattrs(t, tt.xattrErr)
+			if err := os.WriteFile("a.jpg", []byte("image"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if err := storeSourceURL("a.jpg", url, tt.shared); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := os.ReadFile("a.jpg" + sourceURLExt)
+			if tt.attr {
+				if attrs["a.jpg "+sourceURLAttr] != url {
+					t.Errorf("attributes %v, want %s in %s", attrs, url, sourceURLAttr)
+				}
+				if err == nil {
+					t.Errorf("wrote %s next to a file that took the attribute", sourceURLExt)
+				}
+				return
+			}
+			if len(attrs) != 0 {
+				t.Errorf("set attributes %v", attrs)
+			}
+			if err != nil || string(got) != url+"\n" {
+				t.Errorf("%s file holds %q, %v; want the URL", sourceURLExt, got, err)
+			}
+		})
+	}
+}
+
+func TestStoreSourceURLFileFails(t *testing.T) {
+	setupTest(t)
+	fakeXattrs(t, errors.New("operation not supported"))
+	if err := storeSourceURL("missing/a.jpg", "https://dkstatics-public.digikala.com/a.jpg", false); err == nil {
+		t.Error("no error when neither the attribute nor the file could be written")
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// stagingPrefix starts the name of every file put in -staging-dir, so that
+// cleanup leaves other files there alone
+const stagingPrefix = "digigo-"
+
+// stagingOrphanAge is how long a staged file must have been left untouched
+// before cleanup takes it for the leftover of a crashed run; a download in
+// progress, of this run or another sharing the directory, is far younger
+const stagingOrphanAge = time.Hour
+
+// rename renames files; tests replace it to fail like a rename across
+// filesystems
+var rename = os.Rename
+
+// crossDeviceOnce logs the copy fallback of moveFile once per run
+var crossDeviceOnce sync.Once
+
+// stagingPath returns where the image for filePath is written while it
+// downloads: next to it, or in -staging-dir under a name unique to this
+// process and destination
+func stagingPath(filePath string) string {
+	if cfg.StagingDir == "" {
+		return filePath + ".part"
+	}
+	sum := sha256.Sum256([]byte(filePath))
+	name := stagingPrefix + strconv.Itoa(os.Getpid()) + "-" + hex.EncodeToString(sum[:6]) + "-" + filepath.Base(filePath) + ".part"
+	return filepath.Join(cfg.StagingDir, name)
+}
+
+// moveFile renames src to dst, or, when they are on different filesystems,
+// copies src to dst, syncs it and removes src
+func moveFile(src, dst string) error {
+	err := rename(src, dst)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	crossDeviceOnce.Do(func() {
+		slog.Info("The staging folder is on another filesystem than the images; finished images are copied instead of moved", "staging", cfg.StagingDir)
+	})
+	return copyFile(src, dst)
+}
+
+// copyFile copies src to dst through a temporary file next to dst, so a
+// partial copy never takes its name, and removes src once dst is synced
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := dst + ".part"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp) // No-op once renamed
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := rename(tmp, dst); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// cleanStagingDir removes staged files left behind by crashed runs. The
+// directory may be shared, so only our own files untouched for
+// stagingOrphanAge are removed.
+func cleanStagingDir(dir string, now time.Time) error {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read staging directory: %w", err)
+	}
+	removed := 0
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, stagingPrefix) || !strings.HasSuffix(name, ".part") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || now.Sub(info.ModTime()) < stagingOrphanAge {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, name)); err == nil {
+			removed++
+		}
+	}
+	if removed > 0 {
+		slog.Info("Removed files left in the staging folder by earlier runs", "count", removed)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"image/color"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// renameWithinDir replaces rename for the rest of the test with one that
+// fails with EXDEV between directories, as between two filesystems
+func renameWithinDir(t *testing.T) {
+	previous := rename
+	rename = func(oldpath, newpath string) error {
+		if filepath.Dir(oldpath) != filepath.Dir(newpath) {
+			return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+		}
+		return previous(oldpath, newpath)
+	}
+	t.Cleanup(func() { rename = previous })
+}
+
+func TestMoveFileCrossDevice(t *testing.T) {
+	renameWithinDir(t)
+	staging, images := t.TempDir(), t.TempDir()
+	src, dst := filepath.Join(staging, "a.jpg.part"), filepath.Join(images, "a.jpg")
+	if err := os.WriteFile(src, []byte("image"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := moveFile(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(dst); err != nil || string(data) != "image" {
+		t.Errorf("destination holds %q, %v; want the image", data, err)
+	}
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Errorf("staged file left behind: %v", err)
+	}
+	if _, err := os.Stat(dst + ".part"); !os.IsNotExist(err) {
+		t.Errorf("temporary copy left behind: %v", err)
+	}
+}
+
+// TestStagingCrossDevice downloads with -staging-dir on "another
+// filesystem" than the images
+func TestStagingCrossDevice(t *testing.T) {
+	setupTest(t)
+	renameWithinDir(t)
+	cfg.StagingDir = t.TempDir()
+	data := testPNG(t, 8, 8, color.Black)
+	serveAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write(data) }))
+
+	if _, err := httpClient.downloadFromMirrors(context.Background(), "https://dkstatics-public.digikala.com/a.png", imageDir, "a.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if saved, err := os.ReadFile(filepath.Join(imageDir, "a.jpg")); err != nil || len(saved) != len(data) {
+		t.Errorf("saved %d bytes, %v; want the %d byte image", len(saved), err, len(data))
+	}
+	if left, _ := os.ReadDir(cfg.StagingDir); len(left) != 0 {
+		t.Errorf("%d files left in the staging folder", len(left))
+	}
+}
+
+func TestCleanStagingDir(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	files := map[string]time.Time{
+		stagingPrefix + "1-abc-a.jpg.part": now.Add(-2 * stagingOrphanAge), // Orphan
+		stagingPrefix + "2-abc-b.jpg.part": now.Add(-time.Minute),          // Downloading
+		"other-tool.part":                  now.Add(-2 * stagingOrphanAge), // Not ours
+		stagingPrefix + "notes.txt":        now.Add(-2 * stagingOrphanAge),
+	}
+	for name, modified := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modified, modified); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := cleanStagingDir(dir, now); err != nil {
+		t.Fatal(err)
+	}
+	for name := range files {
+		_, err := os.Stat(filepath.Join(dir, name))
+		if removed := os.IsNotExist(err); removed != (name == stagingPrefix+"1-abc-a.jpg.part") {
+			t.Errorf("%s removed: %v", name, removed)
+		}
+	}
+	if err := cleanStagingDir(filepath.Join(dir, "missing"), now); err != nil {
+		t.Errorf("missing staging folder: %v", err)
+	}
+}
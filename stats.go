@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+// Stats holds the counters of a run; it is safe for concurrent use
+type Stats struct {
+	Pages      atomic.Int64
+	Discovered atomic.Int64
+	Products   atomic.Int64
+	Images     atomic.Int64
+	Errors     atomic.Int64
+
+	// Expected is how many products the preflight expects the listing to
+	// have, zero when unknown (see -no-preflight)
+	Expected atomic.Int64
+
+	// Backoffs counts the times every request was paused because the server
+	// refused them (see -backoff-pause), and BackedOff is the nanoseconds
+	// they were paused for in total
+	Backoffs  atomic.Int64
+	BackedOff atomic.Int64
+
+	// MemoryPressure counts the times the heap went over -max-memory
+	MemoryPressure atomic.Int64
+
+	// EmptyResolved counts products whose image list was empty at first but
+	// not on a retry (see -retry-on-empty)
+	EmptyResolved atomic.Int64
+
+	// Fresh counts images reused without a request (see -http-cache-control-respect)
+	Fresh atomic.Int64
+
+	// TooLarge counts images skipped because of -max-file-size
+	TooLarge atomic.Int64
+	// Nonexistent counts probed product IDs without a product (see -id-range)
+	Nonexistent atomic.Int64
+	// Indexed counts products left out because of -skip-indexed
+	Indexed atomic.Int64
+	// ResumeSkipped counts products left out because of -resume-from-id
+	ResumeSkipped atomic.Int64
+	// Checkpointed counts products left out as finished in the -checkpoint file
+	Checkpointed atomic.Int64
+	// Duplicates counts images stored as links or references by -dedupe-strategy
+	Duplicates atomic.Int64
+	// TooSmall counts images skipped because of -min-dimensions
+	TooSmall atomic.Int64
+	// LowQuality counts images skipped because of -min-quality-score
+	LowQuality atomic.Int64
+	// WrongFormat counts images skipped because of -allow-format
+	WrongFormat atomic.Int64
+	// CorruptImages counts images discarded by -verify-image-format
+	CorruptImages atomic.Int64
+	// Filtered counts images rejected by the content filter (see -nsfw-api)
+	Filtered atomic.Int64
+	// Rechecked counts images fetched a second time by -integrity-sample,
+	// and RecheckMismatches those that came back different
+	Rechecked         atomic.Int64
+	RecheckMismatches atomic.Int64
+	// SizeVariants counts images left out as another size of a photo kept
+	// (see -dedup-across-sizes)
+	SizeVariants atomic.Int64
+	// TooOld counts products skipped because of -max-product-age
+	TooOld atomic.Int64
+	// DiscountFiltered counts products skipped because of -min-discount
+	DiscountFiltered atomic.Int64
+	// Trusted counts images skipped because of -trust-manifest
+	Trusted atomic.Int64
+
+	mu       sync.Mutex
+	category string                     // category being crawled
+	page     int                        // listing page being fetched
+	workers  map[string]*workerCounters // by worker ID
+	hosts    map[string]*hostStatuses   // by host
+}
+
+// stats collects the counters for the current run. The run's own code uses
+// it directly; code that may run while a new run starts, such as the server's
+// handlers, goes through runStats.
+var stats = &Stats{}
+
+// statsMu guards replacing stats
+var statsMu sync.Mutex
+
+// resetStats gives the next run fresh counters, leaving the previous ones to
+// whoever still holds them
+func resetStats() {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	stats = &Stats{}
+}
+
+// runStats returns the counters of the current run
+func runStats() *Stats {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	return stats
+}
+
+// setPosition records the listing page the crawler is on
+func (s *Stats) setPosition(category string, page int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.category, s.page = category, page
+}
+
+// position returns the listing page the crawler is on
+func (s *Stats) position() (category string, page int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.category, s.page
+}
+
+// workerCounters are the counters of one worker
+type workerCounters struct {
+	Products atomic.Int64 // Product details fetched
+	Images   atomic.Int64 // Images saved
+	Bytes    atomic.Int64 // Bytes of the images saved
+	Errors   atomic.Int64
+	busy     atomic.Int64 // Nanoseconds spent on jobs
+	idle     atomic.Int64 // Nanoseconds spent waiting for a job
+}
+
+// worker returns the counters of worker id, creating them on first use
+func (s *Stats) worker(id string) *workerCounters {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.workers == nil {
+		s.workers = make(map[string]*workerCounters)
+	}
+	w := s.workers[id]
+	if w == nil {
+		w = &workerCounters{}
+		s.workers[id] = w
+	}
+	return w
+}
+
+// waited adds the time from since until now to the worker's idle time
+func (w *workerCounters) waited(since time.Time) {
+	w.idle.Add(int64(time.Since(since)))
+}
+
+// worked adds the time from since until now to the worker's busy time
+func (w *workerCounters) worked(since time.Time) {
+	w.busy.Add(int64(time.Since(since)))
+}
+
+// WorkerSummary is what one worker did during a run
+type WorkerSummary struct {
+	ID          string  `json:"id"`
+	Products    int64   `json:"products"`
+	Images      int64   `json:"images"`
+	Bytes       int64   `json:"bytes"`
+	Errors      int64   `json:"errors"`
+	BusySeconds float64 `json:"busy_seconds"`
+	IdleSeconds float64 `json:"idle_seconds"`
+}
+
+// workerSummaries returns the counters of every worker of the run, ordered
+// by pool and then by number
+func (s *Stats) workerSummaries() []WorkerSummary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	summaries := make([]WorkerSummary, 0, len(s.workers))
+	for id, w := range s.workers {
+		summaries = append(summaries, WorkerSummary{
+			ID:          id,
+			Products:    w.Products.Load(),
+			Images:      w.Images.Load(),
+			Bytes:       w.Bytes.Load(),
+			Errors:      w.Errors.Load(),
+			BusySeconds: time.Duration(w.busy.Load()).Seconds(),
+			IdleSeconds: time.Duration(w.idle.Load()).Seconds(),
+		})
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		pi, ni := splitWorkerID(summaries[i].ID)
+		pj, nj := splitWorkerID(summaries[j].ID)
+		if pi != pj {
+			return pi < pj
+		}
+		return ni < nj
+	})
+	return summaries
+}
+
+// statusClasses name the classes of HTTP status codes counted per host
+var statusClasses = [...]string{"1xx", "2xx", "3xx", "4xx", "5xx"}
+
+// hostStatuses counts the responses of one host by status class
+type hostStatuses [len(statusClasses)]atomic.Int64
+
+// observe counts a response with status code
+func (h *hostStatuses) observe(code int) {
+	if class := code/100 - 1; class >= 0 && class < len(h) {
+		h[class].Add(1)
+	}
+}
+
+// host returns the status counters of host, creating them on first use
+func (s *Stats) host(host string) *hostStatuses {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.hosts == nil {
+		s.hosts = make(map[string]*hostStatuses)
+	}
+	h := s.hosts[host]
+	if h == nil {
+		h = &hostStatuses{}
+		s.hosts[host] = h
+	}
+	return h
+}
+
+// HostSummary is how one host answered during a run
+type HostSummary struct {
+	Host      string           `json:"host"`
+	Responses int64            `json:"responses"`
+	Statuses  map[string]int64 `json:"statuses"` // By class, e.g. "4xx"; classes never seen are left out
+}
+
+// hostSummaries returns the status counters of every host of the run,
+// ordered by host
+func (s *Stats) hostSummaries() []HostSummary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	summaries := make([]HostSummary, 0, len(s.hosts))
+	for host, h := range s.hosts {
+		summary := HostSummary{Host: host, Statuses: make(map[string]int64)}
+		for i, class := range statusClasses {
+			if n := h[i].Load(); n > 0 {
+				summary.Statuses[class] = n
+				summary.Responses += n
+			}
+		}
+		summaries = append(summaries, summary)
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].Host < summaries[j].Host })
+	return summaries
+}
+
+// shares formats the part of the host's responses each status class was,
+// e.g. "2xx 82% 4xx 18%"
+func (h HostSummary) shares() string {
+	var parts []string
+	for _, class := range statusClasses {
+		if n := h.Statuses[class]; n > 0 {
+			parts = append(parts, fmt.Sprintf("%s %.0f%%", class, 100*float64(n)/float64(h.Responses)))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// splitWorkerID splits a "pool-N" worker ID into its pool and number
+func splitWorkerID(id string) (string, int) {
+	pool, num, _ := strings.Cut(id, "-")
+	n, _ := strconv.Atoi(num)
+	return pool, n
+}
+
+// writeWorkerTable writes the worker summaries as an aligned table
+func writeWorkerTable(out io.Writer, summaries []WorkerSummary) {
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "worker\tproducts\timages\tbytes\terrors\tbusy\tidle\tbusy %\t")
+	for _, w := range summaries {
+		busy := 0.0
+		if total := w.BusySeconds + w.IdleSeconds; total > 0 {
+			busy = 100 * w.BusySeconds / total
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%d\t%s\t%s\t%.0f%%\t\n", w.ID, w.Products, w.Images, byteSize(w.Bytes), w.Errors, seconds(w.BusySeconds), seconds(w.IdleSeconds), busy)
+	}
+	tw.Flush()
+}
+
+// seconds formats a number of seconds as a duration rounded to milliseconds
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second)).Round(time.Millisecond)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"html"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// minFilenameLength leaves room for a hash suffix and an extension
+const minFilenameLength = 32
+
+// cleanText prepares product text such as titles for output files: invalid
+// UTF-8 sequences become U+FFFD, HTML entities are decoded, control
+// characters other than whitespace are dropped and runs of whitespace are
+// collapsed to a single space
+func cleanText(s string) string {
+	s = strings.ToValidUTF8(s, "\uFFFD")
+	s = html.UnescapeString(s)
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) && !unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, s)
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// sanitizeFilename makes name safe to use as a single path element and at
+// most maxLen bytes long. Separators and control characters become
+// underscores. Names that are too long keep their extension and get a short
+// hash of the full name appended to the truncated stem, so different long
+// names stay different.
+func sanitizeFilename(name string, maxLen int) string {
+	name = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == 0 || unicode.IsControl(r) {
+			return '_'
+		}
+		return r
+	}, strings.ToValidUTF8(name, "_"))
+	name = strings.TrimSpace(name)
+	if name == "" || name == "." || name == ".." {
+		name = "_"
+	}
+	if len(name) <= maxLen {
+		return name
+	}
+
+	sum := sha256.Sum256([]byte(name))
+	suffix := "-" + hex.EncodeToString(sum[:4])
+	ext := filepath.Ext(name)
+	if len(ext) > maxLen/2 {
+		ext = "" // Not a real extension, truncate it with the rest
+	}
+	stem := name[:len(name)-len(ext)]
+	keep := maxLen - len(suffix) - len(ext)
+	for keep > 0 && !utf8.RuneStart(stem[keep]) {
+		keep-- // Don't cut a multi-byte character in half
+	}
+	return stem[:keep] + suffix + ext
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestCleanText(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"plain", "گوشی موبایل", "گوشی موبایل"},
+		{"named entities", "Tom &amp; Jerry &lt;3&gt; &quot;new&quot;", `Tom & Jerry <3> "new"`},
+		{"numeric entities", "&#1711;&#x648;&#x634;&#1740;", "گوشی"},
+		{"entity of a space", "a&nbsp;&nbsp;b", "a b"},
+		{"escaped entity", "&amp;amp;", "&amp;"},
+		{"unknown entity", "&nosuch; x", "&nosuch; x"},
+		{"invalid utf-8", "ab\xffcd", "ab\uFFFDcd"},
+		{"truncated rune", "گوش\xdb", "گوش\uFFFD"},
+		{"invalid run", "a\xff\xfe\xfdb", "a\uFFFDb"},
+		{"control characters", "a\x00b\x07c\x1bd\u0085e", "abcd e"},
+		{"entity of a control character", "a&#7;b", "ab"},
+		{"repeated whitespace", "  a \t\n b\r\n\n c  ", "a b c"},
+		{"only whitespace", " \t\n ", ""},
+		{"empty", "", ""},
+	}
+	for _, tt := range tests {
+		if got := cleanText(tt.in); got != tt.want {
+			t.Errorf("%s: cleanText(%q) = %q, want %q", tt.name, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSanitizeFilename(t *testing.T) {
+	tests := []struct {
+		name, in string
+		maxLen   int
+		want     string
+	}{
+		{"short", "product_1_img_1.jpg", 255, "product_1_img_1.jpg"},
+		{"separators", "a/b\\c\x00d\ne.jpg", 255, "a_b_c_d_e.jpg"},
+		{"dot dot", "..", 255, "_"},
+		{"blank", "   ", 255, "_"},
+		{"exactly max", strings.Repeat("a", 28) + ".jpg", 32, strings.Repeat("a", 28) + ".jpg"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sanitizeFilename(tt.in, tt.maxLen); got != tt.want {
+				t.Errorf("sanitizeFilename(%q, %d) = %q, want %q", tt.in, tt.maxLen, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeFilenameTruncatesLongNames(t *testing.T) {
+	tests := []struct {
+		name, in string
+		maxLen   int
+		ext      string
+	}{
+		{"ascii", strings.Repeat("a", 300) + ".jpg", 255, ".jpg"},
+		{"persian", strings.Repeat("گوشی ", 100) + ".jpg", 255, ".jpg"},
+		{"persian at minimum", strings.Repeat("ی", 40) + ".webp", minFilenameLength, ".webp"},
+		// Longer than half the limit, so not taken for an extension
+		{"long extension", "a." + strings.Repeat("b", 40), minFilenameLength, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := sanitizeFilename(tt.in, tt.maxLen)
+			if len(got) > tt.maxLen {
+				t.Errorf("%d bytes, want at most %d", len(got), tt.maxLen)
+			}
+			if !utf8.ValidString(got) {
+				t.Errorf("%q cuts a character in half", got)
+			}
+			if tt.ext != "" && filepath.Ext(got) != tt.ext {
+				t.Errorf("%q lost its extension %s", got, tt.ext)
+			}
+			// The hash suffix is a dash and 8 hex digits before the extension
+			stem := strings.TrimSuffix(got, tt.ext)
+			if i := len(stem) - 9; i < 0 || stem[i] != '-' {
+				t.Errorf("%q has no hash suffix", got)
+			}
+			if !strings.HasPrefix(tt.in, stem[:len(stem)-9]) {
+				t.Errorf("%q does not keep the start of the name", got)
+			}
+		})
+	}
+}
+
+func TestSanitizeFilenameKeepsLongNamesApart(t *testing.T) {
+	prefix := strings.Repeat("x", 300)
+	a := sanitizeFilename(prefix+"a.jpg", 255)
+	b := sanitizeFilename(prefix+"b.jpg", 255)
+	if a == b {
+		t.Errorf("names differing past the limit both became %q", a)
+	}
+	if again := sanitizeFilename(prefix+"a.jpg", 255); again != a {
+		t.Errorf("the same name became %q and %q", a, again)
+	}
+}
+
+func TestSanitizeFilenameFitsFilesystem(t *testing.T) {
+	dir := t.TempDir()
+	name := sanitizeFilename(strings.Repeat("عکس محصول ", 60)+".jpg", 255)
+	if err := os.WriteFile(filepath.Join(dir, name), []byte("x"), 0o644); err != nil {
+		t.Fatalf("creating a file named by a shortened name: %v", err)
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/term"
+)
+
+const (
+	tuiRefresh    = 250 * time.Millisecond // How often the dashboard is redrawn
+	tuiErrorLines = 8                      // Recent errors kept for the error pane
+)
+
+// Escape sequences used to draw the dashboard
+const (
+	ansiAltScreen  = "\x1b[?1049h\x1b[?25l" // Switch to the alternate screen and hide the cursor
+	ansiMainScreen = "\x1b[?25h\x1b[?1049l" // Show the cursor and return to the main screen
+	ansiHome       = "\x1b[H"
+	ansiClearLine  = "\x1b[K"
+	ansiClearBelow = "\x1b[J"
+)
+
+// tui is the -tui dashboard. It only reads Stats and the worker activity
+// board, and drives the pause gate, the download worker pool and the
+// crawler's stop function from key presses.
+type tui struct {
+	pool  *workerPool
+	quit  func()
+	in    int
+	out   *os.File
+	state *term.State
+	start time.Time
+
+	recent   *recentHandler
+	logger   *slog.Logger
+	debugLog *log.Logger
+
+	quitting  atomic.Bool
+	done      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+// startTUI takes over the terminal and starts drawing the dashboard. It fails
+// when stdin and stdout are not a capable terminal, in which case the run
+// should continue with normal logging.
+func startTUI(pool *workerPool, quit func()) (*tui, error) {
+	if cfg.Events {
+		return nil, errors.New("-tui cannot be combined with -events")
+	}
+	in := int(os.Stdin.Fd())
+	if !term.IsTerminal(in) || !term.IsTerminal(int(os.Stdout.Fd())) {
+		return nil, errors.New("stdin and stdout must both be a terminal")
+	}
+	if t := os.Getenv("TERM"); t == "" || t == "dumb" {
+		return nil, fmt.Errorf("terminal type %q does not support cursor movement", t)
+	}
+	if _, _, err := term.GetSize(int(os.Stdout.Fd())); err != nil {
+		return nil, fmt.Errorf("failed to read terminal size: %w", err)
+	}
+	state, err := term.MakeRaw(in)
+	if err != nil {
+		return nil, fmt.Errorf("failed to switch terminal to raw mode: %w", err)
+	}
+
+	ui := &tui{
+		pool:     pool,
+		quit:     quit,
+		in:       in,
+		out:      os.Stdout,
+		state:    state,
+		start:    time.Now(),
+		recent:   &recentHandler{lines: new(recentLines)},
+		logger:   slog.Default(),
+		debugLog: debugLog,
+		done:     make(chan struct{}),
+	}
+
+	// Log lines would scroll the dashboard away; keep warnings and errors for
+	// the error pane and drop everything else while the dashboard is up
+	slog.SetDefault(slog.New(ui.recent))
+	debugLog = log.New(io.Discard, "", 0)
+
+	fmt.Fprint(ui.out, ansiAltScreen)
+	ui.wg.Add(1)
+	go ui.loop()
+	go ui.readKeys()
+	return ui, nil
+}
+
+// close stops drawing and restores the terminal and the logger; it is safe to
+// call on a nil *tui and more than once
+func (ui *tui) close() {
+	if ui == nil {
+		return
+	}
+	ui.closeOnce.Do(func() {
+		close(ui.done)
+		ui.wg.Wait()
+		fmt.Fprint(ui.out, ansiMainScreen)
+		if err := term.Restore(ui.in, ui.state); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to restore terminal: %v\n", err)
+		}
+		slog.SetDefault(ui.logger)
+		debugLog = ui.debugLog
+	})
+}
+
+// loop redraws the dashboard until close is called
+func (ui *tui) loop() {
+	defer ui.wg.Done()
+	ticker := time.NewTicker(tuiRefresh)
+	defer ticker.Stop()
+	for {
+		ui.draw()
+		select {
+		case <-ui.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// readKeys handles key presses; raw mode turns Ctrl-C into a plain byte, so it
+// is treated like q
+func (ui *tui) readKeys() {
+	buf := make([]byte, 16)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			return
+		}
+		for _, key := range buf[:n] {
+			switch key {
+			case 'p', 'P':
+				pause.toggle()
+			case '+', '=':
+				ui.pool.grow()
+			case '-', '_':
+				ui.pool.shrink()
+			case 'q', 'Q', 3:
+				if ui.quitting.Swap(true) {
+					// Second request: stop waiting for the workers
+					ui.close()
+					os.Exit(exitInterrupted)
+				}
+				ui.quit()
+				pause.release()
+			}
+		}
+	}
+}
+
+// draw renders one frame sized to the current terminal
+func (ui *tui) draw() {
+	width, height, err := term.GetSize(int(ui.out.Fd()))
+	if err != nil || width < 20 || height < 5 {
+		return
+	}
+	lines := ui.render(width)
+	footer := "p pause/resume   +/- workers   q quit"
+	if ui.quitting.Load() {
+		footer = "finishing products in progress, q again to exit now"
+	}
+	if len(lines) > height-1 {
+		lines = lines[:height-1]
+	}
+	lines = append(lines, footer)
+
+	var buf bytes.Buffer
+	buf.WriteString(ansiHome)
+	for i, line := range lines {
+		buf.WriteString(truncate(line, width))
+		buf.WriteString(ansiClearLine)
+		if i < len(lines)-1 {
+			buf.WriteString("\r\n")
+		}
+	}
+	buf.WriteString(ansiClearBelow)
+	ui.out.Write(buf.Bytes())
+}
+
+// render returns the dashboard lines, without the footer
+func (ui *tui) render(width int) []string {
+	state := "running"
+	switch {
+	case ui.quitting.Load():
+		state = "stopping"
+	case pause.paused():
+		state = "PAUSED"
+	}
+	category, page := stats.position()
+
+	done := stats.Products.Load()
+	discovered := max(stats.Discovered.Load(), stats.Expected.Load())
+	elapsed := time.Since(ui.start)
+	rate := float64(done) / elapsed.Seconds()
+	eta := "?"
+	if rate > 0 && discovered >= done {
+		eta = (time.Duration(float64(discovered-done)/rate) * time.Second).Round(time.Second).String()
+	}
+
+	lines := []string{
+		fmt.Sprintf("digi  %s  category %s  page %d", state, category, page),
+		"",
+		"Products " + progressBar(done, discovered, width-28) + fmt.Sprintf(" %d/%d", done, discovered),
+		fmt.Sprintf("Images   %d saved, %d errors", stats.Images.Load(), stats.Errors.Load()),
+		fmt.Sprintf("Rate     %.2f products/s  ETA %s  elapsed %s", rate, eta, elapsed.Round(time.Second)),
+		"",
+		fmt.Sprintf("Workers  %d downloading (+/- to change)", ui.pool.size()),
+	}
+	for _, w := range activity.snapshot() {
+		lines = append(lines, fmt.Sprintf("  %-12s %s", w.ID, w.Task))
+	}
+	if hosts := stats.hostSummaries(); len(hosts) > 0 {
+		lines = append(lines, "", "Hosts")
+		for _, h := range hosts {
+			lines = append(lines, fmt.Sprintf("  %-32s %6d  %s", truncate(h.Host, 32), h.Responses, h.shares()))
+		}
+	}
+	lines = append(lines, "", "Recent errors")
+	for _, line := range ui.recent.lines.snapshot() {
+		lines = append(lines, "  "+line)
+	}
+	return lines
+}
+
+// progressBar draws done out of total as a bar of the given width
+func progressBar(done, total int64, width int) string {
+	width = max(width, 10)
+	filled := 0
+	if total > 0 {
+		filled = int(min(done, total) * int64(width) / total)
+	}
+	return "[" + strings.Repeat("#", filled) + strings.Repeat(".", width-filled) + "]"
+}
+
+// truncate shortens s to at most width runes
+func truncate(s string, width int) string {
+	runes := []rune(s)
+	if len(runes) <= width {
+		return s
+	}
+	return string(runes[:width])
+}
+
+// recentLines is a ring of the last tuiErrorLines log lines
+type recentLines struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (r *recentLines) add(line string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lines = append(r.lines, line)
+	if len(r.lines) > tuiErrorLines {
+		r.lines = r.lines[len(r.lines)-tuiErrorLines:]
+	}
+}
+
+func (r *recentLines) snapshot() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.lines...)
+}
+
+// recentHandler is a slog.Handler that keeps warnings and errors for the
+// dashboard's error pane
+type recentHandler struct {
+	lines  *recentLines
+	prefix string
+	attrs  []byte
+}
+
+// Enabled implements slog.Handler
+func (h *recentHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= slog.LevelWarn
+}
+
+// Handle implements slog.Handler
+func (h *recentHandler) Handle(_ context.Context, r slog.Record) error {
+	var buf bytes.Buffer
+	buf.WriteString(r.Time.Format("15:04:05 "))
+	buf.WriteString(r.Message)
+	buf.Write(h.attrs)
+	r.Attrs(func(a slog.Attr) bool {
+		appendAttr(&buf, h.prefix, a)
+		return true
+	})
+	h.lines.add(buf.String())
+	return nil
+}
+
+// WithAttrs implements slog.Handler
+func (h *recentHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	var buf bytes.Buffer
+	buf.Write(h.attrs)
+	for _, a := range attrs {
+		appendAttr(&buf, h.prefix, a)
+	}
+	h2.attrs = buf.Bytes()
+	return &h2
+}
+
+// WithGroup implements slog.Handler
+func (h *recentHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.prefix = h.prefix + name + "."
+	return &h2
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// pingTimeout bounds the API check of validate-config
+const pingTimeout = 15 * time.Second
+
+// validateConfig checks the settings that can be checked offline and returns
+// every problem found rather than stopping at the first
+func validateConfig() []error {
+	var errs []error
+	if !slices.Contains(sources, cfg.Source) {
+		errs = append(errs, fmt.Errorf("invalid -source %q: use category, wishlist, sitemap or id-range", cfg.Source))
+	}
+	if cfg.Source == sourceWishlist && cfg.AuthToken == "" && cfg.AuthTokenFile == "" {
+		errs = append(errs, errors.New("-source wishlist needs -auth-token (or DIGIKALA_TOKEN, or -auth-token-file) from a logged-in session"))
+	}
+	if cfg.Source == sourceIDRange && cfg.IDRange.To == 0 {
+		errs = append(errs, errors.New("-source id-range needs -id-range FROM-TO"))
+	}
+	if cfg.IDStep < 1 {
+		errs = append(errs, errors.New("-id-step must be at least 1"))
+	}
+	if cfg.EstimateSample < 1 {
+		errs = append(errs, errors.New("-estimate-sample must be at least 1"))
+	}
+	if cfg.Category != "" && !slugPattern.MatchString(cfg.Category) {
+		errs = append(errs, fmt.Errorf("invalid -category %q: use the slug from the category URL, e.g. kids-apparel", cfg.Category))
+	}
+	if cfg.MaxDepth < 0 {
+		errs = append(errs, errors.New("-max-depth must not be negative"))
+	}
+	if cfg.EmptyPages < 1 {
+		errs = append(errs, errors.New("-empty-page-tolerance must be at least 1"))
+	}
+	if cfg.PageBackoff && cfg.MaxPageBackoff <= 0 {
+		errs = append(errs, errors.New("-max-page-backoff must be positive"))
+	}
+	if cfg.QueueSize < 0 || cfg.QueueLimit < 0 || cfg.PrefetchPages < 0 {
+		errs = append(errs, errors.New("-queue-size, -queue-limit and -prefetch-pages must not be negative"))
+	}
+	if cfg.DetailWorkers < 1 || cfg.DetailWorkers > maxWorkers || cfg.DownloadWorkers < 1 || cfg.DownloadWorkers > maxWorkers {
+		errs = append(errs, fmt.Errorf("-detail-workers and -download-workers must be between 1 and %d", maxWorkers))
+	}
+	if cfg.MaxPerProduct < 0 {
+		errs = append(errs, errors.New("-max-concurrent-per-product must not be negative"))
+	}
+	if cfg.RampUp < 0 {
+		errs = append(errs, errors.New("-ramp-up must not be negative"))
+	}
+	if cfg.CPUWorkers < 1 {
+		errs = append(errs, errors.New("-cpu-workers must be at least 1"))
+	}
+	if cfg.RPS < 0 || cfg.ProductRate < 0 {
+		errs = append(errs, errors.New("-rps and -products-per-second must not be negative"))
+	}
+	if !slices.Contains(retryPriorities, cfg.RetryPriority) {
+		errs = append(errs, fmt.Errorf("invalid -retry-priority %q: use fifo, low or high", cfg.RetryPriority))
+	}
+	if cfg.MaxRetries < 0 || cfg.RetryBase < 0 || cfg.RetryCap < 0 || cfg.RetryAfterMax < 0 || cfg.BackoffPause < 0 {
+		errs = append(errs, errors.New("-max-retries, -retry-base, -retry-cap, -retry-after-max and -backoff-pause must not be negative"))
+	}
+	if cfg.MaxFilenameLength < minFilenameLength {
+		errs = append(errs, fmt.Errorf("-max-filename-length must be at least %d", minFilenameLength))
+	}
+	if cfg.ContactSheetColumns < 1 {
+		errs = append(errs, errors.New("-contact-sheet-columns must be at least 1"))
+	}
+	if cfg.TrustManifest && cfg.Manifest == "" {
+		errs = append(errs, errors.New("-trust-manifest needs -manifest"))
+	}
+	if cfg.DetectDuplicates && cfg.DuplicateReport == "" {
+		errs = append(errs, errors.New("-detect-duplicate-products-by-metadata needs -duplicate-report"))
+	}
+	if cfg.ReportBroken && cfg.BrokenReport == "" {
+		errs = append(errs, errors.New("-report-broken needs -broken-report"))
+	}
+	if cfg.ManifestBatchSize < 1 || cfg.ManifestFlushInterval <= 0 {
+		errs = append(errs, errors.New("-manifest-batch-size and -manifest-flush-interval must be positive"))
+	}
+	if cfg.CheckpointEvery < 1 || cfg.CheckpointInterval <= 0 {
+		errs = append(errs, errors.New("-checkpoint-every and -checkpoint-interval must be positive"))
+	}
+	if cfg.KeepRuns < 0 || cfg.KeepDays < 0 {
+		errs = append(errs, errors.New("-keep-runs and -keep-days must not be negative"))
+	}
+	if (cfg.KeepRuns > 0 || cfg.KeepDays > 0) && !cfg.WorkspacePerRun && cfg.Workspace == "" {
+		errs = append(errs, errors.New("-keep-runs and -keep-days need -workspace-per-run or -workspace"))
+	}
+	if !slices.Contains(durabilities, cfg.Durability) {
+		errs = append(errs, fmt.Errorf("invalid -durability %q: use none, batch or always", cfg.Durability))
+	}
+	if cfg.SkipIndexed && cfg.Manifest == "" {
+		errs = append(errs, errors.New("-skip-indexed needs -manifest"))
+	}
+	if cfg.MaxAge < 0 || cfg.MaxProductAge < 0 {
+		errs = append(errs, errors.New("-max-age and -max-product-age must not be negative"))
+	}
+	if cfg.IntegritySample < 0 || cfg.IntegritySample > 1 || cfg.IntegrityWarn < 0 || cfg.IntegrityWarn > 1 {
+		errs = append(errs, errors.New("-integrity-sample and -integrity-warn-rate must be between 0 and 1"))
+	}
+	if cfg.IDPadWidth < 0 || cfg.IDPadWidth > 20 {
+		errs = append(errs, fmt.Errorf("invalid -id-pad-width %d: use 1 to 20 digits, or 0 to derive it", cfg.IDPadWidth))
+	}
+	if err := validateSizePreference(cfg.DedupSizes); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.OrderedExports && !cfg.Events {
+		errs = append(errs, errors.New("-ordered-exports orders the event stream: add -events"))
+	}
+	if cfg.OrderedExports && cfg.ReorderWindow < 1 {
+		errs = append(errs, errors.New("-reorder-window must be at least 1"))
+	}
+	if cfg.MinDiscount < 0 || cfg.MinDiscount > 100 {
+		errs = append(errs, fmt.Errorf("invalid -min-discount %d: use a percentage from 0 to 100", cfg.MinDiscount))
+	}
+	if !slices.Contains(downloadOrders, cfg.DownloadOrder) {
+		errs = append(errs, fmt.Errorf("invalid -download-order %q: use fifo, lifo, id-desc or id-asc", cfg.DownloadOrder))
+	}
+	if cfg.DedupeStrategy != "" && !slices.Contains(dedupeStrategies, cfg.DedupeStrategy) {
+		errs = append(errs, fmt.Errorf("invalid -dedupe-strategy %q: use hardlink, symlink or reference", cfg.DedupeStrategy))
+	}
+	if !slices.Contains(imageDedupStrategies, cfg.ImageDedup) {
+		errs = append(errs, fmt.Errorf("invalid -image-dedup-strategy %q: use none, url, sha256 or phash", cfg.ImageDedup))
+	}
+	if cfg.OutputSymlinks && (cfg.ImageDedup == dedupSHA256 || cfg.ImageDedup == dedupPHash) {
+		errs = append(errs, errors.New("-output-symlinks already stores identical images once; use -image-dedup-strategy none or url with it"))
+	}
+	if cfg.OutputSymlinks && cfg.DedupeStrategy != "" {
+		errs = append(errs, errors.New("-output-symlinks already stores identical images once; drop -dedupe-strategy"))
+	}
+	for _, sink := range cfg.Sinks {
+		if sink != sinkLocal && sink != sinkMinIO {
+			errs = append(errs, fmt.Errorf("unknown sink %q: use local or minio", sink))
+		}
+	}
+	if slices.Contains(cfg.Sinks, sinkMinIO) && (cfg.MinIOEndpoint == "" || cfg.MinIOBucket == "") {
+		errs = append(errs, errors.New("the minio sink needs -minio-endpoint and -minio-bucket"))
+	}
+	if cfg.ShutdownTimeout <= 0 {
+		errs = append(errs, errors.New("-graceful-shutdown-timeout must be positive"))
+	}
+	if cfg.DiskFullPoll <= 0 || cfg.DiskFullWait <= 0 {
+		errs = append(errs, errors.New("-disk-full-poll and -disk-full-wait must be positive"))
+	}
+	if cfg.URLRewrite != "" {
+		if _, err := newRegexRewriter(cfg.URLRewrite); err != nil {
+			errs = append(errs, fmt.Errorf("-image-url-rewriter-pattern: %w", err))
+		}
+	}
+	for _, host := range cfg.ImageMirrors {
+		if strings.ContainsAny(host, "/?#@ ") {
+			errs = append(errs, fmt.Errorf("invalid -image-mirrors host %q: give the host name only, e.g. dkstatics-public.digikala.com", host))
+		}
+	}
+	if cfg.NSFWAPI != "" {
+		if u, err := url.Parse(cfg.NSFWAPI); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("invalid -nsfw-api %q: want an http(s) URL", cfg.NSFWAPI))
+		}
+	}
+	if cfg.NoDetailFetch && (cfg.Source == sourceSitemap || cfg.Source == sourceIDRange) {
+		errs = append(errs, fmt.Errorf("-no-detail-fetch needs listing pages: use -source category or wishlist, not %s", cfg.Source))
+	}
+	if cfg.NoDetailFetch && cfg.MaxProductAge > 0 {
+		errs = append(errs, errors.New("-max-product-age needs product details: drop -no-detail-fetch"))
+	}
+	for _, path := range cfg.ExtraFields {
+		if err := validateFieldPath(path); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(cfg.ExtraFields) > 0 && cfg.Manifest == "" {
+		errs = append(errs, errors.New("-product-extra-fields needs -manifest"))
+	}
+	if len(cfg.ExtraFields) > 0 && cfg.NoDetailFetch {
+		errs = append(errs, errors.New("-product-extra-fields reads the product details: drop -no-detail-fetch"))
+	}
+	for _, field := range cfg.ListingFields {
+		if !slices.Contains(listingFieldNames, field) {
+			errs = append(errs, fmt.Errorf("invalid -listing-fields value %q: use title, price or rating", field))
+		}
+	}
+	for _, format := range cfg.AllowFormats {
+		if f := strings.ToLower(format); f != "jpg" && !slices.Contains(imageFormats, f) {
+			errs = append(errs, fmt.Errorf("invalid -allow-format %q: use jpeg, png, gif or webp", format))
+		}
+	}
+	if cfg.MinQuality < 0 || cfg.MinQuality > 1 {
+		errs = append(errs, errors.New("-min-quality-score must be between 0 and 1"))
+	}
+	if cfg.NSFWThreshold < 0 || cfg.NSFWThreshold > 1 {
+		errs = append(errs, errors.New("-nsfw-threshold must be between 0 and 1"))
+	}
+	if _, err := loadSearchFilters(); err != nil {
+		errs = append(errs, fmt.Errorf("invalid filters: %w", err))
+	}
+	return errs
+}
+
+// validateOffline is validateConfig plus the checks a run makes before it
+// starts: a category to scrape, usable -tls-pin values and writable output
+// paths. It makes no network calls.
+func validateOffline() []error {
+	errs := validateConfig()
+	if cfg.Source == sourceCategory && cfg.Category == "" {
+		errs = append(errs, errors.New("missing -category"))
+	}
+	if _, err := newHTTPClient(cfg.TLSPins); err != nil {
+		errs = append(errs, err)
+	}
+	outputs := []struct{ flag, path string }{
+		{"the image folder", filepath.Join(imageDir, "x")},
+		{"-manifest", cfg.Manifest},
+		{"-log-file", cfg.LogFile},
+		{"-audit-log", cfg.AuditLog},
+		{"-schema-baseline", cfg.SchemaBaseline},
+	}
+	if cfg.DetectDuplicates {
+		outputs = append(outputs, struct{ flag, path string }{"-duplicate-report", cfg.DuplicateReport})
+	}
+	if cfg.ReportBroken {
+		outputs = append(outputs, struct{ flag, path string }{"-broken-report", cfg.BrokenReport})
+	}
+	if cfg.StagingDir != "" {
+		outputs = append(outputs, struct{ flag, path string }{"-staging-dir", filepath.Join(cfg.StagingDir, "x")})
+	}
+	for _, o := range outputs {
+		if o.path == "" {
+			continue
+		}
+		if err := checkWritable(o.path); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", o.flag, err))
+		}
+	}
+	return errs
+}
+
+// checkWritable reports whether the file at path could be written, by
+// creating and removing a file in its folder, or in the closest existing
+// parent when the folder does not exist yet
+func checkWritable(path string) error {
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return fmt.Errorf("%s is a directory", path)
+	}
+	dir := filepath.Dir(path)
+	for {
+		info, err := os.Stat(dir)
+		if err == nil {
+			if !info.IsDir() {
+				return fmt.Errorf("%s is not a directory", dir)
+			}
+			break
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return err
+		}
+		dir = parent
+	}
+	probe, err := os.CreateTemp(dir, ".digigo-validate-*")
+	if err != nil {
+		return fmt.Errorf("cannot write to %s: %w", dir, err)
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
+
+// reportProblems prints errs, or that the configuration is valid, and
+// returns the exit status
+func reportProblems(errs []error) int {
+	if len(errs) == 0 {
+		fmt.Println("configuration is valid")
+		return exitOK
+	}
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	return exitFailure
+}
+
+// runValidate is -validate: it checks the command line and the paths it
+// names without touching the network and returns the exit status
+func runValidate() int {
+	return reportProblems(validateOffline())
+}
+
+// runValidateConfig is the validate-config command: it reports every
+// problem with the command line, the files it names and access to the API,
+// and returns the exit status
+func runValidateConfig() int {
+	errs := validateOffline()
+	if client, err := newHTTPClient(cfg.TLSPins); err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+		defer cancel()
+		if _, err := client.fetchCategoryPage(ctx, categoryRootURL); err != nil {
+			errs = append(errs, fmt.Errorf("API not reachable: %w", err))
+		}
+	}
+	return reportProblems(errs)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// replayCassette points httpClient at a replayer of the cassette name under
+// testdata/cassettes for the rest of the test, then calls setupTest. The
+// path is resolved first, as setupTest leaves the package directory.
+func replayCassette(t *testing.T, name string) {
+	t.Helper()
+	path, err := filepath.Abs(filepath.Join(cassetteDir, name+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	setupTest(t)
+	r, err := loadReplayer(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := httpClient
+	httpClient = NewClient(r)
+	t.Cleanup(func() { httpClient = previous })
+}
+
+func TestReplayCategoryPage(t *testing.T) {
+	replayCassette(t, "listing")
+	url := buildCategoryURL(categoryRootURL, "mobile-phone", 1, QueryOptions{})
+	res, err := httpClient.fetchCategoryPage(context.Background(), url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Data.Products) != 2 {
+		t.Fatalf("got %d products, want 2", len(res.Data.Products))
+	}
+	first := res.Data.Products[0]
+	if first.ID != 101 || first.DefaultVariant.Price.SellingPrice.Value() != 125000 || first.Rating.Count.Value() != 12 {
+		t.Errorf("first product = %d at %d with %d ratings, want 101 at 125000 with 12", first.ID, first.DefaultVariant.Price.SellingPrice.Value(), first.Rating.Count.Value())
+	}
+	if got := res.Data.SubCategories; len(got) != 1 || got[0].Code != "android-phone" {
+		t.Errorf("subcategories = %+v, want android-phone", got)
+	}
+
+	unrecorded := buildCategoryURL(categoryRootURL, "laptop", 1, QueryOptions{})
+	if _, err := httpClient.fetchCategoryPage(context.Background(), unrecorded); !errors.Is(err, errNotRecorded) {
+		t.Errorf("unrecorded page: err = %v, want errNotRecorded", err)
+	}
+}
+
+func TestReplayCrawl(t *testing.T) {
+	replayCassette(t, "listing")
+	jobs := make(chan productJob, 10)
+	c := newCrawler(httpClient, jobs, QueryOptions{}, 0, false, 0)
+	c.crawl(context.Background(), "mobile-phone", "mobile-phone", 0)
+	close(jobs)
+
+	var ids []int
+	for job := range jobs {
+		if job.Page != 1 || job.Dir != "mobile-phone" {
+			t.Errorf("product %d: page %d in %q, want page 1 in mobile-phone", job.ID, job.Page, job.Dir)
+		}
+		ids = append(ids, job.ID)
+	}
+	if !slices.Equal(ids, []int{101, 102}) {
+		t.Errorf("queued %v, want [101 102]", ids)
+	}
+	// Page 2 is empty and ends the category; page 3 is not in the cassette
+	if got := stats.Pages.Load(); got != 2 {
+		t.Errorf("fetched %d pages, want 2", got)
+	}
+	if got := stats.Errors.Load(); got != 0 {
+		t.Errorf("%d errors, want none", got)
+	}
+}
+
+func TestReplayProductDetails(t *testing.T) {
+	replayCassette(t, "listing")
+	info, err := httpClient.fetchProductDetails(context.Background(), 101)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Title != "گوشی نمونه" || info.Brand != "Sample" || info.Category != "android-phone" {
+		t.Errorf("title %q, brand %q, category %q; want گوشی نمونه, Sample, android-phone", info.Title, info.Brand, info.Category)
+	}
+	// The discount is worked out from the list price when not given
+	if info.Price != 125000 || info.Discount != 16 {
+		t.Errorf("price %d at %d%% off, want 125000 at 16%% off", info.Price, info.Discount)
+	}
+	want := []string{
+		"https://dkstatics-public.digikala.com/101-main.jpg",
+		"https://dkstatics-public.digikala.com/101-1.jpg",
+		"https://dkstatics-public.digikala.com/101-2.jpg",
+	}
+	if !slices.Equal(info.ImageURLs, want) || info.Main != 1 {
+		t.Errorf("images %v with %d main, want %v with 1", info.ImageURLs, info.Main, want)
+	}
+
+	var se *statusError
+	if _, err := httpClient.fetchProductDetails(context.Background(), 102); !errors.As(err, &se) || se.StatusCode != http.StatusNotFound {
+		t.Errorf("product 102: err = %v, want a 404 status error", err)
+	}
+}
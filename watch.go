@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// productPageURL is the storefront page of a product, filled with its ID
+const productPageURL = "https://www.digikala.com/product/dkp-%d/"
+
+// watchItem is an entry of the -watchlist file
+type watchItem struct {
+	ID     int
+	Target int // Alert once the price is at or below this many rials; zero for none
+}
+
+// priceRecord is the last observed price of a product
+type priceRecord struct {
+	Price   int       `json:"price"` // Rials
+	Time    time.Time `json:"time"`
+	Alerted int       `json:"alerted,omitempty"` // Price last alerted about, zero once the drop is over
+}
+
+// loadWatchlist reads a watchlist file with one "ID [target price]" per
+// line; blank lines and text after # are ignored
+func loadWatchlist(path string) ([]watchItem, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open watchlist: %w", err)
+	}
+	defer file.Close()
+
+	var items []watchItem
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		id, target, _ := strings.Cut(strings.TrimSpace(text), " ")
+		if id == "" {
+			continue
+		}
+		item := watchItem{}
+		if item.ID, err = strconv.Atoi(id); err != nil || item.ID <= 0 {
+			return nil, fmt.Errorf("%s:%d: invalid product ID %q", path, line, id)
+		}
+		if target = strings.TrimSpace(target); target != "" {
+			if item.Target, err = parsePrice(target); err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+			}
+		}
+		items = append(items, item)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read watchlist: %w", err)
+	}
+	return items, nil
+}
+
+// parsePrice reads a price and returns it in rials, the unit of the API.
+// Persian and Arabic digits and thousands separators are accepted, and a
+// toman (or T) suffix multiplies by ten; rial, IRR or no suffix means rials.
+func parsePrice(s string) (int, error) {
+	text := strings.Map(func(r rune) rune {
+		switch {
+		case r >= '۰' && r <= '۹':
+			return '0' + r - '۰'
+		case r >= '٠' && r <= '٩':
+			return '0' + r - '٠'
+		case r == ',' || r == '٬' || r == '_' || r == ' ':
+			return -1
+		}
+		return r
+	}, strings.ToLower(s))
+
+	multiplier := 1
+	for _, unit := range []struct {
+		suffix string
+		factor int
+	}{{"tomans", 10}, {"toman", 10}, {"تومان", 10}, {"t", 10}, {"rials", 1}, {"rial", 1}, {"ریال", 1}, {"irr", 1}} {
+		if strings.HasSuffix(text, unit.suffix) {
+			text, multiplier = strings.TrimSuffix(text, unit.suffix), unit.factor
+			break
+		}
+	}
+	price, err := strconv.Atoi(text)
+	if err != nil || price < 0 {
+		return 0, fmt.Errorf("invalid price %q: want a number with an optional toman or rial suffix", s)
+	}
+	return price * multiplier, nil
+}
+
+// checkPrice compares a newly observed price with the last record of the
+// product and returns why it deserves an alert ("" if it doesn't) and the
+// record to keep. A drop is alerted once: later cycles stay quiet until the
+// price falls further, or rises out of the alert range and drops again.
+func checkPrice(item watchItem, last priceRecord, hasLast bool, price int, dropPercent float64, now time.Time) (string, priceRecord) {
+	record := priceRecord{Price: price, Time: now, Alerted: last.Alerted}
+	var reason string
+	switch {
+	case item.Target > 0 && price <= item.Target:
+		reason = "at or below target " + formatRials(item.Target)
+	case hasLast && dropPercent > 0 && last.Price > 0 && float64(price) <= float64(last.Price)*(1-dropPercent/100):
+		reason = fmt.Sprintf("down %.0f%% since %s", 100*float64(last.Price-price)/float64(last.Price), last.Time.Format(time.DateTime))
+	default:
+		record.Alerted = 0 // Not in a drop any more; the next one alerts again
+		return "", record
+	}
+	if last.Alerted > 0 && price >= last.Alerted {
+		return "", record
+	}
+	record.Alerted = price
+	return reason, record
+}
+
+// loadPriceHistory reads the price history file; a missing file is an
+// empty history
+func loadPriceHistory(path string) (map[int]priceRecord, error) {
+	history := make(map[int]priceRecord)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return history, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read price history: %w", err)
+	}
+	if err := json.Unmarshal(data, &history); err != nil {
+		return nil, fmt.Errorf("failed to decode price history %s: %w", path, err)
+	}
+	return history, nil
+}
+
+// savePriceHistory writes the price history file
+func savePriceHistory(path string, history map[int]priceRecord) error {
+	data, err := json.MarshalIndent(history, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode price history: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create price history directory: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write price history: %w", err)
+	}
+	return nil
+}
+
+// configuredNotifiers returns the alert channels set up on the command line
+func configuredNotifiers() []notifier {
+	var notifiers []notifier
+	if cfg.AlertWebhook != "" {
+		notifiers = append(notifiers, webhookNotifier{url: cfg.AlertWebhook})
+	}
+	if cfg.TelegramToken != "" {
+		notifiers = append(notifiers, telegramNotifier{token: cfg.TelegramToken, chatID: cfg.TelegramChatID})
+	}
+	return notifiers
+}
+
+// runWatch is the watch command: it checks the prices of the watchlist every
+// -watch-interval until interrupted, or once when the interval is zero, and
+// returns the exit status
+func runWatch(ctx context.Context) int {
+	var errs []error
+	if cfg.Watchlist == "" {
+		errs = append(errs, errors.New("missing -watchlist"))
+	}
+	if cfg.PriceDropPercent < 0 || cfg.PriceDropPercent >= 100 {
+		errs = append(errs, errors.New("-price-drop-percent must be between 0 and 100"))
+	}
+	if cfg.FeedSize < 1 {
+		errs = append(errs, errors.New("-feed-size must be at least 1"))
+	}
+	if (cfg.TelegramToken == "") != (cfg.TelegramChatID == "") {
+		errs = append(errs, errors.New("-telegram-token and -telegram-chat-id must be given together"))
+	}
+	if len(errs) > 0 {
+		for _, err := range errs {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		return exitUsage
+	}
+	items, err := loadWatchlist(cfg.Watchlist)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	history, err := loadPriceHistory(cfg.PriceHistory)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	notifiers := configuredNotifiers()
+	if len(notifiers) == 0 {
+		slog.Warn("No -alert-webhook or -telegram-token set; price drops are only logged")
+	}
+	var exporters []exporter
+	if cfg.Feed != "" {
+		exporters = append(exporters, atomExporter{path: cfg.Feed, size: cfg.FeedSize})
+	}
+
+	for {
+		products := watchCycle(ctx, items, history, notifiers)
+		if len(products) > 0 {
+			for _, e := range exporters {
+				if err := e.export(products); err != nil {
+					slog.Error("Failed to export new products", "reason", err)
+				}
+			}
+		}
+		if err := savePriceHistory(cfg.PriceHistory, history); err != nil {
+			slog.Error("Failed to save price history", "reason", err)
+		}
+		if cfg.WatchInterval <= 0 {
+			return exitOK
+		}
+		slog.Info("Next price check", "at", time.Now().Add(cfg.WatchInterval).Format(time.TimeOnly))
+		select {
+		case <-ctx.Done():
+			return exitOK
+		case <-time.After(cfg.WatchInterval):
+		}
+	}
+}
+
+// watchCycle observes the price of every watched product once, updating
+// history and sending alerts. It returns the products that have no history
+// yet, in watchlist order.
+func watchCycle(ctx context.Context, items []watchItem, history map[int]priceRecord, notifiers []notifier) []newProduct {
+	var products []newProduct
+	for _, item := range items {
+		if ctx.Err() != nil {
+			return products
+		}
+		var info productInfo
+		err := cfg.retryPolicy(stageDetails).do(ctx, func(ctx context.Context) (err error) {
+			info, err = httpClient.fetchProductDetails(ctx, item.ID)
+			return err
+		})
+		if err != nil {
+			stats.Errors.Add(1)
+			slog.Error("Failed to check price", "product", item.ID, "reason", friendlyError(err))
+			debugLog.Printf("product %d: %v", item.ID, err)
+			continue
+		}
+		if info.Price <= 0 {
+			slog.Warn("Product has no price, it may be out of stock", "product", item.ID)
+			continue
+		}
+
+		last, hasLast := history[item.ID]
+		if !hasLast {
+			p := newProduct{ID: item.ID, Title: info.Title, Price: info.Price, Seen: time.Now()}
+			if len(info.ImageURLs) > 0 {
+				p.ImageURL = info.ImageURLs[0]
+			}
+			products = append(products, p)
+		}
+		reason, record := checkPrice(item, last, hasLast, info.Price, cfg.PriceDropPercent, time.Now())
+		slog.Info("Price checked", "product", item.ID, "price", info.Price)
+		if reason != "" {
+			alert := priceAlert{ProductID: item.ID, Title: info.Title, NewPrice: info.Price, Reason: reason, URL: fmt.Sprintf(productPageURL, item.ID)}
+			if hasLast {
+				alert.OldPrice = last.Price
+			}
+			slog.Log(ctx, LevelSuccess, "Price drop", "product", item.ID, "title", info.Title, "old", alert.OldPrice, "new", info.Price, "reason", reason)
+			for _, n := range notifiers {
+				if err := n.notify(ctx, alert); err != nil {
+					slog.Error("Failed to send price alert", "product", item.ID, "reason", friendlyError(err))
+					debugLog.Printf("product %d alert: %v", item.ID, err)
+					record.Alerted = last.Alerted // Try again next cycle
+				}
+			}
+		}
+		history[item.ID] = record
+	}
+	return products
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParsePrice(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int
+		wantErr bool
+	}{
+		{"125000", 125000, false},
+		{"125,000", 125000, false},
+		{"125000 rial", 125000, false},
+		{"125000IRR", 125000, false},
+		{"12500 toman", 125000, false},
+		{"12,500T", 125000, false},
+		{"۱۲۵۰۰ تومان", 125000, false},
+		{"١٢٥٠٠٠ ریال", 125000, false},
+		{"۱۲٬۵۰۰ تومان", 125000, false},
+		{"", 0, true},
+		{"cheap", 0, true},
+		{"-5", 0, true},
+		{"12.5 toman", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parsePrice(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parsePrice(%q) = %d, %v; want %d, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestLoadWatchlistNormalizesTargets(t *testing.T) {
+	setupTest(t)
+	list := "101 12500 toman # in tomans\n\n102 ۱۲۵۰۰۰\n103\n"
+	if err := os.WriteFile("watchlist.txt", []byte(list), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	items, err := loadWatchlist("watchlist.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []watchItem{{ID: 101, Target: 125000}, {ID: 102, Target: 125000}, {ID: 103}}
+	if len(items) != len(want) {
+		t.Fatalf("got %v, want %v", items, want)
+	}
+	for i := range want {
+		if items[i] != want[i] {
+			t.Errorf("item %d = %+v, want %+v", i, items[i], want[i])
+		}
+	}
+}
+
+func TestCheckPriceWithoutHistory(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	// A first sighting has nothing to have dropped from
+	reason, record := checkPrice(watchItem{ID: 1}, priceRecord{}, false, 100000, 10, now)
+	if reason != "" {
+		t.Errorf("first sighting alerted %q, want no alert", reason)
+	}
+	if record != (priceRecord{Price: 100000, Time: now}) {
+		t.Errorf("record = %+v, want the price at now", record)
+	}
+
+	// but is alerted when already at the target
+	reason, record = checkPrice(watchItem{ID: 1, Target: 120000}, priceRecord{}, false, 100000, 10, now)
+	if reason == "" {
+		t.Error("first sighting below the target was not alerted")
+	}
+	if record.Alerted != 100000 {
+		t.Errorf("alerted price = %d, want 100000", record.Alerted)
+	}
+}
+
+func TestCheckPriceDrops(t *testing.T) {
+	then := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	now := then.Add(time.Hour)
+	item := watchItem{ID: 1}
+	last := priceRecord{Price: 100000, Time: then}
+
+	if reason, _ := checkPrice(item, last, true, 95000, 10, now); reason != "" {
+		t.Errorf("5%% drop alerted %q with -price-drop-percent 10", reason)
+	}
+	reason, record := checkPrice(item, last, true, 90000, 10, now)
+	if reason != "down 10% since 2024-05-01 12:00:00" {
+		t.Errorf("10%% drop: reason %q", reason)
+	}
+
+	// The same drop is not alerted again, a further one is
+	last = priceRecord{Price: 100000, Time: then, Alerted: record.Alerted}
+	if reason, _ := checkPrice(item, last, true, 90000, 10, now); reason != "" {
+		t.Errorf("repeated drop alerted %q", reason)
+	}
+	if reason, _ := checkPrice(item, last, true, 80000, 10, now); reason == "" {
+		t.Error("further drop was not alerted")
+	}
+
+	// A history without a price can't have dropped
+	if reason, _ := checkPrice(item, priceRecord{Time: then}, true, 1000, 10, now); reason != "" {
+		t.Errorf("drop from a zero price alerted %q", reason)
+	}
+}
+
+func TestLoadPriceHistoryMissing(t *testing.T) {
+	setupTest(t)
+	history, err := loadPriceHistory("prices.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if history == nil || len(history) != 0 {
+		t.Errorf("history = %v, want an empty map", history)
+	}
+
+	history[7] = priceRecord{Price: 5000, Time: time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)}
+	if err := savePriceHistory("data/prices.json", history); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadPriceHistory("data/prices.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded[7].Time.Equal(history[7].Time) || loaded[7].Price != 5000 {
+		t.Errorf("reloaded %+v, want %+v", loaded[7], history[7])
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// wishlistURL lists the products on the wishlist of the token's account,
+// filled with the page number
+const wishlistURL = "https://api.digikala.com/v1/profile/favorites/?page=%d" // Member endpoint, needs -auth-token
+
+// errAuthExpired is returned when the API rejects -auth-token
+var errAuthExpired = errors.New("the API rejected -auth-token")
+
+// tokenPoll is how often a crawl paused for a new token reads
+// -auth-token-file again
+var tokenPoll = 5 * time.Second
+
+// WishlistRes represents the structure of the wishlist API response
+type WishlistRes struct {
+	Status int `json:"status"`
+	Data   struct {
+		Products []Product `json:"products"`
+		Pager    struct {
+			CurrentPage int `json:"current_page"`
+			TotalPages  int `json:"total_pages"`
+		} `json:"pager"`
+	} `json:"data"`
+}
+
+// fetchWishlistPage fetches one page of the wishlist with the auth token
+func (c *Client) fetchWishlistPage(ctx context.Context, page int) (*WishlistRes, error) {
+	url := fmt.Sprintf(wishlistURL, page)
+	resp, err := c.getAuth(ctx, url, cfg.AuthToken)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch wishlist: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return nil, fmt.Errorf("%w: %w", errAuthExpired, newStatusError(url, resp))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, newStatusError(url, resp)
+	}
+
+	var response WishlistRes
+	if err := decodeJSON(resp, &response); err != nil {
+		return nil, fmt.Errorf("failed to decode wishlist: %w", err)
+	}
+	return &response, nil
+}
+
+// crawlWishlist queues every product on the wishlist with dir as its image
+// folder. An expired token pauses the run until -auth-token-file holds a new
+// one and the page is fetched again; without -auth-token-file it stops the
+// crawl with a single clear message instead of failing every remaining page.
+func (c *crawler) crawlWishlist(ctx context.Context, dir string) {
+	for page := 1; page <= maxPages; page++ {
+		pause.wait()
+		if ctx.Err() != nil {
+			return
+		}
+		stats.setPosition(sourceWishlist, page)
+		slog.Info("Fetching wishlist page", "page", page)
+
+		var res *WishlistRes
+		err := cfg.retryPolicy(stageSearch).do(ctx, func(ctx context.Context) (err error) {
+			res, err = c.client.fetchWishlistPage(ctx, page)
+			return err
+		})
+		if errors.Is(err, errAuthExpired) && cfg.AuthTokenFile != "" {
+			slog.Error("Pausing until a new token is saved to -auth-token-file", "path", cfg.AuthTokenFile, "reason", friendlyError(err))
+			cfg.AuthToken = awaitToken(ctx, cfg.AuthTokenFile, cfg.AuthToken)
+			page-- // Fetched again with the new token
+			continue
+		}
+		if errors.Is(err, errAuthExpired) {
+			stats.Errors.Add(1)
+			slog.Error("Stopped reading the wishlist", "reason", friendlyError(err))
+			return
+		}
+		if err != nil {
+			stats.Errors.Add(1)
+			slog.Error("Failed to fetch wishlist page", "page", page, "reason", friendlyError(err))
+			debugLog.Printf("wishlist page %d: %v", page, err)
+			e := newErrorEvent("page", err)
+			e.Page = page
+			reportError(e)
+			continue
+		}
+		stats.Pages.Add(1)
+		events.emit(PageFetchedEvent{EventHeader: newEventHeader(eventPageFetched), Category: sourceWishlist, Page: page, Products: len(res.Data.Products)})
+		if page == 1 {
+			observeIDs(res.Data.Products)
+		}
+
+		for _, product := range res.Data.Products {
+			if !c.queue(ctx, product.ID, sourceWishlist, page, dir, &product) {
+				return
+			}
+		}
+		if len(res.Data.Products) == 0 || page >= res.Data.Pager.TotalPages {
+			return
+		}
+	}
+}
+
+// readAuthToken reads the token saved to path
+func readAuthToken(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read -auth-token-file: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// awaitToken pauses the run until a token other than rejected is saved to
+// path, and returns it. If the pause is lifted another way first, from the
+// dashboard or by shutting down, it returns rejected.
+func awaitToken(ctx context.Context, path, rejected string) string {
+	waiting := make(chan struct{})
+	defer close(waiting)
+	if !pause.paused() {
+		pause.toggle()
+	}
+	found := make(chan string, 1)
+	go func() {
+		ticker := time.NewTicker(tokenPoll)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-waiting:
+				return
+			case <-ctx.Done():
+				pause.release() // Lets the crawl see the cancelled context
+				return
+			case <-ticker.C:
+			}
+			token, err := readAuthToken(path)
+			if err != nil {
+				debugLog.Printf("waiting for a new token: %v", err)
+				continue
+			}
+			if token != "" && token != rejected {
+				found <- token
+				slog.Info("Read a new token, resuming")
+				pause.release()
+				return
+			}
+		}
+	}()
+	pause.wait()
+	select {
+	case token := <-found:
+		return token
+	default:
+		return rejected
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// serveWishlist answers the two pages of a wishlist to requests bearing
+// token and 401 to others, and returns the tokens the pages were asked with
+func serveWishlist(t *testing.T, token string) func() []string {
+	t.Helper()
+	var mu sync.Mutex
+	var seen []string
+	serveAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen = append(seen, r.URL.Query().Get("page")+" "+r.Header.Get("Authorization"))
+		mu.Unlock()
+		if r.Header.Get("Authorization") != "Bearer "+token {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Query().Get("page") == "1" {
+			w.Write([]byte(`{"status":200,"data":{"products":[{"id":1},{"id":2}],"pager":{"current_page":1,"total_pages":2}}}`))
+			return
+		}
+		w.Write([]byte(`{"status":200,"data":{"products":[{"id":3}],"pager":{"current_page":2,"total_pages":2}}}`))
+	}))
+	return func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(seen)
+	}
+}
+
+// TestWishlistWaitsForNewToken rejects the token of -auth-token-file: the
+// crawl pauses the run until a new token is saved there, then fetches the
+// page again with it and goes on
+func TestWishlistWaitsForNewToken(t *testing.T) {
+	setupTest(t)
+	defer func(poll time.Duration) { tokenPoll = poll }(tokenPoll)
+	tokenPoll = time.Millisecond
+	t.Cleanup(pause.release)
+	cfg.AuthTokenFile, cfg.AuthToken = "token", "old"
+	if err := os.WriteFile(cfg.AuthTokenFile, []byte("old\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	seen := serveWishlist(t, "new")
+
+	jobs := make(chan productJob, 10)
+	crawled := make(chan struct{})
+	go func() {
+		defer close(crawled)
+		newCrawler(httpClient, jobs, QueryOptions{}, 0, false, 0).crawlWishlist(context.Background(), "wishlist")
+	}()
+	waitFor(t, pause.paused)
+	select {
+	case <-crawled:
+		t.Fatal("the crawl ended on a rejected token")
+	case <-time.After(20 * time.Millisecond): // Several polls of the unchanged file
+	}
+	if err := os.WriteFile(cfg.AuthTokenFile, []byte("new\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-crawled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the crawl did not go on after a new token was saved")
+	}
+	close(jobs)
+
+	var ids []int
+	for job := range jobs {
+		ids = append(ids, job.ID)
+	}
+	if !slices.Equal(ids, []int{1, 2, 3}) {
+		t.Errorf("queued %v, want [1 2 3]", ids)
+	}
+	if want := []string{"1 Bearer old", "1 Bearer new", "2 Bearer new"}; !slices.Equal(seen(), want) {
+		t.Errorf("requests %q, want %q", seen(), want)
+	}
+	if pause.paused() {
+		t.Error("the run is still paused")
+	}
+	if got := stats.Errors.Load(); got != 0 {
+		t.Errorf("%d errors, want none", got)
+	}
+}
+
+// TestWishlistCancelledWhileWaitingForToken cancels a crawl paused for a
+// new token: it returns without one
+func TestWishlistCancelledWhileWaitingForToken(t *testing.T) {
+	setupTest(t)
+	defer func(poll time.Duration) { tokenPoll = poll }(tokenPoll)
+	tokenPoll = time.Millisecond
+	t.Cleanup(pause.release)
+	cfg.AuthTokenFile, cfg.AuthToken = "token", "old"
+	if err := os.WriteFile(cfg.AuthTokenFile, []byte("old"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	serveWishlist(t, "new")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	crawled := make(chan struct{})
+	go func() {
+		defer close(crawled)
+		newCrawler(httpClient, make(chan productJob, 10), QueryOptions{}, 0, false, 0).crawlWishlist(ctx, "wishlist")
+	}()
+	waitFor(t, pause.paused)
+	cancel()
+	select {
+	case <-crawled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the crawl did not return once cancelled")
+	}
+}
+
+// TestWishlistStopsWithoutTokenFile rejects -auth-token with no
+// -auth-token-file to wait on: the crawl stops at once
+func TestWishlistStopsWithoutTokenFile(t *testing.T) {
+	setupTest(t)
+	cfg.AuthToken = "old"
+	seen := serveWishlist(t, "new")
+
+	newCrawler(httpClient, make(chan productJob, 10), QueryOptions{}, 0, false, 0).crawlWishlist(context.Background(), "wishlist")
+	if got := seen(); len(got) != 1 {
+		t.Errorf("requests %q, want the first page once", got)
+	}
+	if pause.paused() {
+		t.Error("the run was paused without a token file to wait on")
+	}
+	if got := stats.Errors.Load(); got != 1 {
+		t.Errorf("%d errors, want 1", got)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// runsDir is the folder below imageDir the run workspaces are created in
+const runsDir = "runs"
+
+// latestRun names the symlink in runsDir to the newest workspace
+const latestRun = "latest"
+
+// workspaceLayout names a workspace after the time its run started
+const workspaceLayout = "2006-01-02T15-04-05"
+
+// useWorkspace gives the run a workspace of its own, a new one below
+// imageDir/runs with -workspace-per-run or the existing -workspace, and
+// moves the manifest, the duplicate and broken URL reports and the log there unless their
+// flags were given. c.Workspace is set to its path. Images stay in imageDir, shared by every run, so
+// deduplication and skipping saved images still work across runs.
+func (c *Config) useWorkspace(now time.Time) (string, error) {
+	dir := c.Workspace
+	if dir != "" {
+		// Resuming: reopen the workspace, e.g. img/runs/latest, by its real path
+		resolved, err := filepath.EvalSymlinks(dir)
+		if err != nil {
+			return "", fmt.Errorf("failed to open workspace: %w", err)
+		}
+		dir = resolved
+	} else {
+		var err error
+		if dir, err = newWorkspace(filepath.Join(imageDir, runsDir), now); err != nil {
+			return "", err
+		}
+	}
+
+	if !isFlagSet("manifest") {
+		c.Manifest = filepath.Join(dir, "manifest.jsonl")
+	}
+	if !isFlagSet("duplicate-report") {
+		c.DuplicateReport = filepath.Join(dir, "duplicate-products.json")
+	}
+	if !isFlagSet("broken-report") {
+		c.BrokenReport = filepath.Join(dir, "broken-urls.json")
+	}
+	if c.LogFile == "" {
+		c.LogFile = filepath.Join(dir, "digigo.log")
+	}
+	c.Workspace = dir
+	return dir, nil
+}
+
+// newWorkspace creates the workspace of a run started at now in runs and
+// points the latest symlink at it. Runs started within the same second
+// get a numbered suffix.
+func newWorkspace(runs string, now time.Time) (string, error) {
+	if err := os.MkdirAll(runs, os.ModePerm); err != nil {
+		return "", fmt.Errorf("failed to create workspace: %w", err)
+	}
+	name := now.Format(workspaceLayout)
+	dir := filepath.Join(runs, name)
+	for n := 2; ; n++ {
+		err := os.Mkdir(dir, os.ModePerm)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return "", fmt.Errorf("failed to create workspace: %w", err)
+		}
+		name = fmt.Sprintf("%s-%d", now.Format(workspaceLayout), n)
+		dir = filepath.Join(runs, name)
+	}
+
+	// Replace the link in one rename, so it never goes missing
+	tmp := filepath.Join(runs, "."+latestRun+".tmp")
+	os.Remove(tmp)
+	err := os.Symlink(name, tmp)
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(runs, latestRun))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		slog.Warn("Failed to point the latest link at the new workspace", "reason", err)
+	}
+	return dir, nil
+}
+
+// workspaceRun is a workspace found by pruneWorkspaces
+type workspaceRun struct {
+	path    string
+	started time.Time
+}
+
+// pruneWorkspaces removes the workspaces next to current beyond the newest
+// keepRuns, or started more than keepAge before now; zero turns either
+// limit off. The current workspace and the one latest links to are always
+// kept. Only workspace folders are removed; the images they recorded stay
+// in the shared image folder. With dryRun nothing is removed. It returns
+// how many workspaces were, or would be, removed and their size.
+func pruneWorkspaces(current string, keepRuns int, keepAge time.Duration, dryRun bool, now time.Time) (int, int64, error) {
+	runs := filepath.Dir(current)
+	entries, err := os.ReadDir(runs)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to list workspaces: %w", err)
+	}
+	keep := map[string]bool{filepath.Clean(current): true}
+	if latest, err := filepath.EvalSymlinks(filepath.Join(runs, latestRun)); err == nil {
+		keep[filepath.Clean(latest)] = true
+	}
+	var found []workspaceRun
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() || len(name) < len(workspaceLayout) {
+			continue
+		}
+		started, err := time.ParseInLocation(workspaceLayout, name[:len(workspaceLayout)], time.Local)
+		if err != nil {
+			continue // Not a workspace
+		}
+		found = append(found, workspaceRun{path: filepath.Join(runs, name), started: started})
+	}
+	// Newest first; names of the same second sort by their suffix
+	sort.Slice(found, func(i, j int) bool {
+		if !found[i].started.Equal(found[j].started) {
+			return found[i].started.After(found[j].started)
+		}
+		return found[i].path > found[j].path
+	})
+
+	removed, reclaimed := 0, int64(0)
+	for i, run := range found {
+		expired := keepRuns > 0 && i >= keepRuns || keepAge > 0 && now.Sub(run.started) > keepAge
+		if !expired || keep[filepath.Clean(run.path)] {
+			continue
+		}
+		size := dirSize(run.path)
+		if dryRun {
+			slog.Info("Would remove old run workspace", "path", run.path, "size", approxSize(size))
+		} else {
+			if err := os.RemoveAll(run.path); err != nil {
+				slog.Warn("Failed to remove old run workspace", "path", run.path, "reason", err)
+				continue
+			}
+			slog.Info("Removed old run workspace", "path", run.path, "size", approxSize(size))
+		}
+		removed, reclaimed = removed+1, reclaimed+size
+	}
+	return removed, reclaimed, nil
+}
+
+// dirSize adds up the sizes of the files below dir, skipping unreadable ones
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package main
+
+import "errors"
+
+// setXattr is not supported on this system; see xattr_unix.go
+func setXattr(path, name, value string) error {
+	return errors.New("extended attributes are not supported on this system")
+}
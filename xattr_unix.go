@@ -0,0 +1,10 @@
+//go:build linux || darwin
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// setXattr sets the extended attribute name of the file at path to value
+func setXattr(path, name, value string) error {
+	return unix.Setxattr(path, name, []byte(value), 0)
+}